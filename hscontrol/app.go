@@ -9,6 +9,7 @@ import (
 	"net"
 	"net/http"
 	_ "net/http/pprof" // nolint
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -82,6 +83,7 @@ const (
 // Headscale represents the base app of the service.
 type Headscale struct {
 	cfg             *types.Config
+	targetURL       *url.URL
 	db              *db.HSDatabase
 	ipAlloc         *db.IPAllocator
 	noisePrivateKey *key.MachinePrivate
@@ -156,15 +158,24 @@ func NewHeadscale(cfg *types.Config) (*Headscale, error) {
 	app.ephemeralGC = db.NewEphemeralGarbageCollector(func(ni types.NodeID) {
 		if err := app.db.DeleteEphemeralNode(ni); err != nil {
 			log.Err(err).Uint64("node.id", ni.Uint64()).Msgf("failed to delete ephemeral node")
+
+			return
 		}
+		app.mapper.ForgetNode(ni)
 	})
 
 	if err = app.loadPolicyManager(); err != nil {
 		return nil, fmt.Errorf("failed to load ACL policy: %w", err)
 	}
 
+	webProvider, err := NewAuthProviderWebWithTarget(cfg.ServerURL, cfg.TargetURL, cfg.RegisterMode)
+	if err != nil {
+		return nil, err
+	}
+	app.targetURL = webProvider.targetURL
+
 	var authProvider AuthProvider
-	authProvider = NewAuthProviderWebWithTarget(cfg.ServerURL, cfg.TargetURL)
+	authProvider = webProvider
 
 	if cfg.OIDC.Issuer != "" {
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -300,6 +311,7 @@ func (h *Headscale) scheduledTasks(ctx context.Context) {
 				region, _ := h.DERPServer.GenerateRegion()
 				h.DERPMap.Regions[region.RegionID] = &region
 			}
+			h.mapper.SetDERPMap(h.DERPMap)
 
 			ctx := types.NotifyCtx(context.Background(), "derpmap-update", "na")
 			h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
@@ -311,7 +323,7 @@ func (h *Headscale) scheduledTasks(ctx context.Context) {
 			if !ok {
 				continue
 			}
-			h.cfg.TailcfgDNSConfig.ExtraRecords = records
+			h.cfg.TailcfgDNSConfig.ExtraRecords = h.limitExtraRecords(records)
 
 			ctx := types.NotifyCtx(context.Background(), "dns-extrarecord", "all")
 			// TODO(kradalby): We can probably do better than sending a full update here,
@@ -321,6 +333,12 @@ func (h *Headscale) scheduledTasks(ctx context.Context) {
 	}
 }
 
+// limitExtraRecords applies the configured limit to extra records read
+// from dns.extra_records_path.
+func (h *Headscale) limitExtraRecords(records []tailcfg.DNSRecord) []tailcfg.DNSRecord {
+	return dns.LimitRecords(records, h.cfg.DNSConfig.MaxExtraRecords, h.cfg.DNSConfig.ExtraRecordsPriority)
+}
+
 func (h *Headscale) grpcAuthenticationInterceptor(ctx context.Context,
 	req interface{},
 	info *grpc.UnaryServerInfo,
@@ -467,10 +485,11 @@ func (h *Headscale) createRouter(grpcMux *grpcRuntime.ServeMux) *mux.Router {
 	router.HandleFunc(ts2021UpgradePath, h.NoiseUpgradeHandler).
 		Methods(http.MethodPost, http.MethodGet)
 
-	router.HandleFunc("/admin", h.AdminHandler).Methods(http.MethodGet)
+	webHeaders := webSecurityHeaders(h.cfg.WebContentSecurityPolicy)
+	router.Handle("/admin", webHeaders(http.HandlerFunc(h.AdminHandler))).Methods(http.MethodGet)
 	router.HandleFunc("/health", h.HealthHandler).Methods(http.MethodGet)
 	router.HandleFunc("/key", h.KeyHandler).Methods(http.MethodGet)
-	router.HandleFunc("/register/{registration_id}", h.authProvider.WebRegisterHandler).
+	router.Handle("/register/{registration_id}", webHeaders(http.HandlerFunc(h.authProvider.WebRegisterHandler))).
 		Methods(http.MethodGet)
 
 	if provider, ok := h.authProvider.(*AuthProviderOIDC); ok {
@@ -626,7 +645,7 @@ func (h *Headscale) Serve() error {
 		if err != nil {
 			return fmt.Errorf("setting up extrarecord manager: %w", err)
 		}
-		h.cfg.TailcfgDNSConfig.ExtraRecords = h.extraRecordMan.Records()
+		h.cfg.TailcfgDNSConfig.ExtraRecords = h.limitExtraRecords(h.extraRecordMan.Records())
 		go h.extraRecordMan.Run()
 		defer h.extraRecordMan.Close()
 	}
@@ -857,9 +876,24 @@ func (h *Headscale) Serve() error {
 				pol, err := h.policyBytes()
 				if err != nil {
 					log.Error().Err(err).Msg("failed to get policy blob")
+					continue
 				}
 
-				changed, err := h.polMan.SetPolicy(pol)
+				// Without all users and nodes the filter of the policy
+				// cannot be checked against the complexity limit.
+				users, err := h.db.ListUsers()
+				if err != nil {
+					log.Error().Err(err).Msg("failed to load users to validate policy, keeping the current policy")
+					continue
+				}
+
+				nodes, err := h.db.ListNodes()
+				if err != nil {
+					log.Error().Err(err).Msg("failed to load nodes to validate policy, keeping the current policy")
+					continue
+				}
+
+				changed, err := policy.SetPolicyWithinLimit(h.polMan, pol, users, nodes, h.cfg.Policy.MaxFilterComplexity)
 				if err != nil {
 					log.Error().Err(err).Msg("failed to set new policy")
 				}
@@ -868,6 +902,8 @@ func (h *Headscale) Serve() error {
 					log.Info().
 						Msg("ACL policy successfully reloaded, notifying nodes of change")
 
+					h.mapper.InvalidateResponseCache()
+
 					err = h.autoApproveNodes()
 					if err != nil {
 						log.Error().Err(err).Msg("failed to approve routes after new policy")
@@ -1157,6 +1193,12 @@ func (h *Headscale) loadPolicyManager() error {
 			errOut = fmt.Errorf("creating policy manager: %w", err)
 			return
 		}
+
+		filter, _ := h.polMan.Filter()
+		if err := policy.CheckFilterComplexity(filter, h.cfg.Policy.MaxFilterComplexity); err != nil {
+			errOut = fmt.Errorf("validating policy: %w", err)
+			return
+		}
 		log.Info().Msgf("Using policy manager version: %d", h.polMan.Version())
 
 		if len(nodes) > 0 {
@@ -89,6 +89,7 @@ func (h *Headscale) handleExistingNode(
 				if err != nil {
 					return nil, fmt.Errorf("deleting ephemeral node: %w", err)
 				}
+				h.mapper.ForgetNode(node.ID)
 
 				ctx := types.NotifyCtx(context.Background(), "logout-ephemeral", "na")
 				h.nodeNotifier.NotifyAll(ctx, types.UpdatePeerRemoved(node.ID))
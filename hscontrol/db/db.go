@@ -3,9 +3,11 @@ package db
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/netip"
 	"path/filepath"
 	"slices"
@@ -15,6 +17,7 @@ import (
 
 	"github.com/glebarez/sqlite"
 	"github.com/go-gormigrate/gormigrate/v2"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
 	"github.com/rs/zerolog/log"
@@ -932,3 +935,50 @@ func Write[T any](db *gorm.DB, fn func(tx *gorm.DB) (T, error)) (T, error) {
 	}
 	return ret, tx.Commit().Error
 }
+
+// sqliteTransientErrors are the messages of SQLite errors caused by
+// concurrent access, which succeed when retried.
+var sqliteTransientErrors = []string{
+	"database is locked",
+	"database table is locked",
+	"SQLITE_BUSY",
+}
+
+// IsTransientError reports if err is caused by a temporary problem
+// talking to the database, like a dropped connection or a lock held
+// by another writer, and the operation is likely to succeed if retried.
+func IsTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// Class 08: connection exceptions, 40001: serialization failure,
+		// 40P01: deadlock detected, 57P03: cannot connect now.
+		return strings.HasPrefix(pgErr.Code, "08") ||
+			pgErr.Code == "40001" ||
+			pgErr.Code == "40P01" ||
+			pgErr.Code == "57P03"
+	}
+
+	msg := err.Error()
+	for _, transient := range sqliteTransientErrors {
+		if strings.Contains(msg, transient) {
+			return true
+		}
+	}
+
+	return false
+}
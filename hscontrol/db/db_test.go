@@ -1,9 +1,13 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/netip"
 	"os"
 	"os/exec"
@@ -16,6 +20,7 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
 	"github.com/stretchr/testify/assert"
@@ -493,3 +498,29 @@ func dbForTest(t *testing.T) *HSDatabase {
 
 	return db
 }
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "bad-conn", err: fmt.Errorf("listing peers: %w", driver.ErrBadConn), want: true},
+		{name: "conn-done", err: sql.ErrConnDone, want: true},
+		{name: "deadline", err: context.DeadlineExceeded, want: true},
+		{name: "net-error", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, want: true},
+		{name: "sqlite-busy", err: errors.New("database is locked (5) (SQLITE_BUSY)"), want: true},
+		{name: "postgres-connection", err: &pgconn.PgError{Code: "08006"}, want: true},
+		{name: "postgres-serialization", err: &pgconn.PgError{Code: "40001"}, want: true},
+		{name: "postgres-syntax", err: &pgconn.PgError{Code: "42601"}, want: false},
+		{name: "not-found", err: gorm.ErrRecordNotFound, want: false},
+		{name: "other", err: errors.New("no such table: nodes"), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsTransientError(tt.err))
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -44,6 +45,14 @@ func (hsdb *HSDatabase) ListPeers(nodeID types.NodeID, peerIDs ...types.NodeID)
 	})
 }
 
+// ListPeersContext is like ListPeers, but the query is cancelled when
+// ctx is done.
+func (hsdb *HSDatabase) ListPeersContext(ctx context.Context, nodeID types.NodeID, peerIDs ...types.NodeID) (types.Nodes, error) {
+	return Read(hsdb.DB.WithContext(ctx), func(rx *gorm.DB) (types.Nodes, error) {
+		return ListPeers(rx, nodeID, peerIDs...)
+	})
+}
+
 // ListPeers returns peers of node, regardless of any Policy or if the node is expired.
 // If no peer IDs are given, all peers are returned.
 // If at least one peer ID is given, only these peer nodes will be returned.
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/arl/statsviz"
 	"github.com/juanfont/headscale/hscontrol/types"
@@ -22,7 +23,7 @@ func (h *Headscale) debugHTTPServer() *http.Server {
 	debug.Handle("config", "Current configuration", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		config, err := json.MarshalIndent(h.cfg, "", "  ")
 		if err != nil {
-			httpError(w, err)
+			httpError(w, r, err)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -32,7 +33,7 @@ func (h *Headscale) debugHTTPServer() *http.Server {
 	debug.Handle("policy", "Current policy", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		pol, err := h.policyBytes()
 		if err != nil {
-			httpError(w, err)
+			httpError(w, r, err)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -44,7 +45,7 @@ func (h *Headscale) debugHTTPServer() *http.Server {
 
 		filterJSON, err := json.MarshalIndent(filter, "", "  ")
 		if err != nil {
-			httpError(w, err)
+			httpError(w, r, err)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -54,7 +55,7 @@ func (h *Headscale) debugHTTPServer() *http.Server {
 	debug.Handle("ssh", "SSH Policy per node", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		nodes, err := h.db.ListNodes()
 		if err != nil {
-			httpError(w, err)
+			httpError(w, r, err)
 			return
 		}
 
@@ -62,7 +63,7 @@ func (h *Headscale) debugHTTPServer() *http.Server {
 		for _, node := range nodes {
 			pol, err := h.polMan.SSHPolicy(node)
 			if err != nil {
-				httpError(w, err)
+				httpError(w, r, err)
 				return
 			}
 
@@ -71,19 +72,63 @@ func (h *Headscale) debugHTTPServer() *http.Server {
 
 		sshJSON, err := json.MarshalIndent(sshPol, "", "  ")
 		if err != nil {
-			httpError(w, err)
+			httpError(w, r, err)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		w.Write(sshJSON)
 	}))
+	debug.Handle("dns", "DNS configuration per node", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nodes, err := h.db.ListNodes()
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+
+		dnsConfigs := make(map[string]*tailcfg.DNSConfig)
+		for _, node := range nodes {
+			dnsConfigs[fmt.Sprintf("id:%d  hostname:%s givenname:%s", node.ID, node.Hostname, node.GivenName)] = h.mapper.DNSConfigFor(node)
+		}
+
+		dnsJSON, err := json.MarshalIndent(dnsConfigs, "", "  ")
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(dnsJSON)
+	}))
+	debug.Handle("map", "Map response a node would receive (?node=<id>)", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.URL.Query().Get("node"), 10, 64)
+		if err != nil {
+			httpError(w, r, NewHTTPError(http.StatusBadRequest, "invalid node id", err))
+			return
+		}
+
+		resp, err := h.mapper.SimulateRequest(types.NodeID(id), nil)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+
+		respJSON, err := json.MarshalIndent(resp, "", "  ")
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(respJSON)
+	}))
 	debug.Handle("derpmap", "Current DERPMap", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		dm := h.DERPMap
 
 		dmJSON, err := json.MarshalIndent(dm, "", "  ")
 		if err != nil {
-			httpError(w, err)
+			httpError(w, r, err)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -93,7 +138,7 @@ func (h *Headscale) debugHTTPServer() *http.Server {
 	debug.Handle("registration-cache", "Pending registrations", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		registrationsJSON, err := json.MarshalIndent(h.registrationCache.Items(), "", "  ")
 		if err != nil {
-			httpError(w, err)
+			httpError(w, r, err)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -1,16 +1,22 @@
 package dns
 
 import (
+	"cmp"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/netip"
 	"os"
+	"slices"
+	"strings"
 	"sync"
 
 	"github.com/cenkalti/backoff/v4"
 	"github.com/fsnotify/fsnotify"
 	"github.com/rs/zerolog/log"
 	"tailscale.com/tailcfg"
+	"tailscale.com/util/dnsname"
 	"tailscale.com/util/set"
 )
 
@@ -190,5 +196,109 @@ func readExtraRecordsFromPath(path string) ([]tailcfg.DNSRecord, [32]byte, error
 
 	hash := sha256.Sum256(b)
 
-	return records, hash, nil
+	return ValidRecords(records), hash, nil
+}
+
+// ValidRecords returns the records with a valid name and a value
+// matching their type. Malformed records are skipped with a warning
+// instead of failing all of them.
+func ValidRecords(records []tailcfg.DNSRecord) []tailcfg.DNSRecord {
+	valid := make([]tailcfg.DNSRecord, 0, len(records))
+
+	for _, record := range records {
+		if err := validateRecord(record); err != nil {
+			log.Warn().Err(err).Str("name", record.Name).Msg("skipping malformed extra DNS record")
+			continue
+		}
+
+		valid = append(valid, record)
+	}
+
+	return valid
+}
+
+// LimitRecords returns at most limit of the records, as clients only
+// handle a limited number of them. Records whose name comes earlier in
+// priority are kept first, followed by the other records ordered by name.
+// The dropped records are logged. A limit of 0 keeps all records.
+func LimitRecords(records []tailcfg.DNSRecord, limit int, priority []string) []tailcfg.DNSRecord {
+	if limit <= 0 || len(records) <= limit {
+		return records
+	}
+
+	ranks := make(map[string]int, len(priority))
+	for i, name := range priority {
+		name = recordName(name)
+		if _, ok := ranks[name]; !ok {
+			ranks[name] = i
+		}
+	}
+
+	rank := func(record tailcfg.DNSRecord) int {
+		if i, ok := ranks[recordName(record.Name)]; ok {
+			return i
+		}
+
+		return len(priority)
+	}
+
+	sorted := slices.Clone(records)
+	slices.SortStableFunc(sorted, func(a, b tailcfg.DNSRecord) int {
+		return cmp.Or(
+			cmp.Compare(rank(a), rank(b)),
+			cmp.Compare(a.Name, b.Name),
+			cmp.Compare(a.Type, b.Type),
+			cmp.Compare(a.Value, b.Value),
+		)
+	})
+
+	for _, record := range sorted[limit:] {
+		log.Warn().
+			Str("name", record.Name).
+			Str("type", record.Type).
+			Str("value", record.Value).
+			Int("limit", limit).
+			Msg("dropping extra DNS record over the limit")
+	}
+
+	return sorted[:limit]
+}
+
+// recordName normalises a record name for comparison.
+func recordName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// validateRecord checks that the record has a valid DNS name and that
+// its value is an address of its type. Only A and AAAA records are
+// supported by clients, an empty type is either depending on the value.
+func validateRecord(record tailcfg.DNSRecord) error {
+	if record.Name == "" {
+		return errors.New("record has no name")
+	}
+
+	if _, err := dnsname.ToFQDN(record.Name); err != nil {
+		return fmt.Errorf("invalid record name: %w", err)
+	}
+
+	addr, err := netip.ParseAddr(record.Value)
+	if err != nil {
+		return fmt.Errorf("invalid record value: %w", err)
+	}
+
+	switch record.Type {
+	case "":
+	case "A":
+		if !addr.Is4() {
+			return fmt.Errorf("A record value %q is not an IPv4 address", record.Value)
+		}
+	case "AAAA":
+		if !addr.Is6() {
+			return fmt.Errorf("AAAA record value %q is not an IPv6 address", record.Value)
+		}
+	default:
+		return fmt.Errorf("unsupported record type %q", record.Type)
+	}
+
+	return nil
 }
@@ -421,6 +421,7 @@ func (api headscaleV1APIServer) DeleteNode(
 	if err != nil {
 		return nil, err
 	}
+	api.h.mapper.ForgetNode(node.ID)
 
 	ctx = types.NotifyCtx(ctx, "cli-deletenode", node.Hostname)
 	api.h.nodeNotifier.NotifyAll(ctx, types.UpdatePeerRemoved(node.ID))
@@ -746,7 +747,14 @@ func (api headscaleV1APIServer) SetPolicy(
 	if err != nil {
 		return nil, fmt.Errorf("loading nodes from database to validate policy: %w", err)
 	}
-	changed, err := api.h.polMan.SetPolicy([]byte(p))
+	users, err := api.h.db.ListUsers()
+	if err != nil {
+		return nil, fmt.Errorf("loading users from database to validate policy: %w", err)
+	}
+
+	// Policies over the complexity limit are rejected before they are
+	// put into effect.
+	changed, err := policy.SetPolicyWithinLimit(api.h.polMan, []byte(p), users, nodes, api.h.cfg.Policy.MaxFilterComplexity)
 	if err != nil {
 		return nil, fmt.Errorf("setting policy: %w", err)
 	}
@@ -765,6 +773,8 @@ func (api headscaleV1APIServer) SetPolicy(
 
 	// Only send update if the packet filter has changed.
 	if changed {
+		api.h.mapper.InvalidateResponseCache()
+
 		err = api.h.autoApproveNodes()
 		if err != nil {
 			return nil, err
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 
@@ -33,15 +34,62 @@ const (
 )
 
 // httpError logs an error and sends an HTTP error response with the given
-func httpError(w http.ResponseWriter, err error) {
+// error. Clients accepting JSON get an RFC 7807 problem details body,
+// all others plain text.
+func httpError(w http.ResponseWriter, req *http.Request, err error) {
+	code, msg := http.StatusInternalServerError, "internal server error"
+
 	var herr HTTPError
 	if errors.As(err, &herr) {
-		http.Error(w, herr.Msg, herr.Code)
+		code, msg = herr.Code, herr.Msg
 		log.Error().Err(herr.Err).Int("code", herr.Code).Msgf("user msg: %s", herr.Msg)
 	} else {
-		http.Error(w, "internal server error", http.StatusInternalServerError)
 		log.Error().Err(err).Int("code", http.StatusInternalServerError).Msg("http internal server error")
 	}
+
+	if !acceptsJSON(req) {
+		http.Error(w, msg, code)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(problemDetails{
+		Type:   "about:blank",
+		Title:  http.StatusText(code),
+		Status: code,
+		Detail: msg,
+	})
+}
+
+// problemDetails is an RFC 7807 problem details object.
+type problemDetails struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// acceptsJSON reports if the request explicitly accepts a JSON response,
+// wildcards do not count.
+func acceptsJSON(req *http.Request) bool {
+	if req == nil {
+		return false
+	}
+
+	for _, accept := range req.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, _, _ := strings.Cut(mediaRange, ";")
+			switch strings.ToLower(strings.TrimSpace(mediaType)) {
+			case "application/json", "application/problem+json":
+				return true
+			}
+		}
+	}
+
+	return false
 }
 
 // HTTPError represents an error that is surfaced to the user via web.
@@ -108,13 +156,13 @@ func (h *Headscale) VerifyHandler(
 	req *http.Request,
 ) {
 	if req.Method != http.MethodPost {
-		httpError(writer, errMethodNotAllowed)
+		httpError(writer, req, errMethodNotAllowed)
 		return
 	}
 
 	allow, err := h.derpRequestIsAllowed(req)
 	if err != nil {
-		httpError(writer, err)
+		httpError(writer, req, err)
 		return
 	}
 
@@ -135,7 +183,7 @@ func (h *Headscale) KeyHandler(
 	// New Tailscale clients send a 'v' parameter to indicate the CurrentCapabilityVersion
 	capVer, err := parseCabailityVersion(req)
 	if err != nil {
-		httpError(writer, err)
+		httpError(writer, req, err)
 		return
 	}
 
@@ -189,16 +237,24 @@ var codeStyleRegisterWebAPI = styles.Props{
 }
 
 type AuthProviderWeb struct {
-	serverURL string
-	targetURL string
+	serverURL    string
+	targetURL    *url.URL
+	registerMode string
 }
 
 // 设置targetURL和serverURL
-func NewAuthProviderWebWithTarget(serverURL string, targetURL string) *AuthProviderWeb {
-	return &AuthProviderWeb{
-		serverURL: serverURL,
-		targetURL: targetURL,
+// registerMode is one of the types.RegisterMode constants.
+func NewAuthProviderWebWithTarget(serverURL string, targetURL string, registerMode string) (*AuthProviderWeb, error) {
+	target, err := ParseTargetURL(targetURL)
+	if err != nil {
+		return nil, err
 	}
+
+	return &AuthProviderWeb{
+		serverURL:    serverURL,
+		targetURL:    target,
+		registerMode: registerMode,
+	}, nil
 }
 
 func NewAuthProviderWeb(serverURL string) *AuthProviderWeb {
@@ -231,7 +287,7 @@ func (a *AuthProviderWeb) RegisterHandler(
 	// the template and log an error.
 	registrationId, err := types.RegistrationIDFromString(registrationIdStr)
 	if err != nil {
-		httpError(writer, NewHTTPError(http.StatusBadRequest, "invalid registration id", err))
+		httpError(writer, req, NewHTTPError(http.StatusBadRequest, "invalid registration id", err))
 		return
 	}
 
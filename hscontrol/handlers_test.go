@@ -0,0 +1,286 @@
+package hscontrol
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPErrorBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		json        bool
+	}{
+		{
+			name:        "no-accept",
+			contentType: "text/plain; charset=utf-8",
+		},
+		{
+			name:        "html",
+			accept:      "text/html,*/*;q=0.8",
+			contentType: "text/plain; charset=utf-8",
+		},
+		{
+			name:        "json",
+			accept:      "application/json",
+			contentType: "application/problem+json",
+			json:        true,
+		},
+		{
+			name:        "problem-json",
+			accept:      "text/html, application/problem+json;q=0.9",
+			contentType: "application/problem+json",
+			json:        true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/register/invalid", nil)
+			req = mux.SetURLVars(req, map[string]string{"registration_id": "invalid"})
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+
+			(&AuthProviderWeb{}).WebRegisterHandler(rec, req)
+
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			assert.Equal(t, tt.contentType, rec.Header().Get("Content-Type"))
+
+			if !tt.json {
+				assert.Equal(t, "invalid registration id\n", rec.Body.String())
+
+				return
+			}
+
+			var problem problemDetails
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &problem))
+			assert.Equal(t, problemDetails{
+				Type:   "about:blank",
+				Title:  "Bad Request",
+				Status: http.StatusBadRequest,
+				Detail: "invalid registration id",
+			}, problem)
+		})
+	}
+}
+
+func TestHTTPErrorInternal(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+
+	httpError(rec, req, assert.AnError)
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.JSONEq(t,
+		`{"type":"about:blank","title":"Internal Server Error","status":500,"detail":"internal server error"}`,
+		rec.Body.String(),
+	)
+}
+
+func TestAdminHandlerRedirectCode(t *testing.T) {
+	targetURL, err := ParseTargetURL("https://example.com/")
+	require.NoError(t, err)
+
+	for _, code := range []int{http.StatusFound, http.StatusTemporaryRedirect} {
+		h := &Headscale{
+			cfg:       &types.Config{TargetRedirectCode: code},
+			targetURL: targetURL,
+		}
+		rec := httptest.NewRecorder()
+
+		h.AdminHandler(rec, httptest.NewRequest(http.MethodGet, "/admin", nil))
+
+		assert.Equal(t, code, rec.Code)
+		assert.Equal(t, "https://example.com/admin/", rec.Header().Get("Location"))
+	}
+
+	// Without a configured code it redirects with 302.
+	h := &Headscale{cfg: &types.Config{}, targetURL: targetURL}
+	rec := httptest.NewRecorder()
+
+	h.AdminHandler(rec, httptest.NewRequest(http.MethodGet, "/admin", nil))
+
+	assert.Equal(t, http.StatusFound, rec.Code)
+}
+
+func TestAdminHandlerQuery(t *testing.T) {
+	tests := []struct {
+		name      string
+		targetURL string
+		path      string
+		want      string
+	}{
+		{
+			name:      "no-query",
+			targetURL: "https://example.com",
+			path:      "/admin",
+			want:      "https://example.com/admin/",
+		},
+		{
+			name:      "query",
+			targetURL: "https://example.com/",
+			path:      "/admin?tab=nodes",
+			want:      "https://example.com/admin/?tab=nodes",
+		},
+		{
+			name:      "target-query",
+			targetURL: "https://example.com/ui?lang=en",
+			path:      "/admin?tab=nodes&id=1",
+			want:      "https://example.com/ui/admin/?lang=en&tab=nodes&id=1",
+		},
+		{
+			name:      "target-query-only",
+			targetURL: "https://example.com/ui?lang=en",
+			path:      "/admin",
+			want:      "https://example.com/ui/admin/?lang=en",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targetURL, err := ParseTargetURL(tt.targetURL)
+			require.NoError(t, err)
+
+			h := &Headscale{
+				cfg:       &types.Config{TargetRedirectCode: http.StatusFound},
+				targetURL: targetURL,
+			}
+			rec := httptest.NewRecorder()
+
+			h.AdminHandler(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			assert.Equal(t, http.StatusFound, rec.Code)
+			assert.Equal(t, tt.want, rec.Header().Get("Location"))
+		})
+	}
+}
+
+func TestParseTargetURL(t *testing.T) {
+	for _, rawURL := range []string{
+		"example.com",
+		"ftp://example.com",
+		"https://",
+		"https://example.com/#admin",
+		"https://exa mple.com",
+	} {
+		_, err := ParseTargetURL(rawURL)
+		assert.Error(t, err, rawURL)
+	}
+
+	_, err := NewAuthProviderWebWithTarget("https://headscale.example.com", "example.com", types.RegisterModeRedirect)
+	require.Error(t, err)
+
+	tests := []struct {
+		targetURL string
+		want      string
+	}{
+		{targetURL: "", want: "/register/ID"},
+		{targetURL: "https://example.com", want: "https://example.com/register/ID"},
+		{targetURL: "https://example.com/ui//", want: "https://example.com/ui/register/ID"},
+		{targetURL: "http://example.com:8080/?lang=en", want: "http://example.com:8080/register/ID?lang=en"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.targetURL, func(t *testing.T) {
+			provider, err := NewAuthProviderWebWithTarget("https://headscale.example.com", tt.targetURL, types.RegisterModeRedirect)
+			require.NoError(t, err)
+
+			id := types.MustRegistrationID()
+			req := httptest.NewRequest(http.MethodGet, "/register/"+id.String(), nil)
+			req = mux.SetURLVars(req, map[string]string{"registration_id": id.String()})
+			rec := httptest.NewRecorder()
+
+			provider.WebRegisterHandler(rec, req)
+
+			assert.Equal(t, http.StatusFound, rec.Code)
+			assert.Equal(t, strings.Replace(tt.want, "ID", id.String(), 1), rec.Header().Get("Location"))
+		})
+	}
+}
+
+func TestWebRegisterHandlerTemplateMode(t *testing.T) {
+	provider, err := NewAuthProviderWebWithTarget("https://headscale.example.com", "https://example.com", types.RegisterModeTemplate)
+	require.NoError(t, err)
+
+	register := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/register/"+id, nil)
+		req = mux.SetURLVars(req, map[string]string{"registration_id": id})
+		rec := httptest.NewRecorder()
+		provider.WebRegisterHandler(rec, req)
+
+		return rec
+	}
+
+	id := types.MustRegistrationID()
+	rec := register(id.String())
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Empty(t, rec.Header().Get("Location"))
+	assert.Contains(t, rec.Body.String(), id.String())
+
+	rec = register("<script>")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "<script>")
+}
+
+func TestWebSecurityHeaders(t *testing.T) {
+	tests := []struct {
+		name        string
+		csp         string
+		frameOption string
+	}{
+		{
+			name:        "default",
+			csp:         types.DefaultWebContentSecurityPolicy,
+			frameOption: "",
+		},
+		{
+			name:        "embedded",
+			csp:         "default-src 'none'; frame-ancestors https://portal.example.com",
+			frameOption: "",
+		},
+		{
+			name:        "no-frame-ancestors",
+			csp:         "default-src 'none'",
+			frameOption: "DENY",
+		},
+		{
+			name:        "no-csp",
+			frameOption: "DENY",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, err := NewAuthProviderWebWithTarget("https://headscale.example.com", "", types.RegisterModeTemplate)
+			require.NoError(t, err)
+
+			handler := webSecurityHeaders(tt.csp)(http.HandlerFunc(provider.WebRegisterHandler))
+
+			// The headers are set on rejected requests too.
+			for _, id := range []string{types.MustRegistrationID().String(), "<script>"} {
+				req := httptest.NewRequest(http.MethodGet, "/register/"+id, nil)
+				req = mux.SetURLVars(req, map[string]string{"registration_id": id})
+				rec := httptest.NewRecorder()
+
+				handler.ServeHTTP(rec, req)
+
+				assert.Equal(t, "nosniff", rec.Header().Get("X-Content-Type-Options"))
+				assert.Equal(t, tt.csp, rec.Header().Get("Content-Security-Policy"))
+				assert.Equal(t, tt.frameOption, rec.Header().Get("X-Frame-Options"))
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package mapper
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+type cacheKey [sha256.Size]byte
+
+type cachedResponse struct {
+	key     cacheKey
+	resp    *tailcfg.MapResponse
+	expires time.Time
+
+	// peers holds the IDs of the peers in the response.
+	peers map[types.NodeID]bool
+}
+
+// responseCache holds the last full MapResponse sent to every node for
+// a short time, so repeated identical requests are answered without
+// generating the response again. The responses are kept unmarshalled,
+// as their ControlTime has to be set again for every request.
+type responseCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[types.NodeID]cachedResponse
+}
+
+func newResponseCache(ttl time.Duration) *responseCache {
+	return &responseCache{
+		ttl:     ttl,
+		entries: make(map[types.NodeID]cachedResponse),
+	}
+}
+
+// get returns a shallow copy of the cached response of the node if it
+// was generated from the same input and has not expired.
+func (c *responseCache) get(nodeID types.NodeID, key cacheKey) (*tailcfg.MapResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[nodeID]
+	if !ok || entry.key != key {
+		return nil, false
+	}
+
+	if time.Now().After(entry.expires) {
+		delete(c.entries, nodeID)
+
+		return nil, false
+	}
+
+	resp := *entry.resp
+
+	return &resp, true
+}
+
+// set caches a shallow copy of resp, the caller must not modify the
+// slices and maps of resp afterwards.
+func (c *responseCache) set(nodeID types.NodeID, key cacheKey, resp *tailcfg.MapResponse, peers types.Nodes) {
+	peerIDs := make(map[types.NodeID]bool, len(peers))
+	for _, peer := range peers {
+		peerIDs[peer.ID] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached := *resp
+	c.entries[nodeID] = cachedResponse{
+		key:     key,
+		resp:    &cached,
+		expires: time.Now().Add(c.ttl),
+		peers:   peerIDs,
+	}
+}
+
+func (c *responseCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.entries)
+}
+
+// invalidateNodes drops the cached responses of the nodes and the
+// responses containing them as peers.
+func (c *responseCache) invalidateNodes(nodeIDs []types.NodeID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, entry := range c.entries {
+		for _, dropped := range nodeIDs {
+			if id == dropped || entry.peers[dropped] {
+				delete(c.entries, id)
+
+				break
+			}
+		}
+	}
+}
+
+// InvalidateResponseCache drops all cached map responses and converted
+// peers. It must be called when something not covered by the cache key
+// changes, like the policy or the users. Changes of the DERP map are
+// covered by SetDERPMap.
+func (m *Mapper) InvalidateResponseCache() {
+	if m.cache != nil {
+		m.cache.invalidate()
+	}
+	m.tailNodes.invalidate()
+}
+
+// InvalidateByPredicate drops the cached map responses and converted
+// peers of the nodes match reports true for, and the cached responses
+// of all nodes having them as peers, for changes like a policy change
+// that only affect some nodes. If the nodes cannot be listed, all
+// cached responses and peers are dropped and the error is returned.
+func (m *Mapper) InvalidateByPredicate(match func(*types.Node) bool) error {
+	nodes, err := m.ListNodes()
+	if err != nil {
+		m.InvalidateResponseCache()
+
+		return fmt.Errorf("listing nodes to invalidate: %w", err)
+	}
+
+	var nodeIDs []types.NodeID
+	for _, node := range nodes {
+		if match(node) {
+			nodeIDs = append(nodeIDs, node.ID)
+		}
+	}
+
+	if m.cache != nil {
+		m.cache.invalidateNodes(nodeIDs)
+	}
+	m.tailNodes.invalidateNodes(nodeIDs)
+
+	return nil
+}
+
+// responseCacheKey hashes everything a full MapResponse of the node is
+// generated from: the request, the node and its peers, their primary
+// routes, the packet filter and the DNS configuration, which changes
+// when the extra records are reloaded.
+func (m *Mapper) responseCacheKey(
+	mapRequest tailcfg.MapRequest,
+	node *types.Node,
+	peers types.Nodes,
+) (cacheKey, error) {
+	routes := make(map[types.NodeID][]netip.Prefix, len(peers)+1)
+	for _, n := range append(types.Nodes{node}, peers...) {
+		routes[n.ID] = m.primary.PrimaryRoutes(n.ID)
+	}
+	filter, _ := m.polMan.Filter()
+
+	h := sha256.New()
+	err := json.NewEncoder(h).Encode(struct {
+		Version  tailcfg.CapabilityVersion
+		Compress string
+		Node     *types.Node
+		Peers    types.Nodes
+		Routes   map[types.NodeID][]netip.Prefix
+		Filter   []tailcfg.FilterRule
+		DNS      *tailcfg.DNSConfig
+		Health   []string
+	}{
+		Version:  mapRequest.Version,
+		Compress: mapRequest.Compress,
+		Node:     node,
+		Peers:    peers,
+		Routes:   routes,
+		Filter:   filter,
+		DNS:      m.cfg.TailcfgDNSConfig,
+		Health:   m.unsupportedFeatureHealth(mapRequest, node),
+	})
+	if err != nil {
+		return cacheKey{}, err
+	}
+
+	var key cacheKey
+	h.Sum(key[:0])
+
+	return key, nil
+}
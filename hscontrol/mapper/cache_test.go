@@ -0,0 +1,266 @@
+package mapper
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/policy"
+	"github.com/juanfont/headscale/hscontrol/routes"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"tailscale.com/tailcfg"
+)
+
+// cacheTestMapper returns a Mapper caching responses for ttl and a
+// counter of the full responses it generated.
+func cacheTestMapper(t testing.TB, ttl time.Duration, peerCount int) (*Mapper, *types.Node, *staticNodeStore, *int) {
+	t.Helper()
+
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+	node := &types.Node{
+		ID:        1,
+		GivenName: "mini",
+		IPv4:      iap("100.64.0.1"),
+		UserID:    user1.ID,
+		User:      user1,
+		Hostinfo:  &tailcfg.Hostinfo{OS: "linux"},
+	}
+
+	var peers types.Nodes
+	for i := range peerCount {
+		peers = append(peers, &types.Node{
+			ID:        types.NodeID(i + 2),
+			GivenName: fmt.Sprintf("peer%d", i),
+			IPv4:      iap(fmt.Sprintf("100.64.%d.%d", (i+2)/256, (i+2)%256)),
+			UserID:    user1.ID,
+			User:      user1,
+			Hostinfo:  &tailcfg.Hostinfo{OS: "linux"},
+		})
+	}
+
+	polMan, err := policy.NewPolicyManager(nil, []types.User{user1}, append(types.Nodes{node}, peers...))
+	require.NoError(t, err)
+
+	cfg := &types.Config{
+		TailcfgDNSConfig: &tailcfg.DNSConfig{},
+		Tuning: types.Tuning{
+			MapResponseCacheTTL: ttl,
+		},
+	}
+	notif := newTestNotifier(t)
+	mappy := NewMapper(nil, cfg, &tailcfg.DERPMap{}, notif, polMan, routes.New())
+	store := &staticNodeStore{peers: peers}
+	mappy.db = store
+
+	generated := new(int)
+	mappy.Use(func(stage string, next StageFunc) StageFunc {
+		if stage != StageNode {
+			return next
+		}
+
+		return func(mc *MapContext) error {
+			*generated++
+
+			return next(mc)
+		}
+	})
+
+	return mappy, node, store, generated
+}
+
+func TestResponseCache(t *testing.T) {
+	mappy, node, store, generated := cacheTestMapper(t, time.Minute, 2)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mappy.now = func() time.Time { return now }
+
+	first, err := mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Equal(t, 1, *generated)
+
+	now = now.Add(time.Second)
+	second, err := mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Equal(t, 1, *generated, "identical request should be served from the cache")
+
+	// Cached responses get the current ControlTime.
+	var firstResp, secondResp tailcfg.MapResponse
+	require.NoError(t, json.Unmarshal(first[reservedResponseHeaderSize:], &firstResp))
+	require.NoError(t, json.Unmarshal(second[reservedResponseHeaderSize:], &secondResp))
+	require.Equal(t, now, *secondResp.ControlTime)
+	firstResp.ControlTime = secondResp.ControlTime
+	require.Equal(t, firstResp, secondResp)
+
+	// Responses with messages are not served from the cache.
+	_, err = mappy.FullMapResponse(tailcfg.MapRequest{}, node, "message")
+	require.NoError(t, err)
+	require.Equal(t, 2, *generated)
+	_, err = mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Equal(t, 2, *generated)
+
+	// A different request is not served from the cache.
+	_, err = mappy.FullMapResponse(tailcfg.MapRequest{Version: 106}, node)
+	require.NoError(t, err)
+	require.Equal(t, 3, *generated)
+
+	// A change of a peer invalidates the cached response.
+	store.peers[0].Hostinfo = &tailcfg.Hostinfo{OS: "ios"}
+	_, err = mappy.FullMapResponse(tailcfg.MapRequest{Version: 106}, node)
+	require.NoError(t, err)
+	require.Equal(t, 4, *generated)
+
+	// A removed peer invalidates the cached response.
+	store.peers = store.peers[:1]
+	_, err = mappy.FullMapResponse(tailcfg.MapRequest{Version: 106}, node)
+	require.NoError(t, err)
+	require.Equal(t, 5, *generated)
+
+	_, err = mappy.FullMapResponse(tailcfg.MapRequest{Version: 106}, node)
+	require.NoError(t, err)
+	require.Equal(t, 5, *generated)
+
+	// Explicit invalidation, like after a policy change.
+	mappy.InvalidateResponseCache()
+	_, err = mappy.FullMapResponse(tailcfg.MapRequest{Version: 106}, node)
+	require.NoError(t, err)
+	require.Equal(t, 6, *generated)
+}
+
+func TestResponseCachePolicyChange(t *testing.T) {
+	mappy, node, _, generated := cacheTestMapper(t, time.Minute, 1)
+
+	_, err := mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+
+	_, err = mappy.polMan.SetPolicy([]byte(`{"acls": [{"action": "accept", "src": ["user1@"], "dst": ["user1@:22"]}]}`))
+	require.NoError(t, err)
+
+	_, err = mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Equal(t, 2, *generated, "a changed packet filter should not be served from the cache")
+}
+
+func TestResponseCacheExtraRecordsChange(t *testing.T) {
+	mappy, node, _, generated := cacheTestMapper(t, time.Minute, 1)
+
+	_, err := mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+
+	mappy.cfg.TailcfgDNSConfig.ExtraRecords = []tailcfg.DNSRecord{
+		{Name: "grafana.example.com", Type: "A", Value: "100.64.0.3"},
+	}
+
+	data, err := mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Equal(t, 2, *generated, "changed extra records should not be served from the cache")
+
+	var resp tailcfg.MapResponse
+	require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], &resp))
+	require.Equal(t, mappy.cfg.TailcfgDNSConfig.ExtraRecords, resp.DNSConfig.ExtraRecords)
+}
+
+func TestResponseCacheDERPMapChange(t *testing.T) {
+	mappy, node, _, generated := cacheTestMapper(t, time.Minute, 1)
+
+	_, err := mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+
+	derpMap := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{1: {RegionID: 1}}}
+	mappy.SetDERPMap(derpMap)
+
+	_, err = mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Equal(t, 2, *generated)
+
+	// Sending the DERP map set before keeps the cache.
+	_, err = mappy.DERPMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	_, err = mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Equal(t, 2, *generated)
+}
+
+func TestResponseCacheExpiry(t *testing.T) {
+	mappy, node, _, generated := cacheTestMapper(t, 10*time.Millisecond, 1)
+
+	_, err := mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+
+	time.Sleep(20 * time.Millisecond)
+
+	_, err = mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Equal(t, 2, *generated)
+}
+
+func TestResponseCacheDisabled(t *testing.T) {
+	mappy, node, _, generated := cacheTestMapper(t, 0, 1)
+
+	for range 3 {
+		_, err := mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 3, *generated)
+}
+
+func BenchmarkFullMapResponse(b *testing.B) {
+	for _, ttl := range []time.Duration{0, time.Minute} {
+		b.Run(fmt.Sprintf("cache-ttl=%s", ttl), func(b *testing.B) {
+			mappy, node, _, _ := cacheTestMapper(b, ttl, 100)
+
+			b.ResetTimer()
+			for range b.N {
+				if _, err := mappy.FullMapResponse(tailcfg.MapRequest{}, node); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestInvalidateByPredicate(t *testing.T) {
+	mappy, node, store, generated := cacheTestMapper(t, time.Minute, 2)
+	store.peers = append(store.peers, node)
+	peer := store.peers[0]
+
+	// Listing the nodes sets their connection state, which is part of
+	// the cache key, set it before the responses are cached.
+	offline := false
+	node.IsOnline = &offline
+
+	respond := func() {
+		t.Helper()
+		for _, n := range []*types.Node{node, peer} {
+			_, err := mappy.FullMapResponse(tailcfg.MapRequest{}, n)
+			require.NoError(t, err)
+		}
+	}
+
+	respond()
+	require.Equal(t, 2, *generated)
+
+	// The responses of the matching node and of the node having it as
+	// a peer are generated again.
+	err := mappy.InvalidateByPredicate(func(n *types.Node) bool { return n.ID == peer.ID })
+	require.NoError(t, err)
+	respond()
+	require.Equal(t, 4, *generated)
+
+	err = mappy.InvalidateByPredicate(func(*types.Node) bool { return false })
+	require.NoError(t, err)
+	respond()
+	require.Equal(t, 4, *generated)
+
+	// Responses without the matching nodes as peers are kept.
+	cache := newResponseCache(time.Minute)
+	cache.set(1, cacheKey{}, &tailcfg.MapResponse{}, types.Nodes{{ID: 2}})
+	cache.set(3, cacheKey{}, &tailcfg.MapResponse{}, types.Nodes{{ID: 4}})
+	cache.set(4, cacheKey{}, &tailcfg.MapResponse{}, types.Nodes{{ID: 3}})
+	cache.invalidateNodes([]types.NodeID{2})
+	require.Len(t, cache.entries, 2)
+	_, ok := cache.get(3, cacheKey{})
+	require.True(t, ok)
+}
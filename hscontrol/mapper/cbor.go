@@ -0,0 +1,67 @@
+package mapper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// cborEncode re-encodes a JSON document as CBOR.
+// The map response is not encoded to CBOR directly as a lot of the
+// tailcfg types (views, keys) only know how to marshal themselves to
+// JSON, going through the generic JSON representation ensures that a
+// client decoding the CBOR sees exactly the same document.
+func cborEncode(jsonBody []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(jsonBody))
+	dec.UseNumber()
+
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decoding json for cbor encoding: %w", err)
+	}
+
+	out, err := cbor.Marshal(cborValue(doc))
+	if err != nil {
+		return nil, fmt.Errorf("encoding cbor: %w", err)
+	}
+
+	return out, nil
+}
+
+// cborValue converts numbers in a generic JSON document to integers where
+// possible so they are encoded compactly and without loss of precision.
+// Integers above the range of int64, such as uint64 IDs, are kept as
+// uint64.
+func cborValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, val := range v {
+			v[key] = cborValue(val)
+		}
+
+		return v
+	case []any:
+		for i, val := range v {
+			v[i] = cborValue(val)
+		}
+
+		return v
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			return u
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+
+		return v.String()
+	default:
+		return v
+	}
+}
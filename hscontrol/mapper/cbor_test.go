@@ -0,0 +1,130 @@
+package mapper
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/juanfont/headscale/hscontrol/policy"
+	"github.com/juanfont/headscale/hscontrol/routes"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"tailscale.com/tailcfg"
+)
+
+// cborDecode decodes a CBOR encoded map response back into its JSON form.
+func cborDecode(in []byte) ([]byte, error) {
+	var doc any
+	if err := cbor.Unmarshal(in, &doc); err != nil {
+		return nil, fmt.Errorf("decoding cbor: %w", err)
+	}
+
+	return json.Marshal(jsonValue(doc))
+}
+
+// jsonValue converts the generic maps produced by the CBOR decoder
+// into maps that can be marshalled to JSON.
+func jsonValue(v any) any {
+	switch v := v.(type) {
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for key, val := range v {
+			m[fmt.Sprint(key)] = jsonValue(val)
+		}
+
+		return m
+	case []any:
+		for i, val := range v {
+			v[i] = jsonValue(val)
+		}
+
+		return v
+	default:
+		return v
+	}
+}
+
+func TestCBORMapResponseRoundTrip(t *testing.T) {
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+	node := &types.Node{
+		ID:        1,
+		Hostname:  "mini",
+		GivenName: "mini",
+		IPv4:      iap("100.64.0.1"),
+		UserID:    user1.ID,
+		User:      user1,
+		Hostinfo:  &tailcfg.Hostinfo{OS: "linux", Hostname: "mini"},
+	}
+	peer := &types.Node{
+		ID:        2,
+		Hostname:  "peer",
+		GivenName: "peer",
+		IPv4:      iap("100.64.0.2"),
+		UserID:    user1.ID,
+		User:      user1,
+		Hostinfo:  &tailcfg.Hostinfo{OS: "ios"},
+	}
+
+	polMan, err := policy.NewPolicyManager(nil, []types.User{user1}, types.Nodes{node, peer})
+	require.NoError(t, err)
+
+	cfg := &types.Config{
+		TailcfgDNSConfig: &tailcfg.DNSConfig{},
+	}
+	mappy := NewMapper(nil, cfg, &tailcfg.DERPMap{}, newTestNotifier(t), polMan, routes.New())
+	mappy.db = &staticNodeStore{peers: types.Nodes{peer}}
+
+	unframe := func(data []byte) []byte {
+		body, rest, err := readLengthPrefixedFrame(data)
+		require.NoError(t, err)
+		require.Empty(t, rest)
+
+		return body
+	}
+
+	jsonData, err := mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	jsonBody := unframe(jsonData)
+
+	cborData, err := mappy.FullMapResponse(tailcfg.MapRequest{Compress: util.CBORCompression}, node)
+	require.NoError(t, err)
+	cborBody := unframe(cborData)
+
+	require.Less(t, len(cborBody), len(jsonBody), "cbor should be more compact than json")
+
+	decoded, err := cborDecode(cborBody)
+	require.NoError(t, err)
+
+	var fromJSON, fromCBOR tailcfg.MapResponse
+	require.NoError(t, json.Unmarshal(jsonBody, &fromJSON))
+	require.NoError(t, json.Unmarshal(decoded, &fromCBOR))
+
+	// ControlTime is set to now for every response.
+	fromJSON.ControlTime = nil
+	fromCBOR.ControlTime = nil
+
+	want, err := json.Marshal(fromJSON)
+	require.NoError(t, err)
+	got, err := json.Marshal(fromCBOR)
+	require.NoError(t, err)
+	require.JSONEq(t, string(want), string(got))
+	require.Equal(t, "mini", fromCBOR.Node.Hostinfo.Hostname())
+	require.Len(t, fromCBOR.Peers, 1)
+}
+
+func TestCBORIntegerPrecision(t *testing.T) {
+	jsonBody := []byte(`{"ID":18446744073709551615,"Seq":9007199254740993,"Neg":-9007199254740993,"Ratio":0.5}`)
+
+	body, err := cborEncode(jsonBody)
+	require.NoError(t, err)
+
+	var doc map[string]any
+	require.NoError(t, cbor.Unmarshal(body, &doc))
+	require.Equal(t, uint64(18446744073709551615), doc["ID"])
+	require.Equal(t, uint64(9007199254740993), doc["Seq"])
+	require.Equal(t, int64(-9007199254740993), doc["Neg"])
+	require.Equal(t, 0.5, doc["Ratio"])
+}
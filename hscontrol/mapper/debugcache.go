@@ -0,0 +1,69 @@
+package mapper
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+)
+
+// CacheSnapshot describes what the Mapper remembers of the responses
+// sent to a node to build the updates following them, see
+// Mapper.DebugCache. Hashes are hex encoded SHA-256 hashes, empty if
+// the value is not remembered.
+type CacheSnapshot struct {
+	// Peers is the number of peers known to the node and PeersHash the
+	// hash of their IDs. They are only remembered with
+	// types.MapperConfig.DeltaFullUpdates.
+	Peers     int
+	PeersHash string
+
+	// PeersSent is when all peers were last sent to the node.
+	PeersSent time.Time
+
+	DERPMapHash string
+
+	// DNSConfigHash is only remembered with
+	// types.MapperConfig.OmitUnchangedFields.
+	DNSConfigHash string
+
+	// LastUpdate is when a full update was last streamed to the node.
+	LastUpdate time.Time
+}
+
+// DebugCache returns what the Mapper remembers of the responses sent to
+// the node with the given ID, and false if it remembers nothing. It is
+// intended for debugging the updates sent to the node.
+func (m *Mapper) DebugCache(nodeID types.NodeID) (CacheSnapshot, bool) {
+	var snapshot CacheSnapshot
+
+	hashes, updated := m.sentHashes.current(nodeID)
+	found := !updated.IsZero() || len(hashes) > 0
+
+	snapshot.LastUpdate = updated
+	if hash, ok := hashes[fieldDERPMap]; ok {
+		snapshot.DERPMapHash = hex.EncodeToString(hash[:])
+	}
+	if hash, ok := hashes[fieldDNSConfig]; ok {
+		snapshot.DNSConfigHash = hex.EncodeToString(hash[:])
+	}
+
+	if m.peerSnapshots != nil {
+		if ids, sent, ok := m.peerSnapshots.peers(nodeID); ok {
+			found = true
+
+			hash := sha256.New()
+			for _, id := range ids {
+				_ = binary.Write(hash, binary.BigEndian, int64(id))
+			}
+
+			snapshot.Peers = len(ids)
+			snapshot.PeersHash = hex.EncodeToString(hash.Sum(nil))
+			snapshot.PeersSent = sent
+		}
+	}
+
+	return snapshot, found
+}
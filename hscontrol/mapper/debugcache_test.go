@@ -0,0 +1,90 @@
+package mapper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/tailcfg"
+)
+
+func TestDebugCache(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.notif = newTestNotifier(t)
+	mappy.cfg.Mapper.DeltaFullUpdates = true
+	mappy.cfg.Mapper.OmitUnchangedFields = true
+	mappy.peerSnapshots = newPeerSnapshots(0)
+	store := &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+	mappy.db = store
+
+	now := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	mappy.now = func() time.Time { return now }
+
+	hash := func(value any) string {
+		t.Helper()
+		b, err := json.Marshal(value)
+		require.NoError(t, err)
+		sum := sha256.Sum256(b)
+
+		return hex.EncodeToString(sum[:])
+	}
+
+	_, ok := mappy.DebugCache(node.ID)
+	require.False(t, ok)
+
+	stream := tailcfg.MapRequest{Stream: true}
+	_, err := mappy.FullMapResponse(stream, node)
+	require.NoError(t, err)
+
+	first, ok := mappy.DebugCache(node.ID)
+	require.True(t, ok)
+	require.Equal(t, 1, first.Peers)
+	require.NotEmpty(t, first.PeersHash)
+	require.Equal(t, now, first.PeersSent)
+	require.Equal(t, now, first.LastUpdate)
+	require.Equal(t, hash(mappy.derpMap.Load()), first.DERPMapHash)
+	require.Equal(t, hash(generateDNSConfig(mappy.cfg, node, nil)), first.DNSConfigHash)
+
+	// An update without changes only moves the update time.
+	now = now.Add(time.Minute)
+	_, err = mappy.FullMapUpdateResponse(stream, node)
+	require.NoError(t, err)
+
+	second, ok := mappy.DebugCache(node.ID)
+	require.True(t, ok)
+	require.Equal(t, now, second.LastUpdate)
+	second.LastUpdate = first.LastUpdate
+	require.Equal(t, first, second)
+
+	// Incremental peer updates are no full updates.
+	lastFull := now
+	now = now.Add(time.Minute)
+	_, err = mappy.PeerChangedResponse(stream, node, map[types.NodeID]bool{peers[0].ID: true}, nil)
+	require.NoError(t, err)
+	afterPeerChange, _ := mappy.DebugCache(node.ID)
+	require.Equal(t, lastFull, afterPeerChange.LastUpdate)
+
+	// Removed peers and a new DERP map are reflected.
+	store.peers = types.Nodes{node}
+	mappy.SetDERPMap(&tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{2: {RegionID: 2}}})
+	_, err = mappy.FullMapUpdateResponse(stream, node)
+	require.NoError(t, err)
+
+	third, ok := mappy.DebugCache(node.ID)
+	require.True(t, ok)
+	require.Zero(t, third.Peers)
+	require.NotEqual(t, first.PeersHash, third.PeersHash)
+	require.Equal(t, hash(mappy.derpMap.Load()), third.DERPMapHash)
+
+	// Resending the DERP map forgets its hash.
+	mappy.ResendDERPMap()
+	fourth, _ := mappy.DebugCache(node.ID)
+	require.Empty(t, fourth.DERPMapHash)
+
+	_, ok = mappy.DebugCache(peers[0].ID)
+	require.False(t, ok)
+}
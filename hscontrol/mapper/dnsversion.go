@@ -0,0 +1,111 @@
+package mapper
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"strconv"
+	"sync"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+// CapabilityDNSVersion is the node capability holding the version of
+// the DNS configuration last sent to the node.
+const CapabilityDNSVersion tailcfg.NodeCapability = "headscale.net/cap/dns-version"
+
+type dnsVersion struct {
+	hash    [sha256.Size]byte
+	version uint64
+}
+
+// dnsVersions counts the changes of the DNS configuration sent to every
+// node, to correlate the configuration a client reports with the one
+// it was sent.
+type dnsVersions struct {
+	mu       sync.Mutex
+	versions map[types.NodeID]dnsVersion
+}
+
+func newDNSVersions() *dnsVersions {
+	return &dnsVersions{
+		versions: make(map[types.NodeID]dnsVersion),
+	}
+}
+
+// update records dnsConfig as sent to the node. Its version is only
+// incremented if it differs from the last one sent.
+// A nil dnsVersions does not track anything.
+func (v *dnsVersions) update(nodeID types.NodeID, dnsConfig *tailcfg.DNSConfig) {
+	if v == nil {
+		return
+	}
+
+	hash := dnsConfigHash(dnsConfig)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.versions[nodeID], _ = v.versionOf(nodeID, hash)
+}
+
+// next returns the version dnsConfig has once update records it as sent
+// to the node, and if it differs from the last one sent.
+// A nil dnsVersions returns 0.
+func (v *dnsVersions) next(nodeID types.NodeID, dnsConfig *tailcfg.DNSConfig) (uint64, bool) {
+	if v == nil {
+		return 0, false
+	}
+
+	hash := dnsConfigHash(dnsConfig)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	current, changed := v.versionOf(nodeID, hash)
+
+	return current.version, changed
+}
+
+// versionOf returns the version of the DNS configuration with the given
+// hash for the node. v.mu must be held.
+func (v *dnsVersions) versionOf(nodeID types.NodeID, hash [sha256.Size]byte) (dnsVersion, bool) {
+	current, ok := v.versions[nodeID]
+	if ok && current.hash == hash {
+		return current, false
+	}
+
+	return dnsVersion{hash: hash, version: current.version + 1}, true
+}
+
+func dnsConfigHash(dnsConfig *tailcfg.DNSConfig) [sha256.Size]byte {
+	// DNSConfig is a plain struct of strings and slices, it can always
+	// be marshalled.
+	b, _ := json.Marshal(dnsConfig)
+
+	return sha256.Sum256(b)
+}
+
+// get returns the version of the DNS configuration last sent to the
+// node, 0 if none was sent.
+func (v *dnsVersions) get(nodeID types.NodeID) uint64 {
+	if v == nil {
+		return 0
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.versions[nodeID].version
+}
+
+// DNSVersion returns the version of the DNS configuration last sent to
+// the node. It starts at 1 and is incremented every time a changed
+// configuration is sent, 0 means none was sent yet.
+func (m *Mapper) DNSVersion(nodeID types.NodeID) uint64 {
+	return m.dnsVersions.get(nodeID)
+}
+
+func dnsVersionCapValues(version uint64) []tailcfg.RawMessage {
+	return []tailcfg.RawMessage{tailcfg.RawMessage(strconv.FormatUint(version, 10))}
+}
@@ -0,0 +1,67 @@
+package mapper
+
+import (
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/dnstype"
+)
+
+func TestDNSVersion(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.cfg.TailcfgDNSConfig = &tailcfg.DNSConfig{
+		Resolvers: []*dnstype.Resolver{{Addr: "1.1.1.1"}},
+	}
+	require.Equal(t, uint64(0), mappy.DNSVersion(node.ID))
+
+	send := func() {
+		t.Helper()
+		_, err := mappy.fullMapResponse(node, peers, 0)
+		require.NoError(t, err)
+	}
+
+	send()
+	require.Equal(t, uint64(1), mappy.DNSVersion(node.ID))
+
+	// Unchanged configurations keep their version.
+	send()
+	mc := &MapContext{Node: node, Peers: peers, Response: &tailcfg.MapResponse{}}
+	require.NoError(t, mappy.appendPeerChanges(mc))
+	require.Equal(t, uint64(1), mappy.DNSVersion(node.ID))
+
+	mappy.cfg.TailcfgDNSConfig.Domains = []string{"example.com"}
+	send()
+	require.Equal(t, uint64(2), mappy.DNSVersion(node.ID))
+
+	mappy.cfg.Mapper.DNSDisabled = []string{"user1"}
+	send()
+	require.Equal(t, uint64(3), mappy.DNSVersion(node.ID))
+
+	// Every node has its own version.
+	require.Equal(t, uint64(0), mappy.DNSVersion(peers[0].ID))
+
+	// Simulated requests do not count as sent.
+	mappy.db = &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+	mappy.notif = newTestNotifier(t)
+	mappy.cfg.Mapper.DNSDisabled = nil
+	_, err := mappy.SimulateRequest(node.ID, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), mappy.DNSVersion(node.ID))
+}
+
+func TestDNSVersionCapability(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+
+	resp, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.NotContains(t, resp.Node.CapMap, CapabilityDNSVersion)
+
+	mappy.cfg.Mapper.DNSVersionCapability = true
+	mappy.cfg.TailcfgDNSConfig = &tailcfg.DNSConfig{Domains: []string{"example.com"}}
+
+	resp, err = mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Equal(t, []tailcfg.RawMessage{"2"}, resp.Node.CapMap[CapabilityDNSVersion])
+}
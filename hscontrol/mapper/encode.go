@@ -0,0 +1,203 @@
+package mapper
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/klauspost/compress/zstd"
+	"tailscale.com/smallzstd"
+)
+
+// zstdEncoderPools holds a pool of zstd encoders for every
+// zstd.EncoderLevel, encoders of different levels are never mixed.
+var zstdEncoderPools sync.Map
+
+// zstdEncoderPool returns the pool of zstd encoders of level.
+func zstdEncoderPool(level zstd.EncoderLevel) *sync.Pool {
+	if pool, ok := zstdEncoderPools.Load(level); ok {
+		return pool.(*sync.Pool)
+	}
+
+	pool, _ := zstdEncoderPools.LoadOrStore(level, &sync.Pool{
+		New: func() any {
+			encoder, err := smallzstd.NewEncoder(
+				nil,
+				zstd.WithEncoderLevel(level))
+			if err != nil {
+				panic(err)
+			}
+
+			return encoder
+		},
+	})
+
+	return pool.(*sync.Pool)
+}
+
+// MaxDecodedRequestSize is the maximum size of a decompressed request
+// body, guarding against decompression bombs.
+const MaxDecodedRequestSize = 4 << 20
+
+// ErrRequestTooLarge is returned when a request body decompresses to
+// more than MaxDecodedRequestSize bytes.
+var ErrRequestTooLarge = errors.New("decompressed request body too large")
+
+// zstdDecoderPool holds zstd decoders refusing to decompress more than
+// MaxDecodedRequestSize bytes.
+var zstdDecoderPool = &sync.Pool{
+	New: func() any {
+		decoder, err := smallzstd.NewDecoder(
+			nil,
+			zstd.WithDecoderMaxMemory(MaxDecodedRequestSize))
+		if err != nil {
+			panic(err)
+		}
+
+		return decoder
+	},
+}
+
+// zstdDecode reads zstd compressed data from r and returns it
+// decompressed.
+func zstdDecode(r io.Reader) ([]byte, error) {
+	decoder, ok := zstdDecoderPool.Get().(*zstd.Decoder)
+	if !ok {
+		panic("invalid type in sync pool")
+	}
+	defer func() {
+		decoder.Reset(nil)
+		zstdDecoderPool.Put(decoder)
+	}()
+
+	data, err := func() ([]byte, error) {
+		if err := decoder.Reset(r); err != nil {
+			return nil, err
+		}
+
+		return io.ReadAll(io.LimitReader(decoder, MaxDecodedRequestSize+1))
+	}()
+	switch {
+	case errors.Is(err, zstd.ErrDecoderSizeExceeded), len(data) > MaxDecodedRequestSize:
+		return nil, ErrRequestTooLarge
+	case err != nil:
+		return nil, fmt.Errorf("decompressing request body: %w", err)
+	}
+
+	return data, nil
+}
+
+// DecodeRequestBody reads a request body compressed with compression,
+// one of the values of MapRequest.Compress, and returns it decompressed.
+// Uncompressed bodies are returned as read. Bodies decompressing to more
+// than MaxDecodedRequestSize bytes fail with ErrRequestTooLarge.
+func DecodeRequestBody(r io.Reader, compression string) ([]byte, error) {
+	switch compression {
+	case "":
+		return io.ReadAll(r)
+	case util.ZstdCompression:
+		return zstdDecode(r)
+	default:
+		return nil, fmt.Errorf("unsupported request compression %q", compression)
+	}
+}
+
+// writeMapResponse encodes resp, a tailcfg.MapResponse or a type
+// embedding one, as JSON, compressed with compression, and writes it
+// to w. zstd compressed responses use the given encoder
+// level. Uncompressed and zstd compressed responses are streamed into w
+// instead of first being marshalled as a whole.
+// It returns the size of the JSON document before compression.
+func writeMapResponse(w io.Writer, resp any, compression string, level zstd.EncoderLevel) (int, error) {
+	switch compression {
+	case util.ZstdCompression:
+		pool := zstdEncoderPool(level)
+		encoder, ok := pool.Get().(*zstd.Encoder)
+		if !ok {
+			panic("invalid type in sync pool")
+		}
+		defer func() {
+			encoder.Reset(nil)
+			pool.Put(encoder)
+		}()
+
+		encoder.Reset(w)
+		counter := &countingWriter{w: encoder}
+		if err := encodeJSON(counter, resp); err != nil {
+			return 0, err
+		}
+
+		return counter.n, encoder.Close()
+
+	case util.CBORCompression:
+		// CBOR is converted from the JSON document, which therefore
+		// has to be marshalled as a whole.
+		jsonBody, err := json.Marshal(resp)
+		if err != nil {
+			return 0, fmt.Errorf("marshalling map response: %w", err)
+		}
+
+		body, err := cborEncode(jsonBody)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = w.Write(body)
+
+		return len(jsonBody), err
+
+	default:
+		counter := &countingWriter{w: w}
+		err := encodeJSON(counter, resp)
+
+		return counter.n, err
+	}
+}
+
+// encodeJSON writes resp to w encoded the same as by json.Marshal.
+func encodeJSON(w io.Writer, resp any) error {
+	if err := json.NewEncoder(newlineDropper{w}).Encode(resp); err != nil {
+		return fmt.Errorf("marshalling map response: %w", err)
+	}
+
+	return nil
+}
+
+// newlineDropper drops all newlines written to it. json.Encoder ends
+// every value with a newline json.Marshal does not add, compact JSON
+// contains no other literal newlines.
+type newlineDropper struct {
+	w io.Writer
+}
+
+func (d newlineDropper) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		line, rest, _ := bytes.Cut(p, []byte{'\n'})
+		if len(line) > 0 {
+			if _, err := d.w.Write(line); err != nil {
+				return 0, err
+			}
+		}
+		p = rest
+	}
+
+	return n, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+
+	return n, err
+}
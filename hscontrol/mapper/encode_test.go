@@ -0,0 +1,285 @@
+package mapper
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/tailcfg"
+)
+
+// bufferedMapResponse encodes resp by marshalling it as a whole before
+// compressing it, the way writeMapResponse avoids.
+func bufferedMapResponse(t testing.TB, resp *tailcfg.MapResponse, compression string) []byte {
+	t.Helper()
+
+	jsonBody, err := json.Marshal(resp)
+	require.NoError(t, err)
+
+	switch compression {
+	case util.ZstdCompression:
+		pool := zstdEncoderPool(zstd.SpeedFastest)
+		encoder := pool.Get().(*zstd.Encoder)
+		defer pool.Put(encoder)
+
+		return encoder.EncodeAll(jsonBody, nil)
+	case util.CBORCompression:
+		body, err := cborEncode(jsonBody)
+		require.NoError(t, err)
+
+		return body
+	default:
+		return jsonBody
+	}
+}
+
+func encodeTestResponse(t testing.TB, peerCount int) *tailcfg.MapResponse {
+	t.Helper()
+
+	mappy, node, store, _ := cacheTestMapper(t, 0, peerCount)
+	resp, err := mappy.fullMapResponse(node, store.peers, tailcfg.CurrentCapabilityVersion)
+	require.NoError(t, err)
+
+	return resp
+}
+
+func TestWriteMapResponseMatchesBuffered(t *testing.T) {
+	resp := encodeTestResponse(t, 50)
+
+	decoder, err := zstd.NewReader(nil)
+	require.NoError(t, err)
+	defer decoder.Close()
+
+	jsonBody, err := json.Marshal(resp)
+	require.NoError(t, err)
+
+	// CBOR is converted from the buffered JSON on both paths.
+	for _, compression := range []string{"", util.ZstdCompression} {
+		t.Run(compression, func(t *testing.T) {
+			var streamed bytes.Buffer
+			marshalled, err := writeMapResponse(&streamed, resp, compression, zstd.SpeedFastest)
+			require.NoError(t, err)
+			require.Equal(t, len(jsonBody), marshalled)
+
+			buffered := bufferedMapResponse(t, resp, compression)
+
+			if compression == util.ZstdCompression {
+				// The frames of both are not identical, their content is.
+				got, err := decoder.DecodeAll(streamed.Bytes(), nil)
+				require.NoError(t, err)
+				want, err := decoder.DecodeAll(buffered, nil)
+				require.NoError(t, err)
+				require.Equal(t, want, got)
+
+				return
+			}
+
+			require.Equal(t, buffered, streamed.Bytes())
+		})
+	}
+}
+
+func TestMapResponseMarshalError(t *testing.T) {
+	mappy, node, _ := pipelineTestMapper(t)
+	mappy.db = &staticNodeStore{}
+
+	// Hostinfo.Userspace is an opt.Bool, which fails to marshal unless
+	// it holds a boolean.
+	node.Hostinfo = &tailcfg.Hostinfo{Userspace: "not-a-bool"}
+	resp := &tailcfg.MapResponse{Node: &tailcfg.Node{Hostinfo: node.Hostinfo.View()}}
+
+	for name, compression := range map[string]string{
+		"none": "",
+		"zstd": util.ZstdCompression,
+		"cbor": util.CBORCompression,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := writeMapResponse(io.Discard, resp, compression, zstd.SpeedFastest)
+			require.Error(t, err)
+
+			data, err := mappy.FullMapResponse(tailcfg.MapRequest{Compress: compression}, node)
+			require.Error(t, err)
+			require.Nil(t, data)
+		})
+	}
+}
+
+func TestSetZstdLevel(t *testing.T) {
+	mappy, node, _, generated := cacheTestMapper(t, time.Minute, 200)
+	require.Equal(t, zstd.SpeedFastest, mappy.zstdLevel())
+
+	mapRequest := tailcfg.MapRequest{Compress: util.ZstdCompression}
+	fastest, err := mappy.FullMapResponse(mapRequest, node)
+	require.NoError(t, err)
+	require.Equal(t, 1, *generated)
+
+	mappy.SetZstdLevel(19)
+	require.Equal(t, zstd.SpeedBestCompression, mappy.zstdLevel())
+
+	// The cached response was compressed at the previous level.
+	best, err := mappy.FullMapResponse(mapRequest, node)
+	require.NoError(t, err)
+	require.Equal(t, 2, *generated)
+	require.Less(t, len(best), len(fastest))
+
+	decoder, err := zstd.NewReader(nil)
+	require.NoError(t, err)
+	defer decoder.Close()
+
+	body, err := decoder.DecodeAll(best[reservedResponseHeaderSize:], nil)
+	require.NoError(t, err)
+	var resp tailcfg.MapResponse
+	require.NoError(t, json.Unmarshal(body, &resp))
+	require.Len(t, resp.Peers, 200)
+
+	// Levels mapped to the same encoder level keep the cache.
+	mappy.SetZstdLevel(22)
+	_, err = mappy.FullMapResponse(mapRequest, node)
+	require.NoError(t, err)
+	require.Equal(t, 2, *generated)
+}
+
+func TestNewlineDropper(t *testing.T) {
+	var buf bytes.Buffer
+	w := newlineDropper{&buf}
+
+	for _, chunk := range []string{"{\"a\":", "1}\n", "\n", ""} {
+		n, err := w.Write([]byte(chunk))
+		require.NoError(t, err)
+		require.Equal(t, len(chunk), n)
+	}
+	require.Equal(t, `{"a":1}`, buf.String())
+}
+
+func TestDecodeRequestBody(t *testing.T) {
+	body := []byte(`{"Version":115,"Compress":"zstd","Stream":true}`)
+	compress := func(data []byte) []byte {
+		pool := zstdEncoderPool(zstd.SpeedFastest)
+		encoder := pool.Get().(*zstd.Encoder)
+		defer pool.Put(encoder)
+
+		return encoder.EncodeAll(data, nil)
+	}
+	// hideLen hides the length of the reader, which makes the decoder
+	// decompress streaming instead of all at once.
+	type hideLen struct{ io.Reader }
+
+	bomb := compress(make([]byte, MaxDecodedRequestSize+1))
+	fits := compress(make([]byte, MaxDecodedRequestSize))
+
+	tests := []struct {
+		name        string
+		body        io.Reader
+		compression string
+		want        []byte
+		wantErr     error
+	}{
+		{
+			name: "plain",
+			body: bytes.NewReader(body),
+			want: body,
+		},
+		{
+			name:        "zstd",
+			body:        bytes.NewReader(compress(body)),
+			compression: util.ZstdCompression,
+			want:        body,
+		},
+		{
+			name:        "zstd-streaming",
+			body:        hideLen{bytes.NewReader(compress(body))},
+			compression: util.ZstdCompression,
+			want:        body,
+		},
+		{
+			name:        "zstd-max-size",
+			body:        hideLen{bytes.NewReader(fits)},
+			compression: util.ZstdCompression,
+			want:        make([]byte, MaxDecodedRequestSize),
+		},
+		{
+			name:        "zstd-bomb",
+			body:        bytes.NewReader(bomb),
+			compression: util.ZstdCompression,
+			wantErr:     ErrRequestTooLarge,
+		},
+		{
+			name:        "zstd-bomb-streaming",
+			body:        hideLen{bytes.NewReader(bomb)},
+			compression: util.ZstdCompression,
+			wantErr:     ErrRequestTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeRequestBody(tt.body, tt.compression)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := DecodeRequestBody(bytes.NewReader(body), "gzip")
+	require.Error(t, err)
+
+	_, err = DecodeRequestBody(bytes.NewReader(body), util.ZstdCompression)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrRequestTooLarge)
+}
+
+func BenchmarkWriteMapResponse(b *testing.B) {
+	resp := encodeTestResponse(b, 1000)
+
+	b.Run("buffered", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			body := bufferedMapResponse(b, resp, util.ZstdCompression)
+			data := make([]byte, reservedResponseHeaderSize, reservedResponseHeaderSize+len(body))
+			_ = append(data, body...)
+		}
+	})
+
+	b.Run("streamed", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			var buf bytes.Buffer
+			buf.Write(make([]byte, reservedResponseHeaderSize))
+			if _, err := writeMapResponse(&buf, resp, util.ZstdCompression, zstd.SpeedFastest); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkZstdLevel(b *testing.B) {
+	resp := encodeTestResponse(b, 1000)
+
+	for _, level := range []zstd.EncoderLevel{
+		zstd.SpeedFastest,
+		zstd.SpeedDefault,
+		zstd.SpeedBetterCompression,
+		zstd.SpeedBestCompression,
+	} {
+		b.Run(level.String(), func(b *testing.B) {
+			var buf bytes.Buffer
+			b.ReportAllocs()
+			for range b.N {
+				buf.Reset()
+				if _, err := writeMapResponse(&buf, resp, util.ZstdCompression, level); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(buf.Len()), "bytes/response")
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package mapper
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Map responses are sent to clients as frames: the size of the, possibly
+// compressed, response as a 4 byte little endian integer followed by the
+// response itself.
+
+var (
+	// ErrFrameTooLarge is returned for a response larger than the limit
+	// or than the frame header can hold.
+	ErrFrameTooLarge = errors.New("map response too large for frame header")
+
+	// ErrFrameTruncated is returned for a frame shorter than its header
+	// or the size in its header.
+	ErrFrameTruncated = errors.New("map response frame truncated")
+)
+
+// maxFrameBodySize is the largest size the frame header can hold.
+const maxFrameBodySize = math.MaxUint32
+
+// appendLengthPrefixedFrame appends body as a frame to dst and returns
+// the extended slice. Bodies larger than limit, or than the header can
+// hold, are rejected.
+func appendLengthPrefixedFrame(dst []byte, body []byte, limit uint64) ([]byte, error) {
+	if uint64(len(body)) > min(limit, maxFrameBodySize) {
+		return dst, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(body))
+	}
+
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(body)))
+
+	return append(dst, body...), nil
+}
+
+// readLengthPrefixedFrame reads the frame at the start of data and
+// returns its body and the data following it.
+func readLengthPrefixedFrame(data []byte) ([]byte, []byte, error) {
+	if len(data) < reservedResponseHeaderSize {
+		return nil, nil, ErrFrameTruncated
+	}
+
+	size := uint64(binary.LittleEndian.Uint32(data))
+	data = data[reservedResponseHeaderSize:]
+	if uint64(len(data)) < size {
+		return nil, nil, fmt.Errorf("%w: want %d bytes, have %d", ErrFrameTruncated, size, len(data))
+	}
+
+	return data[:size], data[size:], nil
+}
@@ -0,0 +1,66 @@
+package mapper
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"tailscale.com/tailcfg"
+)
+
+func TestLengthPrefixedFrame(t *testing.T) {
+	bodies := [][]byte{
+		{},
+		[]byte(`{"KeepAlive":true}`),
+		bytes.Repeat([]byte{0xff}, 70000),
+	}
+
+	var data []byte
+	for _, body := range bodies {
+		var err error
+		data, err = appendLengthPrefixedFrame(data, body, maxFrameBodySize)
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, []byte{0, 0, 0, 0, 18, 0, 0, 0}, data[:8])
+
+	for _, want := range bodies {
+		var body []byte
+		var err error
+		body, data, err = readLengthPrefixedFrame(data)
+		require.NoError(t, err)
+		require.Equal(t, want, body)
+	}
+	require.Empty(t, data)
+
+}
+
+func TestLengthPrefixedFrameErrors(t *testing.T) {
+	frame, err := appendLengthPrefixedFrame(nil, []byte("body"), maxFrameBodySize)
+	require.NoError(t, err)
+
+	for _, data := range [][]byte{nil, frame[:3], frame[:len(frame)-1]} {
+		_, _, err := readLengthPrefixedFrame(data)
+		require.ErrorIs(t, err, ErrFrameTruncated)
+	}
+
+	// Bodies larger than the limit are rejected instead of having their
+	// size truncated.
+	_, err = appendLengthPrefixedFrame(nil, []byte("body"), 3)
+	require.ErrorIs(t, err, ErrFrameTooLarge)
+}
+
+func TestMapResponseFrame(t *testing.T) {
+	mappy, node, _ := pipelineTestMapper(t)
+
+	// Map responses are single frames, however they are compressed.
+	for _, compression := range []string{"", "zstd"} {
+		data, err := mappy.KeepAliveResponse(tailcfg.MapRequest{Compress: compression}, node)
+		require.NoError(t, err)
+
+		body, rest, err := readLengthPrefixedFrame(data)
+		require.NoError(t, err)
+		require.Empty(t, rest)
+		require.Len(t, body, len(data)-reservedResponseHeaderSize)
+	}
+}
@@ -0,0 +1,221 @@
+package mapper
+
+import (
+	"slices"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/set"
+)
+
+// PeerEventFunc is called with the ID of the node a map response is
+// generated for and the ID of the peer that was added to or removed
+// from the node's view of the network.
+type PeerEventFunc func(nodeID, peerID types.NodeID)
+
+// OnPeerAdded registers fn to be called when a peer becomes visible
+// to a node. It must be called before the Mapper is used.
+func (m *Mapper) OnPeerAdded(fn PeerEventFunc) {
+	m.onPeerAdded = fn
+}
+
+// OnPeerRemoved registers fn to be called when a peer is no longer
+// visible to a node. It must be called before the Mapper is used.
+func (m *Mapper) OnPeerRemoved(fn PeerEventFunc) {
+	m.onPeerRemoved = fn
+}
+
+// SetQuarantine registers a predicate reporting if a node is quarantined.
+// Quarantined nodes stay connected to the control server but are sent
+// no peers and a packet filter denying all traffic.
+// It must be called before the Mapper is used.
+func (m *Mapper) SetQuarantine(isQuarantined func(*types.Node) bool) {
+	m.isQuarantined = isQuarantined
+}
+
+// SetTagDERPRegions makes nodes with one of the given tags prefer the
+// DERP region the tag maps to as their home region, for example
+// "tag:eu" to region 10. Nodes with several of the tags prefer the
+// region of the first one in sorted order.
+// It must be called before the Mapper is used.
+func (m *Mapper) SetTagDERPRegions(regions map[string]int) {
+	m.tagDERPRegions = regions
+}
+
+// ResponseSizeFunc is called with the node a map response was generated
+// for and the size of the response in bytes.
+type ResponseSizeFunc func(node *types.Node, size int)
+
+// OnOversizedResponse registers fn to be called when a map response of
+// more than budget bytes, after compression, is generated for a node.
+// It must be called before the Mapper is used.
+func (m *Mapper) OnOversizedResponse(budget int, fn ResponseSizeFunc) {
+	m.sizeBudget = budget
+	m.onOversizedResponse = fn
+}
+
+// ResponseHookFunc is called with the node a map response was generated
+// for and the response, right before it is marshalled. It may modify
+// the response.
+type ResponseHookFunc func(node *types.Node, resp *tailcfg.MapResponse)
+
+// SetResponseHook registers fn to make final changes to every map
+// response, as an escape hatch for needs the Mapper does not cover.
+// Cached full responses are marshalled once, fn is not called again
+// when they are sent from the cache.
+// It must be called before the Mapper is used.
+func (m *Mapper) SetResponseHook(fn ResponseHookFunc) {
+	m.responseHook = fn
+}
+
+// PresenceProvider reports the presence of nodes from a source other
+// than the connections to headscale, for example heartbeats.
+type PresenceProvider interface {
+	// Online reports if the node with the given ID is online. If ok is
+	// false the provider does not know the node.
+	Online(nodeID types.NodeID) (online bool, ok bool)
+}
+
+// SetPresenceProvider registers p to decide if nodes are online. Nodes
+// p does not know are online while they are connected to headscale,
+// which is also used for all nodes without a provider.
+// It must be called before the Mapper is used.
+func (m *Mapper) SetPresenceProvider(p PresenceProvider) {
+	m.presence = p
+}
+
+// online reports if the node with the given ID is online.
+func (m *Mapper) online(nodeID types.NodeID) bool {
+	if m.presence != nil {
+		if online, ok := m.presence.Online(nodeID); ok {
+			return online
+		}
+	}
+
+	return m.notif.IsLikelyConnected(nodeID)
+}
+
+// presencePatches returns patches with the online status of the peers
+// replaced by the one of the presence provider, if it knows them.
+func (m *Mapper) presencePatches(patches []*tailcfg.PeerChange) []*tailcfg.PeerChange {
+	if m.presence == nil {
+		return patches
+	}
+
+	replaced := make([]*tailcfg.PeerChange, len(patches))
+	for i, patch := range patches {
+		replaced[i] = patch
+		if patch.Online == nil {
+			continue
+		}
+
+		if online, ok := m.presence.Online(types.NodeID(patch.NodeID)); ok && online != *patch.Online {
+			changed := *patch
+			changed.Online = &online
+			replaced[i] = &changed
+		}
+	}
+
+	return replaced
+}
+
+func (m *Mapper) quarantined(node *types.Node) bool {
+	return m.isQuarantined != nil && m.isQuarantined(node)
+}
+
+// dnsDisabled reports if the node does not use the DNS configuration
+// pushed by the control server, see types.MapperConfig.DNSDisabled.
+func (m *Mapper) dnsDisabled(node *types.Node) bool {
+	return nodeMatchesAny(node, nodeTags(node, m.polMan), m.cfg.Mapper.DNSDisabled)
+}
+
+// quarantineResponse strips everything from resp that would allow a
+// quarantined node to reach or learn about other nodes.
+func quarantineResponse(resp *tailcfg.MapResponse) {
+	if resp.Peers != nil {
+		resp.Peers = []*tailcfg.Node{}
+	}
+	resp.PeersChanged = nil
+	resp.PeersChangedPatch = nil
+	resp.UserProfiles = slices.DeleteFunc(resp.UserProfiles, func(profile tailcfg.UserProfile) bool {
+		return resp.Node == nil || profile.ID != resp.Node.User
+	})
+	resp.SSHPolicy = nil
+	resp.PacketFilter = nil
+	resp.PacketFilters = map[string][]tailcfg.FilterRule{
+		"base": {},
+	}
+}
+
+func (m *Mapper) hasPeerHooks() bool {
+	return m.onPeerAdded != nil || m.onPeerRemoved != nil
+}
+
+// trackPeers updates the set of peers known to be visible to the node
+// from the peers in resp and calls the peer hooks for every peer that
+// was added or removed.
+// The peers are only tracked if any hooks are registered.
+func (m *Mapper) trackPeers(nodeID types.NodeID, resp *tailcfg.MapResponse) {
+	if !m.hasPeerHooks() {
+		return
+	}
+
+	m.knownPeersMu.Lock()
+	known, ok := m.knownPeers[nodeID]
+	if !ok {
+		known = set.Set[types.NodeID]{}
+	}
+
+	var added, removed []types.NodeID
+
+	if resp.Peers != nil {
+		current := make(set.Set[types.NodeID], len(resp.Peers))
+		for _, peer := range resp.Peers {
+			current.Add(types.NodeID(peer.ID))
+		}
+
+		for id := range current {
+			if !known.Contains(id) {
+				added = append(added, id)
+			}
+		}
+		for id := range known {
+			if !current.Contains(id) {
+				removed = append(removed, id)
+			}
+		}
+
+		known = current
+	}
+
+	for _, peer := range resp.PeersChanged {
+		id := types.NodeID(peer.ID)
+		if !known.Contains(id) {
+			added = append(added, id)
+			known.Add(id)
+		}
+	}
+
+	for _, peerID := range resp.PeersRemoved {
+		id := types.NodeID(peerID)
+		if known.Contains(id) {
+			removed = append(removed, id)
+			known.Delete(id)
+		}
+	}
+
+	m.knownPeers[nodeID] = known
+	m.knownPeersMu.Unlock()
+
+	for _, id := range added {
+		if m.onPeerAdded != nil {
+			m.onPeerAdded(nodeID, id)
+		}
+	}
+
+	for _, id := range removed {
+		if m.onPeerRemoved != nil {
+			m.onPeerRemoved(nodeID, id)
+		}
+	}
+}
@@ -1,21 +1,29 @@
 package mapper
 
 import (
-	"encoding/binary"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
+	"maps"
+	"math/rand/v2"
 	"net/netip"
 	"net/url"
 	"os"
 	"path"
 	"slices"
-	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/juanfont/headscale/hscontrol/capver"
 	"github.com/juanfont/headscale/hscontrol/db"
 	"github.com/juanfont/headscale/hscontrol/notifier"
 	"github.com/juanfont/headscale/hscontrol/policy"
@@ -25,9 +33,9 @@ import (
 	"github.com/klauspost/compress/zstd"
 	"github.com/rs/zerolog/log"
 	"tailscale.com/envknob"
-	"tailscale.com/smallzstd"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/dnstype"
+	"tailscale.com/util/set"
 )
 
 const (
@@ -39,6 +47,21 @@ const (
 
 var debugDumpMapResponsePath = envknob.String("HEADSCALE_DEBUG_DUMP_MAPRESPONSE_PATH")
 
+var ErrMapResponseTimeout = errors.New("map response generation timed out")
+
+// nodeStore is the subset of the database the Mapper reads nodes from.
+type nodeStore interface {
+	ListPeers(nodeID types.NodeID, peerIDs ...types.NodeID) (types.Nodes, error)
+	ListNodes(nodeIDs ...types.NodeID) (types.Nodes, error)
+}
+
+// contextNodeStore is implemented by node stores able to cancel a query
+// when its context is done, like when generating a map response takes
+// longer than allowed.
+type contextNodeStore interface {
+	ListPeersContext(ctx context.Context, nodeID types.NodeID, peerIDs ...types.NodeID) (types.Nodes, error)
+}
+
 // TODO: Optimise
 // As this work continues, the idea is that there will be one Mapper instance
 // per node, attached to the open stream between the control and client.
@@ -53,16 +76,72 @@ var debugDumpMapResponsePath = envknob.String("HEADSCALE_DEBUG_DUMP_MAPRESPONSE_
 type Mapper struct {
 	// Configuration
 	// TODO(kradalby): figure out if this is the format we want this in
-	db      *db.HSDatabase
+	db      nodeStore
 	cfg     *types.Config
-	derpMap *tailcfg.DERPMap
 	notif   *notifier.Notifier
 	polMan  policy.PolicyManager
 	primary *routes.PrimaryRoutes
 
+	// derpMap is replaced by SetDERPMap while responses are generated.
+	derpMap atomic.Pointer[tailcfg.DERPMap]
+
 	uid     string
 	created time.Time
 	seq     uint64
+
+	// now returns the current time, it is fixed when replaying
+	// recorded requests.
+	now func() time.Time
+
+	onPeerAdded         PeerEventFunc
+	onPeerRemoved       PeerEventFunc
+	isQuarantined       func(*types.Node) bool
+	onOversizedResponse ResponseSizeFunc
+	responseHook        ResponseHookFunc
+	presence            PresenceProvider
+	tagDERPRegions      map[string]int
+	sizeBudget          int
+
+	// knownPeers holds the peers visible to each node in the last
+	// map response, it is only maintained when peer hooks are set.
+	knownPeersMu sync.Mutex
+	knownPeers   map[types.NodeID]set.Set[types.NodeID]
+
+	// derpMapSent holds when the DERP map was last sent to each node,
+	// it is only maintained when DERP map updates are throttled.
+	// derpMapPending holds the nodes a throttled DERP map update is
+	// still to be sent to.
+	derpMapSentMu  sync.Mutex
+	derpMapSent    map[types.NodeID]time.Time
+	derpMapPending map[types.NodeID]bool
+
+	middlewares []Middleware
+
+	// lockdown is set while all nodes are locked down, see SetLockdown.
+	// lockdownShown holds the nodes sent the lockdown health message
+	// and not yet the message restoring their health.
+	lockdown        atomic.Bool
+	lockdownShownMu sync.Mutex
+	lockdownShown   set.Set[types.NodeID]
+
+	// encoderLevel holds the zstd.EncoderLevel of compressed responses,
+	// see SetZstdLevel.
+	encoderLevel atomic.Int64
+
+	// cache is nil if response caching is disabled.
+	cache *responseCache
+
+	// tailNodes is nil if peers are converted for every response.
+	tailNodes *tailNodeCache
+
+	// peerSnapshots is nil if full updates are sent with all peers.
+	peerSnapshots *peerSnapshots
+
+	dnsVersions *dnsVersions
+
+	sentHashes *sentHashes
+
+	names *nameIndex
 }
 
 type patch struct {
@@ -80,10 +159,24 @@ func NewMapper(
 ) *Mapper {
 	uid, _ := util.GenerateRandomStringDNSSafe(mapperIDLength)
 
-	return &Mapper{
+	var cache *responseCache
+	if cfg.Tuning.MapResponseCacheTTL > 0 {
+		cache = newResponseCache(cfg.Tuning.MapResponseCacheTTL)
+	}
+
+	var tailNodes *tailNodeCache
+	if cfg.Tuning.TailNodeCache {
+		tailNodes = newTailNodeCache()
+	}
+
+	var snapshots *peerSnapshots
+	if cfg.Mapper.DeltaFullUpdates {
+		snapshots = newPeerSnapshots(cfg.Mapper.DeltaMaxAge)
+	}
+
+	m := &Mapper{
 		db:      db,
 		cfg:     cfg,
-		derpMap: derpMap,
 		notif:   notif,
 		polMan:  polMan,
 		primary: primary,
@@ -91,41 +184,202 @@ func NewMapper(
 		uid:     uid,
 		created: time.Now(),
 		seq:     0,
+		now:     time.Now,
+
+		knownPeers:     make(map[types.NodeID]set.Set[types.NodeID]),
+		derpMapSent:    make(map[types.NodeID]time.Time),
+		derpMapPending: make(map[types.NodeID]bool),
+		lockdownShown:  make(set.Set[types.NodeID]),
+
+		cache:         cache,
+		tailNodes:     tailNodes,
+		peerSnapshots: snapshots,
+		dnsVersions:   newDNSVersions(),
+		sentHashes:    newSentHashes(),
+		names:         newNameIndex(),
+	}
+	m.derpMap.Store(derpMap)
+	m.encoderLevel.Store(int64(zstd.EncoderLevelFromZstd(cfg.Mapper.ZstdLevel)))
+
+	return m
+}
+
+// lockdownMessage is the health message shown by clients of locked down
+// nodes.
+const lockdownMessage = "This tailnet is locked down by the administrator, all connections to other nodes are blocked."
+
+// SetLockdown locks down or releases all nodes. While locked down every
+// map response only contains the node itself, no peers and a packet
+// filter denying all traffic, together with a health message shown by
+// the clients. It can be called at any time, callers should send a
+// full update to all nodes afterwards to apply the change.
+// After the lockdown is released the first response sent to each node
+// restores the health of the client, see restoresHealth.
+func (m *Mapper) SetLockdown(lockdown bool) {
+	if m.lockdown.Swap(lockdown) != lockdown {
+		m.InvalidateResponseCache()
+	}
+}
+
+// SetZstdLevel changes the standard zstd compression level (1 to 22) of
+// compressed map responses, see types.MapperConfig.ZstdLevel. It can be
+// called at any time, responses generated afterwards use the new level.
+func (m *Mapper) SetZstdLevel(level int) {
+	encoderLevel := int64(zstd.EncoderLevelFromZstd(level))
+	if m.encoderLevel.Swap(encoderLevel) != encoderLevel {
+		m.InvalidateResponseCache()
+	}
+}
+
+// zstdLevel returns the encoder level of compressed map responses.
+func (m *Mapper) zstdLevel() zstd.EncoderLevel {
+	return zstd.EncoderLevel(m.encoderLevel.Load())
+}
+
+// restrictedResponse restricts resp like quarantineResponse and adds
+// the health message shown by the client.
+func restrictedResponse(resp *tailcfg.MapResponse, message string) {
+	quarantineResponse(resp)
+	resp.Health = []string{message}
+}
+
+// healthRestoringResponse marshals a MapResponse with an empty, but
+// non-nil, Health restoring the health of the client. The Health of
+// tailcfg.MapResponse is omitted when empty, which leaves the health
+// messages of the client unchanged.
+type healthRestoringResponse struct {
+	*tailcfg.MapResponse
+	Health []string
+}
+
+// restoresHealth reports if resp, about to be sent to the node, has to
+// restore the health of the client as it is the first response without
+// the lockdown health message since the lockdown was released. Only
+// responses setting no other health messages restore it.
+func (m *Mapper) restoresHealth(nodeID types.NodeID, resp *tailcfg.MapResponse) bool {
+	m.lockdownShownMu.Lock()
+	defer m.lockdownShownMu.Unlock()
+
+	if slices.Contains(resp.Health, lockdownMessage) {
+		m.lockdownShown.Add(nodeID)
+
+		return false
+	}
+
+	if m.lockdown.Load() || !m.lockdownShown.Contains(nodeID) {
+		return false
+	}
+	m.lockdownShown.Delete(nodeID)
+
+	return resp.Health == nil
+}
+
+// unsupportedVersion reports if clients with the capability version are
+// older than the configured minimum, see
+// types.MapperConfig.MinCapabilityVersion.
+func (m *Mapper) unsupportedVersion(capVer tailcfg.CapabilityVersion) bool {
+	return capVer < m.cfg.Mapper.MinCapabilityVersion
+}
+
+// unsupportedVersionMessage returns the health message shown by clients
+// older than the configured minimum capability version.
+func (m *Mapper) unsupportedVersionMessage() string {
+	minVersion := capver.TailscaleVersion(m.cfg.Mapper.MinCapabilityVersion)
+	if minVersion == "" {
+		minVersion = fmt.Sprintf("a version with capability version %d", m.cfg.Mapper.MinCapabilityVersion)
+	}
+
+	return fmt.Sprintf("This Tailscale version is not supported by the control server anymore, all connections to other nodes are blocked. Upgrade to %s or later.", minVersion)
+}
+
+// unsupportedFeatureMessages are the health messages shown by clients
+// requesting a feature the server does not support, see
+// types.MapperConfig.UnsupportedFeatures.
+var unsupportedFeatureMessages = map[string]string{
+	types.FeatureTailnetLock:   "Tailnet lock is not supported by the control server, node keys are not verified against the tailnet key authority.",
+	types.FeatureSessionResume: "Resuming map sessions is not supported by the control server, every connection starts a new session.",
+	types.FeatureFunnel:        "Funnel is not supported by the control server, services of this node are not reachable from the internet.",
+	types.FeatureAppConnector:  "App connectors are not supported by the control server, the routes of the configured domains are not advertised.",
+}
+
+// requestsFeature reports if the node requests the feature, out of the
+// types.Feature constants, in mapRequest or its current Hostinfo.
+func requestsFeature(mapRequest tailcfg.MapRequest, node *types.Node, feature string) bool {
+	hostinfo := node.Hostinfo
+	if hostinfo == nil {
+		hostinfo = &tailcfg.Hostinfo{}
+	}
+
+	switch feature {
+	case types.FeatureTailnetLock:
+		return mapRequest.TKAHead != ""
+	case types.FeatureSessionResume:
+		return mapRequest.MapSessionHandle != ""
+	case types.FeatureFunnel:
+		return hostinfo.IngressEnabled || hostinfo.WireIngress
+	case types.FeatureAppConnector:
+		return hostinfo.AppConnector.EqualBool(true)
+	}
+
+	return false
+}
+
+// unsupportedFeatureHealth returns the health messages of the node for
+// the unsupported features it requests.
+func (m *Mapper) unsupportedFeatureHealth(mapRequest tailcfg.MapRequest, node *types.Node) []string {
+	var health []string
+	for _, feature := range m.cfg.Mapper.UnsupportedFeatures {
+		if requestsFeature(mapRequest, node, feature) {
+			health = append(health, unsupportedFeatureMessages[feature])
+		}
 	}
+
+	return health
+}
+
+// addUnsupportedFeatureHealth adds the health messages of the unsupported
+// features the node requests to resp, after any set before. Messages
+// can not be cleared, an empty Health is not marshalled, they are shown
+// until the client receives other messages or restarts.
+func (m *Mapper) addUnsupportedFeatureHealth(resp *tailcfg.MapResponse, mapRequest tailcfg.MapRequest, node *types.Node) {
+	resp.Health = append(resp.Health, m.unsupportedFeatureHealth(mapRequest, node)...)
 }
 
 func (m *Mapper) String() string {
 	return fmt.Sprintf("Mapper: { seq: %d, uid: %s, created: %s }", m.seq, m.uid, m.created)
 }
 
+// generateUserProfiles returns the profiles of the owners of node and
+// its peers, sorted by ID. Tagged nodes are represented by the profile
+// of their tag, orphaned nodes by the configured orphan user or none.
 func generateUserProfiles(
 	node *types.Node,
 	peers types.Nodes,
+	polMan policy.PolicyManager,
+	cfg *types.Config,
 ) []tailcfg.UserProfile {
-	userMap := make(map[uint]*types.User)
-	ids := make([]uint, 0, len(userMap))
-	userMap[node.User.ID] = &node.User
-	ids = append(ids, node.User.ID)
-	for _, peer := range peers {
-		userMap[peer.User.ID] = &peer.User
-		ids = append(ids, peer.User.ID)
+	profileMap := make(map[tailcfg.UserID]tailcfg.UserProfile)
+	for _, n := range append(types.Nodes{node}, peers...) {
+		if profile, ok := nodeUserProfile(n, nodeTags(n, polMan), cfg); ok {
+			profileMap[profile.ID] = profile
+		}
 	}
 
-	slices.Sort(ids)
-	ids = slices.Compact(ids)
-	var profiles []tailcfg.UserProfile
+	ids := slices.Sorted(maps.Keys(profileMap))
+	profiles := make([]tailcfg.UserProfile, 0, len(ids))
 	for _, id := range ids {
-		if userMap[id] != nil {
-			profiles = append(profiles, userMap[id].TailscaleUserProfile())
-		}
+		profiles = append(profiles, profileMap[id])
 	}
 
 	return profiles
 }
 
+// generateDNSConfig returns the DNS configuration of the node, tags are
+// the tags of the node as computed by nodeTags.
 func generateDNSConfig(
 	cfg *types.Config,
 	node *types.Node,
+	tags []string,
 ) *tailcfg.DNSConfig {
 	if cfg.TailcfgDNSConfig == nil {
 		return nil
@@ -133,33 +387,290 @@ func generateDNSConfig(
 
 	dnsConfig := cfg.TailcfgDNSConfig.Clone()
 
-	addNextDNSMetadata(dnsConfig.Resolvers, node)
+	addDoHMetadata(dnsConfig.Resolvers, cfg.Mapper.DoHMetadata, node)
+	addRegionBaseDomains(dnsConfig, cfg, node)
+	addUserSearchDomains(dnsConfig, cfg, node, tags)
 
 	return dnsConfig
 }
 
-// If any nextdns DoH resolvers are present in the list of resolvers it will
-// take metadata from the node metadata and instruct tailscale to add it
-// to the requests. This makes it possible to identify from which device the
-// requests come in the NextDNS dashboard.
+// baseDomain returns the base domain of the node, which is overridden
+// by the base domain of its preferred DERP region if one is configured.
+func baseDomain(cfg *types.Config, node *types.Node) string {
+	if node.Hostinfo != nil && node.Hostinfo.NetInfo != nil {
+		if domain, ok := cfg.Mapper.RegionBaseDomains[node.Hostinfo.NetInfo.PreferredDERP]; ok {
+			return domain
+		}
+	}
+
+	return cfg.BaseDomain
+}
+
+// addUserSearchDomains adds the search domains configured for the user
+// owning the node, or for the tags of a tagged node, skipping those
+// already present.
+func addUserSearchDomains(dnsConfig *tailcfg.DNSConfig, cfg *types.Config, node *types.Node, tags []string) {
+	var domains []string
+	if len(tags) > 0 {
+		// Sorted, for the same order of domains however the tags are
+		// ordered.
+		for _, tag := range slices.Sorted(slices.Values(tags)) {
+			domains = append(domains, cfg.Mapper.TaggedSearchDomains[strings.ToLower(tag)]...)
+		}
+	} else {
+		domains = cfg.Mapper.UserSearchDomains[strings.ToLower(node.User.Name)]
+	}
+
+	for _, domain := range domains {
+		if !slices.Contains(dnsConfig.Domains, domain) {
+			dnsConfig.Domains = append(dnsConfig.Domains, domain)
+		}
+	}
+}
+
+// addRegionBaseDomains makes the node search its own base domain instead
+// of the global one and, with MagicDNS, resolve the names of peers under
+// all other base domains.
+func addRegionBaseDomains(dnsConfig *tailcfg.DNSConfig, cfg *types.Config, node *types.Node) {
+	if len(cfg.Mapper.RegionBaseDomains) == 0 {
+		return
+	}
+
+	domain := baseDomain(cfg, node)
+	for i, d := range dnsConfig.Domains {
+		if d == cfg.BaseDomain {
+			dnsConfig.Domains[i] = domain
+		}
+	}
+
+	if !dnsConfig.Proxied {
+		return
+	}
+
+	for _, other := range append(slices.Collect(maps.Values(cfg.Mapper.RegionBaseDomains)), cfg.BaseDomain) {
+		if other == "" || other == domain {
+			continue
+		}
+
+		if dnsConfig.Routes == nil {
+			dnsConfig.Routes = make(map[string][]*dnstype.Resolver)
+		}
+
+		// An existing split DNS route for the domain is kept.
+		if _, ok := dnsConfig.Routes[other]; !ok {
+			dnsConfig.Routes[other] = nil
+		}
+	}
+}
+
+// filterDERPMap returns a copy of derpMap only containing the allowed
+// regions. If no regions are listed, derpMap is returned unchanged.
+func filterDERPMap(derpMap *tailcfg.DERPMap, allowed []int) *tailcfg.DERPMap {
+	if derpMap == nil || len(allowed) == 0 {
+		return derpMap
+	}
+
+	return keepDERPRegions(derpMap, allowed)
+}
+
+// keepDERPRegions returns a copy of derpMap only containing the given
+// regions.
+func keepDERPRegions(derpMap *tailcfg.DERPMap, allowed []int) *tailcfg.DERPMap {
+	filtered := derpMap.Clone()
+	maps.DeleteFunc(filtered.Regions, func(id int, _ *tailcfg.DERPRegion) bool {
+		return !slices.Contains(allowed, id)
+	})
+
+	if filtered.HomeParams != nil {
+		maps.DeleteFunc(filtered.HomeParams.RegionScore, func(id int, _ float64) bool {
+			return !slices.Contains(allowed, id)
+		})
+	}
+
+	return filtered
+}
+
+// restrictDERPMap returns a copy of derpMap only containing the regions
+// the node, with the given tags, is restricted to by restrictions, see
+// types.MapperConfig.DERPRegionRestrictions. Nodes without restrictions
+// get derpMap unchanged.
+func restrictDERPMap(
+	node *types.Node,
+	tags []string,
+	derpMap *tailcfg.DERPMap,
+	restrictions map[string][]int,
+) *tailcfg.DERPMap {
+	if derpMap == nil {
+		return nil
+	}
+
+	var allowed []int
+	restricted := false
+
+	for entry, regions := range restrictions {
+		if !nodeMatchesFold(node, tags, entry) {
+			continue
+		}
+
+		if !restricted {
+			allowed = slices.Clone(regions)
+			restricted = true
+
+			continue
+		}
+
+		allowed = slices.DeleteFunc(allowed, func(id int) bool {
+			return !slices.Contains(regions, id)
+		})
+	}
+
+	if !restricted {
+		return derpMap
+	}
+
+	return keepDERPRegions(derpMap, allowed)
+}
+
+// preferredRegionScore is the DERP region score making clients prefer
+// a region as their home region, see tailcfg.DERPHomeParams.
+const preferredRegionScore = 0.01
+
+// nodeDERPMap returns the DERP map sent to the node, with the regions
+// allowed for all nodes and the node only and the home region preferred
+// by its tags.
+func (m *Mapper) nodeDERPMap(node *types.Node, derpMap *tailcfg.DERPMap) *tailcfg.DERPMap {
+	derpMap = filterDERPMap(derpMap, m.cfg.Mapper.DERPAllowedRegions)
+	if len(m.cfg.Mapper.DERPRegionRestrictions) > 0 {
+		derpMap = restrictDERPMap(node, nodeTags(node, m.polMan), derpMap, m.cfg.Mapper.DERPRegionRestrictions)
+	}
+	if derpMap == nil || len(m.tagDERPRegions) == 0 {
+		return derpMap
+	}
+
+	region, ok := m.tagDERPRegion(node)
+	if ok && derpMap.Regions[region] == nil {
+		ok = false
+	}
+
+	// A missing HomeParams keeps the scores of an earlier DERP map, an
+	// empty one resets them when the node lost its tag.
+	if !ok && derpMap.HomeParams != nil {
+		return derpMap
+	}
+
+	preferred := derpMap.Clone()
+	if preferred.HomeParams == nil {
+		preferred.HomeParams = &tailcfg.DERPHomeParams{}
+	}
+	if preferred.HomeParams.RegionScore == nil {
+		preferred.HomeParams.RegionScore = make(map[int]float64)
+	}
+	if ok {
+		preferred.HomeParams.RegionScore[region] = preferredRegionScore
+	}
+
+	return preferred
+}
+
+// tagDERPRegion returns the DERP region preferred by the tags of the
+// node, if any.
+func (m *Mapper) tagDERPRegion(node *types.Node) (int, bool) {
+	tags := nodeTags(node, m.polMan)
+	slices.Sort(tags)
+
+	for _, tag := range tags {
+		if region, ok := m.tagDERPRegions[tag]; ok {
+			return region, true
+		}
+	}
+
+	return 0, false
+}
+
+// DNSConfigFor returns the DNS configuration that is sent to the given
+// node as part of a full MapResponse, including the NextDNS metadata.
+// It is intended to help operators debug what a node receives.
+func (m *Mapper) DNSConfigFor(node *types.Node) *tailcfg.DNSConfig {
+	return generateDNSConfig(m.cfg, node, nodeTags(node, m.polMan))
+}
+
+// nextDNSMetadata is the built-in metadata of NextDNS resolvers. It
+// makes it possible to identify from which device the requests come in
+// the NextDNS dashboard, producing a resolver like:
+// `https://dns.nextdns.io/<nextdns-id>?device_id=1&device_ip=100.64.0.1&device_model=linux+6.1&device_name=node-name`
 //
-// This will produce a resolver like:
-// `https://dns.nextdns.io/<nextdns-id>?device_name=node-name&device_model=linux&device_ip=100.64.0.1`
-func addNextDNSMetadata(resolvers []*dnstype.Resolver, node *types.Node) {
+// The device ID is the node ID, which survives renames and key rotations.
+var nextDNSMetadata = types.DoHMetadataResolver{
+	Prefix: nextDNSDoHPrefix,
+	Params: []types.DoHMetadataParam{
+		{Name: "device_id", Value: "{device_id}"},
+		{Name: "device_name", Value: "{device_name}"},
+		{Name: "device_model", Value: "{device_model}"},
+		{Name: "device_ip", Value: "{device_ip}"},
+	},
+}
+
+// addDoHMetadata adds metadata about the node to the URL of the DNS over
+// HTTPS resolvers matching one of the configured prefixes or the
+// built-in NextDNS prefix, instructing tailscale to send it with the
+// requests. The first matching prefix is used. Parameters already
+// present in the resolver URL are kept as they are.
+func addDoHMetadata(resolvers []*dnstype.Resolver, configured []types.DoHMetadataResolver, node *types.Node) {
+	var replacer *strings.Replacer
+
 	for _, resolver := range resolvers {
-		if strings.HasPrefix(resolver.Addr, nextDNSDoHPrefix) {
-			attrs := url.Values{
-				"device_name":  []string{node.Hostname},
-				"device_model": []string{node.Hostinfo.OS},
-			}
+		idx := slices.IndexFunc(configured, func(doh types.DoHMetadataResolver) bool {
+			return strings.HasPrefix(resolver.Addr, doh.Prefix)
+		})
 
-			if len(node.IPs()) > 0 {
-				attrs.Add("device_ip", node.IPs()[0].String())
-			}
+		var doh types.DoHMetadataResolver
+		switch {
+		case idx >= 0:
+			doh = configured[idx]
+		case strings.HasPrefix(resolver.Addr, nextDNSDoHPrefix):
+			doh = nextDNSMetadata
+		default:
+			continue
+		}
 
-			resolver.Addr = fmt.Sprintf("%s?%s", resolver.Addr, attrs.Encode())
+		resolverURL, err := url.Parse(resolver.Addr)
+		if err != nil {
+			continue
+		}
+
+		if replacer == nil {
+			replacer = dohMetadataReplacer(node)
+		}
+
+		query := resolverURL.Query()
+		for _, param := range doh.Params {
+			if value := replacer.Replace(param.Value); value != "" && !query.Has(param.Name) {
+				query.Set(param.Name, value)
+			}
 		}
+		resolverURL.RawQuery = query.Encode()
+
+		resolver.Addr = resolverURL.String()
+	}
+}
+
+// dohMetadataReplacer returns a replacer filling in the
+// types.DoHMetadataPlaceholders with the metadata of the node.
+func dohMetadataReplacer(node *types.Node) *strings.Replacer {
+	var model, ip string
+	if node.Hostinfo != nil {
+		model = strings.TrimSpace(node.Hostinfo.OS + " " + node.Hostinfo.OSVersion)
 	}
+	if len(node.IPs()) > 0 {
+		ip = node.IPs()[0].String()
+	}
+
+	return strings.NewReplacer(
+		"{device_id}", node.ID.String(),
+		"{device_name}", node.Hostname,
+		"{device_model}", model,
+		"{device_ip}", ip,
+	)
 }
 
 // fullMapResponse creates a complete MapResponse for a node.
@@ -169,26 +680,34 @@ func (m *Mapper) fullMapResponse(
 	peers types.Nodes,
 	capVer tailcfg.CapabilityVersion,
 ) (*tailcfg.MapResponse, error) {
-	resp, err := m.baseWithConfigMapResponse(node, capVer)
-	if err != nil {
-		return nil, err
+	mc := &MapContext{
+		Node:   node,
+		CapVer: capVer,
+		Peers:  peers,
 	}
 
-	err = appendPeerChanges(
-		resp,
-		true, // full change
-		m.polMan,
-		m.primary,
-		node,
-		capVer,
-		peers,
-		m.cfg,
-	)
-	if err != nil {
+	if err := m.buildFullMapResponse(mc); err != nil {
 		return nil, err
 	}
+	mc.commit()
 
-	return resp, nil
+	return mc.Response, nil
+}
+
+// buildFullMapResponse runs the pipeline for mc. The caller commits mc
+// once it uses the response.
+func (m *Mapper) buildFullMapResponse(mc *MapContext) error {
+	if err := m.runPipeline(mc); err != nil {
+		return err
+	}
+
+	if debugValidateMapResponse {
+		if err := validateMapResponse(mc.Response); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // FullMapResponse returns a MapResponse for the given node.
@@ -197,17 +716,275 @@ func (m *Mapper) FullMapResponse(
 	node *types.Node,
 	messages ...string,
 ) ([]byte, error) {
-	peers, err := m.ListPeers(node.ID)
+	return m.fullMapResponseData(mapRequest, node, false, messages...)
+}
+
+// FullMapUpdateResponse returns a MapResponse for the given node updating
+// the responses sent earlier in the same map session. The DERP map, and
+// if types.MapperConfig.OmitUnchangedFields is enabled the DNS
+// configuration, domain, packet filter and SSH policy, are left out if
+// they did not change since they were last sent to the node.
+// If types.MapperConfig.DeltaFullUpdates is enabled and the peers sent
+// to the node before are known, only the peers that changed or were
+// removed are sent.
+func (m *Mapper) FullMapUpdateResponse(
+	mapRequest tailcfg.MapRequest,
+	node *types.Node,
+	messages ...string,
+) ([]byte, error) {
+	return m.fullMapResponseData(mapRequest, node, true, messages...)
+}
+
+func (m *Mapper) fullMapResponseData(
+	mapRequest tailcfg.MapRequest,
+	node *types.Node,
+	update bool,
+	messages ...string,
+) ([]byte, error) {
+	defer observeDuration("full", time.Now())
+
+	var (
+		key      cacheKey
+		cacheHit bool
+		peers    types.Nodes
+		mc       *MapContext
+	)
+
+	// Only streaming map sessions receive updates.
+	update = update && mapRequest.Stream
+	delta := update && m.peerSnapshots != nil && m.peerSnapshots.has(node.ID, m.now())
+
+	resp, err := m.withGenerationTimeout(func(ctx context.Context) (*tailcfg.MapResponse, error) {
+		var err error
+		peers, err = m.listPeers(ctx, node.ID)
+		if err != nil {
+			return nil, withOutcome(outcomeDBError, err)
+		}
+
+		if debugRecordMapRequestPath != "" {
+			m.recordRequest(mapRequest, node, peers)
+		}
+
+		// Cached responses always contain all peers. Messages are
+		// not part of the cache key, responses with messages are
+		// always generated.
+		if m.cache != nil && !delta && len(messages) == 0 {
+			key, err = m.responseCacheKey(mapRequest, node, peers)
+			if err != nil {
+				return nil, withOutcome(outcomeMarshalError, err)
+			}
+
+			if cached, ok := m.cache.get(node.ID, key); ok {
+				cacheHit = true
+				cached.ControlTime = m.controlTime()
+
+				return cached, nil
+			}
+		}
+
+		mc = &MapContext{
+			Node:   node,
+			CapVer: mapRequest.Version,
+			Peers:  peers,
+			ctx:    ctx,
+		}
+		if err := m.buildFullMapResponse(mc); err != nil {
+			return nil, err
+		}
+
+		return mc.Response, nil
+	})
+	if err != nil {
+		return nil, countOutcome("full", err)
+	}
+
+	// Only a response that is sent changes the state kept for the
+	// node, generations given up on at the deadline do not.
+	if mc != nil {
+		mc.commit()
+	}
+
+	// Cached responses already contain the health messages.
+	if !cacheHit {
+		m.addUnsupportedFeatureHealth(resp, mapRequest, node)
+	}
+	m.trackPeers(node.ID, resp)
+
+	if m.peerSnapshots != nil && mapRequest.Stream {
+		m.peerSnapshots.update(node.ID, resp, delta, m.now())
+	}
+
+	// Cached responses always contain all fields.
+	cacheable := m.cache != nil && !delta && !cacheHit && len(messages) == 0
+	if mapRequest.Stream {
+		m.sentHashes.touch(node.ID, m.now())
+	}
+	if mapRequest.Stream && m.omitUnchanged(node.ID, resp, update) {
+		cacheable = false
+	}
+	if cacheable {
+		m.cache.set(node.ID, key, resp, peers)
+	}
+
+	data, err := m.marshalMapResponse(mapRequest, resp, node, mapRequest.Compress, messages...)
+
+	payload := payloadFull
+	if delta {
+		payload = payloadDelta
+	}
+	countPayload(payload, node.ID, err)
+
+	return data, countOutcome("full", err)
+}
+
+// SimulateRequest returns the full MapResponse the node with the given
+// ID would receive from an up to date client, without sending it or
+// updating any state of the Mapper. If polMan is not nil it is used
+// instead of the current policy to preview the effect of a new policy.
+// It is intended for debugging.
+func (m *Mapper) SimulateRequest(
+	nodeID types.NodeID,
+	polMan policy.PolicyManager,
+) (*tailcfg.MapResponse, error) {
+	nodes, err := m.ListNodes(nodeID)
 	if err != nil {
 		return nil, err
 	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("%w: %d", db.ErrNodeNotFound, nodeID)
+	}
 
-	resp, err := m.fullMapResponse(node, peers, mapRequest.Version)
+	peers, err := m.ListPeers(nodeID)
 	if err != nil {
 		return nil, err
 	}
 
-	return m.marshalMapResponse(mapRequest, resp, node, mapRequest.Compress, messages...)
+	sim := m.simulation(polMan)
+
+	return sim.fullMapResponse(nodes[0], peers, tailcfg.CurrentCapabilityVersion)
+}
+
+// derpMapDue reports if a DERP map update may be sent to the node, it
+// is not if the node was sent one within Tuning.DERPMapMinInterval.
+func (m *Mapper) derpMapDue(nodeID types.NodeID) bool {
+	interval := m.cfg.Tuning.DERPMapMinInterval
+	if interval <= 0 {
+		return true
+	}
+
+	m.derpMapSentMu.Lock()
+	defer m.derpMapSentMu.Unlock()
+
+	sent, ok := m.derpMapSent[nodeID]
+
+	return !ok || m.now().Sub(sent) >= interval
+}
+
+// derpMapSentTo records that the DERP map was sent to the node.
+func (m *Mapper) derpMapSentTo(nodeID types.NodeID) {
+	if m.cfg.Tuning.DERPMapMinInterval <= 0 || m.derpMapSent == nil {
+		return
+	}
+
+	m.derpMapSentMu.Lock()
+	defer m.derpMapSentMu.Unlock()
+
+	m.derpMapSent[nodeID] = m.now()
+	delete(m.derpMapPending, nodeID)
+}
+
+// derpMapWithheld records that a DERP map update was not sent to the
+// node because it was throttled.
+func (m *Mapper) derpMapWithheld(nodeID types.NodeID) {
+	m.derpMapSentMu.Lock()
+	defer m.derpMapSentMu.Unlock()
+
+	m.derpMapPending[nodeID] = true
+}
+
+// pendingDERPMap reports if a DERP map update withheld from the node
+// may be sent now.
+func (m *Mapper) pendingDERPMap(nodeID types.NodeID) bool {
+	if m.derpMapPending == nil {
+		return false
+	}
+
+	m.derpMapSentMu.Lock()
+	pending := m.derpMapPending[nodeID]
+	m.derpMapSentMu.Unlock()
+
+	return pending && m.derpMapDue(nodeID)
+}
+
+// simulation returns a Mapper generating the same responses as m, using
+// polMan instead of the current policy if it is not nil. It does not
+// cache responses, track peers or call any hooks.
+//
+// Duplicate names are resolved between the node and its peers only, as
+// in any full MapResponse. A node that got incremental responses since
+// its last full one can have a name suffixed differently, as those use
+// the names of all nodes seen by the Mapper.
+func (m *Mapper) simulation(polMan policy.PolicyManager) *Mapper {
+	sim := &Mapper{
+		db:             m.db,
+		cfg:            m.cfg,
+		notif:          m.notif,
+		polMan:         m.polMan,
+		primary:        m.primary,
+		now:            m.now,
+		isQuarantined:  m.isQuarantined,
+		tagDERPRegions: m.tagDERPRegions,
+		presence:       m.presence,
+		middlewares:    m.middlewares,
+		names:          newNameIndex(),
+	}
+	sim.derpMap.Store(m.derpMap.Load())
+	sim.lockdown.Store(m.lockdown.Load())
+	sim.encoderLevel.Store(m.encoderLevel.Load())
+	if polMan != nil {
+		sim.polMan = polMan
+	}
+
+	return sim
+}
+
+// withGenerationTimeout runs generate and gives up waiting for it if it
+// takes longer than the configured map response generation timeout.
+// The context passed to generate is cancelled at the deadline, to abort
+// the database queries and remaining pipeline stages of generate too.
+// generate may still be running when withGenerationTimeout returns, it
+// must not change any state the response would, see MapContext.commit.
+// A zero timeout disables the deadline.
+func (m *Mapper) withGenerationTimeout(
+	generate func(ctx context.Context) (*tailcfg.MapResponse, error),
+) (*tailcfg.MapResponse, error) {
+	timeout := m.cfg.Tuning.MapResponseGenerationTimeout
+	if timeout <= 0 {
+		return generate(context.Background())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	type result struct {
+		resp *tailcfg.MapResponse
+		err  error
+	}
+
+	// Buffered so the generating goroutine can finish and be
+	// garbage collected even if nobody is waiting for it anymore.
+	resCh := make(chan result, 1)
+	go func() {
+		resp, err := generate(ctx)
+		resCh <- result{resp: resp, err: err}
+	}()
+
+	select {
+	case res := <-resCh:
+		return res.resp, res.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w after %s", ErrMapResponseTimeout, timeout)
+	}
 }
 
 // ReadOnlyMapResponse returns a MapResponse for the given node.
@@ -230,21 +1007,55 @@ func (m *Mapper) KeepAliveResponse(
 	mapRequest tailcfg.MapRequest,
 	node *types.Node,
 ) ([]byte, error) {
+	defer observeDuration("keepalive", time.Now())
+
+	// Clients ignore everything but the keep alive in keep alive
+	// responses, a withheld DERP map update is sent instead.
+	if m.pendingDERPMap(node.ID) {
+		data, err := m.derpMapUpdate(mapRequest, node)
+
+		return data, countOutcome("keepalive", err)
+	}
+
 	resp := m.baseMapResponse()
 	resp.KeepAlive = true
 
-	return m.marshalMapResponse(mapRequest, &resp, node, mapRequest.Compress)
+	data, err := m.marshalMapResponse(mapRequest, &resp, node, mapRequest.Compress)
+
+	return data, countOutcome("keepalive", err)
 }
 
+// DERPMapResponse returns a response updating the DERP map of the node
+// to the one last set with SetDERPMap.
 func (m *Mapper) DERPMapResponse(
 	mapRequest tailcfg.MapRequest,
 	node *types.Node,
-	derpMap *tailcfg.DERPMap,
 ) ([]byte, error) {
-	m.derpMap = derpMap
+	// A throttled update is sent with the next keep alive or peer
+	// change once the node's interval has passed.
+	if !m.derpMapDue(node.ID) {
+		m.derpMapWithheld(node.ID)
+
+		return nil, nil
+	}
 
+	return m.derpMapUpdate(mapRequest, node)
+}
+
+// SetDERPMap replaces the DERP map sent to the nodes. It must be called
+// once when the DERP map is updated, before sending DERPMapResponse to
+// every node.
+func (m *Mapper) SetDERPMap(derpMap *tailcfg.DERPMap) {
+	m.derpMap.Store(derpMap)
+	m.InvalidateResponseCache()
+}
+
+// derpMapUpdate returns a response updating the DERP map of the node.
+func (m *Mapper) derpMapUpdate(mapRequest tailcfg.MapRequest, node *types.Node) ([]byte, error) {
 	resp := m.baseMapResponse()
-	resp.DERPMap = derpMap
+	resp.DERPMap = m.nodeDERPMap(node, m.derpMap.Load())
+	m.derpMapSentTo(node.ID)
+	m.sentHashes.record(node.ID, fieldDERPMap, resp.DERPMap)
 
 	return m.marshalMapResponse(mapRequest, &resp, node, mapRequest.Compress)
 }
@@ -255,12 +1066,24 @@ func (m *Mapper) PeerChangedResponse(
 	changed map[types.NodeID]bool,
 	patches []*tailcfg.PeerChange,
 	messages ...string,
+) ([]byte, error) {
+	data, err := m.peerChangedResponse(mapRequest, node, changed, patches, messages...)
+
+	return data, countOutcome("changed", err)
+}
+
+func (m *Mapper) peerChangedResponse(
+	mapRequest tailcfg.MapRequest,
+	node *types.Node,
+	changed map[types.NodeID]bool,
+	patches []*tailcfg.PeerChange,
+	messages ...string,
 ) ([]byte, error) {
 	var err error
 	resp := m.baseMapResponse()
 
 	var removedIDs []tailcfg.NodeID
-	var changedIDs []types.NodeID
+	var changedIDs, removed []types.NodeID
 	for nodeID, nodeChanged := range changed {
 		if nodeChanged {
 			if nodeID != node.ID {
@@ -268,31 +1091,34 @@ func (m *Mapper) PeerChangedResponse(
 			}
 		} else {
 			removedIDs = append(removedIDs, nodeID.NodeID())
+			removed = append(removed, nodeID)
 		}
 	}
+	m.names.remove(removed)
 	changedNodes := types.Nodes{}
 	if len(changedIDs) > 0 {
 		changedNodes, err = m.ListNodes(changedIDs...)
 		if err != nil {
-			return nil, err
+			return nil, withOutcome(outcomeDBError, err)
 		}
 	}
 
-	err = appendPeerChanges(
-		&resp,
-		false, // partial change
-		m.polMan,
-		m.primary,
-		node,
-		mapRequest.Version,
-		changedNodes,
-		m.cfg,
-	)
+	mc := &MapContext{
+		Node:     node,
+		CapVer:   mapRequest.Version,
+		Peers:    changedNodes,
+		Response: &resp,
+	}
+	err = m.appendPeerChanges(mc)
 	if err != nil {
 		return nil, err
 	}
 
-	resp.PeersRemoved = removedIDs
+	// changed is a map, sort the removed peers to keep the response
+	// stable. Changed peers beyond types.MapperConfig.MaxPeers are
+	// removed too.
+	resp.PeersRemoved = append(resp.PeersRemoved, removedIDs...)
+	slices.Sort(resp.PeersRemoved)
 
 	// Sending patches as a part of a PeersChanged response
 	// is technically not suppose to be done, but they are
@@ -306,24 +1132,60 @@ func (m *Mapper) PeerChangedResponse(
 	// control server should only send these on their own, without
 	// the Peers* fields also set.
 	if patches != nil {
-		resp.PeersChangedPatch = patches
+		resp.PeersChangedPatch = sortedPatches(m.presencePatches(patches))
 	}
 
-	_, matchers := m.polMan.Filter()
 	// Add the node itself, it might have changed, and particularly
 	// if there are no patches or changes, this is a self update.
-	tailnode, err := tailNode(
-		node, mapRequest.Version, m.polMan,
-		func(id types.NodeID) []netip.Prefix {
-			return policy.ReduceRoutes(node, m.primary.PrimaryRoutes(id), matchers)
-		},
-		m.cfg)
+	tailnode, err := m.tailSelfNode(node, mapRequest.Version)
 	if err != nil {
-		return nil, err
+		return nil, withOutcome(outcomeConversionError, err)
 	}
+	disambiguateName(node, tailnode, mc.nameOwners, m.cfg)
 	resp.Node = tailnode
 
-	return m.marshalMapResponse(mapRequest, &resp, node, mapRequest.Compress, messages...)
+	switch {
+	case m.lockdown.Load():
+		restrictedResponse(&resp, lockdownMessage)
+	case m.unsupportedVersion(mapRequest.Version):
+		restrictedResponse(&resp, m.unsupportedVersionMessage())
+	case m.quarantined(node):
+		quarantineResponse(&resp)
+	}
+
+	projectPeers(&resp, m.peerProjection(node))
+
+	if m.pendingDERPMap(node.ID) {
+		resp.DERPMap = m.nodeDERPMap(node, m.derpMap.Load())
+		m.derpMapSentTo(node.ID)
+	}
+
+	mc.commit()
+	m.trackPeers(node.ID, &resp)
+
+	if m.peerSnapshots != nil {
+		m.peerSnapshots.update(node.ID, &resp, false, m.now())
+	}
+
+	if mapRequest.Stream {
+		m.omitUnchanged(node.ID, &resp, true)
+	}
+
+	data, err := m.marshalMapResponse(mapRequest, &resp, node, mapRequest.Compress, messages...)
+	countPayload(payloadDelta, node.ID, err)
+
+	return data, err
+}
+
+// sortedPatches returns a copy of patches sorted by node ID. Patches of
+// the same node keep their order, they are applied one after another.
+func sortedPatches(patches []*tailcfg.PeerChange) []*tailcfg.PeerChange {
+	sorted := slices.Clone(patches)
+	slices.SortStableFunc(sorted, func(a, b *tailcfg.PeerChange) int {
+		return cmp.Compare(a.NodeID, b.NodeID)
+	})
+
+	return sorted
 }
 
 // PeerChangedPatchResponse creates a patch MapResponse with
@@ -333,10 +1195,29 @@ func (m *Mapper) PeerChangedPatchResponse(
 	node *types.Node,
 	changed []*tailcfg.PeerChange,
 ) ([]byte, error) {
+	// Quarantined, locked down and outdated nodes do not know about any
+	// peers.
+	if m.quarantined(node) || m.lockdown.Load() || m.unsupportedVersion(mapRequest.Version) {
+		return nil, nil
+	}
+
+	changed, err := m.stripDERPOnlyPatches(changed)
+	if err != nil {
+		return nil, err
+	}
+
 	resp := m.baseMapResponse()
-	resp.PeersChangedPatch = changed
+	resp.PeersChangedPatch = sortedPatches(m.presencePatches(changed))
+	projectPeers(&resp, m.peerProjection(node))
 
-	return m.marshalMapResponse(mapRequest, &resp, node, mapRequest.Compress)
+	if m.peerSnapshots != nil {
+		m.peerSnapshots.update(node.ID, &resp, false, m.now())
+	}
+
+	data, err := m.marshalMapResponse(mapRequest, &resp, node, mapRequest.Compress)
+	countPayload(payloadDelta, node.ID, err)
+
+	return data, err
 }
 
 func (m *Mapper) marshalMapResponse(
@@ -348,9 +1229,12 @@ func (m *Mapper) marshalMapResponse(
 ) ([]byte, error) {
 	atomic.AddUint64(&m.seq, 1)
 
-	jsonBody, err := json.Marshal(resp)
-	if err != nil {
-		return nil, fmt.Errorf("marshalling map response: %w", err)
+	if m.responseHook != nil {
+		m.responseHook(node, resp)
+	}
+
+	if compression == "" {
+		compression = m.defaultCompression(mapRequest, node)
 	}
 
 	if debugDumpMapResponsePath != "" {
@@ -360,21 +1244,6 @@ func (m *Mapper) marshalMapResponse(
 			"MapResponse": resp,
 		}
 
-		responseType := "keepalive"
-
-		switch {
-		case resp.Peers != nil && len(resp.Peers) > 0:
-			responseType = "full"
-		case resp.Peers == nil && resp.PeersChanged == nil && resp.PeersChangedPatch == nil && resp.DERPMap == nil && !resp.KeepAlive:
-			responseType = "self"
-		case resp.PeersChanged != nil && len(resp.PeersChanged) > 0:
-			responseType = "changed"
-		case resp.PeersChangedPatch != nil && len(resp.PeersChangedPatch) > 0:
-			responseType = "patch"
-		case resp.PeersRemoved != nil && len(resp.PeersRemoved) > 0:
-			responseType = "removed"
-		}
-
 		body, err := json.MarshalIndent(data, "", "  ")
 		if err != nil {
 			return nil, fmt.Errorf("marshalling map response: %w", err)
@@ -391,7 +1260,7 @@ func (m *Mapper) marshalMapResponse(
 
 		mapResponsePath := path.Join(
 			mPath,
-			fmt.Sprintf("%s-%s-%d-%s.json", now, m.uid, atomic.LoadUint64(&m.seq), responseType),
+			fmt.Sprintf("%s-%s-%d-%s.json", now, m.uid, atomic.LoadUint64(&m.seq), mapResponseType(resp)),
 		)
 
 		log.Trace().Msgf("Writing MapResponse to %s", mapResponsePath)
@@ -401,59 +1270,98 @@ func (m *Mapper) marshalMapResponse(
 		}
 	}
 
-	var respBody []byte
-	if compression == util.ZstdCompression {
-		respBody = zstdEncode(jsonBody)
-	} else {
-		respBody = jsonBody
+	var encoded any = resp
+	if m.restoresHealth(node.ID, resp) {
+		encoded = healthRestoringResponse{MapResponse: resp, Health: []string{}}
 	}
 
-	data := make([]byte, reservedResponseHeaderSize)
-	binary.LittleEndian.PutUint32(data, uint32(len(respBody)))
-	data = append(data, respBody...)
+	var body bytes.Buffer
+	marshalled, err := writeMapResponse(&body, encoded, compression, m.zstdLevel())
+	if err != nil {
+		return nil, withOutcome(outcomeMarshalError, err)
+	}
+
+	data, err := appendLengthPrefixedFrame(
+		make([]byte, 0, reservedResponseHeaderSize+body.Len()),
+		body.Bytes(),
+		maxFrameBodySize,
+	)
+	if err != nil {
+		return nil, withOutcome(outcomeMarshalError, err)
+	}
+	size := body.Len()
+
+	observeSize(mapResponseType(resp), compression, marshalled, size)
+
+	if m.onOversizedResponse != nil && size > m.sizeBudget {
+		m.onOversizedResponse(node, size)
+	}
 
 	return data, nil
 }
 
-func zstdEncode(in []byte) []byte {
-	encoder, ok := zstdEncoderPool.Get().(*zstd.Encoder)
-	if !ok {
-		panic("invalid type in sync pool")
+// mapResponseType classifies resp by its content, it is used in metric
+// labels and the names of dumped responses.
+func mapResponseType(resp *tailcfg.MapResponse) string {
+	switch {
+	case len(resp.Peers) > 0:
+		return "full"
+	case resp.Peers == nil && resp.PeersChanged == nil && resp.PeersChangedPatch == nil && resp.DERPMap == nil && !resp.KeepAlive:
+		return "self"
+	case len(resp.PeersChanged) > 0:
+		return "changed"
+	case len(resp.PeersChangedPatch) > 0:
+		return "patch"
+	case len(resp.PeersRemoved) > 0:
+		return "removed"
 	}
-	out := encoder.EncodeAll(in, nil)
-	_ = encoder.Close()
-	zstdEncoderPool.Put(encoder)
 
-	return out
+	return "keepalive"
 }
 
-var zstdEncoderPool = &sync.Pool{
-	New: func() any {
-		encoder, err := smallzstd.NewEncoder(
-			nil,
-			zstd.WithEncoderLevel(zstd.SpeedFastest))
-		if err != nil {
-			panic(err)
-		}
+// defaultCompression returns the compression to use for clients not
+// asking for any, based on their capability version and user.
+func (m *Mapper) defaultCompression(mapRequest tailcfg.MapRequest, node *types.Node) string {
+	if mapRequest.Version < m.cfg.Mapper.DefaultCompressionMinCapVer {
+		return ""
+	}
 
-		return encoder
-	},
+	if compression, ok := m.cfg.Mapper.UserCompression[strings.ToLower(node.User.Name)]; ok {
+		return compression
+	}
+
+	return m.cfg.Mapper.DefaultCompression
 }
 
 // baseMapResponse returns a tailcfg.MapResponse with
-// KeepAlive false and ControlTime set to now.
+// KeepAlive false and ControlTime set to now, shifted by up to
+// Tuning.ControlTimeJitter.
 func (m *Mapper) baseMapResponse() tailcfg.MapResponse {
-	now := time.Now()
-
 	resp := tailcfg.MapResponse{
 		KeepAlive:   false,
-		ControlTime: &now,
+		ControlTime: m.controlTime(),
 		// TODO(kradalby): Implement PingRequest?
 	}
 
 	return resp
 }
 
+// controlTime returns the ControlTime of a new response.
+func (m *Mapper) controlTime() *time.Time {
+	now := m.now().Add(jitter(m.cfg.Tuning.ControlTimeJitter))
+
+	return &now
+}
+
+// jitter returns a random duration between -bound and bound.
+func jitter(bound time.Duration) time.Duration {
+	if bound <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int64N(int64(2*bound)+1)) - bound
+}
+
 // baseWithConfigMapResponse returns a tailcfg.MapResponse struct
 // with the basic configuration from headscale set.
 // It is used in for bigger updates, such as full and lite, not
@@ -462,8 +1370,26 @@ func (m *Mapper) baseWithConfigMapResponse(
 	node *types.Node,
 	capVer tailcfg.CapabilityVersion,
 ) (*tailcfg.MapResponse, error) {
-	resp := m.baseMapResponse()
+	mc := &MapContext{Node: node, CapVer: capVer}
 
+	if err := m.nodeStage(mc); err != nil {
+		return nil, err
+	}
+
+	if err := m.derpStage(mc); err != nil {
+		return nil, err
+	}
+	mc.commit()
+
+	return mc.Response, nil
+}
+
+// tailSelfNode converts the node a map response is generated for into
+// a Tailscale Node, adding the attributes only sent to the node itself.
+func (m *Mapper) tailSelfNode(
+	node *types.Node,
+	capVer tailcfg.CapabilityVersion,
+) (*tailcfg.Node, error) {
 	_, matchers := m.polMan.Filter()
 	tailnode, err := tailNode(
 		node, capVer, m.polMan,
@@ -474,36 +1400,99 @@ func (m *Mapper) baseWithConfigMapResponse(
 	if err != nil {
 		return nil, err
 	}
-	resp.Node = tailnode
 
-	resp.DERPMap = m.derpMap
+	maps.Copy(tailnode.CapMap, m.polMan.NodeAttrs(node))
 
-	resp.Domain = m.cfg.Domain()
+	if nodeMatchesAny(node, tailnode.Tags, m.cfg.Mapper.ServeAllowed) {
+		tailnode.CapMap[tailcfg.CapabilityHTTPS] = []tailcfg.RawMessage{}
+	}
 
-	// Do not instruct clients to collect services we do not
-	// support or do anything with them
-	resp.CollectServices = "false"
+	if nodeMatchesAny(node, tailnode.Tags, m.cfg.Mapper.FunnelAllowed) {
+		tailnode.CapMap[tailcfg.CapabilityHTTPS] = []tailcfg.RawMessage{}
+		tailnode.CapMap[tailcfg.NodeAttrFunnel] = []tailcfg.RawMessage{}
+	}
 
-	resp.KeepAlive = false
+	if secret := m.cfg.Mapper.DataPlaneAuditLogSecret; secret != "" {
+		tailnode.DataPlaneAuditLogID = dataPlaneAuditLogID(secret, node)
+	}
 
-	resp.Debug = &tailcfg.Debug{
-		DisableLogTail: !m.cfg.LogTail.Enabled,
+	if maxSession := m.cfg.Mapper.MaxSession; maxSession > 0 {
+		limit := m.now().Add(maxSession).UTC()
+		if tailnode.KeyExpiry.IsZero() || tailnode.KeyExpiry.After(limit) {
+			tailnode.KeyExpiry = limit
+		}
 	}
 
-	return &resp, nil
+	return tailnode, nil
+}
+
+// dataPlaneAuditLogID derives the data plane audit log ID of the node
+// from its stable ID, so it stays the same for the lifetime of the node.
+func dataPlaneAuditLogID(secret string, node *types.Node) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(node.ID.StableID()))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// nodeMatchesFold is like nodeMatchesAny for a single entry, ignoring
+// case. Viper lowercases map keys, entries loaded as keys cannot be
+// compared to tags and user names exactly.
+func nodeMatchesFold(node *types.Node, tags []string, entry string) bool {
+	if strings.HasPrefix(strings.ToLower(entry), "tag:") {
+		return slices.ContainsFunc(tags, func(tag string) bool {
+			return strings.EqualFold(tag, entry)
+		})
+	}
+
+	return len(tags) == 0 &&
+		(strings.EqualFold(entry, node.User.Name) || strings.EqualFold(entry, node.User.Username()))
+}
+
+// nodeMatchesAny reports if the node, with the given tags, matches any
+// of the entries. An entry is either a tag ("tag:server") or the name
+// of the user owning the node.
+func nodeMatchesAny(node *types.Node, tags []string, entries []string) bool {
+	for _, entry := range entries {
+		if strings.HasPrefix(entry, "tag:") {
+			if slices.Contains(tags, entry) {
+				return true
+			}
+
+			continue
+		}
+
+		if len(tags) == 0 && (entry == node.User.Name || entry == node.User.Username()) {
+			return true
+		}
+	}
+
+	return false
 }
 
 // ListPeers returns peers of node, regardless of any Policy or if the node is expired.
 // If no peer IDs are given, all peers are returned.
 // If at least one peer ID is given, only these peer nodes will be returned.
 func (m *Mapper) ListPeers(nodeID types.NodeID, peerIDs ...types.NodeID) (types.Nodes, error) {
-	peers, err := m.db.ListPeers(nodeID, peerIDs...)
+	return m.listPeers(context.Background(), nodeID, peerIDs...)
+}
+
+// listPeers is like ListPeers, the query is cancelled when ctx is done
+// if the node store supports it.
+func (m *Mapper) listPeers(ctx context.Context, nodeID types.NodeID, peerIDs ...types.NodeID) (types.Nodes, error) {
+	peers, err := m.withDBRetry(ctx, func() (types.Nodes, error) {
+		if store, ok := m.db.(contextNodeStore); ok {
+			return store.ListPeersContext(ctx, nodeID, peerIDs...)
+		}
+
+		return m.db.ListPeers(nodeID, peerIDs...)
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	for _, peer := range peers {
-		online := m.notif.IsLikelyConnected(peer.ID)
+		online := m.online(peer.ID)
 		peer.IsOnline = &online
 	}
 
@@ -513,85 +1502,62 @@ func (m *Mapper) ListPeers(nodeID types.NodeID, peerIDs ...types.NodeID) (types.
 // ListNodes queries the database for either all nodes if no parameters are given
 // or for the given nodes if at least one node ID is given as parameter
 func (m *Mapper) ListNodes(nodeIDs ...types.NodeID) (types.Nodes, error) {
-	nodes, err := m.db.ListNodes(nodeIDs...)
+	nodes, err := m.withDBRetry(context.Background(), func() (types.Nodes, error) {
+		return m.db.ListNodes(nodeIDs...)
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	for _, node := range nodes {
-		online := m.notif.IsLikelyConnected(node.ID)
+		online := m.online(node.ID)
 		node.IsOnline = &online
 	}
 
 	return nodes, nil
 }
 
+// withDBRetry runs query until it succeeds, fails with an error that
+// is not transient, the configured number of retries is used up or
+// ctx is done.
+func (m *Mapper) withDBRetry(ctx context.Context, query func() (types.Nodes, error)) (types.Nodes, error) {
+	backoff := m.cfg.Tuning.MapResponseDBRetryBackoff
+	for attempt := 0; ; attempt++ {
+		nodes, err := query()
+		if err == nil || attempt >= m.cfg.Tuning.MapResponseDBRetries || !db.IsTransientError(err) {
+			return nodes, err
+		}
+
+		log.Debug().
+			Err(err).
+			Int("attempt", attempt+1).
+			Dur("backoff", backoff).
+			Msg("transient database error while generating map response, retrying")
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
 // routeFilterFunc is a function that takes a node ID and returns a list of
 // netip.Prefixes that are allowed for that node. It is used to filter routes
 // from the primary route manager to the node.
 type routeFilterFunc func(id types.NodeID) []netip.Prefix
 
-// appendPeerChanges mutates a tailcfg.MapResponse with all the
-// necessary changes when peers have changed.
-func appendPeerChanges(
-	resp *tailcfg.MapResponse,
-
-	fullChange bool,
-	polMan policy.PolicyManager,
-	primary *routes.PrimaryRoutes,
-	node *types.Node,
-	capVer tailcfg.CapabilityVersion,
-	changed types.Nodes,
-	cfg *types.Config,
-) error {
-	filter, matchers := polMan.Filter()
-
-	sshPolicy, err := polMan.SSHPolicy(node)
-	if err != nil {
+// appendPeerChanges adds the changed peers to the response in
+// mc, together with the policy and DNS configuration of the node.
+func (m *Mapper) appendPeerChanges(mc *MapContext) error {
+	if err := m.peersStage(mc, false); err != nil {
 		return err
 	}
 
-	// If there are filter rules present, see if there are any nodes that cannot
-	// access each-other at all and remove them from the peers.
-	if len(filter) > 0 {
-		changed = policy.ReduceNodes(node, changed, matchers)
-	}
-
-	profiles := generateUserProfiles(node, changed)
-
-	dnsConfig := generateDNSConfig(cfg, node)
-
-	tailPeers, err := tailNodes(
-		changed, capVer, polMan,
-		func(id types.NodeID) []netip.Prefix {
-			return policy.ReduceRoutes(node, primary.PrimaryRoutes(id), matchers)
-		},
-		cfg)
-	if err != nil {
+	if err := m.policyStage(mc); err != nil {
 		return err
 	}
 
-	// Peers is always returned sorted by Node.ID.
-	sort.SliceStable(tailPeers, func(x, y int) bool {
-		return tailPeers[x].ID < tailPeers[y].ID
-	})
-
-	if fullChange {
-		resp.Peers = tailPeers
-	} else {
-		resp.PeersChanged = tailPeers
-	}
-	resp.DNSConfig = dnsConfig
-	resp.UserProfiles = profiles
-	resp.SSHPolicy = sshPolicy
-
-	// CapVer 81: 2023-11-17: MapResponse.PacketFilters (incremental packet filter updates)
-	// Currently, we do not send incremental package filters, however using the
-	// new PacketFilters field and "base" allows us to send a full update when we
-	// have to send an empty list, avoiding the hack in the else block.
-	resp.PacketFilters = map[string][]tailcfg.FilterRule{
-		"base": policy.ReduceFilterRules(node, filter),
-	}
-
-	return nil
+	return m.dnsStage(mc)
 }
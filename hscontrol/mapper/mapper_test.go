@@ -1,22 +1,38 @@
 package mapper
 
 import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
 	"net/netip"
+	"path/filepath"
+	"slices"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/notifier"
 	"github.com/juanfont/headscale/hscontrol/policy"
 	"github.com/juanfont/headscale/hscontrol/routes"
 	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
 	"gorm.io/gorm"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/types/key"
+	"zgo.at/zcache/v2"
 )
 
 var iap = func(ipStr string) *netip.Addr {
@@ -75,6 +91,7 @@ func TestDNSConfigMapResponse(t *testing.T) {
 					TailcfgDNSConfig: &dnsConfigOrig,
 				},
 				nodeInShared1,
+				nil,
 			)
 
 			if diff := cmp.Diff(tt.want, got, cmpopts.EquateEmpty()); diff != "" {
@@ -84,6 +101,286 @@ func TestDNSConfigMapResponse(t *testing.T) {
 	}
 }
 
+func TestAddDoHMetadata(t *testing.T) {
+	node := &types.Node{
+		ID:       7,
+		Hostname: "mini laptop",
+		IPv4:     iap("100.64.0.1"),
+		Hostinfo: &tailcfg.Hostinfo{OS: "linux", OSVersion: "6.1.0"},
+	}
+
+	configured := []types.DoHMetadataResolver{
+		{
+			Prefix: "https://doh.example.com/",
+			Params: []types.DoHMetadataParam{
+				{Name: "clientName", Value: "{device_name} ({device_id})"},
+				{Name: "ip", Value: "{device_ip}"},
+			},
+		},
+		{
+			Prefix: "https://dns.nextdns.io/override",
+			Params: []types.DoHMetadataParam{{Name: "device_name", Value: "{device_name}"}},
+		},
+	}
+
+	tests := []struct {
+		name string
+		addr string
+		node *types.Node
+		want string
+	}{
+		{
+			name: "os-version",
+			addr: "https://dns.nextdns.io/abc123",
+			node: node,
+			want: "https://dns.nextdns.io/abc123?device_id=7&device_ip=100.64.0.1&device_model=linux+6.1.0&device_name=mini+laptop",
+		},
+		{
+			name: "existing-parameters",
+			addr: "https://dns.nextdns.io/abc123?device_name=office&foo=bar",
+			node: node,
+			want: "https://dns.nextdns.io/abc123?device_id=7&device_ip=100.64.0.1&device_model=linux+6.1.0&device_name=office&foo=bar",
+		},
+		{
+			name: "no-hostinfo",
+			addr: "https://dns.nextdns.io/abc123",
+			node: &types.Node{ID: 8, Hostname: "mini"},
+			want: "https://dns.nextdns.io/abc123?device_id=8&device_name=mini",
+		},
+		{
+			name: "configured-resolver",
+			addr: "https://doh.example.com/dns-query",
+			node: node,
+			want: "https://doh.example.com/dns-query?clientName=mini+laptop+%287%29&ip=100.64.0.1",
+		},
+		{
+			name: "configured-overrides-nextdns",
+			addr: "https://dns.nextdns.io/override",
+			node: node,
+			want: "https://dns.nextdns.io/override?device_name=mini+laptop",
+		},
+		{
+			name: "configured-empty-value",
+			addr: "https://doh.example.com/dns-query",
+			node: &types.Node{ID: 8, Hostname: "mini"},
+			want: "https://doh.example.com/dns-query?clientName=mini+%288%29",
+		},
+		{
+			name: "other-resolver",
+			addr: "https://dns.example.com/dns-query",
+			node: node,
+			want: "https://dns.example.com/dns-query",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolvers := []*dnstype.Resolver{{Addr: tt.addr}}
+			addDoHMetadata(resolvers, configured, tt.node)
+			require.Equal(t, tt.want, resolvers[0].Addr)
+		})
+	}
+}
+
+func TestDNSConfigFor(t *testing.T) {
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+	node := &types.Node{
+		ID:        1,
+		Hostname:  "mini",
+		GivenName: "mini",
+		IPv4:      iap("100.64.0.1"),
+		UserID:    user1.ID,
+		User:      user1,
+		Hostinfo:  &tailcfg.Hostinfo{OS: "linux"},
+	}
+
+	cfg := &types.Config{
+		TailcfgDNSConfig: &tailcfg.DNSConfig{
+			Resolvers: []*dnstype.Resolver{
+				{Addr: "https://dns.nextdns.io/abc123"},
+			},
+			Domains: []string{"example.com"},
+		},
+	}
+
+	polMan, err := policy.NewPolicyManager(nil, []types.User{user1}, types.Nodes{node})
+	require.NoError(t, err)
+
+	mappy := NewMapper(nil, cfg, &tailcfg.DERPMap{}, nil, polMan, routes.New())
+
+	got := mappy.DNSConfigFor(node)
+	require.Equal(t,
+		"https://dns.nextdns.io/abc123?device_id=1&device_ip=100.64.0.1&device_model=linux&device_name=mini",
+		got.Resolvers[0].Addr,
+	)
+
+	resp, err := mappy.fullMapResponse(node, types.Nodes{}, 0)
+	require.NoError(t, err)
+
+	if diff := cmp.Diff(resp.DNSConfig, got); diff != "" {
+		t.Errorf("DNSConfigFor() differs from fullMapResponse (-full +got):\n%s", diff)
+	}
+}
+
+func TestUserSearchDomains(t *testing.T) {
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "User1"}
+	user2 := types.User{Model: gorm.Model{ID: 2}, Name: "user2"}
+	user3 := types.User{Model: gorm.Model{ID: 3}, Name: "user3"}
+
+	cfg := &types.Config{
+		TailcfgDNSConfig: &tailcfg.DNSConfig{
+			Domains: []string{"example.com"},
+		},
+		Mapper: types.MapperConfig{
+			UserSearchDomains: map[string][]string{
+				"user1": {"corp.example.com", "example.com"},
+				"user2": {"lab.example.com"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name string
+		user types.User
+		want []string
+	}{
+		{
+			name: "own-domains-deduplicated",
+			user: user1,
+			want: []string{"example.com", "corp.example.com"},
+		},
+		{
+			name: "other-user",
+			user: user2,
+			want: []string{"example.com", "lab.example.com"},
+		},
+		{
+			name: "no-domains",
+			user: user3,
+			want: []string{"example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := &types.Node{
+				ID:        1,
+				GivenName: "node",
+				UserID:    tt.user.ID,
+				User:      tt.user,
+			}
+
+			got := generateDNSConfig(cfg, node, nil)
+			require.Equal(t, tt.want, got.Domains)
+		})
+	}
+
+	require.Equal(t, []string{"example.com"}, cfg.TailcfgDNSConfig.Domains)
+}
+
+func TestTaggedSearchDomains(t *testing.T) {
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+
+	cfg := &types.Config{
+		BaseDomain: "example.com",
+		TailcfgDNSConfig: &tailcfg.DNSConfig{
+			Domains: []string{"example.com"},
+		},
+		Mapper: types.MapperConfig{
+			UserSearchDomains: map[string][]string{
+				"user1": {"corp.example.com"},
+			},
+			TaggedSearchDomains: map[string][]string{
+				"tag:server": {"servers.example.com"},
+				"tag:web":    {"web.example.com", "servers.example.com"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name string
+		tags []string
+		want []string
+	}{
+		{
+			name: "user-owned",
+			want: []string{"example.com", "corp.example.com"},
+		},
+		{
+			name: "tagged",
+			tags: []string{"tag:web", "tag:server"},
+			want: []string{"example.com", "servers.example.com", "web.example.com"},
+		},
+		{
+			name: "tagged-without-domains",
+			tags: []string{"tag:db"},
+			want: []string{"example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := &types.Node{
+				ID:         1,
+				GivenName:  "node",
+				UserID:     user1.ID,
+				User:       user1,
+				ForcedTags: tt.tags,
+			}
+
+			got := generateDNSConfig(cfg, node, tt.tags)
+			require.Equal(t, tt.want, got.Domains)
+		})
+	}
+}
+
+func TestTaggedSearchDomainsRequestTags(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.cfg.TailcfgDNSConfig = &tailcfg.DNSConfig{}
+	mappy.cfg.Mapper.UserSearchDomains = map[string][]string{"user1": {"corp.example.com"}}
+	mappy.cfg.Mapper.TaggedSearchDomains = map[string][]string{"tag:server": {"servers.example.com"}}
+	node.Hostinfo.RequestTags = []string{"tag:server"}
+
+	// The node is tagged by the policy approving its requested tag,
+	// like it is presented in the netmap.
+	pol := []byte(`{"tagOwners": {"tag:server": ["user1@"]}}`)
+	polMan, err := policy.NewPolicyManager(pol, []types.User{node.User}, append(types.Nodes{node}, peers...))
+	require.NoError(t, err)
+	mappy.polMan = polMan
+
+	require.Equal(t, []string{"servers.example.com"}, mappy.DNSConfigFor(node).Domains)
+
+	resp, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"tag:server"}, resp.Node.Tags)
+	require.Equal(t, []string{"servers.example.com"}, resp.DNSConfig.Domains)
+}
+
+func TestGenerateDNSConfigKeepsBase(t *testing.T) {
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+
+	cfg := &types.Config{
+		TailcfgDNSConfig: &tailcfg.DNSConfig{
+			Proxied: false,
+			Resolvers: []*dnstype.Resolver{
+				{Addr: "https://dns.nextdns.io/abc123"},
+			},
+		},
+	}
+
+	first := &types.Node{ID: 1, Hostname: "first", User: user1, UserID: user1.ID, IPv4: iap("100.64.0.1")}
+	second := &types.Node{ID: 2, Hostname: "second", User: user1, UserID: user1.ID, IPv4: iap("100.64.0.2")}
+
+	got := generateDNSConfig(cfg, first, nil)
+	require.Contains(t, got.Resolvers[0].Addr, "device_name=first")
+
+	got = generateDNSConfig(cfg, second, nil)
+	require.Contains(t, got.Resolvers[0].Addr, "device_name=second")
+	require.NotContains(t, got.Resolvers[0].Addr, "device_name=first")
+
+	require.Equal(t, "https://dns.nextdns.io/abc123", cfg.TailcfgDNSConfig.Resolvers[0].Addr)
+}
+
 func Test_fullMapResponse(t *testing.T) {
 	mustNK := func(str string) key.NodePublic {
 		var k key.NodePublic
@@ -165,9 +462,9 @@ func Test_fullMapResponse(t *testing.T) {
 		),
 		Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
 		AllowedIPs: []netip.Prefix{
-			tsaddr.AllIPv4(),
-			netip.MustParsePrefix("192.168.0.0/24"),
 			netip.MustParsePrefix("100.64.0.1/32"),
+			netip.MustParsePrefix("192.168.0.0/24"),
+			tsaddr.AllIPv4(),
 			tsaddr.AllIPv6(),
 		},
 		PrimaryRoutes: []netip.Prefix{
@@ -449,3 +746,2176 @@ func Test_fullMapResponse(t *testing.T) {
 		})
 	}
 }
+
+// newTestNotifier returns a notifier where no nodes are connected.
+func newTestNotifier(t testing.TB) *notifier.Notifier {
+	t.Helper()
+
+	notif := notifier.NewNotifier(&types.Config{
+		Tuning: types.Tuning{BatchChangeDelay: time.Second},
+	})
+	t.Cleanup(notif.Close)
+
+	return notif
+}
+
+// slowNodeStore is a nodeStore that waits for delay before answering.
+type slowNodeStore struct {
+	delay time.Duration
+}
+
+func (s *slowNodeStore) ListPeers(types.NodeID, ...types.NodeID) (types.Nodes, error) {
+	time.Sleep(s.delay)
+	return types.Nodes{}, nil
+}
+
+func (s *slowNodeStore) ListNodes(...types.NodeID) (types.Nodes, error) {
+	time.Sleep(s.delay)
+	return types.Nodes{}, nil
+}
+
+func TestFullMapResponseGenerationTimeout(t *testing.T) {
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+	node := &types.Node{
+		ID:        1,
+		Hostname:  "mini",
+		GivenName: "mini",
+		IPv4:      iap("100.64.0.1"),
+		UserID:    user1.ID,
+		User:      user1,
+		Hostinfo:  &tailcfg.Hostinfo{},
+	}
+
+	polMan, err := policy.NewPolicyManager(nil, []types.User{user1}, types.Nodes{node})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		wantErr error
+	}{
+		{
+			name:    "timeout-exceeded",
+			timeout: 10 * time.Millisecond,
+			wantErr: ErrMapResponseTimeout,
+		},
+		{
+			name:    "no-timeout",
+			timeout: 0,
+		},
+		{
+			name:    "timeout-not-exceeded",
+			timeout: 5 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &types.Config{
+				TailcfgDNSConfig: &tailcfg.DNSConfig{},
+				Tuning: types.Tuning{
+					MapResponseGenerationTimeout: tt.timeout,
+				},
+			}
+
+			mappy := NewMapper(nil, cfg, &tailcfg.DERPMap{}, nil, polMan, routes.New())
+			mappy.db = &slowNodeStore{delay: 200 * time.Millisecond}
+
+			_, err := mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+// blockingNodeStore is a nodeStore whose peer queries block until
+// their context is done, reporting the error to aborted.
+type blockingNodeStore struct {
+	slowNodeStore
+	aborted chan error
+}
+
+func (s *blockingNodeStore) ListPeersContext(ctx context.Context, _ types.NodeID, _ ...types.NodeID) (types.Nodes, error) {
+	<-ctx.Done()
+	s.aborted <- ctx.Err()
+
+	return nil, ctx.Err()
+}
+
+func TestFullMapResponseDeadlineCancelsQuery(t *testing.T) {
+	mappy, node, _ := pipelineTestMapper(t)
+	mappy.cfg.Tuning.MapResponseGenerationTimeout = 10 * time.Millisecond
+
+	store := &blockingNodeStore{aborted: make(chan error, 1)}
+	mappy.db = store
+
+	_, err := mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.ErrorIs(t, err, ErrMapResponseTimeout)
+
+	select {
+	case err := <-store.aborted:
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("query was not aborted at the deadline")
+	}
+}
+
+func TestFullMapResponseTimeoutKeepsState(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.db = &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+	mappy.notif = newTestNotifier(t)
+	mappy.cfg.Tuning.DERPMapMinInterval = time.Hour
+	mappy.cfg.Tuning.MapResponseGenerationTimeout = 10 * time.Millisecond
+
+	// The DERP stage is entered before the deadline and finishes after
+	// it, when nobody waits for the response anymore.
+	release := make(chan struct{})
+	derpDone := make(chan struct{}, 2)
+	mappy.Use(func(stage string, next StageFunc) StageFunc {
+		if stage != StageDERP {
+			return next
+		}
+
+		return func(mc *MapContext) error {
+			<-release
+			defer func() { derpDone <- struct{}{} }()
+
+			return next(mc)
+		}
+	})
+
+	_, err := mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.ErrorIs(t, err, ErrMapResponseTimeout)
+
+	close(release)
+	<-derpDone
+	require.True(t, mappy.derpMapDue(node.ID), "timed out response marked the DERP map as sent")
+	require.Zero(t, mappy.DNSVersion(node.ID))
+
+	mappy.cfg.Tuning.MapResponseGenerationTimeout = 0
+	_, err = mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.False(t, mappy.derpMapDue(node.ID))
+	require.Equal(t, uint64(1), mappy.DNSVersion(node.ID))
+}
+
+// errNodeStore is a nodeStore that always fails.
+type errNodeStore struct{}
+
+func (errNodeStore) ListPeers(types.NodeID, ...types.NodeID) (types.Nodes, error) {
+	return nil, errors.New("database is gone")
+}
+
+func (errNodeStore) ListNodes(...types.NodeID) (types.Nodes, error) {
+	return nil, errors.New("database is gone")
+}
+
+// flakyNodeStore is a nodeStore failing with err for the first
+// failures calls before returning its peers.
+type flakyNodeStore struct {
+	staticNodeStore
+	err      error
+	failures int
+	calls    int
+}
+
+func (s *flakyNodeStore) ListPeers(nodeID types.NodeID, peerIDs ...types.NodeID) (types.Nodes, error) {
+	s.calls++
+	if s.calls <= s.failures {
+		return nil, s.err
+	}
+
+	return s.staticNodeStore.ListPeers(nodeID, peerIDs...)
+}
+
+// staticNodeStore is a nodeStore returning a fixed set of peers.
+type staticNodeStore struct {
+	peers types.Nodes
+}
+
+func (s *staticNodeStore) ListPeers(nodeID types.NodeID, _ ...types.NodeID) (types.Nodes, error) {
+	var peers types.Nodes
+	for _, peer := range s.peers {
+		if peer.ID != nodeID {
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers, nil
+}
+
+func (s *staticNodeStore) ListNodes(nodeIDs ...types.NodeID) (types.Nodes, error) {
+	if len(nodeIDs) == 0 {
+		return s.peers, nil
+	}
+
+	var nodes types.Nodes
+	for _, node := range s.peers {
+		if slices.Contains(nodeIDs, node.ID) {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes, nil
+}
+
+// errSSHPolicyManager is a PolicyManager failing to produce an SSH policy.
+type errSSHPolicyManager struct {
+	policy.PolicyManager
+}
+
+func (errSSHPolicyManager) SSHPolicy(*types.Node) (*tailcfg.SSHPolicy, error) {
+	return nil, errors.New("broken ssh policy")
+}
+
+func TestMapResponseOutcomeMetric(t *testing.T) {
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+	node := &types.Node{
+		ID:        1,
+		Hostname:  "mini",
+		GivenName: "mini",
+		IPv4:      iap("100.64.0.1"),
+		UserID:    user1.ID,
+		User:      user1,
+		Hostinfo:  &tailcfg.Hostinfo{},
+	}
+	unmarshalable := &types.Node{
+		ID:        1,
+		Hostname:  "mini",
+		GivenName: "mini",
+		IPv4:      iap("100.64.0.1"),
+		UserID:    user1.ID,
+		User:      user1,
+		Hostinfo:  &tailcfg.Hostinfo{Userspace: "not-a-bool"},
+	}
+
+	polMan, err := policy.NewPolicyManager(nil, []types.User{user1}, types.Nodes{node})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		store       nodeStore
+		polMan      policy.PolicyManager
+		node        *types.Node
+		keepAlive   bool
+		changed     bool
+		maxPeers    int
+		wantOutcome string
+	}{
+		{
+			name:        "success",
+			store:       &staticNodeStore{},
+			polMan:      polMan,
+			node:        node,
+			wantOutcome: outcomeSuccess,
+		},
+		{
+			name:        "db-error",
+			store:       errNodeStore{},
+			polMan:      polMan,
+			node:        node,
+			wantOutcome: outcomeDBError,
+		},
+		{
+			// The peer limit of incremental responses lists the
+			// peers in the peers stage.
+			name:        "stage-db-error",
+			store:       errNodeStore{},
+			polMan:      polMan,
+			node:        node,
+			changed:     true,
+			maxPeers:    1,
+			wantOutcome: outcomeDBError,
+		},
+		{
+			name:        "policy-error",
+			store:       &staticNodeStore{},
+			polMan:      errSSHPolicyManager{polMan},
+			node:        node,
+			wantOutcome: outcomePolicyError,
+		},
+		{
+			name:        "marshal-error",
+			store:       &staticNodeStore{},
+			polMan:      polMan,
+			node:        unmarshalable,
+			wantOutcome: outcomeMarshalError,
+		},
+		{
+			name:        "keepalive-success",
+			store:       &staticNodeStore{},
+			polMan:      polMan,
+			node:        node,
+			keepAlive:   true,
+			wantOutcome: outcomeSuccess,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &types.Config{
+				TailcfgDNSConfig: &tailcfg.DNSConfig{},
+			}
+			cfg.Mapper.MaxPeers = tt.maxPeers
+			mappy := NewMapper(nil, cfg, &tailcfg.DERPMap{}, nil, tt.polMan, routes.New())
+			mappy.db = tt.store
+
+			responseType := "full"
+			switch {
+			case tt.keepAlive:
+				responseType = "keepalive"
+			case tt.changed:
+				responseType = "changed"
+			}
+			counter := mapResponseGenerated.WithLabelValues(responseType, tt.wantOutcome)
+			before := testutil.ToFloat64(counter)
+
+			switch {
+			case tt.keepAlive:
+				_, err = mappy.KeepAliveResponse(tailcfg.MapRequest{}, tt.node)
+			case tt.changed:
+				_, err = mappy.PeerChangedResponse(tailcfg.MapRequest{}, tt.node, map[types.NodeID]bool{}, nil)
+			default:
+				_, err = mappy.FullMapResponse(tailcfg.MapRequest{}, tt.node)
+			}
+			require.Equal(t, tt.wantOutcome == outcomeSuccess, err == nil, "unexpected error: %v", err)
+
+			require.InDelta(t, before+1, testutil.ToFloat64(counter), 0)
+		})
+	}
+
+	// Errors without an outcome are not attributed to a cause.
+	require.Equal(t, outcomeOther, outcomeOf(errors.New("middleware failed")))
+}
+
+func TestMapResponsePayloadMetric(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.db = &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+	mappy.notif = newTestNotifier(t)
+
+	full := mapResponsePayload.WithLabelValues(payloadFull, "")
+	delta := mapResponsePayload.WithLabelValues(payloadDelta, "")
+
+	tests := []struct {
+		name      string
+		respond   func() ([]byte, error)
+		wantFull  float64
+		wantDelta float64
+	}{
+		{
+			name: "full",
+			respond: func() ([]byte, error) {
+				return mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+			},
+			wantFull: 1,
+		},
+		{
+			name: "peer-changed",
+			respond: func() ([]byte, error) {
+				return mappy.PeerChangedResponse(tailcfg.MapRequest{}, node, map[types.NodeID]bool{2: true}, nil)
+			},
+			wantDelta: 1,
+		},
+		{
+			name: "patch",
+			respond: func() ([]byte, error) {
+				return mappy.PeerChangedPatchResponse(tailcfg.MapRequest{}, node, []*tailcfg.PeerChange{{NodeID: 2}})
+			},
+			wantDelta: 1,
+		},
+		{
+			name: "keepalive",
+			respond: func() ([]byte, error) {
+				return mappy.KeepAliveResponse(tailcfg.MapRequest{}, node)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			beforeFull, beforeDelta := testutil.ToFloat64(full), testutil.ToFloat64(delta)
+
+			_, err := tt.respond()
+			require.NoError(t, err)
+
+			require.InDelta(t, beforeFull+tt.wantFull, testutil.ToFloat64(full), 0)
+			require.InDelta(t, beforeDelta+tt.wantDelta, testutil.ToFloat64(delta), 0)
+		})
+	}
+}
+
+func TestPeerChangedResponseOrder(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.db = &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+	mappy.notif = newTestNotifier(t)
+
+	changed := map[types.NodeID]bool{2: true}
+	for id := types.NodeID(3); id < 20; id++ {
+		changed[id] = false
+	}
+	patches := []*tailcfg.PeerChange{
+		{NodeID: 22, DERPRegion: 1},
+		{NodeID: 21},
+		{NodeID: 22, DERPRegion: 2},
+	}
+
+	for range 5 {
+		data, err := mappy.PeerChangedResponse(tailcfg.MapRequest{}, node, changed, patches)
+		require.NoError(t, err)
+
+		var resp tailcfg.MapResponse
+		require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], &resp))
+		require.Len(t, resp.PeersRemoved, 17)
+		require.True(t, slices.IsSorted(resp.PeersRemoved))
+
+		require.Len(t, resp.PeersChangedPatch, 3)
+		require.Equal(t, tailcfg.NodeID(21), resp.PeersChangedPatch[0].NodeID)
+		// Patches of the same peer keep their order.
+		require.Equal(t, 1, resp.PeersChangedPatch[1].DERPRegion)
+		require.Equal(t, 2, resp.PeersChangedPatch[2].DERPRegion)
+	}
+
+	// The patches of the caller are left untouched.
+	require.Equal(t, tailcfg.NodeID(22), patches[0].NodeID)
+}
+
+// histogramCount returns the number of observations of a histogram.
+func histogramCount(t *testing.T, observer prometheus.Observer) uint64 {
+	t.Helper()
+
+	var metric dto.Metric
+	require.NoError(t, observer.(prometheus.Metric).Write(&metric))
+
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestMapResponseSizeAndDurationMetrics(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.db = &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+	mappy.notif = newTestNotifier(t)
+
+	fullSize := mapResponseSize.WithLabelValues("full")
+	keepAliveSize := mapResponseSize.WithLabelValues("keepalive")
+	fullCompressed := mapResponseCompressedSize.WithLabelValues("full", util.ZstdCompression)
+	fullDuration := mapResponseDuration.WithLabelValues("full")
+	keepAliveDuration := mapResponseDuration.WithLabelValues("keepalive")
+
+	before := []uint64{
+		histogramCount(t, fullSize),
+		histogramCount(t, keepAliveSize),
+		histogramCount(t, fullCompressed),
+		histogramCount(t, fullDuration),
+		histogramCount(t, keepAliveDuration),
+	}
+
+	_, err := mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	_, err = mappy.FullMapResponse(tailcfg.MapRequest{Compress: util.ZstdCompression}, node)
+	require.NoError(t, err)
+	_, err = mappy.KeepAliveResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+
+	require.Equal(t, before[0]+2, histogramCount(t, fullSize))
+	require.Equal(t, before[1]+1, histogramCount(t, keepAliveSize))
+	require.Equal(t, before[2]+1, histogramCount(t, fullCompressed))
+	require.Equal(t, before[3]+2, histogramCount(t, fullDuration))
+	require.Equal(t, before[4]+1, histogramCount(t, keepAliveDuration))
+}
+
+func TestDefaultCompression(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      types.MapperConfig
+		request  tailcfg.MapRequest
+		user     string
+		wantZstd bool
+	}{
+		{
+			name:    "no-default",
+			request: tailcfg.MapRequest{Version: 100},
+		},
+		{
+			name: "user-default",
+			cfg: types.MapperConfig{
+				UserCompression: map[string]string{"user1": util.ZstdCompression},
+			},
+			request:  tailcfg.MapRequest{Version: 100},
+			user:     "User1",
+			wantZstd: true,
+		},
+		{
+			name: "user-without-compression",
+			cfg: types.MapperConfig{
+				DefaultCompression: util.ZstdCompression,
+				UserCompression:    map[string]string{"user1": ""},
+			},
+			request: tailcfg.MapRequest{Version: 100},
+			user:    "user1",
+		},
+		{
+			name: "other-user-uses-default",
+			cfg: types.MapperConfig{
+				DefaultCompression: util.ZstdCompression,
+				UserCompression:    map[string]string{"user1": ""},
+			},
+			request:  tailcfg.MapRequest{Version: 100},
+			user:     "user2",
+			wantZstd: true,
+		},
+		{
+			name: "user-default-incapable-client",
+			cfg: types.MapperConfig{
+				DefaultCompressionMinCapVer: 90,
+				UserCompression:             map[string]string{"user1": util.ZstdCompression},
+			},
+			request: tailcfg.MapRequest{Version: 80},
+			user:    "user1",
+		},
+		{
+			name: "capable-client",
+			cfg: types.MapperConfig{
+				DefaultCompression:          util.ZstdCompression,
+				DefaultCompressionMinCapVer: 90,
+			},
+			request:  tailcfg.MapRequest{Version: 100},
+			wantZstd: true,
+		},
+		{
+			name: "incapable-client",
+			cfg: types.MapperConfig{
+				DefaultCompression:          util.ZstdCompression,
+				DefaultCompressionMinCapVer: 90,
+			},
+			request: tailcfg.MapRequest{Version: 80},
+		},
+		{
+			name: "client-choice-wins",
+			cfg: types.MapperConfig{
+				DefaultCompression: util.ZstdCompression,
+			},
+			request: tailcfg.MapRequest{Version: 100, Compress: util.CBORCompression},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mappy := NewMapper(nil, &types.Config{Mapper: tt.cfg}, nil, nil, nil, nil)
+
+			data, err := mappy.KeepAliveResponse(tt.request, &types.Node{User: types.User{Name: tt.user}})
+			require.NoError(t, err)
+
+			body := data[reservedResponseHeaderSize:]
+			isZstd := bytes.HasPrefix(body, []byte{0x28, 0xb5, 0x2f, 0xfd})
+			require.Equal(t, tt.wantZstd, isZstd)
+		})
+	}
+}
+
+func TestPeerHooks(t *testing.T) {
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+	mkNode := func(id types.NodeID, ip string) *types.Node {
+		return &types.Node{
+			ID:        id,
+			Hostname:  fmt.Sprintf("node%d", id),
+			GivenName: fmt.Sprintf("node%d", id),
+			IPv4:      iap(ip),
+			UserID:    user1.ID,
+			User:      user1,
+			Hostinfo:  &tailcfg.Hostinfo{},
+		}
+	}
+	node := mkNode(1, "100.64.0.1")
+	peer2 := mkNode(2, "100.64.0.2")
+	peer3 := mkNode(3, "100.64.0.3")
+	peer4 := mkNode(4, "100.64.0.4")
+
+	polMan, err := policy.NewPolicyManager(nil, []types.User{user1}, types.Nodes{node, peer2, peer3, peer4})
+	require.NoError(t, err)
+
+	cfg := &types.Config{TailcfgDNSConfig: &tailcfg.DNSConfig{}}
+	store := &staticNodeStore{peers: types.Nodes{peer2, peer3}}
+	mappy := NewMapper(nil, cfg, &tailcfg.DERPMap{}, newTestNotifier(t), polMan, routes.New())
+	mappy.db = store
+
+	type event struct {
+		node, peer types.NodeID
+	}
+	var added, removed []event
+	mappy.OnPeerAdded(func(nodeID, peerID types.NodeID) {
+		added = append(added, event{nodeID, peerID})
+	})
+	mappy.OnPeerRemoved(func(nodeID, peerID types.NodeID) {
+		removed = append(removed, event{nodeID, peerID})
+	})
+
+	_, err = mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []event{{1, 2}, {1, 3}}, added)
+	require.Empty(t, removed)
+
+	// A changed peer that is already known is not reported as added.
+	added, removed = nil, nil
+	store.peers = types.Nodes{peer2, peer3, peer4}
+	_, err = mappy.PeerChangedResponse(
+		tailcfg.MapRequest{},
+		node,
+		map[types.NodeID]bool{2: true, 3: false, 4: true},
+		nil,
+	)
+	require.NoError(t, err)
+	require.Equal(t, []event{{1, 4}}, added)
+	require.Equal(t, []event{{1, 3}}, removed)
+
+	// A full update reports the difference to the previous state.
+	added, removed = nil, nil
+	store.peers = types.Nodes{peer3}
+	_, err = mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Equal(t, []event{{1, 3}}, added)
+	require.ElementsMatch(t, []event{{1, 2}, {1, 4}}, removed)
+}
+
+func TestQuarantinedNode(t *testing.T) {
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+	user2 := types.User{Model: gorm.Model{ID: 2}, Name: "user2"}
+	node := &types.Node{
+		ID:        1,
+		Hostname:  "suspect",
+		GivenName: "suspect",
+		IPv4:      iap("100.64.0.1"),
+		UserID:    user1.ID,
+		User:      user1,
+		Hostinfo:  &tailcfg.Hostinfo{},
+	}
+	peer := &types.Node{
+		ID:        2,
+		Hostname:  "peer",
+		GivenName: "peer",
+		IPv4:      iap("100.64.0.2"),
+		UserID:    user2.ID,
+		User:      user2,
+		Hostinfo:  &tailcfg.Hostinfo{},
+	}
+
+	polMan, err := policy.NewPolicyManager(nil, []types.User{user1, user2}, types.Nodes{node, peer})
+	require.NoError(t, err)
+
+	cfg := &types.Config{TailcfgDNSConfig: &tailcfg.DNSConfig{}}
+	mappy := NewMapper(nil, cfg, &tailcfg.DERPMap{}, newTestNotifier(t), polMan, routes.New())
+	mappy.db = &staticNodeStore{peers: types.Nodes{peer}}
+	mappy.SetQuarantine(func(n *types.Node) bool {
+		return n.ID == node.ID
+	})
+
+	resp, err := mappy.fullMapResponse(node, types.Nodes{peer}, 0)
+	require.NoError(t, err)
+	require.NotNil(t, resp.Node)
+	require.NotNil(t, resp.DERPMap)
+	require.Empty(t, resp.Peers)
+	require.Equal(t, map[string][]tailcfg.FilterRule{"base": {}}, resp.PacketFilters)
+	require.Len(t, resp.UserProfiles, 1)
+	require.Nil(t, resp.SSHPolicy)
+
+	data, err := mappy.PeerChangedPatchResponse(tailcfg.MapRequest{}, node, []*tailcfg.PeerChange{{NodeID: 2}})
+	require.NoError(t, err)
+	require.Nil(t, data)
+
+	// Other nodes are not affected.
+	resp, err = mappy.fullMapResponse(peer, types.Nodes{node}, 0)
+	require.NoError(t, err)
+	require.Len(t, resp.Peers, 1)
+	require.Equal(t, tailcfg.FilterAllowAll, resp.PacketFilters["base"])
+}
+
+func TestLockdown(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.db = &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+	mappy.notif = newTestNotifier(t)
+
+	mappy.SetLockdown(true)
+
+	resp, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.NotNil(t, resp.Node)
+	require.Equal(t, tailcfg.NodeID(node.ID), resp.Node.ID)
+	require.Empty(t, resp.Peers)
+	require.Equal(t, map[string][]tailcfg.FilterRule{"base": {}}, resp.PacketFilters)
+	require.Nil(t, resp.SSHPolicy)
+	require.Equal(t, []string{lockdownMessage}, resp.Health)
+
+	data, err := mappy.PeerChangedPatchResponse(tailcfg.MapRequest{}, node, []*tailcfg.PeerChange{{NodeID: 2}})
+	require.NoError(t, err)
+	require.Nil(t, data)
+
+	mappy.SetLockdown(false)
+
+	resp, err = mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Len(t, resp.Peers, 1)
+	require.Equal(t, tailcfg.FilterAllowAll, resp.PacketFilters["base"])
+	require.Nil(t, resp.Health)
+
+	data, err = mappy.PeerChangedPatchResponse(tailcfg.MapRequest{}, node, []*tailcfg.PeerChange{{NodeID: 2}})
+	require.NoError(t, err)
+	require.NotNil(t, data)
+}
+
+func TestLockdownReleaseRestoresHealth(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.db = &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+	mappy.notif = newTestNotifier(t)
+
+	health := func(data []byte) json.RawMessage {
+		t.Helper()
+		var resp map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], &resp))
+
+		return resp["Health"]
+	}
+
+	mappy.SetLockdown(true)
+
+	data, err := mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.JSONEq(t, `["`+lockdownMessage+`"]`, string(health(data)))
+
+	// Responses without health messages during the lockdown keep it.
+	data, err = mappy.KeepAliveResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Nil(t, health(data))
+
+	mappy.SetLockdown(false)
+
+	data, err = mappy.PeerChangedResponse(tailcfg.MapRequest{}, node, map[types.NodeID]bool{2: true}, nil)
+	require.NoError(t, err)
+	require.JSONEq(t, `[]`, string(health(data)))
+
+	// Only the first response after the release restores the health.
+	data, err = mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Nil(t, health(data))
+
+	// Nodes never locked down are not sent it.
+	data, err = mappy.FullMapResponse(tailcfg.MapRequest{}, peers[0])
+	require.NoError(t, err)
+	require.Nil(t, health(data))
+}
+
+func TestLockdownInvalidatesResponseCache(t *testing.T) {
+	mappy, node, _, generated := cacheTestMapper(t, time.Minute, 1)
+
+	_, err := mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Equal(t, 1, *generated)
+
+	mappy.SetLockdown(true)
+	_, err = mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Equal(t, 2, *generated)
+
+	// Setting the same state again keeps the cache.
+	mappy.SetLockdown(true)
+	_, err = mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Equal(t, 2, *generated)
+
+	mappy.SetLockdown(false)
+	_, err = mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Equal(t, 3, *generated)
+}
+
+func TestMinCapabilityVersion(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.db = &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+	mappy.notif = newTestNotifier(t)
+	mappy.cfg.Mapper.MinCapabilityVersion = 106
+
+	resp, err := mappy.fullMapResponse(node, peers, 95)
+	require.NoError(t, err)
+	require.NotNil(t, resp.Node)
+	require.Empty(t, resp.Peers)
+	require.Equal(t, map[string][]tailcfg.FilterRule{"base": {}}, resp.PacketFilters)
+	require.Len(t, resp.Health, 1)
+	require.Contains(t, resp.Health[0], "v1.74")
+
+	data, err := mappy.PeerChangedPatchResponse(tailcfg.MapRequest{Version: 95}, node, []*tailcfg.PeerChange{{NodeID: 2}})
+	require.NoError(t, err)
+	require.Nil(t, data)
+
+	resp, err = mappy.fullMapResponse(node, peers, 106)
+	require.NoError(t, err)
+	require.Len(t, resp.Peers, 1)
+	require.Equal(t, tailcfg.FilterAllowAll, resp.PacketFilters["base"])
+	require.Nil(t, resp.Health)
+
+	data, err = mappy.PeerChangedPatchResponse(tailcfg.MapRequest{Version: 106}, node, []*tailcfg.PeerChange{{NodeID: 2}})
+	require.NoError(t, err)
+	require.NotNil(t, data)
+}
+
+func TestServeFunnelCapabilities(t *testing.T) {
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+	user2 := types.User{Model: gorm.Model{ID: 2}, Name: "user2"}
+
+	tests := []struct {
+		name       string
+		node       *types.Node
+		wantServe  bool
+		wantFunnel bool
+	}{
+		{
+			name: "funnel-by-tag",
+			node: &types.Node{
+				ID:         1,
+				GivenName:  "web",
+				User:       user1,
+				UserID:     user1.ID,
+				ForcedTags: []string{"tag:web"},
+			},
+			wantServe:  true,
+			wantFunnel: true,
+		},
+		{
+			name: "serve-by-user",
+			node: &types.Node{
+				ID:        2,
+				GivenName: "laptop",
+				User:      user1,
+				UserID:    user1.ID,
+			},
+			wantServe: true,
+		},
+		{
+			name: "disallowed",
+			node: &types.Node{
+				ID:        3,
+				GivenName: "other",
+				User:      user2,
+				UserID:    user2.ID,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			polMan, err := policy.NewPolicyManager(nil, []types.User{user1, user2}, types.Nodes{tt.node})
+			require.NoError(t, err)
+
+			cfg := &types.Config{
+				TailcfgDNSConfig: &tailcfg.DNSConfig{},
+				Mapper: types.MapperConfig{
+					ServeAllowed:  []string{"user1"},
+					FunnelAllowed: []string{"tag:web"},
+				},
+			}
+			mappy := NewMapper(nil, cfg, &tailcfg.DERPMap{}, nil, polMan, routes.New())
+
+			resp, err := mappy.fullMapResponse(tt.node, types.Nodes{}, 0)
+			require.NoError(t, err)
+
+			_, serve := resp.Node.CapMap[tailcfg.CapabilityHTTPS]
+			_, funnel := resp.Node.CapMap[tailcfg.NodeAttrFunnel]
+			require.Equal(t, tt.wantServe, serve)
+			require.Equal(t, tt.wantFunnel, funnel)
+		})
+	}
+}
+
+func TestMaxSessionClampsKeyExpiry(t *testing.T) {
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+	farFuture := time.Now().Add(365 * 24 * time.Hour)
+	soon := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		expiry  *time.Time
+		clamped bool
+	}{
+		{
+			name:    "far-future-is-clamped",
+			expiry:  &farFuture,
+			clamped: true,
+		},
+		{
+			name:    "no-expiry-is-clamped",
+			expiry:  nil,
+			clamped: true,
+		},
+		{
+			name:    "earlier-expiry-is-kept",
+			expiry:  &soon,
+			clamped: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := &types.Node{
+				ID:        1,
+				GivenName: "mini",
+				User:      user1,
+				UserID:    user1.ID,
+				Expiry:    tt.expiry,
+			}
+
+			polMan, err := policy.NewPolicyManager(nil, []types.User{user1}, types.Nodes{node})
+			require.NoError(t, err)
+
+			cfg := &types.Config{
+				TailcfgDNSConfig: &tailcfg.DNSConfig{},
+				Mapper: types.MapperConfig{
+					MaxSession: 24 * time.Hour,
+				},
+			}
+			mappy := NewMapper(nil, cfg, &tailcfg.DERPMap{}, nil, polMan, routes.New())
+
+			before := time.Now()
+			resp, err := mappy.fullMapResponse(node, types.Nodes{}, 0)
+			require.NoError(t, err)
+
+			if tt.clamped {
+				require.WithinRange(t, resp.Node.KeyExpiry, before.Add(24*time.Hour), time.Now().Add(24*time.Hour))
+			} else {
+				require.True(t, resp.Node.KeyExpiry.Equal(*tt.expiry))
+			}
+		})
+	}
+}
+
+func TestPeerProjection(t *testing.T) {
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+	user2 := types.User{Model: gorm.Model{ID: 2}, Name: "user2"}
+
+	peer := &types.Node{
+		ID:        3,
+		GivenName: "peer",
+		User:      user2,
+		UserID:    user2.ID,
+		IPv4:      iap("100.64.0.3"),
+		Hostinfo:  &tailcfg.Hostinfo{OS: "linux", Hostname: "peer"},
+		Endpoints: []netip.AddrPort{netip.MustParseAddrPort("192.0.2.1:41641")},
+	}
+
+	tests := []struct {
+		name      string
+		node      *types.Node
+		projected bool
+	}{
+		{
+			name: "projected",
+			node: &types.Node{
+				ID:        1,
+				GivenName: "sensor",
+				User:      user1,
+				UserID:    user1.ID,
+				IPv4:      iap("100.64.0.1"),
+			},
+			projected: true,
+		},
+		{
+			name: "not-projected",
+			node: &types.Node{
+				ID:        2,
+				GivenName: "laptop",
+				User:      user2,
+				UserID:    user2.ID,
+				IPv4:      iap("100.64.0.2"),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			polMan, err := policy.NewPolicyManager(nil, []types.User{user1, user2}, types.Nodes{tt.node, peer})
+			require.NoError(t, err)
+
+			cfg := &types.Config{
+				TailcfgDNSConfig: &tailcfg.DNSConfig{},
+				Mapper: types.MapperConfig{
+					PeerProjection: types.PeerProjectionConfig{
+						Nodes: []string{"user1"},
+						Omit:  []string{types.PeerFieldHostinfo, types.PeerFieldEndpoints},
+					},
+				},
+			}
+			mappy := NewMapper(nil, cfg, &tailcfg.DERPMap{}, nil, polMan, routes.New())
+
+			resp, err := mappy.fullMapResponse(tt.node, types.Nodes{peer}, 0)
+			require.NoError(t, err)
+			require.Len(t, resp.Peers, 1)
+
+			got := resp.Peers[0]
+			require.Equal(t, tt.projected, !got.Hostinfo.Valid())
+			require.Equal(t, tt.projected, got.Endpoints == nil)
+			require.NotEmpty(t, got.Addresses)
+		})
+	}
+}
+
+func TestPeerProjectionRequestTags(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.cfg.Mapper.PeerProjection = types.PeerProjectionConfig{
+		Nodes: []string{"tag:sensor"},
+		Omit:  []string{types.PeerFieldHostinfo},
+	}
+
+	// The node is tagged by the policy approving its requested tag.
+	node.Hostinfo.RequestTags = []string{"tag:sensor"}
+	pol := []byte(`{
+		"tagOwners": {"tag:sensor": ["user1@"]},
+		"acls": [{"action": "accept", "src": ["*"], "dst": ["*:*"]}]
+	}`)
+	polMan, err := policy.NewPolicyManager(pol, []types.User{node.User}, append(types.Nodes{node}, peers...))
+	require.NoError(t, err)
+	mappy.polMan = polMan
+
+	resp, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Len(t, resp.Peers, 1)
+	require.False(t, resp.Peers[0].Hostinfo.Valid())
+}
+
+func TestProjectPeersDoesNotModifySharedPatches(t *testing.T) {
+	patch := &tailcfg.PeerChange{
+		NodeID:    3,
+		Endpoints: []netip.AddrPort{netip.MustParseAddrPort("192.0.2.1:41641")},
+	}
+	resp := &tailcfg.MapResponse{PeersChangedPatch: []*tailcfg.PeerChange{patch}}
+
+	projectPeers(resp, []string{types.PeerFieldEndpoints})
+
+	require.Nil(t, resp.PeersChangedPatch[0].Endpoints)
+	require.Len(t, patch.Endpoints, 1)
+}
+
+func TestGenerateUserProfilesTagged(t *testing.T) {
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+	user2 := types.User{Model: gorm.Model{ID: 2}, Name: "user2"}
+
+	node := &types.Node{ID: 1, GivenName: "mini", User: user1, UserID: user1.ID}
+	peers := types.Nodes{
+		{ID: 2, GivenName: "laptop", User: user2, UserID: user2.ID},
+		{ID: 3, GivenName: "server1", User: user2, UserID: user2.ID, ForcedTags: []string{"tag:server"}},
+		{ID: 4, GivenName: "server2", User: user1, UserID: user1.ID, ForcedTags: []string{"tag:server"}},
+		{ID: 5, GivenName: "web", User: user1, UserID: user1.ID, ForcedTags: []string{"tag:web", "tag:db"}},
+	}
+
+	polMan, err := policy.NewPolicyManager(nil, []types.User{user1, user2}, append(types.Nodes{node}, peers...))
+	require.NoError(t, err)
+
+	want := []tailcfg.UserProfile{
+		user1.TailscaleUserProfile(),
+		user2.TailscaleUserProfile(),
+		tagUserProfile("tag:db"),
+		tagUserProfile("tag:server"),
+	}
+	slices.SortFunc(want, func(a, b tailcfg.UserProfile) int {
+		return int(a.ID - b.ID)
+	})
+
+	got := generateUserProfiles(node, peers, polMan, &types.Config{})
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("generateUserProfiles() unexpected result (-want +got):\n%s", diff)
+	}
+
+	require.Equal(t, "tag:server", tagUserProfile("tag:server").DisplayName)
+
+	tailPeers, err := tailNodes(peers, 0, polMan, func(types.NodeID) []netip.Prefix { return nil }, &types.Config{})
+	require.NoError(t, err)
+
+	profileIDs := make(map[tailcfg.UserID]bool)
+	for _, profile := range got {
+		profileIDs[profile.ID] = true
+	}
+	for _, peer := range tailPeers {
+		require.True(t, profileIDs[peer.User], "peer %d has no user profile", peer.ID)
+	}
+	require.Equal(t, tailcfg.UserID(user2.ID), tailPeers[0].User)
+	require.Equal(t, tagUserID("tag:server"), tailPeers[1].User)
+	require.Equal(t, tagUserID("tag:server"), tailPeers[2].User)
+	require.Equal(t, tagUserID("tag:db"), tailPeers[3].User)
+}
+
+func TestRegionBaseDomains(t *testing.T) {
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+
+	nodeInRegion := func(id types.NodeID, name string, region int) *types.Node {
+		return &types.Node{
+			ID:        id,
+			GivenName: name,
+			User:      user1,
+			UserID:    user1.ID,
+			Hostinfo: &tailcfg.Hostinfo{
+				NetInfo: &tailcfg.NetInfo{PreferredDERP: region},
+			},
+		}
+	}
+
+	eu := nodeInRegion(1, "eu-node", 900)
+	us := nodeInRegion(2, "us-node", 901)
+	other := nodeInRegion(3, "other-node", 1)
+
+	cfg := &types.Config{
+		BaseDomain: "example.com",
+		TailcfgDNSConfig: &tailcfg.DNSConfig{
+			Proxied: true,
+			Domains: []string{"example.com", "search.test"},
+		},
+		Mapper: types.MapperConfig{
+			RegionBaseDomains: map[int]string{
+				900: "eu.example.com",
+				901: "us.example.com",
+			},
+		},
+	}
+
+	tests := []struct {
+		node        *types.Node
+		wantName    string
+		wantDomains []string
+		wantRoutes  []string
+	}{
+		{
+			node:        eu,
+			wantName:    "eu-node.eu.example.com.",
+			wantDomains: []string{"eu.example.com", "search.test"},
+			wantRoutes:  []string{"example.com", "us.example.com"},
+		},
+		{
+			node:        us,
+			wantName:    "us-node.us.example.com.",
+			wantDomains: []string{"us.example.com", "search.test"},
+			wantRoutes:  []string{"eu.example.com", "example.com"},
+		},
+		{
+			node:        other,
+			wantName:    "other-node.example.com.",
+			wantDomains: []string{"example.com", "search.test"},
+			wantRoutes:  []string{"eu.example.com", "us.example.com"},
+		},
+	}
+
+	polMan, err := policy.NewPolicyManager(nil, []types.User{user1}, types.Nodes{eu, us, other})
+	require.NoError(t, err)
+
+	for _, tt := range tests {
+		t.Run(tt.node.GivenName, func(t *testing.T) {
+			tn, err := tailNode(tt.node, 0, polMan, func(types.NodeID) []netip.Prefix { return nil }, cfg)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantName, tn.Name)
+
+			dnsConfig := generateDNSConfig(cfg, tt.node, nil)
+			require.Equal(t, tt.wantDomains, dnsConfig.Domains)
+			require.Equal(t, tt.wantRoutes, slices.Sorted(maps.Keys(dnsConfig.Routes)))
+		})
+	}
+
+	// The shared configuration must not be modified.
+	require.Equal(t, []string{"example.com", "search.test"}, cfg.TailcfgDNSConfig.Domains)
+	require.Nil(t, cfg.TailcfgDNSConfig.Routes)
+}
+
+func TestOrphanedNode(t *testing.T) {
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+
+	node := &types.Node{ID: 1, GivenName: "mini", User: user1, UserID: user1.ID, IPv4: iap("100.64.0.1")}
+	orphan := &types.Node{ID: 2, GivenName: "orphan", IPv4: iap("100.64.0.2")}
+
+	polMan, err := policy.NewPolicyManager(nil, []types.User{user1}, types.Nodes{node, orphan})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		orphanUser   string
+		wantProfiles []tailcfg.UserProfile
+		wantUser     tailcfg.UserID
+	}{
+		{
+			name:         "skipped",
+			wantProfiles: []tailcfg.UserProfile{user1.TailscaleUserProfile()},
+			wantUser:     0,
+		},
+		{
+			name:       "orphan-user",
+			orphanUser: "orphaned",
+			wantProfiles: []tailcfg.UserProfile{
+				user1.TailscaleUserProfile(),
+				{ID: orphanUserID, LoginName: "orphaned", DisplayName: "orphaned"},
+			},
+			wantUser: orphanUserID,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &types.Config{
+				TailcfgDNSConfig: &tailcfg.DNSConfig{},
+				Mapper:           types.MapperConfig{OrphanUserName: tt.orphanUser},
+			}
+
+			got := generateUserProfiles(node, types.Nodes{orphan}, polMan, cfg)
+			if diff := cmp.Diff(tt.wantProfiles, got); diff != "" {
+				t.Errorf("generateUserProfiles() unexpected result (-want +got):\n%s", diff)
+			}
+
+			mappy := NewMapper(nil, cfg, &tailcfg.DERPMap{}, nil, polMan, routes.New())
+
+			resp, err := mappy.fullMapResponse(node, types.Nodes{orphan}, 0)
+			require.NoError(t, err)
+			require.Len(t, resp.Peers, 1)
+			require.Equal(t, tt.wantUser, resp.Peers[0].User)
+			require.Equal(t, "orphan", resp.Peers[0].Name)
+
+			resp, err = mappy.fullMapResponse(orphan, types.Nodes{node}, 0)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantUser, resp.Node.User)
+		})
+	}
+}
+
+func TestDataPlaneAuditLogID(t *testing.T) {
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+	node1 := &types.Node{ID: 1, GivenName: "node1", User: user1, UserID: user1.ID, IPv4: iap("100.64.0.1")}
+	node2 := &types.Node{ID: 2, GivenName: "node2", User: user1, UserID: user1.ID, IPv4: iap("100.64.0.2")}
+
+	polMan, err := policy.NewPolicyManager(nil, []types.User{user1}, types.Nodes{node1, node2})
+	require.NoError(t, err)
+
+	generate := func(secret string, node *types.Node, peers types.Nodes) *tailcfg.MapResponse {
+		cfg := &types.Config{
+			TailcfgDNSConfig: &tailcfg.DNSConfig{},
+			Mapper:           types.MapperConfig{DataPlaneAuditLogSecret: secret},
+		}
+		mappy := NewMapper(nil, cfg, &tailcfg.DERPMap{}, nil, polMan, routes.New())
+
+		resp, err := mappy.fullMapResponse(node, peers, 0)
+		require.NoError(t, err)
+
+		return resp
+	}
+
+	resp1 := generate("secret", node1, types.Nodes{node2})
+	resp2 := generate("secret", node2, types.Nodes{node1})
+
+	require.Len(t, resp1.Node.DataPlaneAuditLogID, 64)
+	require.Len(t, resp2.Node.DataPlaneAuditLogID, 64)
+	require.NotEqual(t, resp1.Node.DataPlaneAuditLogID, resp2.Node.DataPlaneAuditLogID)
+
+	// The ID is stable for the node but depends on the secret.
+	require.Equal(t, resp1.Node.DataPlaneAuditLogID, generate("secret", node1, nil).Node.DataPlaneAuditLogID)
+	require.NotEqual(t, resp1.Node.DataPlaneAuditLogID, generate("other", node1, nil).Node.DataPlaneAuditLogID)
+
+	// The ID is only sent to the node itself.
+	require.Len(t, resp1.Peers, 1)
+	require.Empty(t, resp1.Peers[0].DataPlaneAuditLogID)
+
+	require.Empty(t, generate("", node1, nil).Node.DataPlaneAuditLogID)
+}
+
+func TestFullMapResponseDBRetry(t *testing.T) {
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+	node := &types.Node{ID: 1, GivenName: "mini", User: user1, UserID: user1.ID, IPv4: iap("100.64.0.1")}
+	peer := &types.Node{ID: 2, GivenName: "peer", User: user1, UserID: user1.ID, IPv4: iap("100.64.0.2")}
+
+	polMan, err := policy.NewPolicyManager(nil, []types.User{user1}, types.Nodes{node, peer})
+	require.NoError(t, err)
+
+	errPermanent := errors.New("no such table: nodes")
+
+	tests := []struct {
+		name      string
+		err       error
+		failures  int
+		retries   int
+		wantErr   error
+		wantCalls int
+	}{
+		{
+			name:      "transient-error-retried",
+			err:       driver.ErrBadConn,
+			failures:  1,
+			retries:   2,
+			wantCalls: 2,
+		},
+		{
+			name:      "retries-used-up",
+			err:       driver.ErrBadConn,
+			failures:  5,
+			retries:   2,
+			wantErr:   driver.ErrBadConn,
+			wantCalls: 3,
+		},
+		{
+			name:      "permanent-error-not-retried",
+			err:       errPermanent,
+			failures:  1,
+			retries:   2,
+			wantErr:   errPermanent,
+			wantCalls: 1,
+		},
+		{
+			name:      "retries-disabled",
+			err:       driver.ErrBadConn,
+			failures:  1,
+			retries:   0,
+			wantErr:   driver.ErrBadConn,
+			wantCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &types.Config{
+				TailcfgDNSConfig: &tailcfg.DNSConfig{},
+				Tuning: types.Tuning{
+					MapResponseDBRetries:      tt.retries,
+					MapResponseDBRetryBackoff: time.Millisecond,
+				},
+			}
+			mappy := NewMapper(nil, cfg, &tailcfg.DERPMap{}, newTestNotifier(t), polMan, routes.New())
+			store := &flakyNodeStore{
+				staticNodeStore: staticNodeStore{peers: types.Nodes{peer}},
+				err:             tt.err,
+				failures:        tt.failures,
+			}
+			mappy.db = store
+
+			_, err := mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.wantCalls, store.calls)
+		})
+	}
+}
+
+func TestDNSDisabledNode(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.cfg.TailcfgDNSConfig = &tailcfg.DNSConfig{
+		Proxied:   true,
+		Resolvers: []*dnstype.Resolver{{Addr: "1.1.1.1"}},
+		Domains:   []string{"example.com"},
+	}
+	mappy.cfg.Mapper.DNSDisabled = []string{"tag:no-dns"}
+	node.ForcedTags = []string{"tag:no-dns"}
+
+	resp, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Equal(t, &tailcfg.DNSConfig{}, resp.DNSConfig)
+
+	// Other nodes still get the full configuration.
+	resp, err = mappy.fullMapResponse(peers[0], types.Nodes{node}, 0)
+	require.NoError(t, err)
+	require.True(t, resp.DNSConfig.Proxied)
+	require.Len(t, resp.DNSConfig.Resolvers, 1)
+	require.Equal(t, []string{"example.com"}, resp.DNSConfig.Domains)
+}
+
+func TestSimulateRequest(t *testing.T) {
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+	node := &types.Node{ID: 1, GivenName: "mini", User: user1, UserID: user1.ID, IPv4: iap("100.64.0.1")}
+	peer := &types.Node{ID: 2, GivenName: "peer", User: user1, UserID: user1.ID, IPv4: iap("100.64.0.2")}
+
+	polMan, err := policy.NewPolicyManager(nil, []types.User{user1}, types.Nodes{node, peer})
+	require.NoError(t, err)
+
+	cfg := &types.Config{TailcfgDNSConfig: &tailcfg.DNSConfig{}}
+	mappy := NewMapper(nil, cfg, &tailcfg.DERPMap{}, newTestNotifier(t), polMan, routes.New())
+	mappy.db = &staticNodeStore{peers: types.Nodes{node, peer}}
+
+	resp, err := mappy.SimulateRequest(node.ID, nil)
+	require.NoError(t, err)
+	require.Equal(t, tailcfg.NodeID(node.ID), resp.Node.ID)
+	require.Len(t, resp.Peers, 1)
+	require.Equal(t, tailcfg.NodeID(peer.ID), resp.Peers[0].ID)
+
+	// A policy not allowing traffic between the nodes hides the peer
+	// without changing the policy of the mapper.
+	pol := []byte(`{"acls": [{"action": "accept", "src": ["100.64.0.1"], "dst": ["192.168.0.0/24:*"]}]}`)
+	restricted, err := policy.NewPolicyManager(pol, []types.User{user1}, types.Nodes{node, peer})
+	require.NoError(t, err)
+
+	resp, err = mappy.SimulateRequest(node.ID, restricted)
+	require.NoError(t, err)
+	require.Empty(t, resp.Peers)
+	require.Same(t, polMan, mappy.polMan)
+
+	_, err = mappy.SimulateRequest(3, nil)
+	require.ErrorIs(t, err, db.ErrNodeNotFound)
+}
+
+func TestPeerAPIOnly(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.cfg.Mapper.PeerAPIOnly = []string{"tag:sensor"}
+	node.ForcedTags = []string{"tag:sensor"}
+
+	resp, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.True(t, resp.Node.UnsignedPeerAPIOnly)
+	require.False(t, resp.Peers[0].UnsignedPeerAPIOnly)
+
+	// Peers are told about the restricted node too.
+	resp, err = mappy.fullMapResponse(peers[0], types.Nodes{node}, 0)
+	require.NoError(t, err)
+	require.False(t, resp.Node.UnsignedPeerAPIOnly)
+	require.True(t, resp.Peers[0].UnsignedPeerAPIOnly)
+}
+
+func TestOversizedResponse(t *testing.T) {
+	mappy, node, _, _ := cacheTestMapper(t, 0, 20)
+
+	var calls []int
+	mappy.OnOversizedResponse(1024, func(n *types.Node, size int) {
+		require.Equal(t, node.ID, n.ID)
+		calls = append(calls, size)
+	})
+
+	data, err := mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Greater(t, len(data), 1024+reservedResponseHeaderSize)
+	require.Equal(t, []int{len(data) - reservedResponseHeaderSize}, calls)
+
+	// Small responses are within the budget.
+	_, err = mappy.KeepAliveResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Len(t, calls, 1)
+}
+
+func TestResponseHook(t *testing.T) {
+	mappy, node, _, _ := cacheTestMapper(t, 0, 2)
+
+	var seen []string
+	mappy.SetResponseHook(func(n *types.Node, resp *tailcfg.MapResponse) {
+		require.Equal(t, node.ID, n.ID)
+		seen = append(seen, mapResponseType(resp))
+		resp.Health = []string{"maintenance tonight"}
+	})
+
+	for _, compression := range []string{"", util.ZstdCompression} {
+		data, err := mappy.FullMapResponse(tailcfg.MapRequest{Compress: compression}, node)
+		require.NoError(t, err)
+
+		body := data[reservedResponseHeaderSize:]
+		if compression == util.ZstdCompression {
+			decoder, err := zstd.NewReader(nil)
+			require.NoError(t, err)
+			body, err = decoder.DecodeAll(body, nil)
+			decoder.Close()
+			require.NoError(t, err)
+		}
+
+		var resp tailcfg.MapResponse
+		require.NoError(t, json.Unmarshal(body, &resp))
+		require.Equal(t, []string{"maintenance tonight"}, resp.Health)
+		require.Len(t, resp.Peers, 2)
+	}
+
+	_, err := mappy.KeepAliveResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Equal(t, []string{"full", "full", "keepalive"}, seen)
+}
+
+// stubPresence is a PresenceProvider knowing the nodes in the map.
+type stubPresence map[types.NodeID]bool
+
+func (p stubPresence) Online(nodeID types.NodeID) (bool, bool) {
+	online, ok := p[nodeID]
+
+	return online, ok
+}
+
+func TestPresenceProvider(t *testing.T) {
+	mappy, node, _ := pipelineTestMapper(t)
+	mappy.notif = newTestNotifier(t)
+
+	peer := func(id types.NodeID) *types.Node {
+		return &types.Node{
+			ID:        id,
+			GivenName: fmt.Sprintf("peer%d", id),
+			User:      node.User,
+			UserID:    node.UserID,
+			IPv4:      iap(fmt.Sprintf("100.64.0.%d", id)),
+		}
+	}
+	mappy.db = &staticNodeStore{peers: types.Nodes{node, peer(2), peer(3), peer(4)}}
+
+	// Peers 2 and 4 are connected to headscale.
+	mappy.notif.AddNode(2, make(chan types.StateUpdate, 1))
+	mappy.notif.AddNode(4, make(chan types.StateUpdate, 1))
+
+	online := func() map[tailcfg.NodeID]bool {
+		data, err := mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+		require.NoError(t, err)
+
+		var resp tailcfg.MapResponse
+		require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], &resp))
+
+		got := make(map[tailcfg.NodeID]bool)
+		for _, peer := range resp.Peers {
+			got[peer.ID] = peer.Online != nil && *peer.Online
+		}
+
+		return got
+	}
+
+	require.Equal(t, map[tailcfg.NodeID]bool{2: true, 3: false, 4: true}, online())
+
+	// The provider overrides the connection state of the peers it
+	// knows, peer 4 is unknown to it.
+	mappy.SetPresenceProvider(stubPresence{2: false, 3: true})
+	require.Equal(t, map[tailcfg.NodeID]bool{2: false, 3: true, 4: true}, online())
+
+	// Patches from connection changes follow the provider as well.
+	offline := false
+	data, err := mappy.PeerChangedPatchResponse(tailcfg.MapRequest{}, node, []*tailcfg.PeerChange{
+		{NodeID: 3, Online: &offline},
+		{NodeID: 4, Online: &offline},
+	})
+	require.NoError(t, err)
+
+	var resp tailcfg.MapResponse
+	require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], &resp))
+	require.Len(t, resp.PeersChangedPatch, 2)
+	require.True(t, *resp.PeersChangedPatch[0].Online)
+	require.False(t, *resp.PeersChangedPatch[1].Online)
+}
+
+// newTestDB returns a migrated sqlite database in a temporary directory.
+func newTestDB(t *testing.T, name string) *db.HSDatabase {
+	t.Helper()
+
+	hsdb, err := db.NewHeadscaleDatabase(
+		types.DatabaseConfig{
+			Type:   types.DatabaseSqlite,
+			Sqlite: types.SqliteConfig{Path: filepath.Join(t.TempDir(), name)},
+		},
+		"",
+		zcache.New[types.RegistrationID, types.RegisterNode](time.Minute, time.Hour),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { hsdb.Close() })
+	require.NoError(t, hsdb.DB.AutoMigrate(&types.User{}, &types.PreAuthKey{}, &types.Node{}))
+
+	return hsdb
+}
+
+func TestSelfNodeCreated(t *testing.T) {
+	hsdb := newTestDB(t, "headscale.db")
+
+	user1 := types.User{Name: "user1"}
+	require.NoError(t, hsdb.DB.Create(&user1).Error)
+	node := &types.Node{
+		ID:         1,
+		Hostname:   "mini",
+		GivenName:  "mini",
+		UserID:     user1.ID,
+		MachineKey: key.NewMachine().Public(),
+		NodeKey:    key.NewNode().Public(),
+		DiscoKey:   key.NewDisco().Public(),
+		IPv4:       iap("100.64.0.1"),
+		CreatedAt:  time.Date(2024, 3, 1, 12, 30, 0, 0, time.FixedZone("CET", 3600)),
+	}
+	require.NoError(t, hsdb.DB.Create(node).Error)
+
+	polMan, err := policy.NewPolicyManager(nil, []types.User{user1}, types.Nodes{node})
+	require.NoError(t, err)
+
+	cfg := &types.Config{TailcfgDNSConfig: &tailcfg.DNSConfig{}}
+	mappy := NewMapper(hsdb, cfg, &tailcfg.DERPMap{}, newTestNotifier(t), polMan, routes.New())
+
+	nodes, err := mappy.ListNodes(node.ID)
+	require.NoError(t, err)
+	require.Len(t, nodes, 1)
+
+	resp, err := mappy.fullMapResponse(nodes[0], types.Nodes{}, 0)
+	require.NoError(t, err)
+	require.True(t, node.CreatedAt.Equal(resp.Node.Created), "want %s, got %s", node.CreatedAt, resp.Node.Created)
+	require.Equal(t, time.UTC, resp.Node.Created.Location())
+}
+
+func TestNodeKeyRotation(t *testing.T) {
+	hsdb := newTestDB(t, "headscale.db")
+
+	user1 := types.User{Name: "user1"}
+	require.NoError(t, hsdb.DB.Create(&user1).Error)
+	newNode := func(id types.NodeID, name string) *types.Node {
+		return &types.Node{
+			ID:         id,
+			Hostname:   name,
+			GivenName:  name,
+			UserID:     user1.ID,
+			MachineKey: key.NewMachine().Public(),
+			NodeKey:    key.NewNode().Public(),
+			DiscoKey:   key.NewDisco().Public(),
+			IPv4:       iap(fmt.Sprintf("100.64.0.%d", id)),
+		}
+	}
+	node, peer := newNode(1, "mini"), newNode(2, "peer")
+	require.NoError(t, hsdb.DB.Create(node).Error)
+	require.NoError(t, hsdb.DB.Create(peer).Error)
+
+	polMan, err := policy.NewPolicyManager(nil, []types.User{user1}, types.Nodes{node, peer})
+	require.NoError(t, err)
+
+	cfg := &types.Config{
+		TailcfgDNSConfig: &tailcfg.DNSConfig{},
+		Tuning:           types.Tuning{MapResponseCacheTTL: time.Minute},
+	}
+	mappy := NewMapper(hsdb, cfg, &tailcfg.DERPMap{}, newTestNotifier(t), polMan, routes.New())
+
+	// keys returns the key of the node in its own map response and in
+	// the map response of its peer.
+	keys := func() (key.NodePublic, key.NodePublic) {
+		t.Helper()
+
+		nodes, err := mappy.ListNodes(node.ID, peer.ID)
+		require.NoError(t, err)
+		require.Len(t, nodes, 2)
+
+		var self, seen tailcfg.MapResponse
+		for _, tt := range []struct {
+			node *types.Node
+			resp *tailcfg.MapResponse
+		}{{nodes[0], &self}, {nodes[1], &seen}} {
+			data, err := mappy.FullMapResponse(tailcfg.MapRequest{}, tt.node)
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], tt.resp))
+		}
+		require.Len(t, seen.Peers, 1)
+
+		return self.Node.Key, seen.Peers[0].Key
+	}
+
+	self, seen := keys()
+	require.Equal(t, node.NodeKey, self)
+	require.Equal(t, node.NodeKey, seen)
+
+	// The client registers its new node key, after which it is the
+	// only key of the node.
+	rotated := key.NewNode().Public()
+	require.NoError(t, hsdb.DB.Transaction(func(tx *gorm.DB) error {
+		return db.NodeSetNodeKey(tx, node, rotated)
+	}))
+
+	self, seen = keys()
+	require.Equal(t, rotated, self)
+	require.Equal(t, rotated, seen)
+}
+
+func TestListPeersContextCancelled(t *testing.T) {
+	hsdb := newTestDB(t, "headscale.db")
+
+	mappy := NewMapper(hsdb, &types.Config{}, &tailcfg.DERPMap{}, newTestNotifier(t), nil, routes.New())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := mappy.listPeers(ctx, 1)
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, err = mappy.listPeers(context.Background(), 1)
+	require.NoError(t, err)
+}
+
+func TestControlTimeJitter(t *testing.T) {
+	const bound = 2 * time.Second
+
+	for range 1000 {
+		j := jitter(bound)
+		require.GreaterOrEqual(t, j, -bound)
+		require.LessOrEqual(t, j, bound)
+	}
+	require.Zero(t, jitter(0))
+
+	// Without jitter configured ControlTime is the current time.
+	mappy := NewMapper(nil, &types.Config{}, &tailcfg.DERPMap{}, nil, nil, routes.New())
+	before := time.Now()
+	resp := mappy.baseMapResponse()
+	require.False(t, resp.ControlTime.Before(before))
+	require.False(t, resp.ControlTime.After(time.Now()))
+
+	mappy.cfg.Tuning.ControlTimeJitter = bound
+	before = time.Now()
+	resp = mappy.baseMapResponse()
+	require.False(t, resp.ControlTime.Before(before.Add(-bound)))
+	require.False(t, resp.ControlTime.After(time.Now().Add(bound)))
+}
+
+func TestDERPOnly(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.cfg.Mapper.DERPOnly = []string{"tag:relayed"}
+	mappy.db = &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+	mappy.notif = newTestNotifier(t)
+
+	endpoints := []netip.AddrPort{netip.MustParseAddrPort("192.0.2.1:41641")}
+	node.ForcedTags = []string{"tag:relayed"}
+	node.Endpoints = endpoints
+	peers[0].Endpoints = endpoints
+
+	// The DERP-only node is not sent the endpoints of its peers.
+	resp, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Empty(t, resp.Peers[0].Endpoints)
+
+	// Its peers are not sent its endpoints.
+	resp, err = mappy.fullMapResponse(peers[0], types.Nodes{node}, 0)
+	require.NoError(t, err)
+	require.Empty(t, resp.Peers[0].Endpoints)
+	require.Equal(t, endpoints, resp.Node.Endpoints)
+
+	patch := &tailcfg.PeerChange{NodeID: tailcfg.NodeID(node.ID), Endpoints: endpoints}
+	data, err := mappy.PeerChangedPatchResponse(tailcfg.MapRequest{}, peers[0], []*tailcfg.PeerChange{patch})
+	require.NoError(t, err)
+
+	var update tailcfg.MapResponse
+	require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], &update))
+	require.Len(t, update.PeersChangedPatch, 1)
+	require.Empty(t, update.PeersChangedPatch[0].Endpoints)
+	require.Equal(t, endpoints, patch.Endpoints)
+
+	// Other nodes keep their endpoints.
+	mappy.cfg.Mapper.DERPOnly = nil
+	resp, err = mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Equal(t, endpoints, resp.Peers[0].Endpoints)
+
+	// Tags approved by the policy count like the tags sent in the netmap.
+	mappy.cfg.Mapper.DERPOnly = []string{"tag:relayed"}
+	node.ForcedTags = nil
+	node.Hostinfo.RequestTags = []string{"tag:relayed"}
+	polMan, err := policy.NewPolicyManager([]byte(`{
+		"tagOwners": {"tag:relayed": ["user1@"]},
+		"acls": [{"action": "accept", "src": ["*"], "dst": ["*:*"]}]
+	}`), []types.User{node.User}, append(types.Nodes{node}, peers...))
+	require.NoError(t, err)
+	mappy.polMan = polMan
+	resp, err = mappy.fullMapResponse(peers[0], types.Nodes{node}, 0)
+	require.NoError(t, err)
+	require.Empty(t, resp.Peers[0].Endpoints)
+}
+
+func TestStripOfflineEndpoints(t *testing.T) {
+	mappy, node, _ := pipelineTestMapper(t)
+	mappy.cfg.Mapper.StripOfflineEndpoints = true
+
+	endpoints := []netip.AddrPort{netip.MustParseAddrPort("192.0.2.1:41641")}
+	online, offline := true, false
+	peer := func(id types.NodeID, isOnline *bool) *types.Node {
+		return &types.Node{
+			ID:        id,
+			GivenName: fmt.Sprintf("peer%d", id),
+			User:      node.User,
+			UserID:    node.UserID,
+			IPv4:      iap(fmt.Sprintf("100.64.0.%d", id)),
+			Endpoints: endpoints,
+			IsOnline:  isOnline,
+			Hostinfo: &tailcfg.Hostinfo{
+				NetInfo: &tailcfg.NetInfo{PreferredDERP: 10},
+			},
+		}
+	}
+	peers := types.Nodes{peer(2, &online), peer(3, &offline), peer(4, nil)}
+
+	resp, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Len(t, resp.Peers, 3)
+
+	// Online peers keep their endpoints.
+	require.Equal(t, endpoints, resp.Peers[0].Endpoints)
+
+	// Offline peers, and peers of unknown status, only keep DERP.
+	for _, peer := range resp.Peers[1:] {
+		require.Empty(t, peer.Endpoints)
+		require.Equal(t, 10, peer.HomeDERP)
+	}
+
+	mappy.cfg.Mapper.StripOfflineEndpoints = false
+	resp, err = mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	for _, peer := range resp.Peers {
+		require.Equal(t, endpoints, peer.Endpoints)
+	}
+}
+
+func TestDERPMapMinInterval(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	mappy.now = func() time.Time { return now }
+
+	// Updates are not throttled by default.
+	for range 2 {
+		data, err := mappy.DERPMapResponse(tailcfg.MapRequest{}, node)
+		require.NoError(t, err)
+		require.NotNil(t, data)
+	}
+
+	mappy.cfg.Tuning.DERPMapMinInterval = time.Hour
+
+	// Full responses always contain the DERP map.
+	resp, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.NotNil(t, resp.DERPMap)
+
+	now = now.Add(10 * time.Minute)
+	data, err := mappy.DERPMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Nil(t, data)
+
+	// Other nodes are throttled on their own.
+	data, err = mappy.DERPMapResponse(tailcfg.MapRequest{}, peers[0])
+	require.NoError(t, err)
+	require.NotNil(t, data)
+
+	now = now.Add(time.Hour)
+	data, err = mappy.DERPMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.NotNil(t, data)
+
+	now = now.Add(time.Minute)
+	data, err = mappy.DERPMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Nil(t, data)
+
+	// The withheld map is still used for the next full response.
+	mappy.SetDERPMap(&tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{2: {RegionID: 2}}})
+	_, err = mappy.DERPMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	resp, err = mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Contains(t, resp.DERPMap.Regions, 2)
+}
+
+func TestDERPMapThrottledDelivery(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.notif = newTestNotifier(t)
+	mappy.db = &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+	mappy.cfg.Tuning.DERPMapMinInterval = time.Hour
+
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	mappy.now = func() time.Time { return now }
+
+	decode := func(data []byte) tailcfg.MapResponse {
+		t.Helper()
+		var resp tailcfg.MapResponse
+		require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], &resp))
+
+		return resp
+	}
+
+	_, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+
+	mappy.SetDERPMap(&tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{2: {RegionID: 2}}})
+	data, err := mappy.DERPMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Nil(t, data)
+
+	// Within the interval keep alives stay keep alives.
+	data, err = mappy.KeepAliveResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.True(t, decode(data).KeepAlive)
+
+	// Once it passed, the withheld map is sent with the next keep alive.
+	now = now.Add(time.Hour)
+	data, err = mappy.KeepAliveResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	resp := decode(data)
+	require.False(t, resp.KeepAlive)
+	require.Contains(t, resp.DERPMap.Regions, 2)
+
+	data, err = mappy.KeepAliveResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.True(t, decode(data).KeepAlive)
+
+	// Or with the next peer change.
+	data, err = mappy.DERPMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Nil(t, data)
+
+	now = now.Add(time.Hour)
+	data, err = mappy.PeerChangedResponse(tailcfg.MapRequest{}, node, map[types.NodeID]bool{peers[0].ID: true}, nil)
+	require.NoError(t, err)
+	require.Contains(t, decode(data).DERPMap.Regions, 2)
+
+	data, err = mappy.KeepAliveResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.True(t, decode(data).KeepAlive)
+}
+
+func TestPolicyNodeAttrs(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+
+	pol := []byte(`{"nodeAttrs": [{"target": ["100.64.0.1"], "attr": ["attr:department=eng"]}]}`)
+	polMan, err := policy.NewPolicyManager(pol, []types.User{node.User}, append(types.Nodes{node}, peers...))
+	require.NoError(t, err)
+	mappy.polMan = polMan
+
+	resp, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Equal(t, []tailcfg.RawMessage{}, resp.Node.CapMap["attr:department=eng"])
+	require.NotContains(t, resp.Peers[0].CapMap, tailcfg.NodeCapability("attr:department=eng"))
+
+	resp, err = mappy.fullMapResponse(peers[0], types.Nodes{node}, 0)
+	require.NoError(t, err)
+	require.NotContains(t, resp.Node.CapMap, tailcfg.NodeCapability("attr:department=eng"))
+}
+
+func TestDeletedUser(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.cfg.Mapper.DeletedUserName = "Deleted user"
+
+	// The user of the peer was removed from the database.
+	peers[0].UserID = 7
+	peers[0].User = types.User{}
+
+	resp, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Equal(t, tailcfg.UserID(7), resp.Peers[0].User)
+	require.Equal(t, []tailcfg.UserProfile{
+		{ID: 1, LoginName: "user1", DisplayName: "user1"},
+		{ID: 7, LoginName: "Deleted user", DisplayName: "Deleted user"},
+	}, resp.UserProfiles)
+}
+
+func TestUserScopedRoutes(t *testing.T) {
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+	user2 := types.User{Model: gorm.Model{ID: 2}, Name: "user2"}
+	route := netip.MustParsePrefix("192.168.0.0/24")
+
+	node := &types.Node{
+		ID:        1,
+		GivenName: "mini",
+		User:      user1,
+		UserID:    user1.ID,
+		IPv4:      iap("100.64.0.1"),
+		Hostinfo:  &tailcfg.Hostinfo{},
+	}
+	router := func(user types.User) *types.Node {
+		return &types.Node{
+			ID:             2,
+			GivenName:      "router",
+			User:           user,
+			UserID:         user.ID,
+			IPv4:           iap("100.64.0.2"),
+			Hostinfo:       &tailcfg.Hostinfo{RoutableIPs: []netip.Prefix{route}},
+			ApprovedRoutes: []netip.Prefix{route},
+		}
+	}
+	grant := []byte(`{
+		"acls": [
+			{"action": "accept", "src": ["100.64.0.1"], "dst": ["100.64.0.2:*", "192.168.0.0/24:*"]},
+		],
+	}`)
+
+	tests := []struct {
+		name       string
+		pol        []byte
+		peer       *types.Node
+		scoped     bool
+		wantRoutes []netip.Prefix
+	}{
+		{
+			name:       "other-user-not-scoped",
+			peer:       router(user2),
+			wantRoutes: []netip.Prefix{route},
+		},
+		{
+			name:   "other-user-wildcard",
+			peer:   router(user2),
+			scoped: true,
+		},
+		{
+			name:       "other-user-granted",
+			pol:        grant,
+			peer:       router(user2),
+			scoped:     true,
+			wantRoutes: []netip.Prefix{route},
+		},
+		{
+			name:       "same-user",
+			peer:       router(user1),
+			scoped:     true,
+			wantRoutes: []netip.Prefix{route},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			polMan, err := policy.NewPolicyManager(tt.pol, []types.User{user1, user2}, types.Nodes{node, tt.peer})
+			require.NoError(t, err)
+
+			primary := routes.New()
+			primary.SetRoutes(tt.peer.ID, route)
+
+			cfg := &types.Config{
+				BaseDomain:       "example.com",
+				TailcfgDNSConfig: &tailcfg.DNSConfig{},
+				Mapper:           types.MapperConfig{UserScopedRoutes: tt.scoped},
+			}
+			mappy := NewMapper(nil, cfg, &tailcfg.DERPMap{}, nil, polMan, primary)
+
+			resp, err := mappy.fullMapResponse(node, types.Nodes{tt.peer}, 0)
+			require.NoError(t, err)
+			require.Len(t, resp.Peers, 1)
+			require.ElementsMatch(t, tt.wantRoutes, resp.Peers[0].PrimaryRoutes)
+			require.Equal(t, len(tt.wantRoutes) > 0, slices.Contains(resp.Peers[0].AllowedIPs, route))
+		})
+	}
+}
+
+func TestRestrictDERPMap(t *testing.T) {
+	derpMap := &tailcfg.DERPMap{
+		HomeParams: &tailcfg.DERPHomeParams{
+			RegionScore: map[int]float64{1: 1.5, 2: 2},
+		},
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, RegionCode: "eu"},
+			2: {RegionID: 2, RegionCode: "us"},
+			3: {RegionID: 3, RegionCode: "ap"},
+		},
+	}
+	restrictions := map[string][]int{
+		"tag:regulated": {1, 2},
+		"tag:eu":        {1, 3},
+		"user1":         {2},
+	}
+
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+	user2 := types.User{Model: gorm.Model{ID: 2}, Name: "user2"}
+
+	tests := []struct {
+		name        string
+		user        types.User
+		tags        []string
+		wantRegions []int
+	}{
+		{
+			name:        "unrestricted-user",
+			user:        user2,
+			wantRegions: []int{1, 2, 3},
+		},
+		{
+			name:        "restricted-user",
+			user:        user1,
+			wantRegions: []int{2},
+		},
+		{
+			name:        "tagged-node-of-restricted-user",
+			user:        user1,
+			tags:        []string{"tag:regulated"},
+			wantRegions: []int{1, 2},
+		},
+		{
+			name:        "several-tags",
+			user:        user2,
+			tags:        []string{"tag:eu", "tag:regulated"},
+			wantRegions: []int{1},
+		},
+		{
+			name:        "unrestricted-tag",
+			user:        user1,
+			tags:        []string{"tag:web"},
+			wantRegions: []int{1, 2, 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := &types.Node{ID: 1, User: tt.user, UserID: tt.user.ID}
+
+			got := restrictDERPMap(node, tt.tags, derpMap, restrictions)
+			require.Equal(t, tt.wantRegions, slices.Sorted(maps.Keys(got.Regions)))
+
+			for id := range got.HomeParams.RegionScore {
+				require.Contains(t, tt.wantRegions, id)
+			}
+		})
+	}
+
+	require.Len(t, derpMap.Regions, 3)
+	require.Nil(t, restrictDERPMap(&types.Node{User: user1}, nil, nil, restrictions))
+
+	// Keys are lowercased when the configuration is loaded, they still
+	// apply to mixed-case users and tags.
+	alice := &types.Node{User: types.User{Model: gorm.Model{ID: 3}, Name: "Alice"}}
+	lowered := map[string][]int{"alice": {2}, "tag:eu-prod": {1}}
+	got := restrictDERPMap(alice, nil, derpMap, lowered)
+	require.Equal(t, []int{2}, slices.Sorted(maps.Keys(got.Regions)))
+	got = restrictDERPMap(alice, []string{"tag:EU-Prod"}, derpMap, lowered)
+	require.Equal(t, []int{1}, slices.Sorted(maps.Keys(got.Regions)))
+	got = restrictDERPMap(alice, nil, derpMap, map[string][]int{"Alice": {3}})
+	require.Equal(t, []int{3}, slices.Sorted(maps.Keys(got.Regions)))
+}
+
+func TestDERPRegionRestrictions(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.SetDERPMap(&tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, RegionCode: "eu"},
+			2: {RegionID: 2, RegionCode: "us"},
+		},
+	})
+	mappy.cfg.Mapper.DERPRegionRestrictions = map[string][]int{"tag:regulated": {1}}
+
+	resp, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2}, slices.Sorted(maps.Keys(resp.DERPMap.Regions)))
+
+	node.ForcedTags = []string{"tag:regulated"}
+	resp, err = mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, slices.Sorted(maps.Keys(resp.DERPMap.Regions)))
+
+	data, err := mappy.DERPMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+
+	var derpResp tailcfg.MapResponse
+	require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], &derpResp))
+	require.Equal(t, []int{1}, slices.Sorted(maps.Keys(derpResp.DERPMap.Regions)))
+}
+
+func TestUnsupportedFeatureHealth(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.notif = newTestNotifier(t)
+	mappy.db = &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+
+	health := func(mapRequest tailcfg.MapRequest) []string {
+		t.Helper()
+		data, err := mappy.FullMapResponse(mapRequest, node)
+		require.NoError(t, err)
+
+		var resp tailcfg.MapResponse
+		require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], &resp))
+
+		return resp.Health
+	}
+
+	tkaRequest := tailcfg.MapRequest{TKAHead: "head"}
+
+	// Nothing is reported unless configured.
+	require.Nil(t, health(tkaRequest))
+
+	mappy.cfg.Mapper.UnsupportedFeatures = []string{types.FeatureTailnetLock, types.FeatureFunnel}
+
+	require.Equal(t, []string{unsupportedFeatureMessages[types.FeatureTailnetLock]}, health(tkaRequest))
+
+	require.Nil(t, health(tailcfg.MapRequest{}))
+
+	// Features of the Hostinfo are detected from the node.
+	node.Hostinfo = &tailcfg.Hostinfo{IngressEnabled: true}
+	require.Equal(t, []string{
+		unsupportedFeatureMessages[types.FeatureTailnetLock],
+		unsupportedFeatureMessages[types.FeatureFunnel],
+	}, health(tkaRequest))
+
+	// Features not configured as unsupported are not reported.
+	node.Hostinfo = &tailcfg.Hostinfo{}
+	require.Nil(t, health(tailcfg.MapRequest{MapSessionHandle: "session"}))
+}
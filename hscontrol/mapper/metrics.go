@@ -0,0 +1,154 @@
+package mapper
+
+import (
+	"errors"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"tailscale.com/envknob"
+)
+
+var debugHighCardinalityMetrics = envknob.Bool("HEADSCALE_DEBUG_HIGH_CARDINALITY_METRICS")
+
+const prometheusNamespace = "headscale"
+
+const (
+	outcomeSuccess         = "success"
+	outcomeDBError         = "db_error"
+	outcomePolicyError     = "policy_error"
+	outcomeConversionError = "conversion_error"
+	outcomeMarshalError    = "marshal_error"
+	outcomeTimeout         = "timeout"
+
+	// outcomeOther counts errors not labelled with withOutcome, for
+	// example errors of middlewares.
+	outcomeOther = "other"
+)
+
+var mapResponseGenerated = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: prometheusNamespace,
+	Name:      "mapper_mapresponse_generated_total",
+	Help:      "total count of map responses generated by the mapper, by outcome",
+}, []string{"type", "outcome"})
+
+const (
+	payloadFull  = "full"
+	payloadDelta = "delta"
+)
+
+var mapResponsePayload = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: prometheusNamespace,
+	Name:      "mapper_mapresponse_payload_total",
+	Help:      "total count of map responses generated by the mapper, by full or delta payload and node.id",
+}, []string{"payload", "id"})
+
+var (
+	mapResponseSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: prometheusNamespace,
+		Name:      "mapper_mapresponse_size_bytes",
+		Help:      "histogram of the size of marshalled map responses before compression, by type",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 10),
+	}, []string{"type"})
+	mapResponseCompressedSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: prometheusNamespace,
+		Name:      "mapper_mapresponse_compressed_size_bytes",
+		Help:      "histogram of the size of compressed map responses, by type and compression",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 10),
+	}, []string{"type", "compression"})
+	mapResponseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: prometheusNamespace,
+		Name:      "mapper_mapresponse_generation_seconds",
+		Help:      "histogram of time spent generating map responses, by type",
+		Buckets:   []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.3, 0.5, 1, 3, 5, 10},
+	}, []string{"type"})
+)
+
+// observeSize records the size of a map response of the given type,
+// marshalled is the size before and size after compression.
+func observeSize(responseType, compression string, marshalled, size int) {
+	mapResponseSize.WithLabelValues(responseType).Observe(float64(marshalled))
+
+	if compression != "" {
+		mapResponseCompressedSize.WithLabelValues(responseType, compression).Observe(float64(size))
+	}
+}
+
+// observeDuration records the time spent generating a map response of
+// the given type since start.
+func observeDuration(responseType string, start time.Time) {
+	mapResponseDuration.WithLabelValues(responseType).Observe(time.Since(start).Seconds())
+}
+
+var peerWarnings = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: prometheusNamespace,
+	Name:      "mapper_peer_warnings_total",
+	Help:      "total count of full map responses with at least mapper.peer_warning_threshold peers, by node.id",
+}, []string{"id"})
+
+// stageError records in which stage of the map response generation
+// an error occurred, it is used to label metrics.
+type stageError struct {
+	outcome string
+	err     error
+}
+
+func (e *stageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+func withOutcome(outcome string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &stageError{outcome: outcome, err: err}
+}
+
+// outcomeOf returns the metric outcome label for the error returned
+// by generating a map response.
+func outcomeOf(err error) string {
+	if err == nil {
+		return outcomeSuccess
+	}
+
+	if errors.Is(err, ErrMapResponseTimeout) {
+		return outcomeTimeout
+	}
+
+	var stageErr *stageError
+	if errors.As(err, &stageErr) {
+		return stageErr.outcome
+	}
+
+	return outcomeOther
+}
+
+// countOutcome increments the map response counter for the given
+// response type with the outcome of err and returns err unchanged.
+func countOutcome(responseType string, err error) error {
+	mapResponseGenerated.WithLabelValues(responseType, outcomeOf(err)).Inc()
+
+	return err
+}
+
+// countPayload increments the payload counter for a map response
+// generated without error for the node. The node ID is only used as
+// label if high cardinality metrics are enabled.
+func countPayload(payload string, nodeID types.NodeID, err error) {
+	if err != nil {
+		return
+	}
+
+	var id string
+	if debugHighCardinalityMetrics {
+		id = nodeID.String()
+	}
+
+	mapResponsePayload.WithLabelValues(payload, id).Inc()
+}
@@ -0,0 +1,127 @@
+package mapper
+
+import (
+	"maps"
+	"sync"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+)
+
+// nameIndex holds the MagicDNS names of all nodes, so the owners of the
+// names are only computed again when a name changes and not read from
+// the database for every incremental response, see
+// types.MapperConfig.DuplicateNames.
+type nameIndex struct {
+	mu     sync.Mutex
+	loaded bool
+	names  map[types.NodeID]string
+
+	// owners is nil if a name changed since it was last computed.
+	owners map[string]types.NodeID
+}
+
+func newNameIndex() *nameIndex {
+	return &nameIndex{
+		names: make(map[types.NodeID]string),
+	}
+}
+
+// isLoaded reports if the index was filled with all nodes by replace.
+func (x *nameIndex) isLoaded() bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	return x.loaded
+}
+
+// replace fills the index with all nodes, dropping the nodes it held.
+func (x *nameIndex) replace(nodes types.Nodes, cfg *types.Config) {
+	names := make(map[types.NodeID]string, len(nodes))
+	for _, node := range nodes {
+		if name, err := nodeName(node, cfg); err == nil {
+			names[node.ID] = name
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.loaded = true
+	if !maps.Equal(x.names, names) {
+		x.names = names
+		x.owners = nil
+	}
+}
+
+// with returns a copy of the index with nodes replacing all nodes if
+// complete is true, or updating them otherwise, to look up the owners
+// of the names before the change is kept.
+func (x *nameIndex) with(nodes types.Nodes, cfg *types.Config, complete bool) *nameIndex {
+	x.mu.Lock()
+	next := &nameIndex{
+		loaded: x.loaded,
+		names:  maps.Clone(x.names),
+		owners: x.owners,
+	}
+	x.mu.Unlock()
+
+	if complete {
+		next.replace(nodes, cfg)
+	} else {
+		next.update(nodes, cfg)
+	}
+
+	return next
+}
+
+// update records the names of the changed nodes.
+func (x *nameIndex) update(nodes types.Nodes, cfg *types.Config) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for _, node := range nodes {
+		name, err := nodeName(node, cfg)
+		current, ok := x.names[node.ID]
+		switch {
+		case err != nil && ok:
+			delete(x.names, node.ID)
+		case err != nil, ok && current == name:
+			continue
+		default:
+			x.names[node.ID] = name
+		}
+		x.owners = nil
+	}
+}
+
+// remove drops the removed nodes.
+func (x *nameIndex) remove(nodeIDs []types.NodeID) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for _, id := range nodeIDs {
+		if _, ok := x.names[id]; ok {
+			delete(x.names, id)
+			x.owners = nil
+		}
+	}
+}
+
+// nameOwners returns the ID of the node owning each name, which is the
+// node with the lowest ID using the name. The returned map must not be
+// modified.
+func (x *nameIndex) nameOwners() map[string]types.NodeID {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.owners == nil {
+		x.owners = make(map[string]types.NodeID, len(x.names))
+		for id, name := range x.names {
+			if owner, ok := x.owners[name]; !ok || id < owner {
+				x.owners[name] = id
+			}
+		}
+	}
+
+	return x.owners
+}
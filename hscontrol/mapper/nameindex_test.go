@@ -0,0 +1,70 @@
+package mapper
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/tailcfg"
+)
+
+func TestNameOwnersIncremental(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.cfg.Mapper.DuplicateNames = types.DuplicateNamesSuffix
+	mappy.notif = newTestNotifier(t)
+
+	node.GivenName = "dup"
+	other := &types.Node{
+		ID:        3,
+		GivenName: "other",
+		User:      node.User,
+		UserID:    node.UserID,
+		IPv4:      iap("100.64.0.3"),
+		Hostinfo:  &tailcfg.Hostinfo{},
+	}
+	peers = append(peers, other)
+	store := &flakyNodeStore{staticNodeStore: staticNodeStore{peers: append(types.Nodes{node}, peers...)}}
+	mappy.db = store
+
+	changedName := func(changed map[types.NodeID]bool) string {
+		t.Helper()
+		data, err := mappy.PeerChangedResponse(tailcfg.MapRequest{}, node, changed, nil)
+		require.NoError(t, err)
+
+		var resp tailcfg.MapResponse
+		require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], &resp))
+		for _, peer := range resp.PeersChanged {
+			if peer.ID == tailcfg.NodeID(other.ID) {
+				return peer.Name
+			}
+		}
+
+		return ""
+	}
+
+	// The names of all nodes are only read once.
+	require.Equal(t, "other.example.com.", changedName(map[types.NodeID]bool{3: true}))
+	require.Equal(t, 1, store.calls)
+	require.Equal(t, "other.example.com.", changedName(map[types.NodeID]bool{3: true}))
+	require.Equal(t, 1, store.calls)
+
+	// Renaming a peer to its name in another case keeps its name.
+	other.GivenName = "Other"
+	require.Equal(t, "other.example.com.", changedName(map[types.NodeID]bool{3: true}))
+
+	// The names of changed peers are updated.
+	other.GivenName = "dup"
+	require.Equal(t, "dup-3.example.com.", changedName(map[types.NodeID]bool{3: true}))
+	require.Equal(t, 1, store.calls)
+	require.Equal(t, types.NodeID(1), mappy.names.nameOwners()["dup.example.com."])
+
+	// Removed peers no longer own their names.
+	node.GivenName = "node"
+	changedName(map[types.NodeID]bool{3: false})
+	require.Equal(t, map[string]types.NodeID{
+		"node.example.com.": 1,
+		"peer.example.com.": 2,
+	}, mappy.names.nameOwners())
+	require.Equal(t, 1, store.calls)
+}
@@ -0,0 +1,599 @@
+package mapper
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"sort"
+
+	"github.com/juanfont/headscale/hscontrol/policy"
+	"github.com/juanfont/headscale/hscontrol/policy/matcher"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/rs/zerolog/log"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/opt"
+)
+
+// Names of the stages of the full MapResponse pipeline, in the order
+// they are run.
+const (
+	StageNode     = "node"
+	StagePeers    = "peers"
+	StagePolicy   = "policy"
+	StageDNS      = "dns"
+	StageDERP     = "derp"
+	StageFinalize = "finalize"
+)
+
+const (
+	controlDialPlanCapVer tailcfg.CapabilityVersion = 44
+	packetFiltersCapVer   tailcfg.CapabilityVersion = 81
+	masqV6CapVer          tailcfg.CapabilityVersion = 104
+	homeDERPCapVer        tailcfg.CapabilityVersion = 111
+)
+
+// matchNothingFilter is sent to clients without PacketFilters instead of
+// an empty packet filter, which they would not apply. Its only rule has
+// an unroutable source address, it matches no traffic.
+var matchNothingFilter = []tailcfg.FilterRule{{
+	SrcIPs:   []string{"0.0.0.0/32"},
+	DstPorts: []tailcfg.NetPortRange{{IP: "0.0.0.0/32", Ports: tailcfg.PortRangeAny}},
+}}
+
+// MapContext holds the state of a full MapResponse while it is being
+// built by the pipeline.
+type MapContext struct {
+	Node   *types.Node
+	CapVer tailcfg.CapabilityVersion
+
+	// Peers are the peers of Node. After the peers stage it only
+	// contains the peers Node is allowed to see.
+	Peers types.Nodes
+
+	// Response is created by the node stage and filled in by the
+	// following stages.
+	Response *tailcfg.MapResponse
+
+	// nameOwners holds the owners of the names of Node and all of its
+	// peers, see Mapper.nameOwners.
+	nameOwners map[string]types.NodeID
+
+	// ctx is done once nobody waits for the response anymore, the
+	// pipeline stops before the next stage. A nil ctx is never done.
+	ctx context.Context
+
+	// commits record the response as sent to Node in the state the
+	// Mapper keeps per node. They only run once the response is
+	// complete, see commit.
+	commits []func()
+}
+
+// context returns the context the response is generated in.
+func (mc *MapContext) context() context.Context {
+	if mc.ctx == nil {
+		return context.Background()
+	}
+
+	return mc.ctx
+}
+
+// onCommit adds fn to the functions run by commit.
+func (mc *MapContext) onCommit(fn func()) {
+	mc.commits = append(mc.commits, fn)
+}
+
+// commit records the response as sent, it must only be called once the
+// response is complete and will be used. Responses given up on, for
+// example at the generation deadline, must not change what the Mapper
+// considers sent to the node.
+func (mc *MapContext) commit() {
+	for _, fn := range mc.commits {
+		fn()
+	}
+	mc.commits = nil
+}
+
+// nameOwners returns the owners of the names of all nodes if duplicate
+// names are handled, see types.MapperConfig.DuplicateNames. If complete
+// is true mc.Peers holds all peers of the node, otherwise only the
+// changed ones and the names of the other nodes are taken from earlier
+// responses. They are only read from the database if there were none.
+func (m *Mapper) nameOwners(mc *MapContext, complete bool) (map[string]types.NodeID, error) {
+	if m.cfg.Mapper.DuplicateNames == types.DuplicateNamesIgnore || mc.nameOwners != nil {
+		return mc.nameOwners, nil
+	}
+
+	nodes := append(types.Nodes{mc.Node}, mc.Peers...)
+	if !complete && !m.names.isLoaded() {
+		peers, err := m.listPeers(mc.context(), mc.Node.ID)
+		if err != nil {
+			return nil, withOutcome(outcomeDBError, err)
+		}
+		nodes, complete = append(types.Nodes{mc.Node}, peers...), true
+	}
+
+	// The index is only changed once the response is sent.
+	mc.nameOwners = m.names.with(nodes, m.cfg, complete).nameOwners()
+	mc.onCommit(func() {
+		if complete {
+			m.names.replace(nodes, m.cfg)
+		} else {
+			m.names.update(nodes, m.cfg)
+		}
+	})
+
+	return mc.nameOwners, nil
+}
+
+// StageFunc is a single stage of the full MapResponse pipeline.
+type StageFunc func(mc *MapContext) error
+
+// Middleware wraps the stage with the given name. It can modify the
+// MapContext before and after calling next, or skip next altogether.
+type Middleware func(stage string, next StageFunc) StageFunc
+
+type stage struct {
+	name string
+	fn   StageFunc
+}
+
+// Use adds a middleware wrapping every stage of the full MapResponse
+// pipeline. Middlewares run in the order they are added, the first one
+// being the outermost. It must be called before the Mapper is used.
+func (m *Mapper) Use(mw Middleware) {
+	m.middlewares = append(m.middlewares, mw)
+}
+
+func (m *Mapper) stages() []stage {
+	return []stage{
+		{StageNode, m.nodeStage},
+		{StagePeers, func(mc *MapContext) error { return m.peersStage(mc, true) }},
+		{StagePolicy, m.policyStage},
+		{StageDNS, m.dnsStage},
+		{StageDERP, m.derpStage},
+		{StageFinalize, m.finalizeStage},
+	}
+}
+
+// runPipeline runs all stages, wrapped in the registered middlewares,
+// stopping at the first error or once the context of mc is done.
+func (m *Mapper) runPipeline(mc *MapContext) error {
+	for _, s := range m.stages() {
+		if err := mc.context().Err(); err != nil {
+			return err
+		}
+
+		fn := s.fn
+		for i := len(m.middlewares) - 1; i >= 0; i-- {
+			fn = m.middlewares[i](s.name, fn)
+		}
+
+		if err := fn(mc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// nodeStage creates the response with the node itself and the
+// settings that do not depend on the peers.
+func (m *Mapper) nodeStage(mc *MapContext) error {
+	resp := m.baseMapResponse()
+
+	tailnode, err := m.tailSelfNode(mc.Node, mc.CapVer)
+	if err != nil {
+		return withOutcome(outcomeConversionError, err)
+	}
+	resp.Node = tailnode
+
+	// The peers are only reduced to the visible ones by the peers stage.
+	owners, err := m.nameOwners(mc, true)
+	if err != nil {
+		return err
+	}
+	disambiguateName(mc.Node, tailnode, owners, m.cfg)
+
+	resp.Domain = m.cfg.Domain()
+
+	// Clients only collect services when asked to, headscale does not
+	// do anything with them unless configured for external tooling.
+	resp.CollectServices = opt.NewBool(m.cfg.Mapper.CollectServices)
+
+	resp.KeepAlive = false
+
+	resp.Debug = &tailcfg.Debug{
+		DisableLogTail: !m.cfg.LogTail.EnabledFor(mc.Node.ID),
+	}
+
+	// CapVer 44: 2022-09-22: MapResponse.ControlDialPlan
+	if m.cfg.Mapper.ControlDialPlan != nil && mc.CapVer >= controlDialPlanCapVer {
+		resp.ControlDialPlan = m.cfg.Mapper.ControlDialPlan.Clone()
+	}
+
+	mc.Response = &resp
+
+	return nil
+}
+
+// peersStage adds the peers the node is allowed to see, and their
+// user profiles, to the response. If fullChange is false they are
+// sent as changed peers.
+func (m *Mapper) peersStage(mc *MapContext, fullChange bool) error {
+	owners, err := m.nameOwners(mc, fullChange)
+	if err != nil {
+		return err
+	}
+
+	filter, matchers := m.polMan.Filter()
+	mc.Peers = m.visiblePeers(mc.Node, mc.Peers, filter, matchers)
+
+	if fullChange {
+		m.warnPeerCount(mc.Node, len(mc.Peers))
+		mc.Peers = limitPeers(mc.Peers, m.cfg.Mapper.MaxPeers)
+	} else if m.cfg.Mapper.MaxPeers > 0 {
+		err := m.limitChangedPeers(mc, filter, matchers)
+		if err != nil {
+			return err
+		}
+	}
+
+	tailPeers, err := m.tailNodes.tailNodes(
+		mc.Peers, mc.CapVer, m.polMan,
+		m.peerRoutes(mc.Node, mc.Peers, matchers),
+		m.cfg)
+	if err != nil {
+		return withOutcome(outcomeConversionError, err)
+	}
+
+	for i, peer := range mc.Peers {
+		disambiguateName(peer, tailPeers[i], owners, m.cfg)
+	}
+
+	m.applyMasquerade(mc, tailPeers)
+	m.stripDERPOnlyPeers(mc.Peers, tailPeers)
+	m.stripOfflineEndpoints(mc.Peers, tailPeers)
+
+	// Peers is returned sorted by Node.ID, unless grouped by subnet.
+	sort.SliceStable(tailPeers, func(x, y int) bool {
+		return tailPeers[x].ID < tailPeers[y].ID
+	})
+	if bits := m.cfg.Mapper.PeerSubnetGrouping; bits > 0 {
+		groupPeersBySubnet(tailPeers, bits)
+	}
+
+	if fullChange {
+		mc.Response.Peers = tailPeers
+	} else {
+		mc.Response.PeersChanged = tailPeers
+	}
+	if !m.cfg.Mapper.OmitUserProfiles {
+		mc.Response.UserProfiles = generateUserProfiles(mc.Node, mc.Peers, m.polMan, m.cfg)
+	}
+
+	return nil
+}
+
+// peerRoutes returns the function filtering the primary routes of the
+// peers down to those the node can access. If
+// types.MapperConfig.UserScopedRoutes is enabled, the routes of peers
+// owned by other users are only kept if the policy grants access to
+// them explicitly.
+func (m *Mapper) peerRoutes(node *types.Node, peers types.Nodes, matchers []matcher.Match) routeFilterFunc {
+	otherUsers := make(map[types.NodeID]bool)
+	if m.cfg.Mapper.UserScopedRoutes && !isOrphaned(node) && len(nodeTags(node, m.polMan)) == 0 {
+		for _, peer := range peers {
+			if peer.UserID != node.UserID && len(nodeTags(peer, m.polMan)) == 0 {
+				otherUsers[peer.ID] = true
+			}
+		}
+	}
+
+	return func(id types.NodeID) []netip.Prefix {
+		if otherUsers[id] {
+			return policy.ReduceRoutesExplicit(node, m.primary.PrimaryRoutes(id), matchers)
+		}
+
+		return policy.ReduceRoutes(node, m.primary.PrimaryRoutes(id), matchers)
+	}
+}
+
+// applyMasquerade sets the address the node is known as by each of
+// its peers according to the configured masquerade rules. The node
+// translates the source address of its traffic to the peer, and the
+// peer is sent the node under that address.
+func (m *Mapper) applyMasquerade(mc *MapContext, peers []*tailcfg.Node) {
+	for _, rule := range m.cfg.Mapper.Masquerade {
+		for _, peer := range peers {
+			addr := rule.Addr
+			switch {
+			case rule.Node == mc.Node.ID && types.NodeID(peer.ID) == rule.Peer:
+				switch {
+				case addr.Is4():
+					peer.SelfNodeV4MasqAddrForThisPeer = &addr
+				// CapVer 104: 2024-08-03: SelfNodeV6MasqAddrForThisPeer now works
+				case mc.CapVer >= masqV6CapVer:
+					peer.SelfNodeV6MasqAddrForThisPeer = &addr
+				}
+
+			case rule.Peer == mc.Node.ID && types.NodeID(peer.ID) == rule.Node:
+				masqueradeAddress(peer, addr)
+			}
+		}
+	}
+}
+
+// masqueradeAddress replaces the address of peer of the same family as
+// addr with addr, in its addresses and allowed IPs. The slices of peer
+// are replaced, not modified, they may be shared with the cache of
+// converted peers.
+func masqueradeAddress(peer *tailcfg.Node, addr netip.Addr) {
+	masq := netip.PrefixFrom(addr, addr.BitLen())
+
+	var own netip.Prefix
+	addresses := slices.Clone(peer.Addresses)
+	for i, prefix := range addresses {
+		if prefix.Addr().Is4() == addr.Is4() && prefix.IsSingleIP() {
+			own = prefix
+			addresses[i] = masq
+
+			break
+		}
+	}
+
+	if !own.IsValid() {
+		return
+	}
+
+	allowedIPs := slices.Clone(peer.AllowedIPs)
+	for i, prefix := range allowedIPs {
+		if prefix == own {
+			allowedIPs[i] = masq
+		}
+	}
+
+	peer.Addresses = addresses
+	peer.AllowedIPs = allowedIPs
+}
+
+// groupPeersBySubnet orders peers by the IPv4 subnet with the given
+// prefix length their address is in, keeping the order of the peers
+// within a subnet. Peers without an IPv4 address go last.
+func groupPeersBySubnet(peers []*tailcfg.Node, bits int) {
+	subnet := func(peer *tailcfg.Node) (netip.Prefix, bool) {
+		for _, addr := range peer.Addresses {
+			if addr.Addr().Is4() {
+				return netip.PrefixFrom(addr.Addr(), bits).Masked(), true
+			}
+		}
+
+		return netip.Prefix{}, false
+	}
+
+	slices.SortStableFunc(peers, func(a, b *tailcfg.Node) int {
+		aNet, aOK := subnet(a)
+		bNet, bOK := subnet(b)
+		switch {
+		case aOK != bOK:
+			if aOK {
+				return -1
+			}
+
+			return 1
+		case !aOK:
+			return 0
+		default:
+			return aNet.Addr().Compare(bNet.Addr())
+		}
+	})
+}
+
+// warnPeerCount logs and counts full map responses of nodes with at
+// least types.MapperConfig.PeerWarningThreshold peers. The node ID is
+// only used as metric label if high cardinality metrics are enabled.
+func (m *Mapper) warnPeerCount(node *types.Node, count int) {
+	threshold := m.cfg.Mapper.PeerWarningThreshold
+	if threshold <= 0 || count < threshold {
+		return
+	}
+
+	log.Warn().
+		Uint64("node.id", node.ID.Uint64()).
+		Str("node.name", node.Hostname).
+		Int("peers", count).
+		Int("threshold", threshold).
+		Int("max_peers", m.cfg.Mapper.MaxPeers).
+		Msg("node has more peers than the warning threshold")
+
+	var id string
+	if debugHighCardinalityMetrics {
+		id = node.ID.String()
+	}
+	peerWarnings.WithLabelValues(id).Inc()
+}
+
+// visiblePeers returns the peers the node is allowed to see.
+func (m *Mapper) visiblePeers(
+	node *types.Node,
+	peers types.Nodes,
+	filter []tailcfg.FilterRule,
+	matchers []matcher.Match,
+) types.Nodes {
+	switch {
+	// If there are filter rules present, see if there are any nodes that cannot
+	// access each-other at all and remove them from the peers.
+	case len(filter) > 0:
+		return policy.ReduceNodes(node, peers, matchers)
+
+	// Without any filter rules no traffic is allowed at all.
+	case m.cfg.Mapper.DenyEmptyFilter:
+		return types.Nodes{}
+	}
+
+	return peers
+}
+
+// limitChangedPeers applies types.MapperConfig.MaxPeers to the changed
+// peers of an incremental response. Only changed peers among the
+// peers a full response would send are kept, the others are removed
+// from the node, they might have been sent to it before.
+func (m *Mapper) limitChangedPeers(mc *MapContext, filter []tailcfg.FilterRule, matchers []matcher.Match) error {
+	all, err := m.listPeers(mc.context(), mc.Node.ID)
+	if err != nil {
+		return withOutcome(outcomeDBError, err)
+	}
+
+	sent := make(map[types.NodeID]bool)
+	for _, peer := range limitPeers(m.visiblePeers(mc.Node, all, filter, matchers), m.cfg.Mapper.MaxPeers) {
+		sent[peer.ID] = true
+	}
+
+	kept := make(types.Nodes, 0, len(mc.Peers))
+	for _, peer := range mc.Peers {
+		if sent[peer.ID] {
+			kept = append(kept, peer)
+		} else {
+			mc.Response.PeersRemoved = append(mc.Response.PeersRemoved, peer.ID.NodeID())
+		}
+	}
+	mc.Peers = kept
+
+	return nil
+}
+
+// limitPeers returns the maxPeers peers that are online or were seen
+// most recently. If maxPeers is zero all peers are returned.
+func limitPeers(peers types.Nodes, maxPeers int) types.Nodes {
+	if maxPeers <= 0 || len(peers) <= maxPeers {
+		return peers
+	}
+
+	recent := slices.Clone(peers)
+	slices.SortStableFunc(recent, func(a, b *types.Node) int {
+		aOnline := a.IsOnline != nil && *a.IsOnline
+		bOnline := b.IsOnline != nil && *b.IsOnline
+		switch {
+		case aOnline != bOnline:
+			if aOnline {
+				return -1
+			}
+
+			return 1
+		case a.LastSeen == nil || b.LastSeen == nil:
+			// Never seen peers go last.
+			if a.LastSeen != nil {
+				return -1
+			}
+			if b.LastSeen != nil {
+				return 1
+			}
+
+			return 0
+		default:
+			return b.LastSeen.Compare(*a.LastSeen)
+		}
+	})
+
+	return recent[:maxPeers]
+}
+
+// sshServerOS lists the values of Hostinfo.OS of the platforms the
+// Tailscale SSH server runs on.
+var sshServerOS = []string{"linux", "macOS", "freebsd", "openbsd", "plan9"}
+
+// sshCapable reports whether the node can run the Tailscale SSH server.
+// Nodes that did not report their OS yet are assumed to be capable.
+func sshCapable(node *types.Node) bool {
+	if node.Hostinfo == nil || node.Hostinfo.OS == "" {
+		return true
+	}
+
+	return slices.Contains(sshServerOS, node.Hostinfo.OS)
+}
+
+// policyStage adds the SSH policy and packet filter of the node. The SSH
+// policy is only sent to nodes that can run the Tailscale SSH server.
+func (m *Mapper) policyStage(mc *MapContext) error {
+	filter, _ := m.polMan.Filter()
+
+	if sshCapable(mc.Node) {
+		sshPolicy, err := m.polMan.SSHPolicy(mc.Node)
+		if err != nil {
+			return withOutcome(outcomePolicyError, err)
+		}
+		mc.Response.SSHPolicy = sshPolicy
+	}
+
+	rules := policy.ReduceFilterRules(mc.Node, filter)
+
+	// CapVer 81: 2023-11-17: MapResponse.PacketFilters (incremental packet filter updates)
+	// Currently, we do not send incremental package filters, however using the
+	// new PacketFilters field and "base" allows us to send a full update when we
+	// have to send an empty list, avoiding the hack in the else block.
+	if !m.cfg.Mapper.LegacyPacketFilter || mc.CapVer >= packetFiltersCapVer {
+		mc.Response.PacketFilters = map[string][]tailcfg.FilterRule{
+			"base": rules,
+		}
+	} else {
+		// PacketFilter has omitempty, an empty list is not sent and
+		// the client keeps its previous packet filter. Send a rule
+		// matching nothing instead, the rules of other nodes are not
+		// for this node to see.
+		if len(rules) > 0 {
+			mc.Response.PacketFilter = rules
+		} else {
+			mc.Response.PacketFilter = matchNothingFilter
+		}
+	}
+
+	return nil
+}
+
+func (m *Mapper) dnsStage(mc *MapContext) error {
+	if m.dnsDisabled(mc.Node) {
+		// An empty, rather than nil, config as nil means no change
+		// when sent in a streamed response.
+		mc.Response.DNSConfig = &tailcfg.DNSConfig{}
+	} else {
+		mc.Response.DNSConfig = generateDNSConfig(m.cfg, mc.Node, nodeTags(mc.Node, m.polMan))
+	}
+
+	dnsConfig := mc.Response.DNSConfig
+	version, changed := m.dnsVersions.next(mc.Node.ID, dnsConfig)
+	mc.onCommit(func() { m.dnsVersions.update(mc.Node.ID, dnsConfig) })
+	log.Trace().
+		Uint64("node.id", mc.Node.ID.Uint64()).
+		Uint64("dns.version", version).
+		Bool("dns.changed", changed).
+		Msg("DNS configuration in map response")
+
+	if m.cfg.Mapper.DNSVersionCapability && mc.Response.Node != nil {
+		mc.Response.Node.CapMap[CapabilityDNSVersion] = dnsVersionCapValues(version)
+	}
+
+	return nil
+}
+
+func (m *Mapper) derpStage(mc *MapContext) error {
+	mc.Response.DERPMap = m.nodeDERPMap(mc.Node, m.derpMap.Load())
+	mc.onCommit(func() { m.derpMapSentTo(mc.Node.ID) })
+
+	return nil
+}
+
+// finalizeStage applies the restrictions configured for the node
+// to the otherwise complete response.
+func (m *Mapper) finalizeStage(mc *MapContext) error {
+	switch {
+	case m.lockdown.Load():
+		restrictedResponse(mc.Response, lockdownMessage)
+	case m.unsupportedVersion(mc.CapVer):
+		restrictedResponse(mc.Response, m.unsupportedVersionMessage())
+	case m.quarantined(mc.Node):
+		quarantineResponse(mc.Response)
+	}
+
+	projectPeers(mc.Response, m.peerProjection(mc.Node))
+
+	return nil
+}
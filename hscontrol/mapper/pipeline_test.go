@@ -0,0 +1,953 @@
+package mapper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/juanfont/headscale/hscontrol/policy"
+	"github.com/juanfont/headscale/hscontrol/routes"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/types/opt"
+)
+
+func pipelineTestMapper(t *testing.T) (*Mapper, *types.Node, types.Nodes) {
+	t.Helper()
+
+	user1 := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+	node := &types.Node{
+		ID:        1,
+		GivenName: "mini",
+		User:      user1,
+		UserID:    user1.ID,
+		IPv4:      iap("100.64.0.1"),
+		Hostinfo:  &tailcfg.Hostinfo{},
+	}
+	peer := &types.Node{
+		ID:        2,
+		GivenName: "peer",
+		User:      user1,
+		UserID:    user1.ID,
+		IPv4:      iap("100.64.0.2"),
+		Hostinfo:  &tailcfg.Hostinfo{},
+	}
+
+	polMan, err := policy.NewPolicyManager(nil, []types.User{user1}, types.Nodes{node, peer})
+	require.NoError(t, err)
+
+	cfg := &types.Config{
+		BaseDomain:       "example.com",
+		TailcfgDNSConfig: &tailcfg.DNSConfig{},
+	}
+	derpMap := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{1: {RegionID: 1}}}
+
+	return NewMapper(nil, cfg, derpMap, nil, polMan, routes.New()), node, types.Nodes{peer}
+}
+
+func TestPipelineMiddleware(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+
+	want, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+
+	var ran []string
+	mappy.Use(func(stage string, next StageFunc) StageFunc {
+		return func(mc *MapContext) error {
+			ran = append(ran, stage)
+
+			return next(mc)
+		}
+	})
+
+	got, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{
+		StageNode,
+		StagePeers,
+		StagePolicy,
+		StageDNS,
+		StageDERP,
+		StageFinalize,
+	}, ran)
+
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(tailcfg.MapResponse{}, "ControlTime")); diff != "" {
+		t.Errorf("fullMapResponse() with middleware unexpected result (-want +got):\n%s", diff)
+	}
+}
+
+func TestPipelineMiddlewareOrder(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+
+	var ran []string
+	for _, name := range []string{"outer", "inner"} {
+		mappy.Use(func(stage string, next StageFunc) StageFunc {
+			return func(mc *MapContext) error {
+				if stage == StageNode {
+					ran = append(ran, name)
+				}
+
+				return next(mc)
+			}
+		})
+	}
+
+	_, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"outer", "inner"}, ran)
+}
+
+func TestPipelineMiddlewareModifiesResponse(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+
+	mappy.Use(func(stage string, next StageFunc) StageFunc {
+		if stage != StageDERP {
+			return next
+		}
+
+		return func(mc *MapContext) error {
+			if err := next(mc); err != nil {
+				return err
+			}
+			mc.Response.DERPMap = nil
+
+			return nil
+		}
+	})
+
+	resp, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Nil(t, resp.DERPMap)
+	require.Len(t, resp.Peers, 1)
+}
+
+func TestPipelineMiddlewareError(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+
+	errStop := errors.New("stop")
+	var ran []string
+	mappy.Use(func(stage string, next StageFunc) StageFunc {
+		return func(mc *MapContext) error {
+			ran = append(ran, stage)
+			if stage == StagePolicy {
+				return errStop
+			}
+
+			return next(mc)
+		}
+	})
+
+	_, err := mappy.fullMapResponse(node, peers, 0)
+	require.ErrorIs(t, err, errStop)
+	require.Equal(t, []string{StageNode, StagePeers, StagePolicy}, ran)
+}
+
+func TestControlDialPlan(t *testing.T) {
+	plan := &tailcfg.ControlDialPlan{
+		Candidates: []tailcfg.ControlIPCandidate{
+			{IP: netip.MustParseAddr("192.0.2.10"), DialTimeoutSec: 5, Priority: 1},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		plan   *tailcfg.ControlDialPlan
+		capVer tailcfg.CapabilityVersion
+		want   *tailcfg.ControlDialPlan
+	}{
+		{
+			name:   "capable",
+			plan:   plan,
+			capVer: 106,
+			want:   plan,
+		},
+		{
+			name:   "not-capable",
+			plan:   plan,
+			capVer: 43,
+			want:   nil,
+		},
+		{
+			name:   "no-plan",
+			plan:   nil,
+			capVer: 106,
+			want:   nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mappy, node, peers := pipelineTestMapper(t)
+			mappy.cfg.Mapper.ControlDialPlan = tt.plan
+
+			resp, err := mappy.fullMapResponse(node, peers, tt.capVer)
+			require.NoError(t, err)
+
+			if diff := cmp.Diff(tt.want, resp.ControlDialPlan, util.Comparers...); diff != "" {
+				t.Errorf("ControlDialPlan unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCollectServices(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+
+	resp, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Equal(t, opt.Bool("false"), resp.CollectServices)
+
+	mappy.cfg.Mapper.CollectServices = true
+	resp, err = mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Equal(t, opt.Bool("true"), resp.CollectServices)
+}
+
+func TestLogTailNodeOverride(t *testing.T) {
+	tests := []struct {
+		name        string
+		enabled     bool
+		nodes       map[types.NodeID]bool
+		wantDisable bool
+	}{
+		{
+			name:        "global-disabled",
+			wantDisable: true,
+		},
+		{
+			name:        "global-enabled",
+			enabled:     true,
+			wantDisable: false,
+		},
+		{
+			name:        "node-enabled",
+			nodes:       map[types.NodeID]bool{1: true},
+			wantDisable: false,
+		},
+		{
+			name:        "node-disabled",
+			enabled:     true,
+			nodes:       map[types.NodeID]bool{1: false},
+			wantDisable: true,
+		},
+		{
+			name:        "other-node-enabled",
+			nodes:       map[types.NodeID]bool{2: true},
+			wantDisable: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mappy, node, peers := pipelineTestMapper(t)
+			mappy.cfg.LogTail = types.LogTailConfig{Enabled: tt.enabled, Nodes: tt.nodes}
+
+			resp, err := mappy.fullMapResponse(node, peers, 0)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantDisable, resp.Debug.DisableLogTail)
+		})
+	}
+}
+
+func TestOmitUserProfiles(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+
+	resp, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.NotEmpty(t, resp.UserProfiles)
+
+	mappy.cfg.Mapper.OmitUserProfiles = true
+	resp, err = mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Nil(t, resp.UserProfiles)
+	require.Len(t, resp.Peers, 1)
+
+	mc := &MapContext{Node: node, Peers: peers, Response: &tailcfg.MapResponse{}}
+	require.NoError(t, mappy.appendPeerChanges(mc))
+	require.Len(t, mc.Response.PeersChanged, 1)
+	require.Nil(t, mc.Response.UserProfiles)
+}
+
+func TestDERPAllowedRegions(t *testing.T) {
+	derpMap := &tailcfg.DERPMap{
+		HomeParams: &tailcfg.DERPHomeParams{
+			RegionScore: map[int]float64{1: 1.5, 2: 2, 3: 0.5},
+		},
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, RegionCode: "eu"},
+			2: {RegionID: 2, RegionCode: "us"},
+			3: {RegionID: 3, RegionCode: "ap"},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		allowed     []int
+		wantRegions []int
+	}{
+		{
+			name:        "all",
+			allowed:     nil,
+			wantRegions: []int{1, 2, 3},
+		},
+		{
+			name:        "restricted",
+			allowed:     []int{1, 3},
+			wantRegions: []int{1, 3},
+		},
+		{
+			name:        "unknown-region",
+			allowed:     []int{2, 900},
+			wantRegions: []int{2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mappy, node, peers := pipelineTestMapper(t)
+			mappy.SetDERPMap(derpMap)
+			mappy.cfg.Mapper.DERPAllowedRegions = tt.allowed
+
+			resp, err := mappy.fullMapResponse(node, peers, 0)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantRegions, slices.Sorted(maps.Keys(resp.DERPMap.Regions)))
+			require.Equal(t, tt.wantRegions, slices.Sorted(maps.Keys(resp.DERPMap.HomeParams.RegionScore)))
+
+			data, err := mappy.DERPMapResponse(tailcfg.MapRequest{}, node)
+			require.NoError(t, err)
+
+			var update tailcfg.MapResponse
+			require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], &update))
+			require.Equal(t, tt.wantRegions, slices.Sorted(maps.Keys(update.DERPMap.Regions)))
+		})
+	}
+
+	// The shared DERP map is not modified.
+	require.Len(t, derpMap.Regions, 3)
+	require.Len(t, derpMap.HomeParams.RegionScore, 3)
+}
+
+func TestMasquerade(t *testing.T) {
+	masqV4 := netip.MustParseAddr("10.0.0.1")
+	masqV6 := netip.MustParseAddr("fd00::1")
+
+	tests := []struct {
+		name   string
+		rules  []types.MasqueradeRule
+		capVer tailcfg.CapabilityVersion
+		wantV4 *netip.Addr
+		wantV6 *netip.Addr
+	}{
+		{
+			name: "no-rules",
+		},
+		{
+			name:   "ipv4",
+			rules:  []types.MasqueradeRule{{Node: 1, Peer: 2, Addr: masqV4}},
+			capVer: 106,
+			wantV4: &masqV4,
+		},
+		{
+			name:   "ipv6",
+			rules:  []types.MasqueradeRule{{Node: 1, Peer: 2, Addr: masqV6}},
+			capVer: 106,
+			wantV6: &masqV6,
+		},
+		{
+			name:   "ipv6-not-capable",
+			rules:  []types.MasqueradeRule{{Node: 1, Peer: 2, Addr: masqV6}},
+			capVer: 100,
+		},
+		{
+			name:   "other-pair",
+			rules:  []types.MasqueradeRule{{Node: 2, Peer: 1, Addr: masqV4}},
+			capVer: 106,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mappy, node, peers := pipelineTestMapper(t)
+			mappy.cfg.Mapper.Masquerade = tt.rules
+
+			resp, err := mappy.fullMapResponse(node, peers, tt.capVer)
+			require.NoError(t, err)
+			require.Len(t, resp.Peers, 1)
+			require.Equal(t, tt.wantV4, resp.Peers[0].SelfNodeV4MasqAddrForThisPeer)
+			require.Equal(t, tt.wantV6, resp.Peers[0].SelfNodeV6MasqAddrForThisPeer)
+		})
+	}
+}
+
+func TestMasqueradePeerView(t *testing.T) {
+	masqV4 := netip.MustParseAddr("10.0.0.1")
+
+	mappy, node, peers := pipelineTestMapper(t)
+	node.IPv6 = iap("fd7a:115c:a1e0::1")
+	mappy.cfg.Mapper.Masquerade = []types.MasqueradeRule{{Node: 1, Peer: 2, Addr: masqV4}}
+
+	// The peer knows the node under the masquerade address.
+	resp, err := mappy.fullMapResponse(peers[0], types.Nodes{node}, 106)
+	require.NoError(t, err)
+	require.Len(t, resp.Peers, 1)
+	require.Nil(t, resp.Peers[0].SelfNodeV4MasqAddrForThisPeer)
+	require.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.1/32"),
+		netip.MustParsePrefix("fd7a:115c:a1e0::1/128"),
+	}, resp.Peers[0].Addresses)
+	require.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.1/32"),
+		netip.MustParsePrefix("fd7a:115c:a1e0::1/128"),
+	}, resp.Peers[0].AllowedIPs)
+
+	// Other nodes still know it under its own address.
+	mappy.cfg.Mapper.Masquerade = []types.MasqueradeRule{{Node: 1, Peer: 3, Addr: masqV4}}
+	resp, err = mappy.fullMapResponse(peers[0], types.Nodes{node}, 106)
+	require.NoError(t, err)
+	require.Equal(t, netip.MustParsePrefix("100.64.0.1/32"), resp.Peers[0].Addresses[0])
+}
+
+func TestLegacyPacketFilter(t *testing.T) {
+	// Only the peer is allowed to reach other nodes, no rule applies
+	// to the traffic of the peer itself.
+	pol := []byte(`{"acls": [{"action": "accept", "src": ["100.64.0.2"], "dst": ["100.64.0.1:*"]}]}`)
+
+	tests := []struct {
+		name        string
+		legacy      bool
+		capVer      tailcfg.CapabilityVersion
+		self        bool
+		wantFilters bool
+	}{
+		{
+			name:        "disabled",
+			capVer:      80,
+			self:        true,
+			wantFilters: true,
+		},
+		{
+			name:        "capable-client",
+			legacy:      true,
+			capVer:      81,
+			self:        true,
+			wantFilters: true,
+		},
+		{
+			name:   "legacy-client",
+			legacy: true,
+			capVer: 80,
+			self:   true,
+		},
+		{
+			name:   "legacy-client-without-rules",
+			legacy: true,
+			capVer: 80,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mappy, node, peers := pipelineTestMapper(t)
+			mappy.cfg.Mapper.LegacyPacketFilter = tt.legacy
+
+			polMan, err := policy.NewPolicyManager(pol, []types.User{node.User}, append(types.Nodes{node}, peers...))
+			require.NoError(t, err)
+			mappy.polMan = polMan
+
+			filter, _ := polMan.Filter()
+			require.NotEmpty(t, filter)
+
+			self, other := node, peers
+			if !tt.self {
+				self, other = peers[0], types.Nodes{node}
+			}
+			want := policy.ReduceFilterRules(self, filter)
+
+			resp, err := mappy.fullMapResponse(self, other, tt.capVer)
+			require.NoError(t, err)
+
+			if tt.wantFilters {
+				require.Nil(t, resp.PacketFilter)
+				require.Equal(t, map[string][]tailcfg.FilterRule{"base": want}, resp.PacketFilters)
+
+				return
+			}
+
+			require.Nil(t, resp.PacketFilters)
+			if tt.self {
+				require.NotEmpty(t, want)
+				require.Equal(t, want, resp.PacketFilter)
+			} else {
+				// An empty filter is not sent, a rule matching nothing
+				// is sent instead of the rules of other nodes.
+				require.Empty(t, want)
+				require.Equal(t, matchNothingFilter, resp.PacketFilter)
+				for _, rule := range resp.PacketFilter {
+					require.NotContains(t, filter, rule)
+				}
+			}
+		})
+	}
+}
+
+func TestDenyEmptyFilter(t *testing.T) {
+	tests := []struct {
+		name      string
+		deny      bool
+		wantPeers int
+	}{
+		{
+			name:      "allow",
+			wantPeers: 1,
+		},
+		{
+			name:      "deny",
+			deny:      true,
+			wantPeers: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mappy, node, peers := pipelineTestMapper(t)
+			mappy.cfg.Mapper.DenyEmptyFilter = tt.deny
+
+			polMan, err := policy.NewPolicyManager([]byte(`{"acls": []}`), []types.User{node.User}, append(types.Nodes{node}, peers...))
+			require.NoError(t, err)
+			mappy.polMan = polMan
+
+			filter, _ := polMan.Filter()
+			require.Empty(t, filter)
+
+			resp, err := mappy.fullMapResponse(node, peers, 0)
+			require.NoError(t, err)
+			require.Len(t, resp.Peers, tt.wantPeers)
+			require.Empty(t, resp.PacketFilters["base"])
+
+			mc := &MapContext{Node: node, Peers: peers, Response: &tailcfg.MapResponse{}}
+			require.NoError(t, mappy.appendPeerChanges(mc))
+			require.Len(t, mc.Response.PeersChanged, tt.wantPeers)
+		})
+	}
+}
+
+func TestLimitPeers(t *testing.T) {
+	now := time.Now()
+	seen := func(ago time.Duration) *time.Time {
+		at := now.Add(-ago)
+		return &at
+	}
+	online := true
+
+	peers := types.Nodes{
+		{ID: 2, LastSeen: seen(time.Hour)},
+		{ID: 3},
+		{ID: 4, LastSeen: seen(time.Minute)},
+		{ID: 5, IsOnline: &online, LastSeen: seen(24 * time.Hour)},
+		{ID: 6, LastSeen: seen(time.Second)},
+	}
+
+	ids := func(nodes types.Nodes) []types.NodeID {
+		var ids []types.NodeID
+		for _, node := range nodes {
+			ids = append(ids, node.ID)
+		}
+		slices.Sort(ids)
+
+		return ids
+	}
+
+	require.Equal(t, ids(peers), ids(limitPeers(peers, 0)))
+	require.Equal(t, ids(peers), ids(limitPeers(peers, 5)))
+	require.Equal(t, []types.NodeID{5}, ids(limitPeers(peers, 1)))
+	require.Equal(t, []types.NodeID{4, 5, 6}, ids(limitPeers(peers, 3)))
+	require.Equal(t, []types.NodeID{2, 4, 5, 6}, ids(limitPeers(peers, 4)))
+
+	// The peers passed in are left untouched.
+	require.Equal(t, []types.NodeID{2, 3, 4, 5, 6}, ids(peers))
+	require.Equal(t, types.NodeID(2), peers[0].ID)
+}
+
+func TestExitNodeDNSResolversInResponses(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.db = &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+	mappy.notif = newTestNotifier(t)
+	mappy.cfg.Mapper.ExitNodeDNSResolvers = map[types.NodeID][]string{
+		2: {"10.0.0.53"},
+		3: {"10.0.0.54"},
+	}
+
+	exit := peers[0]
+	exit.Hostinfo = &tailcfg.Hostinfo{RoutableIPs: tsaddr.ExitRoutes()}
+	exit.ApprovedRoutes = tsaddr.ExitRoutes()
+	other := &types.Node{
+		ID:        3,
+		GivenName: "other",
+		User:      node.User,
+		UserID:    node.UserID,
+		IPv4:      iap("100.64.0.3"),
+		Hostinfo:  &tailcfg.Hostinfo{},
+	}
+	peers = append(peers, other)
+
+	want := map[tailcfg.NodeID][]*dnstype.Resolver{
+		2: {{Addr: "10.0.0.53"}},
+		3: nil,
+	}
+	resolvers := func(nodes []*tailcfg.Node) map[tailcfg.NodeID][]*dnstype.Resolver {
+		got := make(map[tailcfg.NodeID][]*dnstype.Resolver)
+		for _, n := range nodes {
+			got[n.ID] = n.ExitNodeDNSResolvers
+		}
+
+		return got
+	}
+
+	resp, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Equal(t, want, resolvers(resp.Peers))
+
+	mc := &MapContext{Node: node, Peers: peers, Response: &tailcfg.MapResponse{}}
+	require.NoError(t, mappy.appendPeerChanges(mc))
+	require.Equal(t, want, resolvers(mc.Response.PeersChanged))
+}
+
+func TestMaxPeers(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.cfg.Mapper.MaxPeers = 1
+
+	lastSeen := time.Now()
+	recent := &types.Node{
+		ID:        3,
+		GivenName: "recent",
+		User:      node.User,
+		UserID:    node.UserID,
+		IPv4:      iap("100.64.0.3"),
+		LastSeen:  &lastSeen,
+	}
+	peers = append(peers, recent)
+	mappy.db = &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+	mappy.notif = newTestNotifier(t)
+
+	resp, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Len(t, resp.Peers, 1)
+	require.Equal(t, tailcfg.NodeID(recent.ID), resp.Peers[0].ID)
+
+	// Changed peers beyond the limit are removed instead.
+	mc := &MapContext{Node: node, Peers: peers, Response: &tailcfg.MapResponse{}}
+	require.NoError(t, mappy.appendPeerChanges(mc))
+	require.Len(t, mc.Response.PeersChanged, 1)
+	require.Equal(t, tailcfg.NodeID(recent.ID), mc.Response.PeersChanged[0].ID)
+	require.Equal(t, []tailcfg.NodeID{2}, mc.Response.PeersRemoved)
+}
+
+func TestPeerWarningThreshold(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.cfg.Mapper.PeerWarningThreshold = 2
+
+	warnings := peerWarnings.WithLabelValues("")
+	before := testutil.ToFloat64(warnings)
+
+	// Below the threshold.
+	_, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.InDelta(t, before, testutil.ToFloat64(warnings), 0)
+
+	peers = append(peers, &types.Node{
+		ID:        3,
+		GivenName: "other",
+		User:      node.User,
+		UserID:    node.UserID,
+		IPv4:      iap("100.64.0.3"),
+	})
+
+	// At the threshold a warning is counted, all peers are sent.
+	resp, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.InDelta(t, before+1, testutil.ToFloat64(warnings), 0)
+	require.Len(t, resp.Peers, 2)
+
+	// Changed peers are not counted.
+	mc := &MapContext{Node: node, Peers: peers, Response: &tailcfg.MapResponse{}}
+	require.NoError(t, mappy.appendPeerChanges(mc))
+	require.InDelta(t, before+1, testutil.ToFloat64(warnings), 0)
+}
+
+func TestPeerSubnetGrouping(t *testing.T) {
+	mappy, node, _ := pipelineTestMapper(t)
+	mappy.cfg.Mapper.PeerSubnetGrouping = 24
+
+	peer := func(id types.NodeID, v4, v6 string) *types.Node {
+		peer := &types.Node{
+			ID:        id,
+			GivenName: fmt.Sprintf("peer%d", id),
+			User:      node.User,
+			UserID:    node.UserID,
+		}
+		if v4 != "" {
+			peer.IPv4 = iap(v4)
+		}
+		if v6 != "" {
+			peer.IPv6 = iap(v6)
+		}
+
+		return peer
+	}
+	peers := types.Nodes{
+		peer(2, "100.64.1.2", ""),
+		peer(3, "", "fd7a:115c:a1e0::3"),
+		peer(4, "100.64.0.4", "fd7a:115c:a1e0::4"),
+		peer(5, "100.64.1.5", ""),
+		peer(6, "100.64.0.6", ""),
+		peer(7, "100.64.1.7", ""),
+	}
+
+	resp, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+
+	var got []tailcfg.NodeID
+	for _, peer := range resp.Peers {
+		got = append(got, peer.ID)
+	}
+	// Peers of the same subnet are contiguous and sorted by ID, peers
+	// without an IPv4 address go last.
+	require.Equal(t, []tailcfg.NodeID{4, 6, 2, 5, 7, 3}, got)
+
+	mappy.cfg.Mapper.PeerSubnetGrouping = 0
+	resp, err = mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+
+	got = nil
+	for _, peer := range resp.Peers {
+		got = append(got, peer.ID)
+	}
+	require.Equal(t, []tailcfg.NodeID{2, 3, 4, 5, 6, 7}, got)
+}
+
+func TestTagDERPRegions(t *testing.T) {
+	derpMap := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1:  {RegionID: 1, RegionCode: "us"},
+			10: {RegionID: 10, RegionCode: "eu"},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		tags       []string
+		homeParams *tailcfg.DERPHomeParams
+		want       map[int]float64
+	}{
+		{
+			name: "tagged",
+			tags: []string{"tag:eu"},
+			want: map[int]float64{10: preferredRegionScore},
+		},
+		{
+			name: "first-tag-in-sorted-order",
+			tags: []string{"tag:us", "tag:eu"},
+			want: map[int]float64{10: preferredRegionScore},
+		},
+		{
+			name: "keeps-scores",
+			tags: []string{"tag:eu"},
+			homeParams: &tailcfg.DERPHomeParams{
+				RegionScore: map[int]float64{1: 2},
+			},
+			want: map[int]float64{1: 2, 10: preferredRegionScore},
+		},
+		{
+			name: "unknown-region",
+			tags: []string{"tag:ap"},
+			want: map[int]float64{},
+		},
+		{
+			name: "untagged",
+			want: map[int]float64{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mappy, node, peers := pipelineTestMapper(t)
+			derpMap := derpMap.Clone()
+			derpMap.HomeParams = tt.homeParams
+			mappy.SetDERPMap(derpMap)
+			mappy.SetTagDERPRegions(map[string]int{
+				"tag:eu": 10,
+				"tag:us": 1,
+				"tag:ap": 20,
+			})
+			node.ForcedTags = tt.tags
+
+			resp, err := mappy.fullMapResponse(node, peers, 0)
+			require.NoError(t, err)
+			require.NotNil(t, resp.DERPMap.HomeParams)
+			require.Equal(t, tt.want, resp.DERPMap.HomeParams.RegionScore)
+
+			// The DERP map of the Mapper is left untouched.
+			require.Equal(t, tt.homeParams, mappy.derpMap.Load().HomeParams)
+		})
+	}
+}
+
+func TestDuplicateNames(t *testing.T) {
+	names := func(nodes []*tailcfg.Node) map[tailcfg.NodeID]string {
+		names := make(map[tailcfg.NodeID]string)
+		for _, node := range nodes {
+			names[node.ID] = node.Name
+		}
+
+		return names
+	}
+
+	tests := []struct {
+		name     string
+		mode     string
+		wantSelf string
+		want     map[tailcfg.NodeID]string
+	}{
+		{
+			name:     "ignore",
+			mode:     types.DuplicateNamesIgnore,
+			wantSelf: "dup.example.com.",
+			want: map[tailcfg.NodeID]string{
+				2: "peer.example.com.",
+				3: "peer.example.com.",
+				4: "dup.example.com.",
+			},
+		},
+		{
+			name:     "warn",
+			mode:     types.DuplicateNamesWarn,
+			wantSelf: "dup.example.com.",
+			want: map[tailcfg.NodeID]string{
+				2: "peer.example.com.",
+				3: "peer.example.com.",
+				4: "dup.example.com.",
+			},
+		},
+		{
+			name:     "suffix",
+			mode:     types.DuplicateNamesSuffix,
+			wantSelf: "dup-4.example.com.",
+			want: map[tailcfg.NodeID]string{
+				2: "peer.example.com.",
+				3: "peer-3.example.com.",
+				4: "dup-4.example.com.",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mappy, node, peers := pipelineTestMapper(t)
+			mappy.cfg.Mapper.DuplicateNames = tt.mode
+
+			node.GivenName = "dup"
+			same := &types.Node{
+				ID:        3,
+				GivenName: "peer",
+				User:      node.User,
+				UserID:    node.UserID,
+				IPv4:      iap("100.64.0.3"),
+				Hostinfo:  &tailcfg.Hostinfo{},
+			}
+			other := &types.Node{
+				ID:        4,
+				GivenName: "dup",
+				User:      node.User,
+				UserID:    node.UserID,
+				IPv4:      iap("100.64.0.4"),
+				Hostinfo:  &tailcfg.Hostinfo{},
+			}
+			peers = append(peers, same, other)
+			mappy.db = &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+			mappy.notif = newTestNotifier(t)
+
+			resp, err := mappy.fullMapResponse(node, peers, 0)
+			require.NoError(t, err)
+			require.Equal(t, "dup.example.com.", resp.Node.Name)
+			require.Equal(t, tt.want, names(resp.Peers))
+
+			// Changed peers get the same names as in full responses.
+			data, err := mappy.PeerChangedResponse(tailcfg.MapRequest{}, node, map[types.NodeID]bool{3: true}, nil)
+			require.NoError(t, err)
+
+			var changed tailcfg.MapResponse
+			require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], &changed))
+			require.Equal(t, map[tailcfg.NodeID]string{3: tt.want[3]}, names(changed.PeersChanged))
+
+			// The node sharing the name of a node with a lower ID knows
+			// itself by the same name as its peers.
+			resp, err = mappy.fullMapResponse(other, types.Nodes{node, peers[0], same}, 0)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantSelf, resp.Node.Name)
+
+			data, err = mappy.PeerChangedResponse(tailcfg.MapRequest{}, other, map[types.NodeID]bool{}, nil)
+			require.NoError(t, err)
+
+			var self tailcfg.MapResponse
+			require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], &self))
+			require.Equal(t, tt.wantSelf, self.Node.Name)
+		})
+	}
+}
+
+// staticSSHPolicyManager is a PolicyManager returning the same SSH policy
+// for every node.
+type staticSSHPolicyManager struct {
+	policy.PolicyManager
+	sshPolicy *tailcfg.SSHPolicy
+}
+
+func (pm staticSSHPolicyManager) SSHPolicy(*types.Node) (*tailcfg.SSHPolicy, error) {
+	return pm.sshPolicy, nil
+}
+
+func TestSSHPolicyByOS(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	sshPolicy := &tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{{
+		Principals: []*tailcfg.SSHPrincipal{{Any: true}},
+		SSHUsers:   map[string]string{"root": "root"},
+		Action:     &tailcfg.SSHAction{Accept: true},
+	}}}
+	mappy.polMan = staticSSHPolicyManager{PolicyManager: mappy.polMan, sshPolicy: sshPolicy}
+
+	tests := []struct {
+		os   string
+		want *tailcfg.SSHPolicy
+	}{
+		{os: "", want: sshPolicy},
+		{os: "linux", want: sshPolicy},
+		{os: "macOS", want: sshPolicy},
+		{os: "iOS"},
+		{os: "android"},
+		{os: "windows"},
+	}
+
+	for _, tt := range tests {
+		t.Run("os-"+tt.os, func(t *testing.T) {
+			node.Hostinfo = &tailcfg.Hostinfo{OS: tt.os}
+
+			resp, err := mappy.fullMapResponse(node, peers, 0)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, resp.SSHPolicy)
+		})
+	}
+}
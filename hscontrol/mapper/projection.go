@@ -0,0 +1,150 @@
+package mapper
+
+import (
+	"slices"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+// peerProjection returns the peer fields to omit from the map responses
+// sent to node, or nil if the node is sent the full peers.
+func (m *Mapper) peerProjection(node *types.Node) []string {
+	var omit []string
+
+	projection := m.cfg.Mapper.PeerProjection
+	if len(projection.Omit) > 0 && nodeMatchesAny(node, nodeTags(node, m.polMan), projection.Nodes) {
+		omit = projection.Omit
+	}
+
+	// Without the endpoints of its peers a node can only reach them
+	// through DERP.
+	if m.derpOnly(node) && !slices.Contains(omit, types.PeerFieldEndpoints) {
+		omit = append(slices.Clone(omit), types.PeerFieldEndpoints)
+	}
+
+	return omit
+}
+
+// derpOnly reports if the node may only be reached through DERP.
+func (m *Mapper) derpOnly(node *types.Node) bool {
+	return nodeMatchesAny(node, nodeTags(node, m.polMan), m.cfg.Mapper.DERPOnly)
+}
+
+// stripDERPOnlyPeers removes the endpoints of the DERP-only nodes from
+// peers, which holds the Tailscale nodes of nodes at the same index.
+func (m *Mapper) stripDERPOnlyPeers(nodes types.Nodes, peers []*tailcfg.Node) {
+	for i, node := range nodes {
+		if m.derpOnly(node) {
+			peers[i].Endpoints = nil
+		}
+	}
+}
+
+// stripOfflineEndpoints removes the endpoints of the offline nodes from
+// peers, which holds the Tailscale nodes of nodes at the same index, if
+// types.MapperConfig.StripOfflineEndpoints is enabled. Their DERP home
+// region is kept.
+func (m *Mapper) stripOfflineEndpoints(nodes types.Nodes, peers []*tailcfg.Node) {
+	if !m.cfg.Mapper.StripOfflineEndpoints {
+		return
+	}
+
+	for i, node := range nodes {
+		if node.IsOnline == nil || !*node.IsOnline {
+			peers[i].Endpoints = nil
+		}
+	}
+}
+
+// stripDERPOnlyPatches returns patches without the endpoints of
+// DERP-only nodes. The patches are copied before being modified as they
+// are shared between the responses of multiple nodes.
+func (m *Mapper) stripDERPOnlyPatches(patches []*tailcfg.PeerChange) ([]*tailcfg.PeerChange, error) {
+	if len(m.cfg.Mapper.DERPOnly) == 0 {
+		return patches, nil
+	}
+
+	var ids []types.NodeID
+	for _, patch := range patches {
+		if patch.Endpoints != nil {
+			ids = append(ids, types.NodeID(patch.NodeID))
+		}
+	}
+	if len(ids) == 0 {
+		return patches, nil
+	}
+
+	nodes, err := m.ListNodes(ids...)
+	if err != nil {
+		return nil, err
+	}
+
+	derpOnly := make(map[tailcfg.NodeID]bool)
+	for _, node := range nodes {
+		if m.derpOnly(node) {
+			derpOnly[tailcfg.NodeID(node.ID)] = true
+		}
+	}
+
+	stripped := make([]*tailcfg.PeerChange, len(patches))
+	for i, patch := range patches {
+		stripped[i] = patch
+		if derpOnly[patch.NodeID] {
+			strippedPatch := *patch
+			strippedPatch.Endpoints = nil
+			stripped[i] = &strippedPatch
+		}
+	}
+
+	return stripped, nil
+}
+
+// projectPeers removes the omitted fields from all peers in resp.
+// The peers are copied before being modified as patches can be shared
+// between the responses of multiple nodes.
+func projectPeers(resp *tailcfg.MapResponse, omit []string) {
+	if len(omit) == 0 {
+		return
+	}
+
+	for i, peer := range resp.Peers {
+		resp.Peers[i] = projectPeer(peer, omit)
+	}
+
+	for i, peer := range resp.PeersChanged {
+		resp.PeersChanged[i] = projectPeer(peer, omit)
+	}
+
+	if resp.PeersChangedPatch != nil {
+		patches := make([]*tailcfg.PeerChange, len(resp.PeersChangedPatch))
+		for i, patch := range resp.PeersChangedPatch {
+			projected := *patch
+			if slices.Contains(omit, types.PeerFieldEndpoints) {
+				projected.Endpoints = nil
+			}
+			if slices.Contains(omit, types.PeerFieldCapMap) {
+				projected.CapMap = nil
+			}
+			patches[i] = &projected
+		}
+		resp.PeersChangedPatch = patches
+	}
+}
+
+func projectPeer(peer *tailcfg.Node, omit []string) *tailcfg.Node {
+	projected := *peer
+
+	for _, field := range omit {
+		switch field {
+		case types.PeerFieldHostinfo:
+			projected.Hostinfo = tailcfg.HostinfoView{}
+		case types.PeerFieldEndpoints:
+			projected.Endpoints = nil
+		case types.PeerFieldCapMap:
+			projected.CapMap = nil
+		}
+	}
+
+	return &projected
+}
@@ -0,0 +1,143 @@
+package mapper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/policy"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/rs/zerolog/log"
+	"tailscale.com/envknob"
+	"tailscale.com/tailcfg"
+)
+
+var debugRecordMapRequestPath = envknob.String("HEADSCALE_DEBUG_RECORD_MAPREQUEST_PATH")
+
+// Recordings hold the state of nodes and are only readable by the user
+// running headscale.
+const (
+	recordingDirPerm  = 0o700
+	recordingFilePerm = 0o600
+)
+
+// Recording is a MapRequest together with the state of the node sending
+// it and its peers at the time it was received. Recordings are stored as
+// JSON and can be replayed against a Mapper to reproduce the response.
+type Recording struct {
+	Time       time.Time
+	MapRequest tailcfg.MapRequest
+	Node       *types.Node
+	Peers      types.Nodes
+}
+
+// NewRecording records mapRequest sent by node with the given peers at
+// the current time. The secrets of the nodes are left out.
+func NewRecording(mapRequest tailcfg.MapRequest, node *types.Node, peers types.Nodes) *Recording {
+	recPeers := make(types.Nodes, len(peers))
+	for i, peer := range peers {
+		recPeers[i] = recordedNode(peer)
+	}
+
+	return &Recording{
+		Time:       time.Now().UTC(),
+		MapRequest: mapRequest,
+		Node:       recordedNode(node),
+		Peers:      recPeers,
+	}
+}
+
+// recordedNode returns a copy of node without the pre auth key secret.
+// The rest of the pre auth key is kept, its tags are tags of the node.
+func recordedNode(node *types.Node) *types.Node {
+	if node == nil || node.AuthKey == nil {
+		return node
+	}
+
+	authKey := *node.AuthKey
+	authKey.Key = ""
+
+	recorded := *node
+	recorded.AuthKey = &authKey
+
+	return &recorded
+}
+
+// WriteRecording writes rec to w as JSON.
+func WriteRecording(w io.Writer, rec *Recording) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(rec); err != nil {
+		return fmt.Errorf("encoding recording: %w", err)
+	}
+
+	return nil
+}
+
+// ReadRecording reads a recording written by WriteRecording from r.
+func ReadRecording(r io.Reader) (*Recording, error) {
+	var rec Recording
+	if err := json.NewDecoder(r).Decode(&rec); err != nil {
+		return nil, fmt.Errorf("decoding recording: %w", err)
+	}
+
+	if rec.Node == nil {
+		return nil, errors.New("decoding recording: no node")
+	}
+
+	return &rec, nil
+}
+
+// Replay runs the full map response pipeline for the recorded request
+// as if it was received at the time it was recorded, without updating
+// any state of the Mapper. The recorded peers are used instead of the
+// current ones, and polMan instead of the current policy if not nil.
+// Replaying a recording with the same policy and configuration always
+// returns the same response.
+func (m *Mapper) Replay(rec *Recording, polMan policy.PolicyManager) (*tailcfg.MapResponse, error) {
+	sim := m.simulation(polMan)
+	sim.now = func() time.Time { return rec.Time }
+
+	// ControlTime has to be the recorded time.
+	cfg := *m.cfg
+	cfg.Tuning.ControlTimeJitter = 0
+	sim.cfg = &cfg
+
+	return sim.fullMapResponse(rec.Node, rec.Peers, rec.MapRequest.Version)
+}
+
+// recordRequest writes a recording of the request to the directory
+// set in HEADSCALE_DEBUG_RECORD_MAPREQUEST_PATH.
+func (m *Mapper) recordRequest(mapRequest tailcfg.MapRequest, node *types.Node, peers types.Nodes) {
+	rec := NewRecording(mapRequest, node, peers)
+
+	dir := path.Join(debugRecordMapRequestPath, node.Hostname)
+	if err := os.MkdirAll(dir, recordingDirPerm); err != nil {
+		log.Error().Err(err).Msg("creating map request recording directory")
+
+		return
+	}
+
+	name := path.Join(
+		dir,
+		fmt.Sprintf("%s-%s-%d.json", rec.Time.Format("2006-01-02T15-04-05.999999999"), m.uid, atomic.LoadUint64(&m.seq)),
+	)
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, recordingFilePerm)
+	if err != nil {
+		log.Error().Err(err).Msg("creating map request recording")
+
+		return
+	}
+	defer f.Close()
+
+	if err := WriteRecording(f, rec); err != nil {
+		log.Error().Err(err).Str("path", name).Msg("writing map request recording")
+	}
+}
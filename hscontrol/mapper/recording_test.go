@@ -0,0 +1,105 @@
+package mapper
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/tailcfg"
+)
+
+func TestReplayRecording(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.cfg.Tuning.ControlTimeJitter = time.Second
+	mappy.cfg.Mapper.MaxSession = time.Hour
+
+	rec := NewRecording(tailcfg.MapRequest{Version: 106, NodeKey: node.NodeKey}, node, peers)
+	rec.Time = time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteRecording(&buf, rec))
+
+	replayed, err := ReadRecording(&buf)
+	require.NoError(t, err)
+
+	first, err := mappy.Replay(replayed, nil)
+	require.NoError(t, err)
+	require.Equal(t, rec.Time, *first.ControlTime)
+	require.Equal(t, rec.Time.Add(time.Hour), first.Node.KeyExpiry)
+	require.Len(t, first.Peers, 1)
+
+	second, err := mappy.Replay(replayed, nil)
+	require.NoError(t, err)
+	if diff := cmp.Diff(first, second, util.Comparers...); diff != "" {
+		t.Errorf("Replay() not deterministic (-first +second):\n%s", diff)
+	}
+
+	// The recording replays like the original request.
+	original, err := mappy.Replay(rec, nil)
+	require.NoError(t, err)
+	if diff := cmp.Diff(original, first, util.Comparers...); diff != "" {
+		t.Errorf("Replay() of decoded recording unexpected result (-want +got):\n%s", diff)
+	}
+}
+
+func TestReadRecordingWithoutNode(t *testing.T) {
+	_, err := ReadRecording(strings.NewReader(`{"MapRequest": {}}`))
+	require.Error(t, err)
+}
+
+func TestRecordRequest(t *testing.T) {
+	dir := t.TempDir()
+	debugRecordMapRequestPath = dir
+	t.Cleanup(func() { debugRecordMapRequestPath = "" })
+
+	mappy, node, peers := pipelineTestMapper(t)
+	node.Hostname = "mini"
+	node.AuthKey = &types.PreAuthKey{Key: "secret-node-key", Tags: []string{"tag:server"}}
+	peers[0].AuthKey = &types.PreAuthKey{Key: "secret-peer-key"}
+	mappy.db = &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+	mappy.notif = newTestNotifier(t)
+
+	_, err := mappy.FullMapResponse(tailcfg.MapRequest{Version: 106}, node)
+	require.NoError(t, err)
+
+	files, err := filepath.Glob(filepath.Join(dir, "mini", "*.json"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	info, err := os.Stat(filepath.Join(dir, "mini"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o700), info.Mode().Perm())
+	info, err = os.Stat(files[0])
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// Pre auth key secrets are not recorded, and the nodes are not
+	// modified.
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "secret-")
+	require.Contains(t, string(data), "tag:server")
+	require.Equal(t, "secret-node-key", node.AuthKey.Key)
+
+	f, err := os.Open(files[0])
+	require.NoError(t, err)
+	defer f.Close()
+
+	rec, err := ReadRecording(f)
+	require.NoError(t, err)
+	require.Equal(t, tailcfg.CapabilityVersion(106), rec.MapRequest.Version)
+	require.Equal(t, node.ID, rec.Node.ID)
+	require.Len(t, rec.Peers, 1)
+
+	resp, err := mappy.Replay(rec, nil)
+	require.NoError(t, err)
+	require.Equal(t, tailcfg.NodeID(node.ID), resp.Node.ID)
+	require.Len(t, resp.Peers, 1)
+}
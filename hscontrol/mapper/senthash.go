@@ -0,0 +1,184 @@
+package mapper
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+// Fields of a MapResponse whose hashes are tracked by sentHashes.
+const (
+	fieldDERPMap      = "DERPMap"
+	fieldDNSConfig    = "DNSConfig"
+	fieldDomain       = "Domain"
+	fieldPacketFilter = "PacketFilter"
+	fieldSSHPolicy    = "SSHPolicy"
+)
+
+type sentHash struct {
+	hash       [sha256.Size]byte
+	generation uint64
+}
+
+// sentHashes holds the hashes of MapResponse fields last sent to every
+// node, to leave fields that did not change out of updates.
+type sentHashes struct {
+	mu          sync.Mutex
+	generations map[string]uint64
+	hashes      map[types.NodeID]map[string]sentHash
+
+	// updated holds when a full update was last sent to every node.
+	updated map[types.NodeID]time.Time
+}
+
+func newSentHashes() *sentHashes {
+	return &sentHashes{
+		generations: make(map[string]uint64),
+		hashes:      make(map[types.NodeID]map[string]sentHash),
+		updated:     make(map[types.NodeID]time.Time),
+	}
+}
+
+// touch records now as the time a full update was sent to the node.
+func (h *sentHashes) touch(nodeID types.NodeID, now time.Time) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.updated[nodeID] = now
+}
+
+// current returns the hashes of the fields sent to the node that are
+// still compared to, and when a full update was last sent to it.
+func (h *sentHashes) current(nodeID types.NodeID) (map[string][sha256.Size]byte, time.Time) {
+	if h == nil {
+		return nil, time.Time{}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hashes := make(map[string][sha256.Size]byte)
+	for field, sent := range h.hashes[nodeID] {
+		if sent.generation == h.generations[field] {
+			hashes[field] = sent.hash
+		}
+	}
+
+	return hashes, h.updated[nodeID]
+}
+
+// record records value as sent to the node in field and reports if the
+// same value was sent to the node before, since the last call to bump
+// for field. A nil sentHashes does not track anything.
+func (h *sentHashes) record(nodeID types.NodeID, field string, value any) bool {
+	if h == nil {
+		return false
+	}
+
+	// The tracked fields are plain structs of strings, numbers, slices
+	// and maps, they can always be marshalled.
+	b, _ := json.Marshal(value)
+	hash := sha256.Sum256(b)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fields, ok := h.hashes[nodeID]
+	if !ok {
+		fields = make(map[string]sentHash)
+		h.hashes[nodeID] = fields
+	}
+
+	last, ok := fields[field]
+	current := sentHash{hash: hash, generation: h.generations[field]}
+	fields[field] = current
+
+	return ok && last == current
+}
+
+// forget drops the hashes of the fields sent to the node.
+func (h *sentHashes) forget(nodeID types.NodeID) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.hashes, nodeID)
+	delete(h.updated, nodeID)
+}
+
+// bump forgets the values of field sent before.
+func (h *sentHashes) bump(field string) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.generations[field]++
+}
+
+// omitUnchanged records the fields of resp as sent to the node. If
+// resp is an update, the fields that did not change since they were
+// last sent are left out, the client keeps their previous value. The
+// DERP map is always tracked, the other fields only if
+// types.MapperConfig.OmitUnchangedFields is enabled.
+// It reports if any field was left out.
+func (m *Mapper) omitUnchanged(nodeID types.NodeID, resp *tailcfg.MapResponse, update bool) bool {
+	omitted := false
+	unchanged := func(field string, value any) bool {
+		if m.sentHashes.record(nodeID, field, value) && update {
+			omitted = true
+
+			return true
+		}
+
+		return false
+	}
+
+	if resp.DERPMap != nil && unchanged(fieldDERPMap, resp.DERPMap) {
+		resp.DERPMap = nil
+	}
+
+	if !m.cfg.Mapper.OmitUnchangedFields {
+		return omitted
+	}
+
+	if resp.DNSConfig != nil && unchanged(fieldDNSConfig, resp.DNSConfig) {
+		resp.DNSConfig = nil
+	}
+
+	if resp.Domain != "" && unchanged(fieldDomain, resp.Domain) {
+		resp.Domain = ""
+	}
+
+	if (resp.PacketFilter != nil || resp.PacketFilters != nil) &&
+		unchanged(fieldPacketFilter, []any{resp.PacketFilter, resp.PacketFilters}) {
+		resp.PacketFilter = nil
+		resp.PacketFilters = nil
+	}
+
+	if resp.SSHPolicy != nil && unchanged(fieldSSHPolicy, resp.SSHPolicy) {
+		resp.SSHPolicy = nil
+	}
+
+	return omitted
+}
+
+// ResendDERPMap makes the next full update of every node contain the
+// DERP map, even if it did not change since it was last sent.
+func (m *Mapper) ResendDERPMap() {
+	m.sentHashes.bump(fieldDERPMap)
+	m.InvalidateResponseCache()
+}
@@ -0,0 +1,131 @@
+package mapper
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/tailcfg"
+)
+
+func TestFullMapUpdateResponseDERPMap(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.notif = newTestNotifier(t)
+	mappy.db = &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+
+	stream := tailcfg.MapRequest{Stream: true}
+	derpMap := func(data []byte, err error) *tailcfg.DERPMap {
+		t.Helper()
+		require.NoError(t, err)
+
+		var resp tailcfg.MapResponse
+		require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], &resp))
+
+		return resp.DERPMap
+	}
+
+	// The first response of a session always contains the DERP map.
+	require.NotNil(t, derpMap(mappy.FullMapResponse(stream, node)))
+	require.NotNil(t, derpMap(mappy.FullMapResponse(stream, node)))
+
+	// Updates leave it out while it does not change.
+	require.Nil(t, derpMap(mappy.FullMapUpdateResponse(stream, node)))
+
+	// Non-streaming requests always get it.
+	require.NotNil(t, derpMap(mappy.FullMapUpdateResponse(tailcfg.MapRequest{}, node)))
+
+	// A changed DERP map is sent again.
+	mappy.SetDERPMap(&tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{2: {RegionID: 2}}})
+	got := derpMap(mappy.FullMapUpdateResponse(stream, node))
+	require.NotNil(t, got)
+	require.Contains(t, got.Regions, 2)
+	require.Nil(t, derpMap(mappy.FullMapUpdateResponse(stream, node)))
+
+	// A DERP map update counts as sent.
+	mappy.SetDERPMap(&tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{3: {RegionID: 3}}})
+	require.NotNil(t, derpMap(mappy.DERPMapResponse(stream, node)))
+	require.Nil(t, derpMap(mappy.FullMapUpdateResponse(stream, node)))
+
+	// Resending forces the unchanged DERP map into the next update.
+	mappy.ResendDERPMap()
+	require.NotNil(t, derpMap(mappy.FullMapUpdateResponse(stream, node)))
+	require.Nil(t, derpMap(mappy.FullMapUpdateResponse(stream, node)))
+}
+
+func TestFullMapUpdateResponseDERPMapCache(t *testing.T) {
+	mappy, node, _, generated := cacheTestMapper(t, time.Minute, 1)
+
+	stream := tailcfg.MapRequest{Stream: true}
+	derpMap := func(data []byte, err error) *tailcfg.DERPMap {
+		t.Helper()
+		require.NoError(t, err)
+
+		var resp tailcfg.MapResponse
+		require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], &resp))
+
+		return resp.DERPMap
+	}
+
+	require.NotNil(t, derpMap(mappy.FullMapResponse(stream, node)))
+	require.Equal(t, 1, *generated)
+
+	mappy.InvalidateResponseCache()
+	require.Nil(t, derpMap(mappy.FullMapUpdateResponse(stream, node)))
+	require.Equal(t, 2, *generated)
+
+	// The update without DERP map is not cached for the first response
+	// of the next session.
+	require.NotNil(t, derpMap(mappy.FullMapResponse(stream, node)))
+	require.Equal(t, 3, *generated)
+}
+
+func TestOmitUnchangedFields(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.notif = newTestNotifier(t)
+	mappy.db = &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+	mappy.cfg.ServerURL = "https://headscale.example.com"
+	mappy.cfg.Mapper.OmitUnchangedFields = true
+
+	stream := tailcfg.MapRequest{Stream: true}
+	decode := func(data []byte, err error) tailcfg.MapResponse {
+		t.Helper()
+		require.NoError(t, err)
+
+		var resp tailcfg.MapResponse
+		require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], &resp))
+
+		return resp
+	}
+
+	resp := decode(mappy.FullMapResponse(stream, node))
+	require.NotNil(t, resp.DNSConfig)
+	require.NotEmpty(t, resp.Domain)
+	require.NotNil(t, resp.PacketFilters)
+
+	resp = decode(mappy.FullMapUpdateResponse(stream, node))
+	require.Nil(t, resp.DNSConfig)
+	require.Empty(t, resp.Domain)
+	require.Nil(t, resp.PacketFilters)
+	require.NotNil(t, resp.Node)
+	require.Len(t, resp.Peers, 1)
+
+	resp = decode(mappy.PeerChangedResponse(stream, node, map[types.NodeID]bool{2: true}, nil))
+	require.Nil(t, resp.DNSConfig)
+	require.Nil(t, resp.PacketFilters)
+	require.Len(t, resp.PeersChanged, 1)
+
+	// A changed DNS configuration is sent, the rest is still left out.
+	mappy.cfg.TailcfgDNSConfig = &tailcfg.DNSConfig{Domains: []string{"example.org"}}
+	resp = decode(mappy.FullMapUpdateResponse(stream, node))
+	require.NotNil(t, resp.DNSConfig)
+	require.Nil(t, resp.PacketFilters)
+
+	// Without the option every update contains all fields.
+	mappy.cfg.Mapper.OmitUnchangedFields = false
+	resp = decode(mappy.FullMapUpdateResponse(stream, node))
+	require.NotNil(t, resp.DNSConfig)
+	require.NotEmpty(t, resp.Domain)
+	require.NotNil(t, resp.PacketFilters)
+}
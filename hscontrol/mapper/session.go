@@ -0,0 +1,44 @@
+package mapper
+
+import (
+	"github.com/juanfont/headscale/hscontrol/types"
+)
+
+// ResetSession drops what the Mapper recorded about the responses sent
+// to the node: the peers, the hashes of unchanged fields and the DERP
+// map updates. It must be called when a streaming session of the node
+// starts or ends, so a session is never sent a delta against the
+// responses of another session of the same node, as during reconnects.
+func (m *Mapper) ResetSession(nodeID types.NodeID) {
+	if m.peerSnapshots != nil {
+		m.peerSnapshots.forget(nodeID)
+	}
+	m.sentHashes.forget(nodeID)
+
+	m.derpMapSentMu.Lock()
+	delete(m.derpMapSent, nodeID)
+	delete(m.derpMapPending, nodeID)
+	m.derpMapSentMu.Unlock()
+}
+
+// ForgetNode drops all state the Mapper holds about a deleted node,
+// including the peers tracked for the peer hooks and the cached
+// responses containing it.
+func (m *Mapper) ForgetNode(nodeID types.NodeID) {
+	m.ResetSession(nodeID)
+
+	m.knownPeersMu.Lock()
+	delete(m.knownPeers, nodeID)
+	m.knownPeersMu.Unlock()
+
+	m.lockdownShownMu.Lock()
+	m.lockdownShown.Delete(nodeID)
+	m.lockdownShownMu.Unlock()
+
+	m.names.remove([]types.NodeID{nodeID})
+
+	if m.cache != nil {
+		m.cache.invalidateNodes([]types.NodeID{nodeID})
+	}
+	m.tailNodes.invalidateNodes([]types.NodeID{nodeID})
+}
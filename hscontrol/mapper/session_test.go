@@ -0,0 +1,68 @@
+package mapper
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/tailcfg"
+)
+
+func TestResetSession(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.notif = newTestNotifier(t)
+	mappy.cfg.Mapper.DeltaFullUpdates = true
+	mappy.cfg.Mapper.OmitUnchangedFields = true
+	mappy.cfg.Tuning.DERPMapMinInterval = time.Hour
+	mappy.peerSnapshots = newPeerSnapshots(0)
+	mappy.db = &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+
+	update := func() tailcfg.MapResponse {
+		t.Helper()
+		data, err := mappy.FullMapUpdateResponse(tailcfg.MapRequest{Stream: true}, node)
+		require.NoError(t, err)
+
+		var resp tailcfg.MapResponse
+		require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], &resp))
+
+		return resp
+	}
+
+	_, err := mappy.FullMapResponse(tailcfg.MapRequest{Stream: true}, node)
+	require.NoError(t, err)
+
+	// The session is sent deltas against what it was sent before.
+	resp := update()
+	require.Nil(t, resp.Peers)
+	require.Nil(t, resp.DNSConfig)
+
+	// A new session of the node is sent everything again.
+	mappy.ResetSession(node.ID)
+	_, ok := mappy.DebugCache(node.ID)
+	require.False(t, ok)
+
+	resp = update()
+	require.Len(t, resp.Peers, 1)
+	require.NotNil(t, resp.DNSConfig)
+	require.NotNil(t, resp.DERPMap)
+}
+
+func TestForgetNode(t *testing.T) {
+	mappy, node, _, generated := cacheTestMapper(t, time.Minute, 1)
+	var added []types.NodeID
+	mappy.OnPeerAdded(func(_, peerID types.NodeID) { added = append(added, peerID) })
+
+	_, err := mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Len(t, added, 1)
+
+	mappy.ForgetNode(node.ID)
+
+	// The cached response and the tracked peers are gone.
+	_, err = mappy.FullMapResponse(tailcfg.MapRequest{}, node)
+	require.NoError(t, err)
+	require.Equal(t, 2, *generated)
+	require.Len(t, added, 2)
+}
@@ -0,0 +1,208 @@
+package mapper
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+// peerSnapshots holds the peers last sent to each node, to send full
+// updates as the difference to the previous response, see
+// types.MapperConfig.DeltaFullUpdates.
+type peerSnapshots struct {
+	mu sync.Mutex
+
+	// nodes holds the peers known to each node by ID. A nil peer is
+	// known to the node in an unknown state, it was patched since.
+	nodes map[types.NodeID]map[tailcfg.NodeID]*tailcfg.Node
+
+	// sent holds when all peers were last sent to each node.
+	sent map[types.NodeID]time.Time
+
+	// maxAge is the age after which the peers sent to a node are no
+	// longer used, see types.MapperConfig.DeltaMaxAge.
+	maxAge time.Duration
+}
+
+func newPeerSnapshots(maxAge time.Duration) *peerSnapshots {
+	return &peerSnapshots{
+		nodes:  make(map[types.NodeID]map[tailcfg.NodeID]*tailcfg.Node),
+		sent:   make(map[types.NodeID]time.Time),
+		maxAge: maxAge,
+	}
+}
+
+// has reports if the peers sent to the node are known, and they were
+// not sent in full longer than maxAge before now.
+func (s *peerSnapshots) has(nodeID types.NodeID, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.nodes[nodeID]; !ok {
+		return false
+	}
+
+	return s.maxAge <= 0 || now.Sub(s.sent[nodeID]) < s.maxAge
+}
+
+// peers returns the IDs of the peers known to the node, in order, and
+// when all peers were last sent to it.
+func (s *peerSnapshots) peers(nodeID types.NodeID) ([]tailcfg.NodeID, time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	known, ok := s.nodes[nodeID]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+
+	return slices.Sorted(maps.Keys(known)), s.sent[nodeID], true
+}
+
+// forget drops the peers recorded for the node, the next full update
+// sends all peers.
+func (s *peerSnapshots) forget(nodeID types.NodeID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.nodes, nodeID)
+	delete(s.sent, nodeID)
+}
+
+// update records the peers sent to the node in resp. If delta is true
+// and the peers sent before are known, the full list of peers in resp
+// is replaced by the peers that were added or changed in PeersChanged,
+// patches for the peers with only lightweight changes in
+// PeersChangedPatch and the peers no longer visible in PeersRemoved.
+// now is recorded as the time all peers were sent if resp keeps them.
+func (s *peerSnapshots) update(nodeID types.NodeID, resp *tailcfg.MapResponse, delta bool, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, ok := s.nodes[nodeID]
+
+	if resp.Peers == nil {
+		if !ok {
+			return
+		}
+
+		for _, peer := range resp.PeersChanged {
+			prev[peer.ID] = peer
+		}
+		for _, id := range resp.PeersRemoved {
+			delete(prev, id)
+		}
+		for _, change := range resp.PeersChangedPatch {
+			if _, known := prev[change.NodeID]; known {
+				prev[change.NodeID] = nil
+			}
+		}
+
+		return
+	}
+
+	current := make(map[tailcfg.NodeID]*tailcfg.Node, len(resp.Peers))
+	for _, peer := range resp.Peers {
+		current[peer.ID] = peer
+	}
+	s.nodes[nodeID] = current
+
+	if !delta || !ok {
+		s.sent[nodeID] = now
+
+		return
+	}
+
+	var (
+		changed []*tailcfg.Node
+		patches []*tailcfg.PeerChange
+	)
+	for _, peer := range resp.Peers {
+		if peer.Equal(prev[peer.ID]) {
+			continue
+		}
+
+		if patch, ok := peerPatch(prev[peer.ID], peer); ok {
+			patches = append(patches, patch)
+		} else {
+			changed = append(changed, peer)
+		}
+	}
+
+	var removed []tailcfg.NodeID
+	for id := range prev {
+		if _, ok := current[id]; !ok {
+			removed = append(removed, id)
+		}
+	}
+	slices.Sort(removed)
+
+	resp.Peers = nil
+	resp.PeersChanged = changed
+	resp.PeersChangedPatch = patches
+	resp.PeersRemoved = removed
+}
+
+// peerPatch returns the patch turning prev into peer, if they only
+// differ in their endpoints, home DERP region, online status or last
+// seen time. Peers not known before can not be patched.
+func peerPatch(prev, peer *tailcfg.Node) (*tailcfg.PeerChange, bool) {
+	if prev == nil {
+		return nil, false
+	}
+
+	patched := *prev
+	patch := &tailcfg.PeerChange{NodeID: peer.ID}
+
+	// Patches can not clear fields, their zero value means unchanged.
+	if !slices.Equal(prev.Endpoints, peer.Endpoints) {
+		if len(peer.Endpoints) == 0 {
+			return nil, false
+		}
+		patched.Endpoints = peer.Endpoints
+		patch.Endpoints = peer.Endpoints
+	}
+
+	if prev.HomeDERP != peer.HomeDERP {
+		if peer.HomeDERP == 0 {
+			return nil, false
+		}
+		patched.HomeDERP = peer.HomeDERP
+		patched.LegacyDERPString = peer.LegacyDERPString
+		patch.DERPRegion = peer.HomeDERP
+	}
+
+	if !ptrEqual(prev.Online, peer.Online) {
+		if peer.Online == nil {
+			return nil, false
+		}
+		patched.Online = peer.Online
+		patch.Online = peer.Online
+	}
+
+	if !timePtrEqual(prev.LastSeen, peer.LastSeen) {
+		if peer.LastSeen == nil {
+			return nil, false
+		}
+		patched.LastSeen = peer.LastSeen
+		patch.LastSeen = peer.LastSeen
+	}
+
+	if !patched.Equal(peer) {
+		return nil, false
+	}
+
+	return patch, true
+}
+
+func ptrEqual[T comparable](a, b *T) bool {
+	return a == b || (a != nil && b != nil && *a == *b)
+}
+
+func timePtrEqual(a, b *time.Time) bool {
+	return a == b || (a != nil && b != nil && a.Equal(*b))
+}
@@ -0,0 +1,276 @@
+package mapper
+
+import (
+	"encoding/json"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/tailcfg"
+)
+
+func TestFullMapUpdateResponse(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.notif = newTestNotifier(t)
+	mappy.cfg.Mapper.DeltaFullUpdates = true
+	mappy.peerSnapshots = newPeerSnapshots(0)
+
+	other := &types.Node{
+		ID:        3,
+		GivenName: "other",
+		User:      node.User,
+		UserID:    node.UserID,
+		IPv4:      iap("100.64.0.3"),
+		Hostinfo:  &tailcfg.Hostinfo{},
+	}
+	store := &staticNodeStore{peers: append(types.Nodes{node, other}, peers...)}
+	mappy.db = store
+
+	stream := tailcfg.MapRequest{Stream: true}
+	decode := func(data []byte, err error) tailcfg.MapResponse {
+		t.Helper()
+		require.NoError(t, err)
+
+		var resp tailcfg.MapResponse
+		require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], &resp))
+
+		return resp
+	}
+	ids := func(nodes []*tailcfg.Node) []tailcfg.NodeID {
+		var ids []tailcfg.NodeID
+		for _, node := range nodes {
+			ids = append(ids, node.ID)
+		}
+
+		return ids
+	}
+
+	// Without a previous response all peers are sent.
+	resp := decode(mappy.FullMapUpdateResponse(stream, node))
+	require.Equal(t, []tailcfg.NodeID{2, 3}, ids(resp.Peers))
+
+	// Nothing changed.
+	resp = decode(mappy.FullMapUpdateResponse(stream, node))
+	require.Nil(t, resp.Peers)
+	require.Empty(t, resp.PeersChanged)
+	require.Empty(t, resp.PeersRemoved)
+	require.NotNil(t, resp.Node)
+
+	// Peer 2 changes, peer 3 is removed and peer 4 added.
+	changed := *peers[0]
+	changed.GivenName = "renamed"
+	added := &types.Node{
+		ID:        4,
+		GivenName: "added",
+		User:      node.User,
+		UserID:    node.UserID,
+		IPv4:      iap("100.64.0.4"),
+		Hostinfo:  &tailcfg.Hostinfo{},
+	}
+	store.peers = types.Nodes{node, &changed, added}
+
+	resp = decode(mappy.FullMapUpdateResponse(stream, node))
+	require.Nil(t, resp.Peers)
+	require.Equal(t, []tailcfg.NodeID{2, 4}, ids(resp.PeersChanged))
+	require.Equal(t, []tailcfg.NodeID{3}, resp.PeersRemoved)
+
+	// A patched peer is sent again, even if it is back in the state
+	// of the previous full update.
+	_, err := mappy.PeerChangedPatchResponse(stream, node, []*tailcfg.PeerChange{{NodeID: 4}})
+	require.NoError(t, err)
+
+	resp = decode(mappy.FullMapUpdateResponse(stream, node))
+	require.Equal(t, []tailcfg.NodeID{4}, ids(resp.PeersChanged))
+	require.Empty(t, resp.PeersRemoved)
+
+	// FullMapResponse and non-streaming requests always send all peers.
+	resp = decode(mappy.FullMapResponse(stream, node))
+	require.Equal(t, []tailcfg.NodeID{2, 4}, ids(resp.Peers))
+
+	resp = decode(mappy.FullMapUpdateResponse(tailcfg.MapRequest{}, node))
+	require.Equal(t, []tailcfg.NodeID{2, 4}, ids(resp.Peers))
+}
+
+func TestFullMapUpdateResponseDisabled(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.db = &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+	mappy.notif = newTestNotifier(t)
+
+	stream := tailcfg.MapRequest{Stream: true}
+	for range 2 {
+		data, err := mappy.FullMapUpdateResponse(stream, node)
+		require.NoError(t, err)
+
+		var resp tailcfg.MapResponse
+		require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], &resp))
+		require.Len(t, resp.Peers, 1)
+	}
+}
+
+func TestPeerPatch(t *testing.T) {
+	online, offline := true, false
+	lastSeen := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	endpoint := netip.MustParseAddrPort("192.0.2.1:41641")
+
+	prev := &tailcfg.Node{
+		ID:               2,
+		Name:             "peer.example.com.",
+		Endpoints:        []netip.AddrPort{netip.MustParseAddrPort("192.0.2.2:41641")},
+		HomeDERP:         1,
+		LegacyDERPString: "127.3.3.40:1",
+		Online:           &online,
+	}
+
+	tests := []struct {
+		name   string
+		update func(peer *tailcfg.Node)
+		want   *tailcfg.PeerChange
+	}{
+		{
+			name: "endpoints",
+			update: func(peer *tailcfg.Node) {
+				peer.Endpoints = []netip.AddrPort{endpoint}
+			},
+			want: &tailcfg.PeerChange{NodeID: 2, Endpoints: []netip.AddrPort{endpoint}},
+		},
+		{
+			name: "derp-region",
+			update: func(peer *tailcfg.Node) {
+				peer.HomeDERP = 2
+				peer.LegacyDERPString = "127.3.3.40:2"
+			},
+			want: &tailcfg.PeerChange{NodeID: 2, DERPRegion: 2},
+		},
+		{
+			name: "offline",
+			update: func(peer *tailcfg.Node) {
+				peer.Online = &offline
+				peer.LastSeen = &lastSeen
+			},
+			want: &tailcfg.PeerChange{NodeID: 2, Online: &offline, LastSeen: &lastSeen},
+		},
+		{
+			name: "renamed",
+			update: func(peer *tailcfg.Node) {
+				peer.Name = "renamed.example.com."
+				peer.Online = &offline
+			},
+		},
+		{
+			name: "endpoints-cleared",
+			update: func(peer *tailcfg.Node) {
+				peer.Endpoints = nil
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := *prev
+			tt.update(&peer)
+
+			got, ok := peerPatch(prev, &peer)
+			require.Equal(t, tt.want != nil, ok)
+			require.Equal(t, tt.want, got)
+		})
+	}
+
+	// Peers not known before can not be patched.
+	_, ok := peerPatch(nil, prev)
+	require.False(t, ok)
+}
+
+func TestFullMapUpdateResponsePatches(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.notif = newTestNotifier(t)
+	mappy.cfg.Mapper.DeltaFullUpdates = true
+	mappy.peerSnapshots = newPeerSnapshots(0)
+
+	store := &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+	mappy.db = store
+
+	stream := tailcfg.MapRequest{Stream: true}
+	decode := func(data []byte, err error) tailcfg.MapResponse {
+		t.Helper()
+		require.NoError(t, err)
+
+		var resp tailcfg.MapResponse
+		require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], &resp))
+
+		return resp
+	}
+
+	resp := decode(mappy.FullMapResponse(stream, node))
+	require.Len(t, resp.Peers, 1)
+
+	// The peer comes online with new endpoints and a peer with
+	// endpoints is added at the same time.
+	endpoint := netip.MustParseAddrPort("192.0.2.1:41641")
+	mappy.notif.AddNode(peers[0].ID, make(chan types.StateUpdate, 1))
+	flapped := *peers[0]
+	flapped.Endpoints = []netip.AddrPort{endpoint}
+	added := &types.Node{
+		ID:        3,
+		GivenName: "added",
+		User:      node.User,
+		UserID:    node.UserID,
+		IPv4:      iap("100.64.0.3"),
+		Endpoints: []netip.AddrPort{endpoint},
+		Hostinfo:  &tailcfg.Hostinfo{},
+	}
+	store.peers = types.Nodes{node, &flapped, added}
+
+	resp = decode(mappy.FullMapUpdateResponse(stream, node))
+	require.Nil(t, resp.Peers)
+	require.Len(t, resp.PeersChanged, 1)
+	require.Equal(t, tailcfg.NodeID(3), resp.PeersChanged[0].ID)
+	require.Len(t, resp.PeersChangedPatch, 1)
+	online := true
+	require.Equal(t, &tailcfg.PeerChange{
+		NodeID:    2,
+		Endpoints: []netip.AddrPort{endpoint},
+		Online:    &online,
+	}, resp.PeersChangedPatch[0])
+}
+
+func TestFullMapUpdateResponseMaxAge(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+	mappy.notif = newTestNotifier(t)
+	mappy.cfg.Mapper.DeltaFullUpdates = true
+	mappy.peerSnapshots = newPeerSnapshots(time.Minute)
+	mappy.db = &staticNodeStore{peers: append(types.Nodes{node}, peers...)}
+
+	now := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	mappy.now = func() time.Time { return now }
+
+	stream := tailcfg.MapRequest{Stream: true}
+	decode := func(data []byte, err error) tailcfg.MapResponse {
+		t.Helper()
+		require.NoError(t, err)
+
+		var resp tailcfg.MapResponse
+		require.NoError(t, json.Unmarshal(data[reservedResponseHeaderSize:], &resp))
+
+		return resp
+	}
+
+	resp := decode(mappy.FullMapResponse(stream, node))
+	require.Len(t, resp.Peers, 1)
+
+	// Differences are sent while the peers are younger than the max age,
+	// sending them does not renew the peers.
+	now = now.Add(30 * time.Second)
+	resp = decode(mappy.FullMapUpdateResponse(stream, node))
+	require.Nil(t, resp.Peers)
+
+	now = now.Add(30 * time.Second)
+	resp = decode(mappy.FullMapUpdateResponse(stream, node))
+	require.Len(t, resp.Peers, 1)
+
+	// The full update renews the peers.
+	now = now.Add(30 * time.Second)
+	resp = decode(mappy.FullMapUpdateResponse(stream, node))
+	require.Nil(t, resp.Peers)
+}
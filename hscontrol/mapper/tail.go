@@ -1,16 +1,175 @@
 package mapper
 
 import (
+	"cmp"
 	"fmt"
+	"hash/fnv"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/juanfont/headscale/hscontrol/policy"
 	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/rs/zerolog/log"
 	"github.com/samber/lo"
-	"tailscale.com/net/tsaddr"
+	"go4.org/netipx"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/dnstype"
 )
 
+// CapabilityAutogroup is the node capability listing the autogroups
+// a node is a member of.
+const CapabilityAutogroup tailcfg.NodeCapability = "headscale.net/cap/autogroup"
+
+const (
+	autogroupMember = "autogroup:member"
+	autogroupTagged = "autogroup:tagged"
+)
+
+// autogroupCapValues returns the values for CapabilityAutogroup of a
+// node with the given (policy approved) tags. Nodes with tags belong to
+// autogroup:tagged, all other nodes are owned by a user and belong to
+// autogroup:member.
+func autogroupCapValues(tags []string) []tailcfg.RawMessage {
+	group := autogroupMember
+	if len(tags) > 0 {
+		group = autogroupTagged
+	}
+
+	return []tailcfg.RawMessage{tailcfg.RawMessage(strconv.Quote(group))}
+}
+
+// tagUserIDBase is the first user ID of the synthetic user profiles
+// of tags, far above the IDs of real users.
+const tagUserIDBase tailcfg.UserID = 1 << 48
+
+// tagUserID returns the stable ID of the synthetic user profile of tag.
+func tagUserID(tag string) tailcfg.UserID {
+	h := fnv.New32a()
+	h.Write([]byte(tag))
+
+	return tagUserIDBase + tailcfg.UserID(h.Sum32())
+}
+
+// tagUserProfile returns the synthetic user profile representing tag.
+// Tagged nodes are owned by their tag instead of a user.
+func tagUserProfile(tag string) tailcfg.UserProfile {
+	return tailcfg.UserProfile{
+		ID:          tagUserID(tag),
+		LoginName:   tag,
+		DisplayName: tag,
+	}
+}
+
+// nodeTags returns the tags of node that are approved by the policy.
+func nodeTags(node *types.Node, polMan policy.PolicyManager) []string {
+	var tags []string
+	for _, tag := range node.RequestTags() {
+		if polMan.NodeCanHaveTag(node, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	return lo.Uniq(append(tags, node.ForcedTags...))
+}
+
+// orphanUserID is the user ID of the synthetic user profile of
+// orphaned nodes, see types.MapperConfig.OrphanUserName.
+const orphanUserID = tagUserIDBase - 1
+
+// isOrphaned reports if the node is not owned by any user.
+func isOrphaned(node *types.Node) bool {
+	return node.UserID == 0 && node.User.ID == 0
+}
+
+// nodeUserProfile returns the profile of the owner of the node with
+// the given (policy approved) tags. Tagged nodes are owned by their
+// first tag, all other nodes by their user. Orphaned nodes are owned
+// by the configured orphan user, if there is none false is returned.
+// Nodes of users missing from the database are owned by a placeholder
+// user with the configured deleted user name.
+func nodeUserProfile(node *types.Node, tags []string, cfg *types.Config) (tailcfg.UserProfile, bool) {
+	if len(tags) > 0 {
+		return tagUserProfile(slices.Min(tags)), true
+	}
+
+	if isOrphaned(node) {
+		if cfg.Mapper.OrphanUserName == "" {
+			return tailcfg.UserProfile{}, false
+		}
+
+		return tailcfg.UserProfile{
+			ID:          orphanUserID,
+			LoginName:   cfg.Mapper.OrphanUserName,
+			DisplayName: cfg.Mapper.OrphanUserName,
+		}, true
+	}
+
+	// The node references a user missing from the database.
+	if node.User.ID == 0 {
+		return tailcfg.UserProfile{
+			ID:          tailcfg.UserID(node.UserID),
+			LoginName:   cfg.Mapper.DeletedUserName,
+			DisplayName: cfg.Mapper.DeletedUserName,
+		}, true
+	}
+
+	return node.User.TailscaleUserProfile(), true
+}
+
+// enabledRoutes returns the routes that the node announces and that
+// are approved, which enables them. Disabled routes are left out even
+// if the primary routes were not recalculated yet.
+func enabledRoutes(node *types.Node, routes []netip.Prefix) []netip.Prefix {
+	subnetRoutes := node.SubnetRoutes()
+
+	var enabled []netip.Prefix
+	for _, route := range routes {
+		if slices.Contains(subnetRoutes, route) {
+			enabled = append(enabled, route)
+		}
+	}
+
+	return enabled
+}
+
+// minimizePrefixes returns the shortest list of prefixes covering the
+// same addresses as prefixes, merging overlapping and adjacent ones.
+func minimizePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	if len(prefixes) < 2 {
+		return prefixes
+	}
+
+	var builder netipx.IPSetBuilder
+	for _, prefix := range prefixes {
+		builder.AddPrefix(prefix)
+	}
+
+	set, err := builder.IPSet()
+	if err != nil {
+		return prefixes
+	}
+
+	return set.Prefixes()
+}
+
+// sortPrefixesBySpecificity sorts prefixes with IPv4 prefixes first and
+// the most specific prefixes first within each family, so clients
+// matching them in order find the most specific one first. Prefixes of
+// the same length are sorted by address.
+func sortPrefixesBySpecificity(prefixes []netip.Prefix) {
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+		return cmp.Or(
+			cmp.Compare(a.Addr().BitLen(), b.Addr().BitLen()),
+			cmp.Compare(b.Bits(), a.Bits()),
+			a.Addr().Compare(b.Addr()),
+		)
+	})
+}
+
 func tailNodes(
 	nodes types.Nodes,
 	capVer tailcfg.CapabilityVersion,
@@ -49,15 +208,16 @@ func tailNode(
 	addrs := node.Prefixes()
 
 	var derp int
+	if node.Hostinfo != nil && node.Hostinfo.NetInfo != nil {
+		derp = node.Hostinfo.NetInfo.PreferredDERP
+	}
 
 	// TODO(kradalby): legacyDERP was removed in tailscale/tailscale@2fc4455e6dd9ab7f879d4e2f7cffc2be81f14077
 	// and should be removed after 111 is the minimum capver.
+	// CapVer 111: 2025-01-14: Client supports a peer having Node.HomeDERP
 	var legacyDERP string
-	if node.Hostinfo != nil && node.Hostinfo.NetInfo != nil {
-		legacyDERP = fmt.Sprintf("127.3.3.40:%d", node.Hostinfo.NetInfo.PreferredDERP)
-		derp = node.Hostinfo.NetInfo.PreferredDERP
-	} else {
-		legacyDERP = "127.3.3.40:0" // Zero means disconnected or unknown.
+	if capVer < homeDERPCapVer {
+		legacyDERP = fmt.Sprintf("127.3.3.40:%d", derp) // Zero means disconnected or unknown.
 	}
 
 	var keyExpiry time.Time
@@ -67,23 +227,24 @@ func tailNode(
 		keyExpiry = time.Time{}
 	}
 
-	hostname, err := node.GetFQDN(cfg.BaseDomain)
+	hostname, err := nodeName(node, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("tailNode, failed to create FQDN: %s", err)
 	}
 
-	var tags []string
-	for _, tag := range node.RequestTags() {
-		if polMan.NodeCanHaveTag(node, tag) {
-			tags = append(tags, tag)
-		}
-	}
-	tags = lo.Uniq(append(tags, node.ForcedTags...))
+	tags := nodeTags(node, polMan)
 
-	routes := primaryRouteFunc(node.ID)
-	allowed := append(node.Prefixes(), routes...)
+	routes := enabledRoutes(node, primaryRouteFunc(node.ID))
+	allowed := append(node.Prefixes(), minimizePrefixes(routes)...)
 	allowed = append(allowed, node.ExitRoutes()...)
-	tsaddr.SortPrefixes(allowed)
+	sortPrefixesBySpecificity(allowed)
+
+	user := tailcfg.UserID(node.UserID)
+	if len(tags) > 0 || isOrphaned(node) {
+		if profile, ok := nodeUserProfile(node, tags, cfg); ok {
+			user = profile.ID
+		}
+	}
 
 	tNode := tailcfg.Node{
 		ID:       tailcfg.NodeID(node.ID), // this is the actual ID
@@ -91,7 +252,7 @@ func tailNode(
 		Name:     hostname,
 		Cap:      capVer,
 
-		User: tailcfg.UserID(node.UserID),
+		User: user,
 
 		Key:       node.NodeKey,
 		KeyExpiry: keyExpiry.UTC(),
@@ -113,6 +274,8 @@ func tailNode(
 
 		MachineAuthorized: !node.IsExpired(),
 		Expired:           node.IsExpired(),
+
+		UnsignedPeerAPIOnly: nodeMatchesAny(node, tags, cfg.Mapper.PeerAPIOnly),
 	}
 
 	tNode.CapMap = tailcfg.NodeCapMap{
@@ -125,6 +288,17 @@ func tailNode(
 		tNode.CapMap[tailcfg.NodeAttrRandomizeClientPort] = []tailcfg.RawMessage{}
 	}
 
+	if cfg.Mapper.AutogroupCapability {
+		tNode.CapMap[CapabilityAutogroup] = autogroupCapValues(tags)
+	}
+
+	// Clients only use the resolvers of WireGuard-only exit nodes.
+	if len(node.ExitRoutes()) > 0 {
+		for _, addr := range cfg.Mapper.ExitNodeDNSResolvers[node.ID] {
+			tNode.ExitNodeDNSResolvers = append(tNode.ExitNodeDNSResolvers, &dnstype.Resolver{Addr: addr})
+		}
+	}
+
 	if node.IsOnline == nil || !*node.IsOnline {
 		// LastSeen is only set when node is
 		// not connected to the control server.
@@ -133,3 +307,67 @@ func tailNode(
 
 	return &tNode, nil
 }
+
+// dnsSafeNode returns the node itself if its GivenName is a valid DNS
+// label, otherwise a shallow copy with a sanitized GivenName.
+// As sanitizing can map different names to the same label, the node ID
+// is appended to keep the name unique within the tailnet. Names only
+// differing in case already collide in DNS and are left to
+// types.MapperConfig.DuplicateNames, so lowercasing appends nothing.
+func dnsSafeNode(node *types.Node) *types.Node {
+	label := util.SanitizeDNSLabel(node.GivenName)
+	if label == node.GivenName || label == "" {
+		return node
+	}
+
+	safe := *node
+	safe.GivenName = label
+	if label != strings.ToLower(node.GivenName) {
+		safe.GivenName = suffixedLabel(label, node.ID)
+	}
+
+	return &safe
+}
+
+// suffixedLabel appends the node ID to label, shortening label if the
+// result would be too long for a DNS label.
+func suffixedLabel(label string, nodeID types.NodeID) string {
+	suffix := "-" + nodeID.String()
+	if len(label)+len(suffix) > util.LabelHostnameLength {
+		label = strings.TrimRight(label[:util.LabelHostnameLength-len(suffix)], "-")
+	}
+
+	return label + suffix
+}
+
+// nodeName returns the MagicDNS name of the node.
+func nodeName(node *types.Node, cfg *types.Config) (string, error) {
+	return dnsSafeNode(node).GetFQDN(baseDomain(cfg, node))
+}
+
+// disambiguateName handles the Tailscale node tNode of node if another
+// node in owners uses the same name, see
+// types.MapperConfig.DuplicateNames. The node owning the name keeps
+// it, all others get their ID appended to their first label, so that
+// every node agrees on the names.
+func disambiguateName(node *types.Node, tNode *tailcfg.Node, owners map[string]types.NodeID, cfg *types.Config) {
+	owner, ok := owners[tNode.Name]
+	if !ok || owner == node.ID {
+		return
+	}
+
+	switch cfg.Mapper.DuplicateNames {
+	case types.DuplicateNamesWarn:
+		log.Warn().
+			Uint64("node.id", node.ID.Uint64()).
+			Uint64("owner.id", owner.Uint64()).
+			Str("name", tNode.Name).
+			Msg("node shares its name with another node")
+	case types.DuplicateNamesSuffix:
+		renamed := *dnsSafeNode(node)
+		renamed.GivenName = suffixedLabel(renamed.GivenName, node.ID)
+		if name, err := renamed.GetFQDN(baseDomain(cfg, node)); err == nil {
+			tNode.Name = name
+		}
+	}
+}
@@ -3,6 +3,7 @@ package mapper
 import (
 	"encoding/json"
 	"net/netip"
+	"strings"
 	"testing"
 	"time"
 
@@ -11,9 +12,12 @@ import (
 	"github.com/juanfont/headscale/hscontrol/policy"
 	"github.com/juanfont/headscale/hscontrol/routes"
 	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
 	"github.com/stretchr/testify/require"
+	"go4.org/netipx"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/dnstype"
 	"tailscale.com/types/key"
 )
 
@@ -137,9 +141,9 @@ func TestTailNode(t *testing.T) {
 				),
 				Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
 				AllowedIPs: []netip.Prefix{
-					tsaddr.AllIPv4(),
-					netip.MustParsePrefix("192.168.0.0/24"),
 					netip.MustParsePrefix("100.64.0.1/32"),
+					netip.MustParsePrefix("192.168.0.0/24"),
+					tsaddr.AllIPv4(),
 					tsaddr.AllIPv6(),
 				},
 				PrimaryRoutes: []netip.Prefix{
@@ -309,3 +313,398 @@ func TestNodeExpiry(t *testing.T) {
 		})
 	}
 }
+
+func TestTailNodeNameSanitization(t *testing.T) {
+	tests := []struct {
+		name      string
+		id        types.NodeID
+		givenName string
+		want      string
+	}{
+		{
+			name:      "valid",
+			id:        1,
+			givenName: "mini",
+			want:      "mini.example.com.",
+		},
+		{
+			name:      "uppercase",
+			id:        6,
+			givenName: "MyLaptop",
+			want:      "mylaptop.example.com.",
+		},
+		{
+			name:      "spaces",
+			id:        2,
+			givenName: "My Laptop",
+			want:      "my-laptop-2.example.com.",
+		},
+		{
+			name:      "underscores",
+			id:        3,
+			givenName: "my_laptop",
+			want:      "my-laptop-3.example.com.",
+		},
+		{
+			name:      "unicode",
+			id:        4,
+			givenName: "café",
+			want:      "caf-4.example.com.",
+		},
+		{
+			name:      "too-long",
+			id:        5,
+			givenName: strings.Repeat("A", 70),
+			want:      strings.Repeat("a", 61) + "-5.example.com.",
+		},
+	}
+
+	polMan, err := policy.NewPolicyManager(nil, nil, nil)
+	require.NoError(t, err)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := &types.Node{
+				ID:        tt.id,
+				GivenName: tt.givenName,
+			}
+
+			got, err := tailNode(
+				node,
+				0,
+				polMan,
+				func(id types.NodeID) []netip.Prefix {
+					return []netip.Prefix{}
+				},
+				&types.Config{BaseDomain: "example.com"},
+			)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got.Name)
+
+			// The stored node must not be modified.
+			require.Equal(t, tt.givenName, node.GivenName)
+		})
+	}
+}
+
+func TestTailNodeAutogroupCapability(t *testing.T) {
+	tests := []struct {
+		name    string
+		node    *types.Node
+		enabled bool
+		want    []tailcfg.RawMessage
+	}{
+		{
+			name: "member",
+			node: &types.Node{
+				ID:        1,
+				GivenName: "member",
+			},
+			enabled: true,
+			want:    []tailcfg.RawMessage{`"autogroup:member"`},
+		},
+		{
+			name: "tagged",
+			node: &types.Node{
+				ID:         2,
+				GivenName:  "tagged",
+				ForcedTags: []string{"tag:server"},
+			},
+			enabled: true,
+			want:    []tailcfg.RawMessage{`"autogroup:tagged"`},
+		},
+		{
+			name: "disabled",
+			node: &types.Node{
+				ID:        3,
+				GivenName: "disabled",
+			},
+			enabled: false,
+			want:    nil,
+		},
+	}
+
+	polMan, err := policy.NewPolicyManager(nil, nil, nil)
+	require.NoError(t, err)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tailNode(
+				tt.node,
+				0,
+				polMan,
+				func(id types.NodeID) []netip.Prefix {
+					return []netip.Prefix{}
+				},
+				&types.Config{
+					Mapper: types.MapperConfig{AutogroupCapability: tt.enabled},
+				},
+			)
+			require.NoError(t, err)
+
+			caps, ok := got.CapMap[CapabilityAutogroup]
+			require.Equal(t, tt.enabled, ok)
+			require.Equal(t, tt.want, caps)
+		})
+	}
+}
+
+func TestMinimizePrefixes(t *testing.T) {
+	mp := netip.MustParsePrefix
+
+	tests := []struct {
+		name     string
+		prefixes []netip.Prefix
+		want     []netip.Prefix
+	}{
+		{
+			name:     "empty",
+			prefixes: nil,
+			want:     nil,
+		},
+		{
+			name:     "single",
+			prefixes: []netip.Prefix{mp("10.0.0.0/24")},
+			want:     []netip.Prefix{mp("10.0.0.0/24")},
+		},
+		{
+			name:     "contained",
+			prefixes: []netip.Prefix{mp("10.0.0.0/8"), mp("10.1.0.0/16"), mp("10.1.2.0/24")},
+			want:     []netip.Prefix{mp("10.0.0.0/8")},
+		},
+		{
+			name:     "adjacent",
+			prefixes: []netip.Prefix{mp("192.168.0.0/24"), mp("192.168.1.0/24")},
+			want:     []netip.Prefix{mp("192.168.0.0/23")},
+		},
+		{
+			name:     "duplicates",
+			prefixes: []netip.Prefix{mp("172.16.0.0/16"), mp("172.16.0.0/16")},
+			want:     []netip.Prefix{mp("172.16.0.0/16")},
+		},
+		{
+			name: "disjoint-and-ipv6",
+			prefixes: []netip.Prefix{
+				mp("fd00::/64"), mp("10.0.0.0/24"), mp("fd00::/48"), mp("192.168.0.0/24"),
+			},
+			want: []netip.Prefix{mp("10.0.0.0/24"), mp("192.168.0.0/24"), mp("fd00::/48")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := minimizePrefixes(tt.prefixes)
+			if diff := cmp.Diff(tt.want, got, util.PrefixComparer); diff != "" {
+				t.Errorf("minimizePrefixes() unexpected result (-want +got):\n%s", diff)
+			}
+
+			// The covered addresses do not change.
+			var before, after netipx.IPSetBuilder
+			for _, prefix := range tt.prefixes {
+				before.AddPrefix(prefix)
+			}
+			for _, prefix := range got {
+				after.AddPrefix(prefix)
+			}
+			beforeSet, _ := before.IPSet()
+			afterSet, _ := after.IPSet()
+			require.True(t, beforeSet.Equal(afterSet))
+		})
+	}
+}
+
+func TestTailNodeMinimizesAllowedIPs(t *testing.T) {
+	mp := netip.MustParsePrefix
+
+	polMan, err := policy.NewPolicyManager(nil, nil, nil)
+	require.NoError(t, err)
+
+	routes := []netip.Prefix{mp("10.0.0.0/24"), mp("10.0.1.0/24"), mp("10.0.0.0/25")}
+	node := &types.Node{
+		ID:             1,
+		GivenName:      "router",
+		IPv4:           iap("100.64.0.1"),
+		Hostinfo:       &tailcfg.Hostinfo{RoutableIPs: routes},
+		ApprovedRoutes: routes,
+	}
+
+	got, err := tailNode(node, 0, polMan, func(types.NodeID) []netip.Prefix { return routes }, &types.Config{})
+	require.NoError(t, err)
+
+	want := []netip.Prefix{mp("100.64.0.1/32"), mp("10.0.0.0/23")}
+	if diff := cmp.Diff(want, got.AllowedIPs, util.PrefixComparer); diff != "" {
+		t.Errorf("AllowedIPs unexpected result (-want +got):\n%s", diff)
+	}
+
+	// The primary routes are sent as announced.
+	require.Len(t, got.PrimaryRoutes, 3)
+}
+
+func TestTailNodeAllowedIPsSpecificity(t *testing.T) {
+	mp := netip.MustParsePrefix
+
+	polMan, err := policy.NewPolicyManager(nil, nil, nil)
+	require.NoError(t, err)
+
+	// The routes overlap with each other and with the addresses of the
+	// node.
+	routes := []netip.Prefix{
+		mp("100.64.0.0/10"),
+		mp("fd00::/8"),
+		mp("10.0.0.0/8"),
+		tsaddr.AllIPv4(),
+		tsaddr.AllIPv6(),
+	}
+	node := &types.Node{
+		ID:             1,
+		GivenName:      "router",
+		IPv4:           iap("100.64.0.1"),
+		IPv6:           iap("fd7a:115c:a1e0::1"),
+		Hostinfo:       &tailcfg.Hostinfo{RoutableIPs: routes},
+		ApprovedRoutes: routes,
+	}
+
+	got, err := tailNode(node, 0, polMan, func(types.NodeID) []netip.Prefix { return routes[:3] }, &types.Config{})
+	require.NoError(t, err)
+
+	want := []netip.Prefix{
+		mp("100.64.0.1/32"),
+		mp("100.64.0.0/10"),
+		mp("10.0.0.0/8"),
+		tsaddr.AllIPv4(),
+		mp("fd7a:115c:a1e0::1/128"),
+		mp("fd00::/8"),
+		tsaddr.AllIPv6(),
+	}
+	if diff := cmp.Diff(want, got.AllowedIPs, util.PrefixComparer); diff != "" {
+		t.Errorf("AllowedIPs unexpected result (-want +got):\n%s", diff)
+	}
+}
+
+func TestTailNodeExitNodeDNSResolvers(t *testing.T) {
+	exitRoutes := tsaddr.ExitRoutes()
+
+	tests := []struct {
+		name string
+		node *types.Node
+		want []*dnstype.Resolver
+	}{
+		{
+			name: "exit-node",
+			node: &types.Node{
+				ID:             1,
+				GivenName:      "exit",
+				Hostinfo:       &tailcfg.Hostinfo{RoutableIPs: exitRoutes},
+				ApprovedRoutes: exitRoutes,
+			},
+			want: []*dnstype.Resolver{{Addr: "10.0.0.53"}, {Addr: "10.0.0.54"}},
+		},
+		{
+			name: "exit-routes-not-approved",
+			node: &types.Node{
+				ID:        1,
+				GivenName: "exit",
+				Hostinfo:  &tailcfg.Hostinfo{RoutableIPs: exitRoutes},
+			},
+			want: nil,
+		},
+		{
+			name: "exit-node-without-resolvers",
+			node: &types.Node{
+				ID:             2,
+				GivenName:      "other-exit",
+				Hostinfo:       &tailcfg.Hostinfo{RoutableIPs: exitRoutes},
+				ApprovedRoutes: exitRoutes,
+			},
+			want: nil,
+		},
+	}
+
+	polMan, err := policy.NewPolicyManager(nil, nil, nil)
+	require.NoError(t, err)
+
+	cfg := &types.Config{
+		Mapper: types.MapperConfig{
+			ExitNodeDNSResolvers: map[types.NodeID][]string{
+				1: {"10.0.0.53", "10.0.0.54"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tailNode(tt.node, 0, polMan, func(types.NodeID) []netip.Prefix { return nil }, cfg)
+			require.NoError(t, err)
+
+			if diff := cmp.Diff(tt.want, got.ExitNodeDNSResolvers); diff != "" {
+				t.Errorf("ExitNodeDNSResolvers unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTailNodeLegacyDERP(t *testing.T) {
+	node := &types.Node{
+		ID:        1,
+		GivenName: "node",
+		Hostinfo:  &tailcfg.Hostinfo{NetInfo: &tailcfg.NetInfo{PreferredDERP: 3}},
+	}
+
+	tests := []struct {
+		name       string
+		capVer     tailcfg.CapabilityVersion
+		wantLegacy string
+	}{
+		{
+			name:       "before-home-derp",
+			capVer:     homeDERPCapVer - 1,
+			wantLegacy: "127.3.3.40:3",
+		},
+		{
+			name:       "home-derp",
+			capVer:     homeDERPCapVer,
+			wantLegacy: "",
+		},
+	}
+
+	polMan, err := policy.NewPolicyManager(nil, nil, nil)
+	require.NoError(t, err)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tailNode(node, tt.capVer, polMan, func(types.NodeID) []netip.Prefix { return nil }, &types.Config{})
+			require.NoError(t, err)
+			require.Equal(t, 3, got.HomeDERP)
+			require.Equal(t, tt.wantLegacy, got.LegacyDERPString)
+		})
+	}
+}
+
+func TestSelfNodeDisabledRoutes(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+
+	enabled := netip.MustParsePrefix("10.0.0.0/24")
+	disabled := netip.MustParsePrefix("10.0.1.0/24")
+	node.Hostinfo.RoutableIPs = []netip.Prefix{enabled, disabled}
+	node.ApprovedRoutes = []netip.Prefix{enabled, disabled}
+	mappy.primary.SetRoutes(node.ID, node.SubnetRoutes()...)
+
+	resp, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Equal(t, []netip.Prefix{enabled, disabled}, resp.Node.PrimaryRoutes)
+
+	// The route is disabled before the primary routes are recalculated.
+	node.ApprovedRoutes = []netip.Prefix{enabled}
+
+	resp, err = mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Equal(t, []netip.Prefix{enabled}, resp.Node.PrimaryRoutes)
+	require.NotContains(t, resp.Node.AllowedIPs, disabled)
+
+	// Enabling it again brings it back.
+	node.ApprovedRoutes = []netip.Prefix{enabled, disabled}
+
+	resp, err = mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.Equal(t, []netip.Prefix{enabled, disabled}, resp.Node.PrimaryRoutes)
+}
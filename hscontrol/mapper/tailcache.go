@@ -0,0 +1,173 @@
+package mapper
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/policy"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+// tailNodeKey identifies a node converted for clients with a capability
+// version.
+type tailNodeKey struct {
+	id     types.NodeID
+	capVer tailcfg.CapabilityVersion
+}
+
+// tailNodeState holds what the conversion of a node depends on, apart
+// from its routes, the policy and the users. UpdatedAt serves as the
+// mutation counter of the fields stored in the database.
+type tailNodeState struct {
+	generation uint64
+	updatedAt  time.Time
+	lastSeen   time.Time
+	online     bool
+	connected  bool
+	expired    bool
+}
+
+func newTailNodeState(node *types.Node, generation uint64) tailNodeState {
+	state := tailNodeState{
+		generation: generation,
+		updatedAt:  node.UpdatedAt,
+		expired:    node.IsExpired(),
+	}
+	if node.LastSeen != nil {
+		state.lastSeen = *node.LastSeen
+	}
+	if node.IsOnline != nil {
+		state.connected = true
+		state.online = *node.IsOnline
+	}
+
+	return state
+}
+
+type tailNodeEntry struct {
+	state  tailNodeState
+	routes []netip.Prefix
+	node   *tailcfg.Node
+}
+
+// tailNodeCache holds the Tailscale nodes converted from the peers of
+// earlier responses, so unchanged peers are not converted again, see
+// types.Tuning.TailNodeCache.
+type tailNodeCache struct {
+	mu         sync.Mutex
+	generation uint64
+	entries    map[tailNodeKey]tailNodeEntry
+
+	// dropped counts the invalidations of single nodes, conversions
+	// started before one are not kept.
+	dropped uint64
+}
+
+func newTailNodeCache() *tailNodeCache {
+	return &tailNodeCache{
+		entries: make(map[tailNodeKey]tailNodeEntry),
+	}
+}
+
+// invalidate drops all converted nodes. A nil tailNodeCache does not
+// hold any.
+func (c *tailNodeCache) invalidate() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	clear(c.entries)
+}
+
+// invalidateNodes drops the converted nodes with the IDs, for clients
+// of all capability versions. A nil tailNodeCache does not hold any.
+func (c *tailNodeCache) invalidateNodes(nodeIDs []types.NodeID) {
+	if c == nil || len(nodeIDs) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	drop := make(map[types.NodeID]bool, len(nodeIDs))
+	for _, id := range nodeIDs {
+		drop[id] = true
+	}
+
+	c.dropped++
+	for key := range c.entries {
+		if drop[key.id] {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// tailNodes converts nodes like tailNodes, reusing the nodes converted
+// before if neither they nor their routes changed. The returned nodes
+// are shallow copies, the caller can set their fields but must not
+// modify their slices and maps in place. A nil tailNodeCache converts
+// all nodes.
+func (c *tailNodeCache) tailNodes(
+	nodes types.Nodes,
+	capVer tailcfg.CapabilityVersion,
+	polMan policy.PolicyManager,
+	primaryRouteFunc routeFilterFunc,
+	cfg *types.Config,
+) ([]*tailcfg.Node, error) {
+	if c == nil {
+		return tailNodes(nodes, capVer, polMan, primaryRouteFunc, cfg)
+	}
+
+	c.mu.Lock()
+	generation, dropped := c.generation, c.dropped
+	c.mu.Unlock()
+
+	tNodes := make([]*tailcfg.Node, len(nodes))
+
+	for index, node := range nodes {
+		key := tailNodeKey{id: node.ID, capVer: capVer}
+		state := newTailNodeState(node, generation)
+		routes := primaryRouteFunc(node.ID)
+
+		c.mu.Lock()
+		entry, ok := c.entries[key]
+		c.mu.Unlock()
+
+		if ok && entry.state == state && slices.Equal(entry.routes, routes) {
+			tNode := *entry.node
+			tNodes[index] = &tNode
+
+			continue
+		}
+
+		tNode, err := tailNode(
+			node,
+			capVer,
+			polMan,
+			func(types.NodeID) []netip.Prefix { return routes },
+			cfg,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		c.mu.Lock()
+		// Nodes converted before an invalidation are not kept.
+		if c.generation == generation && c.dropped == dropped {
+			c.entries[key] = tailNodeEntry{state: state, routes: routes, node: tNode}
+		}
+		c.mu.Unlock()
+
+		copied := *tNode
+		tNodes[index] = &copied
+	}
+
+	return tNodes, nil
+}
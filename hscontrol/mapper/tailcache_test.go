@@ -0,0 +1,134 @@
+package mapper
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/policy"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"tailscale.com/tailcfg"
+)
+
+func tailCacheTestNodes(n int) types.Nodes {
+	user := types.User{Model: gorm.Model{ID: 1}, Name: "user1"}
+	updated := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	nodes := make(types.Nodes, n)
+	for i := range nodes {
+		nodes[i] = &types.Node{
+			ID:        types.NodeID(i + 1),
+			GivenName: fmt.Sprintf("node%d", i+1),
+			User:      user,
+			UserID:    user.ID,
+			IPv4:      iap(fmt.Sprintf("100.64.%d.%d", (i+1)/256, (i+1)%256)),
+			Hostinfo:  &tailcfg.Hostinfo{OS: "linux"},
+			UpdatedAt: updated,
+		}
+	}
+
+	return nodes
+}
+
+func TestTailNodeCache(t *testing.T) {
+	route := netip.MustParsePrefix("10.0.0.0/24")
+	nodes := tailCacheTestNodes(2)
+	nodes[1].Hostinfo.RoutableIPs = []netip.Prefix{route}
+	nodes[1].ApprovedRoutes = []netip.Prefix{route}
+	polMan, err := policy.NewPolicyManager(nil, []types.User{nodes[0].User}, nodes)
+	require.NoError(t, err)
+
+	cfg := &types.Config{}
+	routes := map[types.NodeID][]netip.Prefix{}
+	routeFunc := func(id types.NodeID) []netip.Prefix { return routes[id] }
+
+	cache := newTailNodeCache()
+	convert := func() []*tailcfg.Node {
+		t.Helper()
+		got, err := cache.tailNodes(nodes, 0, polMan, routeFunc, cfg)
+		require.NoError(t, err)
+
+		return got
+	}
+
+	first := convert()
+	require.Len(t, cache.entries, 2)
+
+	// Unchanged nodes are reused, as copies the caller can modify.
+	first[0].Name = "modified"
+	second := convert()
+	require.Equal(t, "node1", second[0].Name)
+
+	// A node updated in the database is converted again.
+	nodes[0].GivenName = "renamed"
+	nodes[0].UpdatedAt = nodes[0].UpdatedAt.Add(time.Second)
+	require.Equal(t, "renamed", convert()[0].Name)
+
+	// So is a node that changed its connection state or routes.
+	online := true
+	nodes[1].IsOnline = &online
+	require.Equal(t, &online, convert()[1].Online)
+
+	routes[2] = []netip.Prefix{route}
+	require.Equal(t, routes[2], convert()[1].PrimaryRoutes)
+
+	// Fields changed in memory only are not seen until invalidation.
+	nodes[1].GivenName = "stale"
+	require.Equal(t, "node2", convert()[1].Name)
+
+	cache.invalidate()
+	require.Empty(t, cache.entries)
+	require.Equal(t, "stale", convert()[1].Name)
+
+	// Clients with another capability version get their own nodes.
+	_, err = cache.tailNodes(nodes, 1, polMan, routeFunc, cfg)
+	require.NoError(t, err)
+	require.Len(t, cache.entries, 4)
+
+	// Invalidating single nodes drops only their conversions, for all
+	// capability versions.
+	nodes[0].GivenName = "ignored"
+	nodes[1].GivenName = "fresh"
+	cache.invalidateNodes([]types.NodeID{nodes[1].ID})
+	require.Len(t, cache.entries, 2)
+	got := convert()
+	require.Equal(t, "renamed", got[0].Name)
+	require.Equal(t, "fresh", got[1].Name)
+}
+
+// BenchmarkTailNodeCache converts the peers of a network of 1000 nodes
+// where a few nodes change between every conversion.
+func BenchmarkTailNodeCache(b *testing.B) {
+	nodes := tailCacheTestNodes(1000)
+	polMan, err := policy.NewPolicyManager(nil, []types.User{nodes[0].User}, nodes)
+	require.NoError(b, err)
+
+	cfg := &types.Config{}
+	routeFunc := func(types.NodeID) []netip.Prefix { return nil }
+
+	for _, bench := range []struct {
+		name  string
+		cache *tailNodeCache
+	}{
+		{name: "uncached"},
+		{name: "cached", cache: newTailNodeCache()},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+
+			for i := range b.N {
+				for j := range 5 {
+					node := nodes[(i*5+j)%len(nodes)]
+					node.UpdatedAt = node.UpdatedAt.Add(time.Second)
+				}
+
+				if _, err := bench.cache.tailNodes(nodes, 0, polMan, routeFunc, cfg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
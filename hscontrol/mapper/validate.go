@@ -0,0 +1,96 @@
+package mapper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"tailscale.com/envknob"
+	"tailscale.com/tailcfg"
+)
+
+var debugValidateMapResponse = envknob.Bool("HEADSCALE_DEBUG_VALIDATE_MAPRESPONSE")
+
+var (
+	ErrInvalidMapResponse = errors.New("invalid map response")
+	errNoSelfNode         = errors.New("self node is missing")
+)
+
+// maxFrameSize is the largest body that fits in the uint32 length
+// prefix of a map response frame.
+const maxFrameSize = math.MaxUint32
+
+// validateMapResponse checks the invariants of a full MapResponse
+// that clients rely on. It is only run when debugging as it marshals
+// the response to verify its size.
+func validateMapResponse(resp *tailcfg.MapResponse) error {
+	if resp.Node == nil {
+		return fmt.Errorf("%w: %w", ErrInvalidMapResponse, errNoSelfNode)
+	}
+
+	seen := make(map[tailcfg.NodeID]bool, len(resp.Peers)+len(resp.PeersChanged))
+	for _, peers := range [][]*tailcfg.Node{resp.Peers, resp.PeersChanged} {
+		for _, peer := range peers {
+			if peer == nil {
+				return fmt.Errorf("%w: nil peer", ErrInvalidMapResponse)
+			}
+
+			if seen[peer.ID] {
+				return fmt.Errorf("%w: duplicate peer ID %d", ErrInvalidMapResponse, peer.ID)
+			}
+			seen[peer.ID] = true
+
+			if peer.ID == resp.Node.ID {
+				return fmt.Errorf("%w: node %d is its own peer", ErrInvalidMapResponse, peer.ID)
+			}
+		}
+	}
+
+	if err := validateDNSConfig(resp.DNSConfig); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidMapResponse, err)
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("%w: marshalling: %w", ErrInvalidMapResponse, err)
+	}
+
+	if uint64(len(body)) > maxFrameSize {
+		return fmt.Errorf("%w: size %d does not fit in a frame", ErrInvalidMapResponse, len(body))
+	}
+
+	return nil
+}
+
+func validateDNSConfig(dnsConfig *tailcfg.DNSConfig) error {
+	if dnsConfig == nil {
+		return nil
+	}
+
+	for _, resolver := range append(dnsConfig.Resolvers, dnsConfig.FallbackResolvers...) {
+		if resolver == nil || resolver.Addr == "" {
+			return errors.New("dns resolver without address")
+		}
+	}
+
+	for domain, resolvers := range dnsConfig.Routes {
+		if domain == "" {
+			return errors.New("dns route without domain")
+		}
+
+		for _, resolver := range resolvers {
+			if resolver == nil || resolver.Addr == "" {
+				return fmt.Errorf("dns route %q has a resolver without address", domain)
+			}
+		}
+	}
+
+	for _, domain := range dnsConfig.Domains {
+		if domain == "" {
+			return errors.New("empty dns search domain")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package mapper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/dnstype"
+)
+
+func TestValidateMapResponse(t *testing.T) {
+	self := &tailcfg.Node{ID: 1}
+
+	tests := []struct {
+		name    string
+		resp    *tailcfg.MapResponse
+		wantErr string
+	}{
+		{
+			name: "valid",
+			resp: &tailcfg.MapResponse{
+				Node:  self,
+				Peers: []*tailcfg.Node{{ID: 2}, {ID: 3}},
+				DNSConfig: &tailcfg.DNSConfig{
+					Resolvers: []*dnstype.Resolver{{Addr: "1.1.1.1"}},
+					Routes:    map[string][]*dnstype.Resolver{"example.com": nil},
+					Domains:   []string{"example.com"},
+				},
+			},
+		},
+		{
+			name:    "no-self-node",
+			resp:    &tailcfg.MapResponse{},
+			wantErr: "invalid map response: self node is missing",
+		},
+		{
+			name: "duplicate-peer",
+			resp: &tailcfg.MapResponse{
+				Node:  self,
+				Peers: []*tailcfg.Node{{ID: 2}, {ID: 2}},
+			},
+			wantErr: "invalid map response: duplicate peer ID 2",
+		},
+		{
+			name: "duplicate-changed-peer",
+			resp: &tailcfg.MapResponse{
+				Node:         self,
+				Peers:        []*tailcfg.Node{{ID: 2}},
+				PeersChanged: []*tailcfg.Node{{ID: 2}},
+			},
+			wantErr: "invalid map response: duplicate peer ID 2",
+		},
+		{
+			name: "self-as-peer",
+			resp: &tailcfg.MapResponse{
+				Node:  self,
+				Peers: []*tailcfg.Node{{ID: 1}},
+			},
+			wantErr: "invalid map response: node 1 is its own peer",
+		},
+		{
+			name: "resolver-without-address",
+			resp: &tailcfg.MapResponse{
+				Node: self,
+				DNSConfig: &tailcfg.DNSConfig{
+					Resolvers: []*dnstype.Resolver{{}},
+				},
+			},
+			wantErr: "invalid map response: dns resolver without address",
+		},
+		{
+			name: "route-without-domain",
+			resp: &tailcfg.MapResponse{
+				Node: self,
+				DNSConfig: &tailcfg.DNSConfig{
+					Routes: map[string][]*dnstype.Resolver{"": nil},
+				},
+			},
+			wantErr: "invalid map response: dns route without domain",
+		},
+		{
+			name: "empty-search-domain",
+			resp: &tailcfg.MapResponse{
+				Node: self,
+				DNSConfig: &tailcfg.DNSConfig{
+					Domains: []string{""},
+				},
+			},
+			wantErr: "invalid map response: empty dns search domain",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMapResponse(tt.resp)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+
+				return
+			}
+
+			require.ErrorIs(t, err, ErrInvalidMapResponse)
+			require.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestValidateFullMapResponse(t *testing.T) {
+	mappy, node, peers := pipelineTestMapper(t)
+
+	resp, err := mappy.fullMapResponse(node, peers, 0)
+	require.NoError(t, err)
+	require.NoError(t, validateMapResponse(resp))
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/juanfont/headscale/hscontrol/capver"
+	"github.com/juanfont/headscale/hscontrol/mapper"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/net/http2"
@@ -83,7 +84,7 @@ func (h *Headscale) NoiseUpgradeHandler(
 		noiseServer.earlyNoise,
 	)
 	if err != nil {
-		httpError(writer, fmt.Errorf("noise upgrade failed: %w", err))
+		httpError(writer, req, fmt.Errorf("noise upgrade failed: %w", err))
 		return
 	}
 
@@ -196,11 +197,20 @@ func (ns *noiseServer) NoisePollNetMapHandler(
 	writer http.ResponseWriter,
 	req *http.Request,
 ) {
-	body, _ := io.ReadAll(req.Body)
+	body, err := mapper.DecodeRequestBody(req.Body, req.Header.Get("Content-Encoding"))
+	if err != nil {
+		code := http.StatusBadRequest
+		if errors.Is(err, mapper.ErrRequestTooLarge) {
+			code = http.StatusRequestEntityTooLarge
+		}
+		httpError(writer, req, NewHTTPError(code, "invalid request body", err))
+
+		return
+	}
 
 	var mapRequest tailcfg.MapRequest
 	if err := json.Unmarshal(body, &mapRequest); err != nil {
-		httpError(writer, err)
+		httpError(writer, req, err)
 		return
 	}
 
@@ -214,10 +224,10 @@ func (ns *noiseServer) NoisePollNetMapHandler(
 	node, err := ns.headscale.db.GetNodeByNodeKey(mapRequest.NodeKey)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			httpError(writer, NewHTTPError(http.StatusNotFound, "node not found", nil))
+			httpError(writer, req, NewHTTPError(http.StatusNotFound, "node not found", nil))
 			return
 		}
-		httpError(writer, err)
+		httpError(writer, req, err)
 		return
 	}
 
@@ -240,7 +250,7 @@ func (ns *noiseServer) NoiseRegistrationHandler(
 	req *http.Request,
 ) {
 	if req.Method != http.MethodPost {
-		httpError(writer, errMethodNotAllowed)
+		httpError(writer, req, errMethodNotAllowed)
 
 		return
 	}
@@ -281,7 +291,7 @@ func (ns *noiseServer) NoiseRegistrationHandler(
 
 	respBody, err := json.Marshal(registerResponse)
 	if err != nil {
-		httpError(writer, err)
+		httpError(writer, req, err)
 		return
 	}
 
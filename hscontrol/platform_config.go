@@ -39,19 +39,19 @@ func (h *Headscale) ApplePlatformConfig(
 	vars := mux.Vars(req)
 	platform, ok := vars["platform"]
 	if !ok {
-		httpError(writer, NewHTTPError(http.StatusBadRequest, "no platform specified", nil))
+		httpError(writer, req, NewHTTPError(http.StatusBadRequest, "no platform specified", nil))
 		return
 	}
 
 	id, err := uuid.NewV4()
 	if err != nil {
-		httpError(writer, err)
+		httpError(writer, req, err)
 		return
 	}
 
 	contentID, err := uuid.NewV4()
 	if err != nil {
-		httpError(writer, err)
+		httpError(writer, req, err)
 		return
 	}
 
@@ -65,21 +65,21 @@ func (h *Headscale) ApplePlatformConfig(
 	switch platform {
 	case "macos-standalone":
 		if err := macosStandaloneTemplate.Execute(&payload, platformConfig); err != nil {
-			httpError(writer, err)
+			httpError(writer, req, err)
 			return
 		}
 	case "macos-app-store":
 		if err := macosAppStoreTemplate.Execute(&payload, platformConfig); err != nil {
-			httpError(writer, err)
+			httpError(writer, req, err)
 			return
 		}
 	case "ios":
 		if err := iosTemplate.Execute(&payload, platformConfig); err != nil {
-			httpError(writer, err)
+			httpError(writer, req, err)
 			return
 		}
 	default:
-		httpError(writer, NewHTTPError(http.StatusBadRequest, "platform must be ios, macos-app-store or macos-standalone", nil))
+		httpError(writer, req, NewHTTPError(http.StatusBadRequest, "platform must be ios, macos-app-store or macos-standalone", nil))
 		return
 	}
 
@@ -91,7 +91,7 @@ func (h *Headscale) ApplePlatformConfig(
 
 	var content bytes.Buffer
 	if err := commonTemplate.Execute(&content, config); err != nil {
-		httpError(writer, err)
+		httpError(writer, req, err)
 		return
 	}
 
@@ -8,6 +8,7 @@ import (
 
 	"github.com/juanfont/headscale/hscontrol/util"
 	"go4.org/netipx"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
 )
 
@@ -90,3 +91,9 @@ func (m *Match) SrcsOverlapsPrefixes(prefixes ...netip.Prefix) bool {
 func (m *Match) DestsOverlapsPrefixes(prefixes ...netip.Prefix) bool {
 	return slices.ContainsFunc(prefixes, m.dests.OverlapsPrefix)
 }
+
+// DestsContainsAllIPs reports if the destinations contain every IPv4
+// and IPv6 address, as for the wildcard destination "*".
+func (m *Match) DestsContainsAllIPs() bool {
+	return m.dests.ContainsPrefix(tsaddr.AllIPv4()) && m.dests.ContainsPrefix(tsaddr.AllIPv6())
+}
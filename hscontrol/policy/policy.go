@@ -1,6 +1,8 @@
 package policy
 
 import (
+	"errors"
+	"fmt"
 	"net/netip"
 	"slices"
 
@@ -13,6 +15,61 @@ import (
 	"tailscale.com/tailcfg"
 )
 
+var ErrPolicyTooComplex = errors.New("policy is too complex")
+
+// FilterComplexity returns a measure of how expensive the given filter
+// rules are to evaluate for every node, it is the number of source and
+// destination combinations across all rules.
+func FilterComplexity(rules []tailcfg.FilterRule) int {
+	var complexity int
+	for _, rule := range rules {
+		complexity += max(len(rule.SrcIPs), 1) * max(len(rule.DstPorts), 1)
+	}
+
+	return complexity
+}
+
+// CheckFilterComplexity returns ErrPolicyTooComplex if the complexity of
+// the given filter rules exceeds limit. A limit of zero or less disables
+// the check.
+func CheckFilterComplexity(rules []tailcfg.FilterRule, limit int) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	if complexity := FilterComplexity(rules); complexity > limit {
+		return fmt.Errorf("%w: filter complexity %d exceeds the limit of %d", ErrPolicyTooComplex, complexity, limit)
+	}
+
+	return nil
+}
+
+// SetPolicyWithinLimit sets pol on polMan like PolicyManager.SetPolicy,
+// unless its filter rules compiled for users and nodes exceed the
+// complexity limit. The policy in effect is then kept and
+// ErrPolicyTooComplex is returned.
+func SetPolicyWithinLimit(
+	polMan PolicyManager,
+	pol []byte,
+	users []types.User,
+	nodes types.Nodes,
+	limit int,
+) (bool, error) {
+	if limit > 0 && len(pol) > 0 {
+		candidate, err := NewPolicyManager(pol, users, nodes)
+		if err != nil {
+			return false, err
+		}
+
+		filter, _ := candidate.Filter()
+		if err := CheckFilterComplexity(filter, limit); err != nil {
+			return false, err
+		}
+	}
+
+	return polMan.SetPolicy(pol)
+}
+
 // ReduceNodes returns the list of peers authorized to be accessed from a given node.
 func ReduceNodes(
 	node *types.Node,
@@ -51,6 +108,25 @@ func ReduceRoutes(
 	return result
 }
 
+// ReduceRoutesExplicit returns a reduced list of routes for a given node
+// that it can access through rules naming them, see
+// types.Node.CanAccessRouteExplicitly.
+func ReduceRoutesExplicit(
+	node *types.Node,
+	routes []netip.Prefix,
+	matchers []matcher.Match,
+) []netip.Prefix {
+	var result []netip.Prefix
+
+	for _, route := range routes {
+		if node.CanAccessRouteExplicitly(matchers, route) {
+			result = append(result, route)
+		}
+	}
+
+	return result
+}
+
 // ReduceFilterRules takes a node and a set of rules and removes all rules and destinations
 // that are not relevant to that particular node.
 func ReduceFilterRules(node *types.Node, rules []tailcfg.FilterRule) []tailcfg.FilterRule {
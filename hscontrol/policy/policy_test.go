@@ -2473,3 +2473,96 @@ func TestReduceRoutes(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckFilterComplexity(t *testing.T) {
+	rule := func(srcs, dsts int) tailcfg.FilterRule {
+		r := tailcfg.FilterRule{}
+		for i := range srcs {
+			r.SrcIPs = append(r.SrcIPs, fmt.Sprintf("100.64.0.%d/32", i))
+		}
+		for i := range dsts {
+			r.DstPorts = append(r.DstPorts, tailcfg.NetPortRange{
+				IP:    fmt.Sprintf("100.64.1.%d/32", i),
+				Ports: tailcfg.PortRangeAny,
+			})
+		}
+
+		return r
+	}
+
+	// A synthetic policy with 100 rules of 20 sources and 20 destinations.
+	var oversized []tailcfg.FilterRule
+	for range 100 {
+		oversized = append(oversized, rule(20, 20))
+	}
+
+	tests := []struct {
+		name    string
+		rules   []tailcfg.FilterRule
+		limit   int
+		wantErr bool
+	}{
+		{
+			name:  "no-limit",
+			rules: oversized,
+			limit: 0,
+		},
+		{
+			name:  "within-limit",
+			rules: []tailcfg.FilterRule{rule(2, 3)},
+			limit: 6,
+		},
+		{
+			name:    "oversized",
+			rules:   oversized,
+			limit:   10000,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckFilterComplexity(tt.rules, tt.limit)
+			if tt.wantErr {
+				require.ErrorIs(t, err, ErrPolicyTooComplex)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+
+	require.Equal(t, 40000, FilterComplexity(oversized))
+}
+
+func TestSetPolicyWithinLimit(t *testing.T) {
+	users := []types.User{
+		{Model: gorm.Model{ID: 1}, Name: "user1"},
+		{Model: gorm.Model{ID: 2}, Name: "user2"},
+	}
+	nodes := types.Nodes{
+		{ID: 1, IPv4: ap("100.64.0.1"), User: users[0], UserID: users[0].ID},
+		{ID: 2, IPv4: ap("100.64.0.2"), User: users[1], UserID: users[1].ID},
+	}
+
+	small := []byte(`{"acls": [{"action": "accept", "src": ["user1@"], "dst": ["user2@:22"]}]}`)
+	large := []byte(`{"acls": [{"action": "accept", "src": ["user1@", "user2@"], "dst": ["user1@:*", "user2@:*"]}]}`)
+
+	for idx, pmf := range PolicyManagerFuncsForTest(small) {
+		t.Run(fmt.Sprintf("PolicyManager%d", idx), func(t *testing.T) {
+			pm, err := pmf(users, nodes)
+			require.NoError(t, err)
+			before, _ := pm.Filter()
+
+			_, err = SetPolicyWithinLimit(pm, large, users, nodes, 2)
+			require.ErrorIs(t, err, ErrPolicyTooComplex)
+
+			// The policy over the limit is not in effect.
+			after, _ := pm.Filter()
+			require.Equal(t, before, after)
+
+			changed, err := SetPolicyWithinLimit(pm, large, users, nodes, 0)
+			require.NoError(t, err)
+			require.True(t, changed)
+		})
+	}
+}
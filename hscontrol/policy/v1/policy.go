@@ -102,6 +102,12 @@ func (pm *PolicyManager) SSHPolicy(node *types.Node) (*tailcfg.SSHPolicy, error)
 	return pm.pol.CompileSSHPolicy(node, pm.users, pm.nodes)
 }
 
+// NodeAttrs returns nil, node attributes are not supported by v1
+// policies.
+func (pm *PolicyManager) NodeAttrs(node *types.Node) tailcfg.NodeCapMap {
+	return nil
+}
+
 func (pm *PolicyManager) SetPolicy(polB []byte) (bool, error) {
 	if len(polB) == 0 {
 		return false, nil
@@ -95,6 +95,36 @@ func sshAction(accept bool, duration time.Duration) tailcfg.SSHAction {
 	}
 }
 
+// compileNodeAttrs returns the capabilities granted to node by the
+// nodeAttrs of the policy.
+func (pol *Policy) compileNodeAttrs(
+	users types.Users,
+	node *types.Node,
+	nodes types.Nodes,
+) tailcfg.NodeCapMap {
+	if pol == nil || len(pol.NodeAttrs) == 0 {
+		return nil
+	}
+
+	capMap := make(tailcfg.NodeCapMap)
+	for _, grant := range pol.NodeAttrs {
+		ips, err := grant.Targets.Resolve(pol, users, nodes)
+		if err != nil {
+			log.Trace().Err(err).Msgf("resolving node attribute targets")
+		}
+
+		if ips == nil || !node.InIPSet(ips) {
+			continue
+		}
+
+		for _, attr := range grant.Attrs {
+			capMap[tailcfg.NodeCapability(attr)] = []tailcfg.RawMessage{}
+		}
+	}
+
+	return capMap
+}
+
 func (pol *Policy) compileSSHPolicy(
 	users types.Users,
 	node *types.Node,
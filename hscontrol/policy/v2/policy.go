@@ -36,6 +36,9 @@ type PolicyManager struct {
 	autoApproveMapHash deephash.Sum
 	autoApproveMap     map[netip.Prefix]*netipx.IPSet
 
+	nodeAttrsHash deephash.Sum
+	nodeAttrs     map[types.NodeID]tailcfg.NodeCapMap
+
 	// Lazy map of SSH policies
 	sshPolicyMap map[types.NodeID]*tailcfg.SSHPolicy
 }
@@ -114,8 +117,18 @@ func (pm *PolicyManager) updateLocked() (bool, error) {
 	pm.exitSet = exitSet
 	pm.exitSetHash = exitSetHash
 
+	nodeAttrs := make(map[types.NodeID]tailcfg.NodeCapMap, len(pm.nodes))
+	for _, node := range pm.nodes {
+		nodeAttrs[node.ID] = pm.pol.compileNodeAttrs(pm.users, node, pm.nodes)
+	}
+
+	nodeAttrsHash := deephash.Hash(&nodeAttrs)
+	nodeAttrsChanged := nodeAttrsHash != pm.nodeAttrsHash
+	pm.nodeAttrs = nodeAttrs
+	pm.nodeAttrsHash = nodeAttrsHash
+
 	// If neither of the calculated values changed, no need to update nodes
-	if !filterChanged && !tagOwnerChanged && !autoApproveChanged && !exitSetChanged {
+	if !filterChanged && !tagOwnerChanged && !autoApproveChanged && !exitSetChanged && !nodeAttrsChanged {
 		return false, nil
 	}
 
@@ -139,6 +152,22 @@ func (pm *PolicyManager) SSHPolicy(node *types.Node) (*tailcfg.SSHPolicy, error)
 	return sshPol, nil
 }
 
+// NodeAttrs returns the attributes granted to node by the policy.
+func (pm *PolicyManager) NodeAttrs(node *types.Node) tailcfg.NodeCapMap {
+	if pm == nil {
+		return nil
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if capMap, ok := pm.nodeAttrs[node.ID]; ok {
+		return capMap
+	}
+
+	return pm.pol.compileNodeAttrs(pm.users, node, pm.nodes)
+}
+
 func (pm *PolicyManager) SetPolicy(polB []byte) (bool, error) {
 	if len(polB) == 0 {
 		return false, nil
@@ -66,3 +66,65 @@ func TestPolicyManager(t *testing.T) {
 		})
 	}
 }
+
+func TestNodeAttrs(t *testing.T) {
+	users := types.Users{
+		{Model: gorm.Model{ID: 1}, Name: "testuser"},
+		{Model: gorm.Model{ID: 2}, Name: "otheruser"},
+	}
+
+	eng := node("eng", "100.64.0.1", "fd7a:115c:a1e0::1", users[0], nil)
+	eng.ID = 1
+	other := node("other", "100.64.0.2", "fd7a:115c:a1e0::2", users[1], nil)
+	other.ID = 2
+	tagged := node("tagged", "100.64.0.3", "fd7a:115c:a1e0::3", users[1], nil)
+	tagged.ID = 3
+	tagged.ForcedTags = []string{"tag:server"}
+
+	pol := `{
+		"tagOwners": {"tag:server": ["otheruser@"]},
+		"nodeAttrs": [
+			{"target": ["testuser@"], "attr": ["attr:department=eng"]},
+			{"target": ["tag:server", "testuser@"], "attr": ["funnel"]}
+		]
+	}`
+
+	pm, err := NewPolicyManager([]byte(pol), users, types.Nodes{eng, other, tagged})
+	require.NoError(t, err)
+
+	require.Equal(t, tailcfg.NodeCapMap{
+		"attr:department=eng": []tailcfg.RawMessage{},
+		"funnel":              []tailcfg.RawMessage{},
+	}, pm.NodeAttrs(eng))
+	require.Empty(t, pm.NodeAttrs(other))
+	require.Equal(t, tailcfg.NodeCapMap{
+		"funnel": []tailcfg.RawMessage{},
+	}, pm.NodeAttrs(tagged))
+
+	_, err = NewPolicyManager([]byte(`{"nodeAttrs": [{"target": ["tag:unknown"], "attr": ["funnel"]}]}`), users, nil)
+	require.Error(t, err)
+
+	_, err = NewPolicyManager([]byte(`{"nodeAttrs": [{"target": ["testuser@"], "attr": [""]}]}`), users, nil)
+	require.Error(t, err)
+}
+
+func TestNodeAttrsChange(t *testing.T) {
+	users := types.Users{{Model: gorm.Model{ID: 1}, Name: "testuser"}}
+	eng := node("eng", "100.64.0.1", "fd7a:115c:a1e0::1", users[0], nil)
+	eng.ID = 1
+
+	acls := `"acls": [{"action": "accept", "src": ["testuser@"], "dst": ["testuser@:*"]}]`
+	pm, err := NewPolicyManager([]byte(`{`+acls+`}`), users, types.Nodes{eng})
+	require.NoError(t, err)
+	require.Empty(t, pm.NodeAttrs(eng))
+
+	// Only the node attributes are edited, the filter is unchanged.
+	changed, err := pm.SetPolicy([]byte(`{` + acls + `, "nodeAttrs": [{"target": ["testuser@"], "attr": ["funnel"]}]}`))
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.Equal(t, tailcfg.NodeCapMap{"funnel": []tailcfg.RawMessage{}}, pm.NodeAttrs(eng))
+
+	changed, err = pm.SetPolicy([]byte(`{` + acls + `, "nodeAttrs": [{"target": ["testuser@"], "attr": ["funnel"]}]}`))
+	require.NoError(t, err)
+	require.False(t, changed)
+}
@@ -3,6 +3,7 @@ package v2
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/netip"
 	"strings"
@@ -946,6 +947,7 @@ type Policy struct {
 	ACLs          []ACL              `json:"acls"`
 	AutoApprovers AutoApproverPolicy `json:"autoApprovers"`
 	SSHs          []SSH              `json:"ssh"`
+	NodeAttrs     []NodeAttrGrant    `json:"nodeAttrs"`
 }
 
 var (
@@ -1183,6 +1185,46 @@ func (p *Policy) validate() error {
 		}
 	}
 
+	for _, grant := range p.NodeAttrs {
+		for _, target := range grant.Targets {
+			switch target.(type) {
+			case *Host:
+				h := target.(*Host)
+				if !p.Hosts.exist(*h) {
+					errs = append(errs, fmt.Errorf(`Host %q is not defined in the Policy, please define or remove the reference to it`, *h))
+				}
+			case *AutoGroup:
+				ag := target.(*AutoGroup)
+
+				if err := validateAutogroupSupported(ag); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+
+				if err := validateAutogroupForSrc(ag); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+			case *Group:
+				g := target.(*Group)
+				if err := p.Groups.Contains(g); err != nil {
+					errs = append(errs, err)
+				}
+			case *Tag:
+				tagOwner := target.(*Tag)
+				if err := p.TagOwners.Contains(tagOwner); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+
+		for _, attr := range grant.Attrs {
+			if attr == "" {
+				errs = append(errs, errors.New("node attribute must not be empty"))
+			}
+		}
+	}
+
 	for _, tagOwners := range p.TagOwners {
 		for _, tagOwner := range tagOwners {
 			switch tagOwner.(type) {
@@ -1235,6 +1277,13 @@ func (p *Policy) validate() error {
 	return nil
 }
 
+// NodeAttrGrant grants attributes to the nodes matching its targets.
+// The attributes are sent to the nodes as capabilities in their CapMap.
+type NodeAttrGrant struct {
+	Targets Aliases  `json:"target"`
+	Attrs   []string `json:"attr"`
+}
+
 // SSH controls who can ssh into which machines.
 type SSH struct {
 	Action       string         `json:"action"`
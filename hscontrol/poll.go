@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/netip"
 	"slices"
+	"strings"
 	"time"
 
 	"github.com/juanfont/headscale/hscontrol/mapper"
@@ -20,9 +21,32 @@ import (
 )
 
 const (
-	keepAliveInterval = 50 * time.Second
+	defaultKeepAliveInterval = 50 * time.Second
 )
 
+// keepAliveInterval returns the time between two keep alive messages
+// sent to a client with the given Hostinfo. Mobile clients use a
+// separate, usually longer, interval to save battery. Unset intervals
+// fall back to the default.
+func keepAliveInterval(tuning types.Tuning, hostinfo *tailcfg.Hostinfo) time.Duration {
+	interval := tuning.KeepAliveInterval
+	if hostinfo != nil && isMobileOS(hostinfo.OS) {
+		interval = tuning.MobileKeepAliveInterval
+	}
+
+	if interval <= 0 {
+		return defaultKeepAliveInterval
+	}
+
+	return interval
+}
+
+// isMobileOS reports if os, as reported in Hostinfo.OS, is a mobile
+// operating system.
+func isMobileOS(os string) bool {
+	return strings.EqualFold(os, "ios") || strings.EqualFold(os, "android")
+}
+
 type contextKey string
 
 const nodeNameContextKey = contextKey("nodeName")
@@ -43,6 +67,10 @@ type mapSession struct {
 	keepAlive       time.Duration
 	keepAliveTicker *time.Ticker
 
+	// sentFull is set once the first full MapResponse of the session
+	// was generated, later full updates may only contain changed peers.
+	sentFull bool
+
 	node *types.Node
 	w    http.ResponseWriter
 
@@ -69,7 +97,13 @@ func (h *Headscale) newMapSession(
 		updateChan <- types.UpdateFull()
 	}
 
-	ka := keepAliveInterval + (time.Duration(rand.IntN(9000)) * time.Millisecond)
+	// The Hostinfo of the request is the most recent, but it is not
+	// sent with every request.
+	hostinfo := req.Hostinfo
+	if hostinfo == nil {
+		hostinfo = node.Hostinfo
+	}
+	ka := keepAliveInterval(h.cfg.Tuning, hostinfo) + (time.Duration(rand.IntN(9000)) * time.Millisecond)
 
 	return &mapSession{
 		h:      h,
@@ -201,6 +235,8 @@ func (m *mapSession) serveLongPoll() {
 		// reconnects, the channel might be of another connection.
 		// In that case, it is not closed and the node is still online.
 		if m.h.nodeNotifier.RemoveNode(m.node.ID, m.ch) {
+			m.mapper.ResetSession(m.node.ID)
+
 			// Failover the node's routes if any.
 			m.h.updateNodeOnlineStatus(false, m.node)
 
@@ -239,6 +275,9 @@ func (m *mapSession) serveLongPoll() {
 
 	m.keepAliveTicker = time.NewTicker(m.keepAlive)
 
+	// The responses sent to an earlier session of the node are no base
+	// for the updates of this one.
+	m.mapper.ResetSession(m.node.ID)
 	m.h.nodeNotifier.AddNode(m.node.ID, m.ch)
 	go m.h.updateNodeOnlineStatus(true, m.node)
 
@@ -293,7 +332,13 @@ func (m *mapSession) serveLongPoll() {
 			switch update.Type {
 			case types.StateFullUpdate:
 				m.tracef("Sending Full MapResponse")
-				data, err = m.mapper.FullMapResponse(m.req, m.node, fmt.Sprintf("from mapSession: %p, stream: %t", m, m.isStreaming()))
+				message := fmt.Sprintf("from mapSession: %p, stream: %t", m, m.isStreaming())
+				if m.sentFull {
+					data, err = m.mapper.FullMapUpdateResponse(m.req, m.node, message)
+				} else {
+					data, err = m.mapper.FullMapResponse(m.req, m.node, message)
+					m.sentFull = err == nil
+				}
 			case types.StatePeerChanged:
 				changed := make(map[types.NodeID]bool, len(update.ChangeNodes))
 
@@ -327,7 +372,7 @@ func (m *mapSession) serveLongPoll() {
 				updateType = "remove"
 			case types.StateDERPUpdated:
 				m.tracef("Sending DERPUpdate MapResponse")
-				data, err = m.mapper.DERPMapResponse(m.req, m.node, m.h.DERPMap)
+				data, err = m.mapper.DERPMapResponse(m.req, m.node)
 				updateType = "derp"
 			}
 
@@ -0,0 +1,66 @@
+package hscontrol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+func TestKeepAliveInterval(t *testing.T) {
+	tuning := types.Tuning{
+		KeepAliveInterval:       30 * time.Second,
+		MobileKeepAliveInterval: 100 * time.Second,
+	}
+
+	tests := []struct {
+		name     string
+		tuning   types.Tuning
+		hostinfo *tailcfg.Hostinfo
+		want     time.Duration
+	}{
+		{
+			name:     "linux",
+			tuning:   tuning,
+			hostinfo: &tailcfg.Hostinfo{OS: "linux"},
+			want:     30 * time.Second,
+		},
+		{
+			name:     "windows",
+			tuning:   tuning,
+			hostinfo: &tailcfg.Hostinfo{OS: "windows"},
+			want:     30 * time.Second,
+		},
+		{
+			name:     "ios",
+			tuning:   tuning,
+			hostinfo: &tailcfg.Hostinfo{OS: "iOS"},
+			want:     100 * time.Second,
+		},
+		{
+			name:     "android",
+			tuning:   tuning,
+			hostinfo: &tailcfg.Hostinfo{OS: "android"},
+			want:     100 * time.Second,
+		},
+		{
+			name:   "no-hostinfo",
+			tuning: tuning,
+			want:   30 * time.Second,
+		},
+		{
+			name:     "unset",
+			hostinfo: &tailcfg.Hostinfo{OS: "iOS"},
+			want:     defaultKeepAliveInterval,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := keepAliveInterval(tt.tuning, tt.hostinfo); got != tt.want {
+				t.Errorf("keepAliveInterval() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,13 +4,19 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"maps"
+	"net/http"
 	"net/netip"
 	"net/url"
 	"os"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
+	headscaledns "github.com/juanfont/headscale/hscontrol/dns"
 	"github.com/juanfont/headscale/hscontrol/util"
 	"github.com/prometheus/common/model"
 	"github.com/rs/zerolog"
@@ -51,10 +57,41 @@ const (
 	PolicyModeFile = "file"
 )
 
+// targetRedirectCodes are the HTTP status codes redirecting to the
+// target URL can use.
+var targetRedirectCodes = []int{
+	http.StatusMovedPermanently,
+	http.StatusFound,
+	http.StatusSeeOther,
+	http.StatusTemporaryRedirect,
+	http.StatusPermanentRedirect,
+}
+
+// How the registration page of web authentication is served, see
+// Config.RegisterMode.
+const (
+	// RegisterModeRedirect redirects to the registration page under the
+	// target URL.
+	RegisterModeRedirect = "redirect"
+	// RegisterModeTemplate serves the built-in registration page, for
+	// deployments without an external frontend.
+	RegisterModeTemplate = "template"
+)
+
+var registerModes = []string{RegisterModeRedirect, RegisterModeTemplate}
+
+// DefaultWebContentSecurityPolicy only allows the inline styles of the
+// built-in pages and forbids embedding them in frames.
+const DefaultWebContentSecurityPolicy = "default-src 'none'; style-src 'unsafe-inline'; " +
+	"base-uri 'none'; form-action 'none'; frame-ancestors 'none'"
+
 // Config contains the initial Headscale configuration.
 type Config struct {
 	ServerURL                      string
 	TargetURL                      string
+	TargetRedirectCode             int
+	RegisterMode                   string
+	WebContentSecurityPolicy       string
 	Addr                           string
 	MetricsAddr                    string
 	GRPCAddr                       string
@@ -98,6 +135,8 @@ type Config struct {
 
 	Policy PolicyConfig
 
+	Mapper MapperConfig
+
 	Tuning Tuning
 }
 
@@ -109,6 +148,11 @@ type DNSConfig struct {
 	SearchDomains    []string            `mapstructure:"search_domains"`
 	ExtraRecords     []tailcfg.DNSRecord `mapstructure:"extra_records"`
 	ExtraRecordsPath string              `mapstructure:"extra_records_path"`
+
+	// MaxExtraRecords limits the number of extra records sent to nodes,
+	// keeping those named first in ExtraRecordsPriority. 0 sends all.
+	MaxExtraRecords      int      `mapstructure:"max_extra_records"`
+	ExtraRecordsPriority []string `mapstructure:"extra_records_priority"`
 }
 
 type Nameservers struct {
@@ -207,6 +251,19 @@ type DERPConfig struct {
 
 type LogTailConfig struct {
 	Enabled bool
+
+	// Nodes overrides Enabled for the nodes with the given IDs, for
+	// example to debug a single node.
+	Nodes map[NodeID]bool
+}
+
+// EnabledFor reports if logtail is enabled for the node with the given ID.
+func (c LogTailConfig) EnabledFor(nodeID NodeID) bool {
+	if enabled, ok := c.Nodes[nodeID]; ok {
+		return enabled
+	}
+
+	return c.Enabled
 }
 
 type CLIConfig struct {
@@ -219,6 +276,10 @@ type CLIConfig struct {
 type PolicyConfig struct {
 	Path string
 	Mode PolicyMode
+
+	// MaxFilterComplexity is the maximum complexity of the compiled
+	// filter rules, see policy.FilterComplexity. Zero means no limit.
+	MaxFilterComplexity int
 }
 
 func (p *PolicyConfig) IsEmpty() bool {
@@ -230,10 +291,333 @@ type LogConfig struct {
 	Level  zerolog.Level
 }
 
+// MapperConfig contains settings changing the content of the
+// map responses sent to nodes.
+type MapperConfig struct {
+	// AutogroupCapability adds the autogroups a node is a member of
+	// (autogroup:member or autogroup:tagged) to the CapMap of the node.
+	AutogroupCapability bool
+
+	// CollectServices asks clients to report the services listening on
+	// their node in Hostinfo.Services, for tooling reading them from
+	// the database or API. Enabling it exposes the ports and process
+	// names of every node to the control server and its operators,
+	// which users may not expect.
+	CollectServices bool
+
+	// OmitUserProfiles leaves the user profiles out of map responses,
+	// clients then show nodes without the users owning them.
+	OmitUserProfiles bool
+
+	// DefaultCompression is the compression used for map responses
+	// when the client did not ask for any. Only "zstd" is supported,
+	// empty keeps sending uncompressed responses.
+	DefaultCompression string
+
+	// DefaultCompressionMinCapVer is the minimum capability version a
+	// client needs to be sent DefaultCompression.
+	DefaultCompressionMinCapVer tailcfg.CapabilityVersion
+
+	// UserCompression overrides DefaultCompression for the nodes of the
+	// given users, keyed by lowercase user name. An empty value sends
+	// their nodes uncompressed responses.
+	UserCompression map[string]string
+
+	// ZstdLevel is the standard zstd compression level (1 to 22) of zstd
+	// compressed map responses. The encoder supports four speeds, levels
+	// are mapped to the closest one.
+	ZstdLevel int
+
+	// ServeAllowed and FunnelAllowed list the tags ("tag:web") and users
+	// whose nodes are allowed to use Tailscale Serve and Funnel.
+	ServeAllowed  []string
+	FunnelAllowed []string
+
+	// DERPOnly lists the tags and users whose nodes only communicate
+	// with their peers through DERP. The endpoints of their peers are
+	// not sent to them and their own endpoints are not sent to peers.
+	DERPOnly []string
+
+	// DNSDisabled lists the tags and users whose nodes do not use the
+	// DNS configuration pushed by the control server, for example
+	// nodes running tailscale up --accept-dns=false. They are sent an
+	// empty DNS configuration. Clients do not report if they accept it.
+	DNSDisabled []string
+
+	// StripOfflineEndpoints leaves the endpoints of offline peers out of
+	// map responses, clients can not reach them directly anyway.
+	StripOfflineEndpoints bool
+
+	// MaxPeers limits the number of peers sent to a node to the most
+	// recently seen ones. Changed peers beyond the limit are removed
+	// from the node in incremental responses. Zero sends all peers.
+	MaxPeers int
+
+	// PeerWarningThreshold logs a warning and counts a metric when a
+	// node has at least this many peers in a full map response, before
+	// MaxPeers is applied. It helps sizing MaxPeers. Zero disables it.
+	PeerWarningThreshold int
+
+	// PeerSubnetGrouping is the prefix length of the IPv4 subnets peers
+	// are grouped by, keeping peers of the same subnet adjacent in map
+	// responses. Zero sorts peers by ID only.
+	PeerSubnetGrouping int
+
+	// PeerAPIOnly lists the tags and users whose nodes are marked as
+	// only reaching the PeerAPI of their peers, see
+	// tailcfg.Node.UnsignedPeerAPIOnly. The policy has to restrict
+	// their access accordingly.
+	PeerAPIOnly []string
+
+	// PeerProjection strips fields from the peers sent to some nodes.
+	PeerProjection PeerProjectionConfig
+
+	// RegionBaseDomains overrides the base domain of nodes by the ID of
+	// their preferred DERP region. Nodes in other regions use BaseDomain.
+	RegionBaseDomains map[int]string
+
+	// ControlDialPlan is sent to clients to tell them which addresses
+	// to use to reach the control server, nil sends no dial plan.
+	ControlDialPlan *tailcfg.ControlDialPlan
+
+	// OrphanUserName is the name of the user profile sent for nodes
+	// not owned by any user. Empty sends no profile for them.
+	OrphanUserName string
+
+	// DeletedUserName is the name of the user profile sent for nodes
+	// whose user no longer exists in the database.
+	DeletedUserName string
+
+	// DataPlaneAuditLogSecret is the secret the per-node data plane
+	// audit log IDs are derived from. Empty sends no audit log IDs.
+	DataPlaneAuditLogSecret string
+
+	// DERPAllowedRegions restricts the DERP regions sent to clients to
+	// the given region IDs. Empty sends all regions of the DERP map.
+	DERPAllowedRegions []int
+
+	// DERPRegionRestrictions restricts the DERP regions sent to the nodes
+	// with a tag ("tag:regulated") or of a user to the given region IDs.
+	// Nodes matching several entries only get the regions all of them
+	// allow.
+	DERPRegionRestrictions map[string][]int
+
+	// ExitNodeDNSResolvers lists the addresses of the DNS resolvers
+	// peers use when routing through the exit node with the given ID.
+	ExitNodeDNSResolvers map[NodeID][]string
+
+	// UserSearchDomains lists additional DNS search domains of the nodes
+	// of the given users, keyed by lowercase user name. Nodes only get
+	// the domains of their own user, not those of their peers' users.
+	UserSearchDomains map[string][]string
+
+	// TaggedSearchDomains lists additional DNS search domains of tagged
+	// nodes, keyed by tag. Tagged nodes are not owned by their user and
+	// get the domains of their tags instead of UserSearchDomains.
+	TaggedSearchDomains map[string][]string
+
+	// DoHMetadata lists DNS over HTTPS resolvers that get metadata
+	// about the node added to their URL, in addition to the built-in
+	// NextDNS resolvers.
+	DoHMetadata []DoHMetadataResolver
+
+	// Masquerade lists the addresses nodes are known as by some of
+	// their peers.
+	Masquerade []MasqueradeRule
+
+	// DNSVersionCapability adds the version of the DNS configuration
+	// sent to a node to its CapMap, to debug clients with a stale one.
+	DNSVersionCapability bool
+
+	// DenyEmptyFilter hides all peers from nodes when the policy
+	// yields no filter rules at all, instead of sending every peer.
+	DenyEmptyFilter bool
+
+	// UserScopedRoutes hides the subnet routes of nodes owned by a user
+	// from the nodes of other users, unless the policy grants access to
+	// the routes with a rule naming them. Rules allowing access to all
+	// destinations do not count. Tagged nodes are not owned by a user.
+	UserScopedRoutes bool
+
+	// DeltaFullUpdates sends full updates to a node streaming map
+	// responses as the peers that changed or were removed since the
+	// previous response, instead of the complete list of peers.
+	DeltaFullUpdates bool
+
+	// DeltaMaxAge is the age of the peers last sent in full to a node
+	// after which the next full update sends all peers again instead of
+	// the differences, bounding how long a node can drift from the
+	// peers it should know. Zero keeps sending differences.
+	DeltaMaxAge time.Duration
+
+	// OmitUnchangedFields leaves the DNS configuration, domain, packet
+	// filter and SSH policy out of updates sent to a node streaming map
+	// responses if they did not change since they were last sent.
+	OmitUnchangedFields bool
+
+	// MinCapabilityVersion is the oldest capability version of clients
+	// sent their peers. Older clients are sent a deny all packet filter
+	// and a health message asking to upgrade. Zero allows every client
+	// supported by headscale.
+	MinCapabilityVersion tailcfg.CapabilityVersion
+
+	// LegacyPacketFilter sends the packet filter in the legacy
+	// MapResponse.PacketFilter field to clients too old to understand
+	// MapResponse.PacketFilters. Newer clients always get PacketFilters.
+	LegacyPacketFilter bool
+
+	// MaxSession clamps the key expiry sent to a node to now+MaxSession,
+	// including nodes without an expiry. Zero disables the clamp.
+	MaxSession time.Duration
+
+	// DuplicateNames is how nodes sharing their MagicDNS name with
+	// another node are handled, one of the DuplicateNames constants.
+	DuplicateNames string
+
+	// UnsupportedFeatures lists client features, out of the Feature
+	// constants, that nodes requesting them are told about with a
+	// health message explaining that the server does not support them.
+	UnsupportedFeatures []string
+}
+
+// Handling of duplicate node names, see MapperConfig.DuplicateNames.
+const (
+	// DuplicateNamesIgnore sends the names as they are.
+	DuplicateNamesIgnore = ""
+	// DuplicateNamesWarn logs a warning for every duplicate name sent.
+	DuplicateNamesWarn = "warn"
+	// DuplicateNamesSuffix keeps the name of the node with the lowest
+	// ID and appends their ID to the names of the other nodes.
+	DuplicateNamesSuffix = "suffix"
+)
+
+var duplicateNamesModes = []string{DuplicateNamesIgnore, DuplicateNamesWarn, DuplicateNamesSuffix}
+
+// Client features that can be reported as unsupported, see
+// MapperConfig.UnsupportedFeatures.
+const (
+	// FeatureTailnetLock is requested by clients with tailnet lock
+	// enabled, which report their tailnet key authority head.
+	FeatureTailnetLock = "tailnet-lock"
+	// FeatureSessionResume is requested by clients resuming an earlier
+	// map session.
+	FeatureSessionResume = "session-resume"
+	// FeatureFunnel is requested by clients with Funnel enabled.
+	FeatureFunnel = "funnel"
+	// FeatureAppConnector is requested by clients running as app
+	// connector.
+	FeatureAppConnector = "app-connector"
+)
+
+var unsupportedFeatures = []string{FeatureTailnetLock, FeatureSessionResume, FeatureFunnel, FeatureAppConnector}
+
+// Peer fields that can be omitted with PeerProjectionConfig.
+const (
+	PeerFieldHostinfo  = "hostinfo"
+	PeerFieldEndpoints = "endpoints"
+	PeerFieldCapMap    = "capmap"
+)
+
+var peerProjectionFields = []string{PeerFieldHostinfo, PeerFieldEndpoints, PeerFieldCapMap}
+
+// PeerProjectionConfig configures a lightweight view of the peers for
+// nodes that do not need all of their details.
+type PeerProjectionConfig struct {
+	// Nodes lists the tags ("tag:sensor") and users whose nodes
+	// are sent projected peers.
+	Nodes []string
+
+	// Omit lists the peer fields that are not sent to these nodes.
+	Omit []string
+}
+
+// MasqueradeRule makes Peer know Node under Addr instead of its own
+// address, see tailcfg.Node.SelfNodeV4MasqAddrForThisPeer.
+type MasqueradeRule struct {
+	Node NodeID
+	Peer NodeID
+	Addr netip.Addr
+}
+
+// DoHMetadataPlaceholders are the placeholders replaced by the metadata
+// of the node in the parameter templates of a DoHMetadataResolver.
+var DoHMetadataPlaceholders = []string{
+	"{device_id}",
+	"{device_name}",
+	"{device_model}",
+	"{device_ip}",
+}
+
+// DoHMetadataResolver adds query parameters with metadata about the node
+// to the URL of the DNS over HTTPS resolvers starting with Prefix.
+type DoHMetadataResolver struct {
+	Prefix string             `mapstructure:"prefix"`
+	Params []DoHMetadataParam `mapstructure:"params"`
+}
+
+// DoHMetadataParam is a query parameter added by a DoHMetadataResolver.
+// Value is a template containing DoHMetadataPlaceholders, parameters
+// with an empty value are left out. The parameters are a list and not
+// a map, as viper lowercases the keys of maps and parameter names are
+// case-sensitive.
+type DoHMetadataParam struct {
+	Name  string `mapstructure:"name"`
+	Value string `mapstructure:"value"`
+}
+
+// ControlDialCandidate is an address clients can use to connect to
+// the control server, see tailcfg.ControlIPCandidate.
+type ControlDialCandidate struct {
+	IP                string  `mapstructure:"ip"`
+	DialStartDelaySec float64 `mapstructure:"dial_start_delay_sec"`
+	DialTimeoutSec    float64 `mapstructure:"dial_timeout_sec"`
+	Priority          int     `mapstructure:"priority"`
+}
+
 type Tuning struct {
 	NotifierSendTimeout            time.Duration
 	BatchChangeDelay               time.Duration
 	NodeMapSessionBufferedChanSize int
+
+	// MapResponseGenerationTimeout is the maximum time spent generating
+	// a full MapResponse before giving up. Zero means no timeout.
+	MapResponseGenerationTimeout time.Duration
+
+	// MapResponseDBRetries is how often reading nodes from the database
+	// is retried on transient errors while generating a MapResponse.
+	// The wait between the retries starts at MapResponseDBRetryBackoff
+	// and doubles after every attempt.
+	MapResponseDBRetries      int
+	MapResponseDBRetryBackoff time.Duration
+
+	// MapResponseCacheTTL is how long a full MapResponse is reused for
+	// identical requests of the same node. Zero disables the cache.
+	MapResponseCacheTTL time.Duration
+
+	// TailNodeCache reuses the Tailscale nodes converted from peers for
+	// later responses while the peers are not updated in the database,
+	// their routes, connection state and the policy stay the same.
+	TailNodeCache bool
+
+	// ControlTimeJitter randomly shifts the ControlTime sent in every
+	// MapResponse by up to this duration in either direction, so that
+	// clients syncing to it do not all act at the same time.
+	// Zero sends the exact time.
+	ControlTimeJitter time.Duration
+
+	// DERPMapMinInterval is the minimum time between two DERP map
+	// updates sent to the same node. Updates within the interval are
+	// withheld until it passed and sent with the next keep alive or
+	// update, full map responses always contain the DERP map.
+	// Zero sends every update.
+	DERPMapMinInterval time.Duration
+
+	// KeepAliveInterval is the time between two keep alive messages sent
+	// to streaming clients. Mobile clients (iOS and Android) use
+	// MobileKeepAliveInterval instead, a longer interval saves them
+	// battery. Clients end sessions without any message for two minutes.
+	KeepAliveInterval       time.Duration
+	MobileKeepAliveInterval time.Duration
 }
 
 func validatePKCEMethod(method string) error {
@@ -281,6 +665,11 @@ func LoadConfig(path string, isFile bool) error {
 	viper.AutomaticEnv()
 
 	viper.SetDefault("policy.mode", "file")
+	viper.SetDefault("policy.max_filter_complexity", 0)
+
+	viper.SetDefault("target_redirect_code", http.StatusFound)
+	viper.SetDefault("register_mode", RegisterModeRedirect)
+	viper.SetDefault("web_content_security_policy", DefaultWebContentSecurityPolicy)
 
 	viper.SetDefault("tls_letsencrypt_cache_dir", "/var/www/.cache")
 	viper.SetDefault("tls_letsencrypt_challenge_type", HTTP01ChallengeType)
@@ -294,6 +683,7 @@ func LoadConfig(path string, isFile bool) error {
 	viper.SetDefault("dns.nameservers.global", []string{})
 	viper.SetDefault("dns.nameservers.split", map[string]string{})
 	viper.SetDefault("dns.search_domains", []string{})
+	viper.SetDefault("dns.max_extra_records", 0)
 
 	viper.SetDefault("derp.server.enabled", false)
 	viper.SetDefault("derp.server.stun.enabled", true)
@@ -324,13 +714,61 @@ func LoadConfig(path string, isFile bool) error {
 	viper.SetDefault("oidc.pkce.method", "S256")
 
 	viper.SetDefault("logtail.enabled", false)
+	viper.SetDefault("logtail.nodes", map[string]bool{})
 	viper.SetDefault("randomize_client_port", false)
 
 	viper.SetDefault("ephemeral_node_inactivity_timeout", "120s")
 
+	viper.SetDefault("mapper.autogroup_capability", false)
+	viper.SetDefault("mapper.collect_services", false)
+	viper.SetDefault("mapper.omit_user_profiles", false)
+	viper.SetDefault("mapper.default_compression", "")
+	viper.SetDefault("mapper.default_compression_min_capver", 0)
+	viper.SetDefault("mapper.user_compression", map[string]string{})
+	viper.SetDefault("mapper.user_search_domains", map[string][]string{})
+	viper.SetDefault("mapper.tagged_search_domains", map[string][]string{})
+	viper.SetDefault("mapper.zstd_level", 1)
+	viper.SetDefault("mapper.serve_allowed", []string{})
+	viper.SetDefault("mapper.funnel_allowed", []string{})
+	viper.SetDefault("mapper.peer_api_only", []string{})
+	viper.SetDefault("mapper.max_peers", 0)
+	viper.SetDefault("mapper.peer_warning_threshold", 0)
+	viper.SetDefault("mapper.peer_subnet_grouping", 0)
+	viper.SetDefault("mapper.derp_only", []string{})
+	viper.SetDefault("mapper.dns_disabled", []string{})
+	viper.SetDefault("mapper.strip_offline_endpoints", false)
+	viper.SetDefault("mapper.max_session", "0s")
+	viper.SetDefault("mapper.delta_max_age", "0s")
+	viper.SetDefault("mapper.duplicate_names", DuplicateNamesIgnore)
+	viper.SetDefault("mapper.unsupported_features", []string{})
+	viper.SetDefault("mapper.legacy_packet_filter", false)
+	viper.SetDefault("mapper.deny_empty_filter", false)
+	viper.SetDefault("mapper.user_scoped_routes", false)
+	viper.SetDefault("mapper.min_capability_version", 0)
+	viper.SetDefault("mapper.delta_full_updates", false)
+	viper.SetDefault("mapper.omit_unchanged_fields", false)
+	viper.SetDefault("mapper.dns_version_capability", false)
+	viper.SetDefault("mapper.derp_allowed_regions", []int{})
+	viper.SetDefault("mapper.data_plane_audit_log_secret", "")
+	viper.SetDefault("mapper.orphan_user_name", "")
+	viper.SetDefault("mapper.deleted_user_name", "Deleted user")
+	viper.SetDefault("mapper.region_base_domains", map[string]string{})
+	viper.SetDefault("mapper.exit_node_dns_resolvers", map[string][]string{})
+	viper.SetDefault("mapper.peer_projection.nodes", []string{})
+	viper.SetDefault("mapper.peer_projection.omit", []string{PeerFieldHostinfo, PeerFieldEndpoints})
+
 	viper.SetDefault("tuning.notifier_send_timeout", "800ms")
 	viper.SetDefault("tuning.batch_change_delay", "800ms")
 	viper.SetDefault("tuning.node_mapsession_buffered_chan_size", 30)
+	viper.SetDefault("tuning.map_response_generation_timeout", "0s")
+	viper.SetDefault("tuning.map_response_cache_ttl", "0s")
+	viper.SetDefault("tuning.tail_node_cache", false)
+	viper.SetDefault("tuning.map_response_db_retries", 0)
+	viper.SetDefault("tuning.map_response_db_retry_backoff", "50ms")
+	viper.SetDefault("tuning.control_time_jitter", "0s")
+	viper.SetDefault("tuning.derp_map_min_interval", "0s")
+	viper.SetDefault("tuning.keepalive_interval", "50s")
+	viper.SetDefault("tuning.mobile_keepalive_interval", "50s")
 
 	viper.SetDefault("prefixes.allocation", string(IPAllocationStrategySequential))
 
@@ -341,6 +779,11 @@ func LoadConfig(path string, isFile bool) error {
 	return nil
 }
 
+// maxKeepAliveInterval is the longest configurable keep alive interval.
+// Up to 9s of jitter are added to it, clients end sessions without any
+// message for two minutes.
+const maxKeepAliveInterval = 110 * time.Second
+
 func validateServerConfig() error {
 	depr := deprecator{
 		warns:  make(set.Set[string]),
@@ -405,6 +848,14 @@ func validateServerConfig() error {
 		errorText += "Fatal config error: the only supported values for tls_letsencrypt_challenge_type are HTTP-01 and TLS-ALPN-01\n"
 	}
 
+	if code := viper.GetInt("target_redirect_code"); !slices.Contains(targetRedirectCodes, code) {
+		errorText += fmt.Sprintf("Fatal config error: target_redirect_code must be one of %v, got %d\n", targetRedirectCodes, code)
+	}
+
+	if mode := viper.GetString("register_mode"); !slices.Contains(registerModes, mode) {
+		errorText += fmt.Sprintf("Fatal config error: register_mode must be one of %q, got %q\n", registerModes, mode)
+	}
+
 	if !strings.HasPrefix(viper.GetString("server_url"), "http://") &&
 		!strings.HasPrefix(viper.GetString("server_url"), "https://") {
 		errorText += "Fatal config error: server_url must start with https:// or http://\n"
@@ -421,12 +872,92 @@ func validateServerConfig() error {
 		)
 	}
 
+	for _, key := range []string{"tuning.keepalive_interval", "tuning.mobile_keepalive_interval"} {
+		if interval := viper.GetDuration(key); interval <= 0 || interval > maxKeepAliveInterval {
+			errorText += fmt.Sprintf("Fatal config error: %s must be more than 0s and at most %s, got %s\n", key, maxKeepAliveInterval, interval)
+		}
+	}
+
 	if viper.GetBool("dns.override_local_dns") {
 		if global := viper.GetStringSlice("dns.nameservers.global"); len(global) == 0 {
 			errorText += "Fatal config error: dns.nameservers.global must be set when dns.override_local_dns is true\n"
 		}
 	}
 
+	if limit := viper.GetInt("dns.max_extra_records"); limit < 0 {
+		errorText += fmt.Sprintf("Fatal config error: dns.max_extra_records must not be negative, got %d\n", limit)
+	}
+
+	if compression := viper.GetString("mapper.default_compression"); compression != "" && compression != util.ZstdCompression {
+		errorText += fmt.Sprintf("Fatal config error: mapper.default_compression must be empty or %q, got %q\n", util.ZstdCompression, compression)
+	}
+
+	if level := viper.GetInt("mapper.zstd_level"); level < 1 || level > 22 {
+		errorText += fmt.Sprintf("Fatal config error: mapper.zstd_level must be between 1 and 22, got %d\n", level)
+	}
+
+	for user, compression := range viper.GetStringMapString("mapper.user_compression") {
+		if compression != "" && compression != util.ZstdCompression {
+			errorText += fmt.Sprintf("Fatal config error: mapper.user_compression for %q must be empty or %q, got %q\n", user, util.ZstdCompression, compression)
+		}
+	}
+
+	for region, domain := range viper.GetStringMapString("mapper.region_base_domains") {
+		if _, err := strconv.Atoi(region); err != nil {
+			errorText += fmt.Sprintf("Fatal config error: mapper.region_base_domains key %q is not a DERP region ID\n", region)
+		}
+		if domain == "" {
+			errorText += fmt.Sprintf("Fatal config error: mapper.region_base_domains has an empty domain for region %q\n", region)
+		}
+	}
+
+	for node := range viper.GetStringMap("logtail.nodes") {
+		if _, err := strconv.ParseUint(node, util.Base10, 64); err != nil {
+			errorText += fmt.Sprintf("Fatal config error: logtail.nodes key %q is not a node ID\n", node)
+		}
+	}
+
+	for node, addrs := range viper.GetStringMapStringSlice("mapper.exit_node_dns_resolvers") {
+		if _, err := strconv.ParseUint(node, util.Base10, 64); err != nil {
+			errorText += fmt.Sprintf("Fatal config error: mapper.exit_node_dns_resolvers key %q is not a node ID\n", node)
+		}
+		if slices.Contains(addrs, "") {
+			errorText += fmt.Sprintf("Fatal config error: mapper.exit_node_dns_resolvers has an empty resolver for node %q\n", node)
+		}
+	}
+
+	if mode := viper.GetString("mapper.duplicate_names"); !slices.Contains(duplicateNamesModes, mode) {
+		errorText += fmt.Sprintf("Fatal config error: mapper.duplicate_names must be one of %q, got %q\n", duplicateNamesModes, mode)
+	}
+
+	for _, feature := range viper.GetStringSlice("mapper.unsupported_features") {
+		if !slices.Contains(unsupportedFeatures, feature) {
+			errorText += fmt.Sprintf("Fatal config error: mapper.unsupported_features contains unknown feature %q, must be one of %v\n", feature, unsupportedFeatures)
+		}
+	}
+
+	for _, field := range viper.GetStringSlice("mapper.peer_projection.omit") {
+		if !slices.Contains(peerProjectionFields, field) {
+			errorText += fmt.Sprintf("Fatal config error: mapper.peer_projection.omit contains unknown field %q, must be one of %v\n", field, peerProjectionFields)
+		}
+	}
+
+	if minCapVer := viper.GetInt("mapper.min_capability_version"); minCapVer < 0 {
+		errorText += fmt.Sprintf("Fatal config error: mapper.min_capability_version must not be negative, got %d\n", minCapVer)
+	}
+
+	if maxPeers := viper.GetInt("mapper.max_peers"); maxPeers < 0 {
+		errorText += fmt.Sprintf("Fatal config error: mapper.max_peers must not be negative, got %d\n", maxPeers)
+	}
+
+	if threshold := viper.GetInt("mapper.peer_warning_threshold"); threshold < 0 {
+		errorText += fmt.Sprintf("Fatal config error: mapper.peer_warning_threshold must not be negative, got %d\n", threshold)
+	}
+
+	if bits := viper.GetInt("mapper.peer_subnet_grouping"); bits < 0 || bits > 32 {
+		errorText += fmt.Sprintf("Fatal config error: mapper.peer_subnet_grouping must be an IPv4 prefix length between 0 and 32, got %d\n", bits)
+	}
+
 	if errorText != "" {
 		// nolint
 		return errors.New(strings.TrimSuffix(errorText, "\n"))
@@ -435,6 +966,225 @@ func validateServerConfig() error {
 	return nil
 }
 
+func mapperConfig() (MapperConfig, error) {
+	dialPlan, err := controlDialPlan()
+	if err != nil {
+		return MapperConfig{}, err
+	}
+
+	masquerade, err := masqueradeRules()
+	if err != nil {
+		return MapperConfig{}, err
+	}
+
+	dohMetadata, err := dohMetadataResolvers()
+	if err != nil {
+		return MapperConfig{}, err
+	}
+
+	derpRestrictions, err := derpRegionRestrictions()
+	if err != nil {
+		return MapperConfig{}, err
+	}
+
+	return MapperConfig{
+		AutogroupCapability: viper.GetBool("mapper.autogroup_capability"),
+		CollectServices:     viper.GetBool("mapper.collect_services"),
+		DefaultCompression:  viper.GetString("mapper.default_compression"),
+		DefaultCompressionMinCapVer: tailcfg.CapabilityVersion(
+			viper.GetInt("mapper.default_compression_min_capver"),
+		),
+		UserCompression:    viper.GetStringMapString("mapper.user_compression"),
+		ZstdLevel:          viper.GetInt("mapper.zstd_level"),
+		ServeAllowed:       viper.GetStringSlice("mapper.serve_allowed"),
+		FunnelAllowed:      viper.GetStringSlice("mapper.funnel_allowed"),
+		PeerAPIOnly:        viper.GetStringSlice("mapper.peer_api_only"),
+		MaxPeers:           viper.GetInt("mapper.max_peers"),
+		PeerSubnetGrouping: viper.GetInt("mapper.peer_subnet_grouping"),
+		DERPOnly:           viper.GetStringSlice("mapper.derp_only"),
+		DNSDisabled:        viper.GetStringSlice("mapper.dns_disabled"),
+		PeerProjection: PeerProjectionConfig{
+			Nodes: viper.GetStringSlice("mapper.peer_projection.nodes"),
+			Omit:  viper.GetStringSlice("mapper.peer_projection.omit"),
+		},
+		RegionBaseDomains:       regionBaseDomains(),
+		ExitNodeDNSResolvers:    exitNodeDNSResolvers(),
+		ControlDialPlan:         dialPlan,
+		OrphanUserName:          viper.GetString("mapper.orphan_user_name"),
+		DeletedUserName:         viper.GetString("mapper.deleted_user_name"),
+		DataPlaneAuditLogSecret: viper.GetString("mapper.data_plane_audit_log_secret"),
+		DERPAllowedRegions:      viper.GetIntSlice("mapper.derp_allowed_regions"),
+		Masquerade:              masquerade,
+		DenyEmptyFilter:         viper.GetBool("mapper.deny_empty_filter"),
+		UserScopedRoutes:        viper.GetBool("mapper.user_scoped_routes"),
+		DeltaFullUpdates:        viper.GetBool("mapper.delta_full_updates"),
+		MinCapabilityVersion:    tailcfg.CapabilityVersion(viper.GetInt("mapper.min_capability_version")),
+		PeerWarningThreshold:    viper.GetInt("mapper.peer_warning_threshold"),
+		DoHMetadata:             dohMetadata,
+		UserSearchDomains:       viper.GetStringMapStringSlice("mapper.user_search_domains"),
+		TaggedSearchDomains:     viper.GetStringMapStringSlice("mapper.tagged_search_domains"),
+		StripOfflineEndpoints:   viper.GetBool("mapper.strip_offline_endpoints"),
+		OmitUnchangedFields:     viper.GetBool("mapper.omit_unchanged_fields"),
+		DNSVersionCapability:    viper.GetBool("mapper.dns_version_capability"),
+		LegacyPacketFilter:      viper.GetBool("mapper.legacy_packet_filter"),
+		MaxSession:              viper.GetDuration("mapper.max_session"),
+		DeltaMaxAge:             viper.GetDuration("mapper.delta_max_age"),
+		DuplicateNames:          viper.GetString("mapper.duplicate_names"),
+		OmitUserProfiles:        viper.GetBool("mapper.omit_user_profiles"),
+		DERPRegionRestrictions:  derpRestrictions,
+		UnsupportedFeatures:     viper.GetStringSlice("mapper.unsupported_features"),
+	}, nil
+}
+
+// derpRegionRestrictions returns the DERP regions configured in
+// mapper.derp_region_restrictions.
+func derpRegionRestrictions() (map[string][]int, error) {
+	if !viper.IsSet("mapper.derp_region_restrictions") {
+		return nil, nil
+	}
+
+	var restrictions map[string][]int
+	if err := viper.UnmarshalKey("mapper.derp_region_restrictions", &restrictions); err != nil {
+		return nil, fmt.Errorf("unmarshalling mapper.derp_region_restrictions: %w", err)
+	}
+
+	for entry, regions := range restrictions {
+		if len(regions) == 0 {
+			return nil, fmt.Errorf("mapper.derp_region_restrictions for %q must list at least one region", entry)
+		}
+	}
+
+	return restrictions, nil
+}
+
+// masqueradeRules returns the rules configured in mapper.masquerade.
+func masqueradeRules() ([]MasqueradeRule, error) {
+	if !viper.IsSet("mapper.masquerade") {
+		return nil, nil
+	}
+
+	var entries []struct {
+		Node uint64 `mapstructure:"node"`
+		Peer uint64 `mapstructure:"peer"`
+		Addr string `mapstructure:"addr"`
+	}
+	if err := viper.UnmarshalKey("mapper.masquerade", &entries); err != nil {
+		return nil, fmt.Errorf("unmarshalling mapper.masquerade: %w", err)
+	}
+
+	var rules []MasqueradeRule
+	for _, entry := range entries {
+		addr, err := netip.ParseAddr(entry.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing mapper.masquerade address %q: %w", entry.Addr, err)
+		}
+
+		rules = append(rules, MasqueradeRule{
+			Node: NodeID(entry.Node),
+			Peer: NodeID(entry.Peer),
+			Addr: addr,
+		})
+	}
+
+	return rules, nil
+}
+
+// dohMetadataResolvers returns the resolvers configured in
+// mapper.doh_metadata.
+func dohMetadataResolvers() ([]DoHMetadataResolver, error) {
+	if !viper.IsSet("mapper.doh_metadata") {
+		return nil, nil
+	}
+
+	var resolvers []DoHMetadataResolver
+	if err := viper.UnmarshalKey("mapper.doh_metadata", &resolvers); err != nil {
+		return nil, fmt.Errorf("unmarshalling mapper.doh_metadata: %w", err)
+	}
+
+	placeholder := regexp.MustCompile(`\{[^{}]*\}`)
+	for _, resolver := range resolvers {
+		if !strings.HasPrefix(resolver.Prefix, "https://") {
+			return nil, fmt.Errorf("mapper.doh_metadata prefix %q must start with https://", resolver.Prefix)
+		}
+
+		for _, param := range resolver.Params {
+			if param.Name == "" {
+				return nil, fmt.Errorf("mapper.doh_metadata parameter of %q has no name", resolver.Prefix)
+			}
+
+			for _, found := range placeholder.FindAllString(param.Value, -1) {
+				if !slices.Contains(DoHMetadataPlaceholders, found) {
+					return nil, fmt.Errorf("mapper.doh_metadata parameter %q of %q uses unknown placeholder %s", param.Name, resolver.Prefix, found)
+				}
+			}
+		}
+	}
+
+	return resolvers, nil
+}
+
+// controlDialPlan returns the dial plan configured in
+// mapper.control_dial_plan, or nil if there is none.
+func controlDialPlan() (*tailcfg.ControlDialPlan, error) {
+	if !viper.IsSet("mapper.control_dial_plan") {
+		return nil, nil
+	}
+
+	var candidates []ControlDialCandidate
+	if err := viper.UnmarshalKey("mapper.control_dial_plan", &candidates); err != nil {
+		return nil, fmt.Errorf("unmarshalling mapper.control_dial_plan: %w", err)
+	}
+
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	plan := &tailcfg.ControlDialPlan{}
+	for _, candidate := range candidates {
+		ip, err := netip.ParseAddr(candidate.IP)
+		if err != nil {
+			return nil, fmt.Errorf("parsing mapper.control_dial_plan IP %q: %w", candidate.IP, err)
+		}
+
+		plan.Candidates = append(plan.Candidates, tailcfg.ControlIPCandidate{
+			IP:                ip,
+			DialStartDelaySec: candidate.DialStartDelaySec,
+			DialTimeoutSec:    candidate.DialTimeoutSec,
+			Priority:          candidate.Priority,
+		})
+	}
+
+	return plan, nil
+}
+
+// regionBaseDomains returns the base domains per DERP region ID.
+// Invalid region IDs are rejected by validateServerConfig.
+func regionBaseDomains() map[int]string {
+	domains := make(map[int]string)
+	for region, domain := range viper.GetStringMapString("mapper.region_base_domains") {
+		regionID, err := strconv.Atoi(region)
+		if err != nil {
+			continue
+		}
+		domains[regionID] = domain
+	}
+
+	return domains
+}
+
+func exitNodeDNSResolvers() map[NodeID][]string {
+	resolvers := make(map[NodeID][]string)
+	for node, addrs := range viper.GetStringMapStringSlice("mapper.exit_node_dns_resolvers") {
+		nodeID, err := strconv.ParseUint(node, util.Base10, 64)
+		if err != nil {
+			continue
+		}
+		resolvers[NodeID(nodeID)] = addrs
+	}
+
+	return resolvers
+}
+
 func tlsConfig() TLSConfig {
 	return TLSConfig{
 		LetsEncrypt: LetsEncryptConfig{
@@ -518,8 +1268,18 @@ func derpConfig() DERPConfig {
 func logtailConfig() LogTailConfig {
 	enabled := viper.GetBool("logtail.enabled")
 
+	nodes := make(map[NodeID]bool)
+	for node := range viper.GetStringMap("logtail.nodes") {
+		nodeID, err := strconv.ParseUint(node, util.Base10, 64)
+		if err != nil {
+			continue
+		}
+		nodes[NodeID(nodeID)] = viper.GetBool("logtail.nodes." + node)
+	}
+
 	return LogTailConfig{
 		Enabled: enabled,
+		Nodes:   nodes,
 	}
 }
 
@@ -528,8 +1288,9 @@ func policyConfig() PolicyConfig {
 	policyMode := viper.GetString("policy.mode")
 
 	return PolicyConfig{
-		Path: policyPath,
-		Mode: PolicyMode(policyMode),
+		Path:                policyPath,
+		Mode:                PolicyMode(policyMode),
+		MaxFilterComplexity: viper.GetInt("policy.max_filter_complexity"),
 	}
 }
 
@@ -631,6 +1392,8 @@ func dns() (DNSConfig, error) {
 	dns.Nameservers.Split = viper.GetStringMapStringSlice("dns.nameservers.split")
 	dns.SearchDomains = viper.GetStringSlice("dns.search_domains")
 	dns.ExtraRecordsPath = viper.GetString("dns.extra_records_path")
+	dns.MaxExtraRecords = viper.GetInt("dns.max_extra_records")
+	dns.ExtraRecordsPriority = viper.GetStringSlice("dns.extra_records_priority")
 
 	if viper.IsSet("dns.extra_records") {
 		var extraRecords []tailcfg.DNSRecord
@@ -639,7 +1402,11 @@ func dns() (DNSConfig, error) {
 		if err != nil {
 			return DNSConfig{}, fmt.Errorf("unmarshalling dns extra records: %w", err)
 		}
-		dns.ExtraRecords = extraRecords
+		dns.ExtraRecords = headscaledns.LimitRecords(
+			headscaledns.ValidRecords(extraRecords),
+			dns.MaxExtraRecords,
+			dns.ExtraRecordsPriority,
+		)
 	}
 
 	return dns, nil
@@ -687,9 +1454,12 @@ func (d *DNSConfig) globalResolvers() []*dnstype.Resolver {
 // If a nameserver is a valid IP, it will be used as a regular resolver.
 // If a nameserver is a valid URL, it will be used as a DoH resolver.
 // If a nameserver is neither a valid URL nor a valid IP, it will be ignored.
+// Domains that only differ by case or a trailing dot are the same route,
+// their resolvers are merged instead of one replacing the other.
 func (d *DNSConfig) splitResolvers() map[string][]*dnstype.Resolver {
 	routes := make(map[string][]*dnstype.Resolver)
-	for domain, nameservers := range d.Nameservers.Split {
+	for _, domain := range slices.Sorted(maps.Keys(d.Nameservers.Split)) {
+		nameservers := d.Nameservers.Split[domain]
 		var resolvers []*dnstype.Resolver
 		for _, nsStr := range nameservers {
 			warn := ""
@@ -717,7 +1487,18 @@ func (d *DNSConfig) splitResolvers() map[string][]*dnstype.Resolver {
 				log.Warn().Msg(warn)
 			}
 		}
-		routes[domain] = resolvers
+
+		// A route without resolvers is only resolved by MagicDNS.
+		if len(nameservers) > 0 && len(resolvers) == 0 {
+			log.Warn().Msgf("No valid split dns nameserver for %q, the domain is only resolved by MagicDNS", domain)
+		}
+
+		route := strings.TrimSuffix(strings.ToLower(domain), ".")
+		if existing, ok := routes[route]; ok {
+			log.Warn().Msgf("Split dns domain %q collides with another domain, merging nameservers into %q", domain, route)
+			resolvers = append(existing, resolvers...)
+		}
+		routes[route] = resolvers
 	}
 
 	return routes
@@ -861,6 +1642,11 @@ func LoadServerConfig() (*Config, error) {
 		return nil, err
 	}
 
+	mapper, err := mapperConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	derpConfig := derpConfig()
 	logTailConfig := logtailConfig()
 	randomizeClientPort := viper.GetBool("randomize_client_port")
@@ -894,13 +1680,16 @@ func LoadServerConfig() (*Config, error) {
 	}
 
 	return &Config{
-		ServerURL:          serverURL,
-		TargetURL:          viper.GetString("target_url"),
-		Addr:               viper.GetString("listen_addr"),
-		MetricsAddr:        viper.GetString("metrics_listen_addr"),
-		GRPCAddr:           viper.GetString("grpc_listen_addr"),
-		GRPCAllowInsecure:  viper.GetBool("grpc_allow_insecure"),
-		DisableUpdateCheck: false,
+		ServerURL:                serverURL,
+		TargetURL:                viper.GetString("target_url"),
+		TargetRedirectCode:       viper.GetInt("target_redirect_code"),
+		RegisterMode:             viper.GetString("register_mode"),
+		WebContentSecurityPolicy: viper.GetString("web_content_security_policy"),
+		Addr:                     viper.GetString("listen_addr"),
+		MetricsAddr:              viper.GetString("metrics_listen_addr"),
+		GRPCAddr:                 viper.GetString("grpc_listen_addr"),
+		GRPCAllowInsecure:        viper.GetBool("grpc_allow_insecure"),
+		DisableUpdateCheck:       false,
 
 		PrefixV4:     prefix4,
 		PrefixV6:     prefix6,
@@ -969,6 +1758,8 @@ func LoadServerConfig() (*Config, error) {
 
 		Policy: policyConfig(),
 
+		Mapper: mapper,
+
 		CLI: CLIConfig{
 			Address:  viper.GetString("cli.address"),
 			APIKey:   viper.GetString("cli.api_key"),
@@ -985,6 +1776,21 @@ func LoadServerConfig() (*Config, error) {
 			NodeMapSessionBufferedChanSize: viper.GetInt(
 				"tuning.node_mapsession_buffered_chan_size",
 			),
+			MapResponseGenerationTimeout: viper.GetDuration(
+				"tuning.map_response_generation_timeout",
+			),
+			MapResponseDBRetries: viper.GetInt("tuning.map_response_db_retries"),
+			MapResponseDBRetryBackoff: viper.GetDuration(
+				"tuning.map_response_db_retry_backoff",
+			),
+			MapResponseCacheTTL: viper.GetDuration("tuning.map_response_cache_ttl"),
+			TailNodeCache:       viper.GetBool("tuning.tail_node_cache"),
+			ControlTimeJitter:   viper.GetDuration("tuning.control_time_jitter"),
+			DERPMapMinInterval:  viper.GetDuration("tuning.derp_map_min_interval"),
+			KeepAliveInterval:   viper.GetDuration("tuning.keepalive_interval"),
+			MobileKeepAliveInterval: viper.GetDuration(
+				"tuning.mobile_keepalive_interval",
+			),
 		},
 	}, nil
 }
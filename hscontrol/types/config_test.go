@@ -1,13 +1,18 @@
 package types
 
 import (
+	"bytes"
 	"fmt"
+	"net/http"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -405,6 +410,27 @@ tls_letsencrypt_challenge_type: TLS-ALPN-01
 	require.NoError(t, err)
 }
 
+func TestTargetRedirectCodeValidation(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	require.NoError(t, LoadConfig("testdata/minimal.yaml", true))
+	assert.Equal(t, http.StatusFound, viper.GetInt("target_redirect_code"))
+
+	for _, code := range []int{http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect} {
+		viper.Set("target_redirect_code", code)
+		if err := validateServerConfig(); err != nil {
+			assert.NotContains(t, err.Error(), "target_redirect_code")
+		}
+	}
+
+	for _, code := range []int{0, http.StatusOK, http.StatusNotModified} {
+		viper.Set("target_redirect_code", code)
+		err := validateServerConfig()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "Fatal config error: target_redirect_code must be one of")
+	}
+}
+
 // OK
 // server_url: headscale.com, base: clients.headscale.com
 // server_url: headscale.com, base: headscale.net
@@ -466,3 +492,316 @@ func TestSafeServerURL(t *testing.T) {
 		})
 	}
 }
+
+func TestSplitResolvers(t *testing.T) {
+	tests := []struct {
+		name  string
+		split map[string][]string
+		want  map[string][]*dnstype.Resolver
+	}{
+		{
+			name: "distinct-domains",
+			split: map[string][]string{
+				"foo.example.com": {"1.1.1.1"},
+				"bar.example.com": {"8.8.8.8"},
+			},
+			want: map[string][]*dnstype.Resolver{
+				"foo.example.com": {{Addr: "1.1.1.1"}},
+				"bar.example.com": {{Addr: "8.8.8.8"}},
+			},
+		},
+		{
+			name: "colliding-domains-are-merged",
+			split: map[string][]string{
+				"user1.example.com":  {"1.1.1.1"},
+				"user1.example.com.": {"8.8.8.8"},
+			},
+			want: map[string][]*dnstype.Resolver{
+				"user1.example.com": {{Addr: "1.1.1.1"}, {Addr: "8.8.8.8"}},
+			},
+		},
+		{
+			name: "collision-does-not-clear-route",
+			split: map[string][]string{
+				"user1.example.com":  {"1.1.1.1"},
+				"user1.example.com.": {"http://[::1"},
+			},
+			want: map[string][]*dnstype.Resolver{
+				"user1.example.com": {{Addr: "1.1.1.1"}},
+			},
+		},
+		{
+			name: "invalid-nameservers-keep-empty-route",
+			split: map[string][]string{
+				"local.example.com": {"http://[::1"},
+			},
+			want: map[string][]*dnstype.Resolver{
+				"local.example.com": nil,
+			},
+		},
+		{
+			name: "empty-route-is-kept",
+			split: map[string][]string{
+				"local.example.com": {},
+			},
+			want: map[string][]*dnstype.Resolver{
+				"local.example.com": nil,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dns := DNSConfig{Nameservers: Nameservers{Split: tt.split}}
+
+			if diff := cmp.Diff(tt.want, dns.splitResolvers()); diff != "" {
+				t.Errorf("splitResolvers() unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestControlDialPlan(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   any
+		want    *tailcfg.ControlDialPlan
+		wantErr bool
+	}{
+		{
+			name:  "unset",
+			value: nil,
+			want:  nil,
+		},
+		{
+			name:  "empty",
+			value: []any{},
+			want:  nil,
+		},
+		{
+			name: "candidates",
+			value: []any{
+				map[string]any{"ip": "192.0.2.10", "dial_timeout_sec": 5, "priority": 1},
+				map[string]any{"ip": "2001:db8::10", "dial_start_delay_sec": 0.5},
+			},
+			want: &tailcfg.ControlDialPlan{
+				Candidates: []tailcfg.ControlIPCandidate{
+					{IP: netip.MustParseAddr("192.0.2.10"), DialTimeoutSec: 5, Priority: 1},
+					{IP: netip.MustParseAddr("2001:db8::10"), DialStartDelaySec: 0.5},
+				},
+			},
+		},
+		{
+			name: "invalid-ip",
+			value: []any{
+				map[string]any{"ip": "control.example.com"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Reset()
+			t.Cleanup(viper.Reset)
+			if tt.value != nil {
+				viper.Set("mapper.control_dial_plan", tt.value)
+			}
+
+			got, err := controlDialPlan()
+			if tt.wantErr {
+				require.Error(t, err)
+
+				return
+			}
+			require.NoError(t, err)
+
+			if diff := cmp.Diff(tt.want, got, cmp.Comparer(func(x, y netip.Addr) bool { return x == y })); diff != "" {
+				t.Errorf("controlDialPlan() unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestExitNodeDNSResolvers(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.SetConfigType("yaml")
+
+	// YAML parses the node IDs as integer keys.
+	err := viper.ReadConfig(bytes.NewBufferString(`
+mapper:
+  exit_node_dns_resolvers:
+    5:
+      - 10.0.0.53
+      - 10.0.0.54
+    exit:
+      - 10.0.0.55
+`))
+	require.NoError(t, err)
+
+	assert.Equal(t, map[NodeID][]string{5: {"10.0.0.53", "10.0.0.54"}}, exitNodeDNSResolvers())
+}
+
+func TestDoHMetadataResolvers(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   any
+		want    []DoHMetadataResolver
+		wantErr bool
+	}{
+		{
+			name:  "unset",
+			value: nil,
+			want:  nil,
+		},
+		{
+			name: "resolvers",
+			value: []any{
+				map[string]any{
+					"prefix": "https://doh.example.com/",
+					"params": []any{
+						map[string]any{"name": "nodeName", "value": "{device_name}-{device_id}"},
+					},
+				},
+			},
+			want: []DoHMetadataResolver{
+				{
+					Prefix: "https://doh.example.com/",
+					Params: []DoHMetadataParam{{Name: "nodeName", Value: "{device_name}-{device_id}"}},
+				},
+			},
+		},
+		{
+			name: "unnamed-parameter",
+			value: []any{
+				map[string]any{
+					"prefix": "https://doh.example.com/",
+					"params": []any{map[string]any{"value": "{device_id}"}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "plain-http",
+			value: []any{
+				map[string]any{"prefix": "http://doh.example.com/"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown-placeholder",
+			value: []any{
+				map[string]any{
+					"prefix": "https://doh.example.com/",
+					"params": []any{map[string]any{"name": "user", "value": "{user}"}},
+				},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Reset()
+			t.Cleanup(viper.Reset)
+			if tt.value != nil {
+				viper.Set("mapper.doh_metadata", tt.value)
+			}
+
+			got, err := dohMetadataResolvers()
+			if tt.wantErr {
+				require.Error(t, err)
+
+				return
+			}
+			require.NoError(t, err)
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("dohMetadataResolvers() unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestExtraRecordsValidation(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.Set("dns.extra_records", []any{
+		map[string]any{"name": "git.internal", "type": "A", "value": "100.64.0.5"},
+		map[string]any{"name": "git.internal", "type": "AAAA", "value": "fd7a:115c:a1e0::5"},
+		map[string]any{"name": "any.internal", "value": "100.64.0.6"},
+		map[string]any{"name": "v6.internal", "type": "A", "value": "fd7a:115c:a1e0::7"},
+		map[string]any{"name": "mx.internal", "type": "MX", "value": "100.64.0.8"},
+		map[string]any{"name": "host.internal", "type": "A", "value": "host"},
+		map[string]any{"name": "bad..name", "type": "A", "value": "100.64.0.9"},
+		map[string]any{"type": "A", "value": "100.64.0.10"},
+	})
+
+	got, err := dns()
+	require.NoError(t, err)
+
+	want := []tailcfg.DNSRecord{
+		{Name: "git.internal", Type: "A", Value: "100.64.0.5"},
+		{Name: "git.internal", Type: "AAAA", Value: "fd7a:115c:a1e0::5"},
+		{Name: "any.internal", Value: "100.64.0.6"},
+	}
+	if diff := cmp.Diff(want, got.ExtraRecords); diff != "" {
+		t.Errorf("dns() unexpected extra records (-want +got):\n%s", diff)
+	}
+}
+
+func TestExtraRecordsLimit(t *testing.T) {
+	var logs bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = logger })
+
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.Set("dns.max_extra_records", 3)
+	viper.Set("dns.extra_records_priority", []string{"Prometheus.internal.", "grafana.internal"})
+	viper.Set("dns.extra_records", []any{
+		map[string]any{"name": "b.internal", "type": "A", "value": "100.64.0.2"},
+		map[string]any{"name": "a.internal", "type": "A", "value": "100.64.0.1"},
+		map[string]any{"name": "grafana.internal", "type": "A", "value": "100.64.0.3"},
+		map[string]any{"name": "prometheus.internal", "type": "A", "value": "100.64.0.4"},
+		map[string]any{"name": "c.internal", "type": "A", "value": "100.64.0.5"},
+	})
+
+	got, err := dns()
+	require.NoError(t, err)
+
+	want := []tailcfg.DNSRecord{
+		{Name: "prometheus.internal", Type: "A", Value: "100.64.0.4"},
+		{Name: "grafana.internal", Type: "A", Value: "100.64.0.3"},
+		{Name: "a.internal", Type: "A", Value: "100.64.0.1"},
+	}
+	if diff := cmp.Diff(want, got.ExtraRecords); diff != "" {
+		t.Errorf("dns() unexpected extra records (-want +got):\n%s", diff)
+	}
+
+	assert.Equal(t, 2, bytes.Count(logs.Bytes(), []byte("dropping extra DNS record over the limit")))
+	assert.Contains(t, logs.String(), `"name":"b.internal"`)
+	assert.Contains(t, logs.String(), `"name":"c.internal"`)
+
+	// Without a limit all records are kept in their order.
+	viper.Set("dns.max_extra_records", 0)
+	got, err = dns()
+	require.NoError(t, err)
+	assert.Len(t, got.ExtraRecords, 5)
+	assert.Equal(t, "b.internal", got.ExtraRecords[0].Name)
+}
+
+func TestLogTailConfig(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.Set("logtail.enabled", false)
+	viper.Set("logtail.nodes", map[string]any{"5": true, "7": false})
+
+	cfg := logtailConfig()
+	assert.Equal(t, map[NodeID]bool{5: true, 7: false}, cfg.Nodes)
+	assert.True(t, cfg.EnabledFor(5))
+	assert.False(t, cfg.EnabledFor(6))
+	assert.False(t, cfg.EnabledFor(7))
+}
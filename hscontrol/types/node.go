@@ -305,6 +305,25 @@ func (node *Node) CanAccessRoute(matchers []matcher.Match, route netip.Prefix) b
 	return false
 }
 
+// CanAccessRouteExplicitly reports if the node can access route through
+// a rule naming a destination overlapping the route. Rules allowing
+// access to all destinations ("*") are ignored.
+func (node *Node) CanAccessRouteExplicitly(matchers []matcher.Match, route netip.Prefix) bool {
+	src := node.IPs()
+
+	for _, matcher := range matchers {
+		if !matcher.SrcsContainsIPs(src...) || matcher.DestsContainsAllIPs() {
+			continue
+		}
+
+		if matcher.DestsOverlapsPrefixes(route) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (nodes Nodes) FilterByIP(ip netip.Addr) Nodes {
 	var found Nodes
 
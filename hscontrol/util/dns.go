@@ -22,6 +22,7 @@ const (
 )
 
 var invalidDNSRegex = regexp.MustCompile("[^a-z0-9-.]+")
+var invalidDNSLabelRegex = regexp.MustCompile("[^a-z0-9-]+")
 var invalidCharsInUserRegex = regexp.MustCompile("[^a-z0-9-.]+")
 
 var ErrInvalidUserName = errors.New("invalid user name")
@@ -102,6 +103,23 @@ func ConvertWithFQDNRules(name string) string {
 	return name
 }
 
+// SanitizeDNSLabel converts name into a valid DNS label. The name is
+// lowercased, every run of characters not allowed in a label (including
+// dots, spaces, underscores and non-ASCII characters) is replaced by a
+// single hyphen, leading and trailing hyphens are removed and the result
+// is truncated to LabelHostnameLength.
+func SanitizeDNSLabel(name string) string {
+	name = strings.ToLower(name)
+	name = invalidDNSLabelRegex.ReplaceAllString(name, "-")
+	name = strings.Trim(name, "-")
+
+	if len(name) > LabelHostnameLength {
+		name = strings.TrimRight(name[:LabelHostnameLength], "-")
+	}
+
+	return name
+}
+
 // generateMagicDNSRootDomains generates a list of DNS entries to be included in `Routes` in `MapResponse`.
 // This list of reverse DNS entries instructs the OS on what subnets and domains the Tailscale embedded DNS
 // server (listening in 100.100.100.100 udp/53) should be used for.
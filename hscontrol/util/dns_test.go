@@ -2,6 +2,7 @@ package util
 
 import (
 	"net/netip"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -99,6 +100,56 @@ func TestConvertWithFQDNRules(t *testing.T) {
 	}
 }
 
+func TestSanitizeDNSLabel(t *testing.T) {
+	tests := []struct {
+		name  string
+		label string
+		want  string
+	}{
+		{
+			name:  "already-valid",
+			label: "mini",
+			want:  "mini",
+		},
+		{
+			name:  "spaces",
+			label: "My Laptop",
+			want:  "my-laptop",
+		},
+		{
+			name:  "underscores",
+			label: "build_server__01",
+			want:  "build-server-01",
+		},
+		{
+			name:  "unicode",
+			label: "Björns-Mäc",
+			want:  "bj-rns-m-c",
+		},
+		{
+			name:  "dots",
+			label: "host.local",
+			want:  "host-local",
+		},
+		{
+			name:  "leading-and-trailing",
+			label: " _host_ ",
+			want:  "host",
+		},
+		{
+			name:  "too-long",
+			label: strings.Repeat("a", 70),
+			want:  strings.Repeat("a", LabelHostnameLength),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, SanitizeDNSLabel(tt.label))
+		})
+	}
+}
+
 func TestMagicDNSRootDomains100(t *testing.T) {
 	domains := GenerateIPv4DNSRootDomain(netip.MustParsePrefix("100.64.0.0/10"))
 
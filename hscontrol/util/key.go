@@ -7,4 +7,7 @@ import (
 var (
 	ErrCannotDecryptResponse = errors.New("cannot decrypt response")
 	ZstdCompression          = "zstd"
+	// CBORCompression is a headscale specific value for MapRequest.Compress
+	// asking for the map response to be encoded as CBOR instead of JSON.
+	CBORCompression = "cbor"
 )
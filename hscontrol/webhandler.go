@@ -3,6 +3,7 @@ package hscontrol
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/gorilla/mux"
@@ -14,20 +15,104 @@ type WebConfig struct {
 	TargetURL string
 }
 
+// ParseTargetURL parses and normalizes the target_url the admin and
+// registration pages are redirected to. An empty URL redirects to paths
+// on the same host.
+func ParseTargetURL(rawURL string) (*url.URL, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing target_url %q: %w", rawURL, err)
+	}
+
+	if rawURL != "" {
+		if target.Scheme != "http" && target.Scheme != "https" {
+			return nil, fmt.Errorf("target_url %q must start with https:// or http://", rawURL)
+		}
+		if target.Host == "" {
+			return nil, fmt.Errorf("target_url %q has no host", rawURL)
+		}
+		if target.Fragment != "" {
+			return nil, fmt.Errorf("target_url %q must not contain a fragment", rawURL)
+		}
+	}
+
+	target.Path = strings.TrimRight(target.Path, "/")
+	target.RawPath = ""
+
+	return target, nil
+}
+
+// targetLocation returns the location of path under the target URL, with
+// query appended to the query of the target URL. A nil target URL
+// redirects to the path on the same host.
+func targetLocation(target *url.URL, path string, query string) string {
+	location := url.URL{}
+	if target != nil {
+		location = *target
+	}
+	location.Path += path
+
+	if query != "" {
+		if location.RawQuery != "" {
+			location.RawQuery += "&" + query
+		} else {
+			location.RawQuery = query
+		}
+	}
+
+	return location.String()
+}
+
+// webSecurityHeaders returns a middleware setting security headers on
+// the responses of the web pages. An empty csp leaves out the
+// Content-Security-Policy header. Framing is denied with
+// X-Frame-Options unless csp controls it with frame-ancestors, so
+// deployments embedding the pages can allow it there.
+func webSecurityHeaders(csp string) mux.MiddlewareFunc {
+	framed := strings.Contains(strings.ToLower(csp), "frame-ancestors")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+			header := writer.Header()
+			header.Set("X-Content-Type-Options", "nosniff")
+			if csp != "" {
+				header.Set("Content-Security-Policy", csp)
+			}
+			if !framed {
+				header.Set("X-Frame-Options", "DENY")
+			}
+
+			next.ServeHTTP(writer, req)
+		})
+	}
+}
+
 func (h *Headscale) AdminHandler(
 	writer http.ResponseWriter,
 	req *http.Request,
 ) {
 	// 重定向到后台管理地址
-	targetURL := fmt.Sprintf("%s/admin/", strings.TrimSuffix(h.cfg.TargetURL, "/"))
-	writer.Header().Set("Location", targetURL)
-	writer.WriteHeader(http.StatusFound)
+	// The query of the request, e.g. a deep link into the admin
+	// interface, is kept after the query of the target URL.
+	writer.Header().Set("Location", targetLocation(h.targetURL, "/admin/", req.URL.RawQuery))
+
+	// Configs not loaded by LoadServerConfig have no redirect code.
+	code := h.cfg.TargetRedirectCode
+	if code == 0 {
+		code = http.StatusFound
+	}
+	writer.WriteHeader(code)
 }
 
 func (a *AuthProviderWeb) WebRegisterHandler(
 	writer http.ResponseWriter,
 	req *http.Request,
 ) {
+	if a.registerMode == types.RegisterModeTemplate {
+		a.RegisterHandler(writer, req)
+		return
+	}
+
 	vars := mux.Vars(req)
 	registrationIdStr := vars["registration_id"]
 
@@ -36,16 +121,11 @@ func (a *AuthProviderWeb) WebRegisterHandler(
 	// the template and log an error.
 	registrationId, err := types.RegistrationIDFromString(registrationIdStr)
 	if err != nil {
-		httpError(writer, NewHTTPError(http.StatusBadRequest, "invalid registration id", err))
+		httpError(writer, req, NewHTTPError(http.StatusBadRequest, "invalid registration id", err))
 		return
 	}
 
-	//writer.Header().Set("Content-Type", "text/html; charset=utf-8")
-	//writer.WriteHeader(http.StatusOK)
-	//writer.Write([]byte(templates.RegisterWeb(registrationId, a.targetURL).Render()))
-
 	// 先拼接成完整的注册地址
-	targetURL := fmt.Sprintf("%s/register/%s", strings.TrimSuffix(a.targetURL, "/"), registrationId.String())
-	writer.Header().Set("Location", targetURL)
+	writer.Header().Set("Location", targetLocation(a.targetURL, "/register/"+registrationId.String(), ""))
 	writer.WriteHeader(http.StatusFound)
 }